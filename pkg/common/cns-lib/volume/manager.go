@@ -29,6 +29,7 @@ import (
 	"github.com/vmware/govmomi/cns"
 	cnstypes "github.com/vmware/govmomi/cns/types"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
 	vim25types "github.com/vmware/govmomi/vim25/types"
 
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
@@ -60,10 +61,16 @@ type Manager interface {
 	QueryVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error)
 	// QueryVolumeInfo calls the CNS QueryVolumeInfo API and return a task, from which CnsQueryVolumeInfoResult is extracted
 	QueryVolumeInfo(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId) (*cnstypes.CnsQueryVolumeInfoResult, error)
+	// QueryVolumeInfoList calls the CNS QueryVolumeInfo API for all the given volumes in a single task and
+	// returns the CnsQueryVolumeInfoResult of each volume whose info was retrieved
+	QueryVolumeInfoList(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId) ([]*cnstypes.CnsQueryVolumeInfoResult, error)
 	// QueryAllVolume returns all volumes matching the given filter and selection.
 	QueryAllVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter, querySelection cnstypes.CnsQuerySelection) (*cnstypes.CnsQueryResult, error)
 	// ExpandVolume expands a volume to a new size.
 	ExpandVolume(ctx context.Context, volumeID string, size int64) error
+	// UpdateVolumePolicy reconfigures a volume on the given datastore to the given storage policy.
+	UpdateVolumePolicy(ctx context.Context, volumeID string, datastore vim25types.ManagedObjectReference,
+		storagePolicyID string) error
 	// ResetManager helps set new manager instance and VC configuration
 	ResetManager(ctx context.Context, vcenter *cnsvsphere.VirtualCenter)
 }
@@ -76,6 +83,11 @@ var (
 	volumeTaskMap       = make(map[string]*createVolumeTaskDetails)
 )
 
+// ErrCreateVolumeInProgress is returned by CreateVolume when the context expired while
+// waiting for the CNS task creating the volume. The task keeps running, and its result
+// is returned by a later CreateVolume call for the same volume name.
+var ErrCreateVolumeInProgress = errors.New("CNS CreateVolume task is still in progress")
+
 // createVolumeTaskDetails contains taskInfo object and expiration time
 type createVolumeTaskDetails struct {
 	sync.Mutex
@@ -99,6 +111,15 @@ func GetManager(ctx context.Context, vc *cnsvsphere.VirtualCenter) Manager {
 	return managerInstance
 }
 
+// NewManager returns a Manager of the volumes of the given vCenter. Unlike the
+// Manager returned by GetManager, it is not shared, so that the volumes of a
+// linked vCenter can be managed alongside the ones of the configured vCenter.
+func NewManager(vc *cnsvsphere.VirtualCenter) Manager {
+	return &defaultManager{
+		virtualCenter: vc,
+	}
+}
+
 // DefaultManager provides functionality to manage volumes.
 type defaultManager struct {
 	virtualCenter *cnsvsphere.VirtualCenter
@@ -147,6 +168,9 @@ func (m *defaultManager) CreateVolume(ctx context.Context, spec *cnstypes.CnsVol
 	if err != nil {
 		return nil, err
 	}
+	if err = waitForRateLimit(ctx, "CreateVolume"); err != nil {
+		return nil, err
+	}
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCns(ctx)
 	if err != nil {
@@ -175,6 +199,9 @@ func (m *defaultManager) CreateVolume(ctx context.Context, spec *cnstypes.CnsVol
 		task = taskDetailsInMap.task
 		log.Infof("CreateVolume task still pending for VolumeName: %q, with taskInfo: %+v", spec.Name, task)
 	} else {
+		if err = startVolumeProvisioning(ctx, spec.Name); err != nil {
+			return nil, err
+		}
 		task, err = m.virtualCenter.CnsClient.CreateVolume(ctx, cnsCreateSpecList)
 		if err != nil {
 			log.Errorf("CNS CreateVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
@@ -190,11 +217,15 @@ func (m *defaultManager) CreateVolume(ctx context.Context, spec *cnstypes.CnsVol
 	}
 	// Get the taskInfo
 	taskInfo, err = cns.GetTaskInfo(ctx, task)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		log.Infof("CreateVolume task for VolumeName: %q is still in progress: %+v", spec.Name, task)
+		return nil, fmt.Errorf("%w. VolumeName: %q", ErrCreateVolumeInProgress, spec.Name)
+	}
 	if err != nil || taskInfo == nil {
 		log.Errorf("failed to get taskInfo for CreateVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return nil, err
 	}
-	log.Infof("CreateVolume: VolumeName: %q, opId: %q", spec.Name, taskInfo.ActivationId)
+	recordCnsTask(ctx, taskInfo, "CreateVolume: VolumeName: %q", spec.Name)
 	// Get the taskResult
 	taskResult, err := cns.GetTaskResult(ctx, taskInfo)
 
@@ -220,11 +251,11 @@ func (m *defaultManager) CreateVolume(ctx context.Context, spec *cnstypes.CnsVol
 		// Remove the taskInfo object associated with the volume name when the current task fails.
 		//  This is needed to ensure the sub-sequent create volume call from the external provisioner invokes Create Volume
 		delete(volumeTaskMap, spec.Name)
-		msg := fmt.Sprintf("failed to create cns volume. createSpec: %q, fault: %q, opId: %q", spew.Sdump(spec), spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
+		msg := fmt.Sprintf("failed to create cns volume. createSpec: %q, fault: %q, taskId: %q, opId: %q", spew.Sdump(spec), spew.Sdump(volumeOperationRes.Fault), taskInfo.Task.Value, taskInfo.ActivationId)
 		log.Error(msg)
-		return nil, errors.New(msg)
+		return nil, newOperationError(volumeOperationRes.Fault, msg)
 	}
-	log.Infof("CreateVolume: Volume created successfully. VolumeName: %q, volumeID: %q, opId: %q", spec.Name, volumeOperationRes.VolumeId.Id, taskInfo.ActivationId)
+	log.Infof("CreateVolume: Volume created successfully. VolumeName: %q, volumeID: %q, taskId: %q, opId: %q", spec.Name, volumeOperationRes.VolumeId.Id, taskInfo.Task.Value, taskInfo.ActivationId)
 	return &cnstypes.CnsVolumeId{
 		Id: volumeOperationRes.VolumeId.Id,
 	}, nil
@@ -237,6 +268,9 @@ func (m *defaultManager) AttachVolume(ctx context.Context, vm *cnsvsphere.Virtua
 	if err != nil {
 		return "", err
 	}
+	if err = waitForRateLimit(ctx, "AttachVolume"); err != nil {
+		return "", err
+	}
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCns(ctx)
 	if err != nil {
@@ -294,7 +328,7 @@ func (m *defaultManager) AttachVolume(ctx context.Context, vm *cnsvsphere.Virtua
 		}
 		msg := fmt.Sprintf("failed to attach cns volume: %q to node vm: %q. fault: %q. opId: %q", volumeID, vm.String(), spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
 		log.Error(msg)
-		return "", errors.New(msg)
+		return "", newOperationError(volumeOperationRes.Fault, msg)
 	}
 	diskUUID := interface{}(taskResult).(*cnstypes.CnsVolumeAttachResult).DiskUUID
 	log.Infof("AttachVolume: Volume attached successfully. volumeID: %q, opId: %q, vm: %q, diskUUID: %q", volumeID, taskInfo.ActivationId, vm.String(), diskUUID)
@@ -308,6 +342,9 @@ func (m *defaultManager) DetachVolume(ctx context.Context, vm *cnsvsphere.Virtua
 	if err != nil {
 		return err
 	}
+	if err = waitForRateLimit(ctx, "DetachVolume"); err != nil {
+		return err
+	}
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCns(ctx)
 	if err != nil {
@@ -396,6 +433,9 @@ func (m *defaultManager) DeleteVolume(ctx context.Context, volumeID string, dele
 	if err != nil {
 		return err
 	}
+	if err = waitForRateLimit(ctx, "DeleteVolume"); err != nil {
+		return err
+	}
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCns(ctx)
 	if err != nil {
@@ -424,7 +464,7 @@ func (m *defaultManager) DeleteVolume(ctx context.Context, volumeID string, dele
 		log.Errorf("failed to get taskInfo for DeleteVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
 	}
-	log.Infof("DeleteVolume: volumeID: %q, opId: %q", volumeID, taskInfo.ActivationId)
+	recordCnsTask(ctx, taskInfo, "DeleteVolume: volumeID: %q", volumeID)
 	// Get the task results for the given task
 	taskResult, err := cns.GetTaskResult(ctx, taskInfo)
 	if err != nil {
@@ -438,11 +478,11 @@ func (m *defaultManager) DeleteVolume(ctx context.Context, volumeID string, dele
 	}
 	volumeOperationRes := taskResult.GetCnsVolumeOperationResult()
 	if volumeOperationRes.Fault != nil {
-		msg := fmt.Sprintf("failed to delete volume: %q, fault: %q, opID: %q", volumeID, spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
+		msg := fmt.Sprintf("failed to delete volume: %q, fault: %q, taskId: %q, opID: %q", volumeID, spew.Sdump(volumeOperationRes.Fault), taskInfo.Task.Value, taskInfo.ActivationId)
 		log.Error(msg)
-		return errors.New(msg)
+		return newOperationError(volumeOperationRes.Fault, msg)
 	}
-	log.Infof("DeleteVolume: Volume deleted successfully. volumeID: %q, opId: %q", volumeID, taskInfo.ActivationId)
+	log.Infof("DeleteVolume: Volume deleted successfully. volumeID: %q, taskId: %q, opId: %q", volumeID, taskInfo.Task.Value, taskInfo.ActivationId)
 	return nil
 }
 
@@ -453,6 +493,9 @@ func (m *defaultManager) UpdateVolumeMetadata(ctx context.Context, spec *cnstype
 	if err != nil {
 		return err
 	}
+	if err = waitForRateLimit(ctx, "UpdateVolumeMetadata"); err != nil {
+		return err
+	}
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCns(ctx)
 	if err != nil {
@@ -518,6 +561,9 @@ func (m *defaultManager) ExpandVolume(ctx context.Context, volumeID string, size
 		log.Errorf("validateManager failed with err: %+v", err)
 		return err
 	}
+	if err = waitForRateLimit(ctx, "ExpandVolume"); err != nil {
+		return err
+	}
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCns(ctx)
 	if err != nil {
@@ -550,7 +596,7 @@ func (m *defaultManager) ExpandVolume(ctx context.Context, volumeID string, size
 		log.Errorf("failed to get taskInfo for ExtendVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
 	}
-	log.Infof("ExpandVolume: volumeID: %q, opId: %q", volumeID, taskInfo.ActivationId)
+	recordCnsTask(ctx, taskInfo, "ExpandVolume: volumeID: %q", volumeID)
 	// Get the task results for the given task
 	taskResult, err := cns.GetTaskResult(ctx, taskInfo)
 	if err != nil {
@@ -564,11 +610,50 @@ func (m *defaultManager) ExpandVolume(ctx context.Context, volumeID string, size
 	}
 	volumeOperationRes := taskResult.GetCnsVolumeOperationResult()
 	if volumeOperationRes.Fault != nil {
-		msg := fmt.Sprintf("failed to extend volume: %q, fault: %q, opID: %q", volumeID, spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
+		msg := fmt.Sprintf("failed to extend volume: %q, fault: %q, taskId: %q, opID: %q", volumeID, spew.Sdump(volumeOperationRes.Fault), taskInfo.Task.Value, taskInfo.ActivationId)
 		log.Error(msg)
 		return errors.New(msg)
 	}
-	log.Infof("ExpandVolume: Volume expanded successfully. volumeID: %q, opId: %q", volumeID, taskInfo.ActivationId)
+	log.Infof("ExpandVolume: Volume expanded successfully. volumeID: %q, taskId: %q, opId: %q", volumeID, taskInfo.Task.Value, taskInfo.ActivationId)
+	return nil
+}
+
+// UpdateVolumePolicy reconfigures a volume on the given datastore to the given storage policy.
+func (m *defaultManager) UpdateVolumePolicy(ctx context.Context, volumeID string,
+	datastore vim25types.ManagedObjectReference, storagePolicyID string) error {
+	log := logger.GetLogger(ctx)
+	err := validateManager(ctx, m)
+	if err != nil {
+		return err
+	}
+	if err = waitForRateLimit(ctx, "UpdateVolumePolicy"); err != nil {
+		return err
+	}
+	// Set up the VC connection
+	err = m.virtualCenter.Connect(ctx)
+	if err != nil {
+		log.Errorf("Connect failed with err: %+v", err)
+		return err
+	}
+	req := vim25types.UpdateVStorageObjectPolicy_Task{
+		This:      *m.virtualCenter.Client.ServiceContent.VStorageObjectManager,
+		Id:        vim25types.ID{Id: volumeID},
+		Datastore: datastore,
+		Profile: []vim25types.BaseVirtualMachineProfileSpec{
+			&vim25types.VirtualMachineDefinedProfileSpec{ProfileId: storagePolicyID},
+		},
+	}
+	res, err := methods.UpdateVStorageObjectPolicy_Task(ctx, m.virtualCenter.Client, &req)
+	if err != nil {
+		log.Errorf("UpdateVStorageObjectPolicy failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
+		return err
+	}
+	task := object.NewTask(m.virtualCenter.Client.Client, res.Returnval)
+	if _, err = task.WaitForResult(ctx, nil); err != nil {
+		log.Errorf("failed to update the storage policy of volume %q to %q. err: %v", volumeID, storagePolicyID, err)
+		return err
+	}
+	log.Infof("UpdateVolumePolicy: Volume %q reconfigured to storage policy %q", volumeID, storagePolicyID)
 	return nil
 }
 
@@ -579,6 +664,9 @@ func (m *defaultManager) QueryVolume(ctx context.Context, queryFilter cnstypes.C
 	if err != nil {
 		return nil, err
 	}
+	if err = waitForRateLimit(ctx, "QueryVolume"); err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	// Set up the VC connection
@@ -603,6 +691,9 @@ func (m *defaultManager) QueryAllVolume(ctx context.Context, queryFilter cnstype
 	if err != nil {
 		return nil, err
 	}
+	if err = waitForRateLimit(ctx, "QueryAllVolume"); err != nil {
+		return nil, err
+	}
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCns(ctx)
 	if err != nil {
@@ -625,6 +716,9 @@ func (m *defaultManager) QueryVolumeInfo(ctx context.Context, volumeIDList []cns
 	if err != nil {
 		return nil, err
 	}
+	if err = waitForRateLimit(ctx, "QueryVolumeInfo"); err != nil {
+		return nil, err
+	}
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCns(ctx)
 	if err != nil {
@@ -666,3 +760,60 @@ func (m *defaultManager) QueryVolumeInfo(ctx context.Context, volumeIDList []cns
 	log.Infof("QueryVolumeInfo successfully returned volumeInfo volumeIDList %v:, opId: %q", volumeIDList, taskInfo.ActivationId)
 	return volumeInfoResult, nil
 }
+
+// QueryVolumeInfoList calls the CNS QueryVolumeInfo API for all the given volumes in a single task and
+// returns the CnsQueryVolumeInfoResult of each volume whose info was retrieved
+func (m *defaultManager) QueryVolumeInfoList(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId) ([]*cnstypes.CnsQueryVolumeInfoResult, error) {
+	log := logger.GetLogger(ctx)
+	err := validateManager(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if err = waitForRateLimit(ctx, "QueryVolumeInfoList"); err != nil {
+		return nil, err
+	}
+	// Set up the VC connection
+	err = m.virtualCenter.ConnectCns(ctx)
+	if err != nil {
+		log.Errorf("ConnectCns failed with err: %+v", err)
+		return nil, err
+	}
+	//Call the CNS QueryVolumeInfo
+	queryVolumeInfoTask, err := m.virtualCenter.CnsClient.QueryVolumeInfo(ctx, volumeIDList)
+	if err != nil {
+		log.Errorf("CNS QueryVolumeInfo failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
+		return nil, err
+	}
+	// Get the taskInfo
+	taskInfo, err := cns.GetTaskInfo(ctx, queryVolumeInfoTask)
+	if err != nil || taskInfo == nil {
+		log.Errorf("failed to get taskInfo for QueryVolumeInfo task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
+		return nil, err
+	}
+	log.Infof("QueryVolumeInfoList: volumeIDList: %v, opId: %q", volumeIDList, taskInfo.ActivationId)
+	// The task result holds the result of each of the volumes
+	batchResult, ok := taskInfo.Result.(cnstypes.CnsVolumeOperationBatchResult)
+	if !ok {
+		msg := fmt.Sprintf("unexpected result %+v of QueryVolumeInfo task %q, opID: %q", taskInfo.Result, taskInfo.Task.Value, taskInfo.ActivationId)
+		log.Error(msg)
+		return nil, errors.New(msg)
+	}
+	var volumeInfoResults []*cnstypes.CnsQueryVolumeInfoResult
+	for _, volumeResult := range batchResult.VolumeResults {
+		volumeOperationRes := volumeResult.GetCnsVolumeOperationResult()
+		if volumeOperationRes.Fault != nil {
+			log.Warnf("failed to query info of volume %q, fault: %q, opID: %q", volumeOperationRes.VolumeId.Id,
+				spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
+			continue
+		}
+		volumeInfoResult, ok := volumeResult.(*cnstypes.CnsQueryVolumeInfoResult)
+		if !ok {
+			log.Warnf("unexpected result %+v for volume %q, opID: %q", volumeResult, volumeOperationRes.VolumeId.Id, taskInfo.ActivationId)
+			continue
+		}
+		volumeInfoResults = append(volumeInfoResults, volumeInfoResult)
+	}
+	log.Infof("QueryVolumeInfoList successfully returned info of %d volumes for volumeIDList %v, opId: %q",
+		len(volumeInfoResults), volumeIDList, taskInfo.ActivationId)
+	return volumeInfoResults, nil
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/flowcontrol"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
+)
+
+// ErrRateLimited is returned by the CNS operations exceeding the rate limit when
+// the rate limiter is set to fail fast.
+var ErrRateLimited = errors.New("CNS call rate limit exceeded")
+
+// ErrProvisioningRateLimited is returned by CreateVolume when starting a new CNS
+// create task would exceed the volume provisioning rate limit. It wraps
+// ErrRateLimited.
+var ErrProvisioningRateLimited = fmt.Errorf("volume provisioning %w", ErrRateLimited)
+
+// provisioningRateWindow is the window the volume provisioning rate is computed over.
+const provisioningRateWindow = time.Minute
+
+// rateLimit is the rate limit of the CNS calls.
+type rateLimit struct {
+	qps      int
+	burst    int
+	failFast bool
+}
+
+var (
+	// cnsRateLimit is the current rate limit, zero if the CNS calls are not limited.
+	cnsRateLimit rateLimit
+	// cnsRateLimiter is the token bucket limiting the CNS calls, nil if they are not limited.
+	cnsRateLimiter flowcontrol.RateLimiter
+	// cnsRateLimiterLock protects cnsRateLimit and cnsRateLimiter.
+	cnsRateLimiterLock sync.RWMutex
+)
+
+// SetRateLimit limits the CNS calls to qps calls per second on average, with bursts
+// of up to burst calls. The calls over the limit wait for their turn, or fail with
+// ErrRateLimited if failFast is set. The CNS calls are not limited if qps is not
+// positive. The token bucket is kept if the limit is unchanged.
+func SetRateLimit(ctx context.Context, qps int, burst int, failFast bool) {
+	log := logger.GetLogger(ctx)
+	if burst < 1 {
+		burst = 1
+	}
+	limit := rateLimit{qps: qps, burst: burst, failFast: failFast}
+	if qps <= 0 {
+		limit = rateLimit{}
+	}
+	cnsRateLimiterLock.Lock()
+	defer cnsRateLimiterLock.Unlock()
+	if limit == cnsRateLimit {
+		return
+	}
+	cnsRateLimit = limit
+	if limit.qps == 0 {
+		cnsRateLimiter = nil
+		log.Infof("CNS calls are not rate limited")
+		return
+	}
+	cnsRateLimiter = flowcontrol.NewTokenBucketRateLimiter(float32(limit.qps), limit.burst)
+	log.Infof("CNS calls are rate limited to %d per second with bursts of %d, fail fast: %t",
+		limit.qps, limit.burst, limit.failFast)
+}
+
+// waitForRateLimit waits until the CNS call for the given operation is allowed by the
+// rate limit. Returns an error wrapping ErrRateLimited if the call exceeds the limit
+// and the rate limiter is set to fail fast, or the error of the context if it is done
+// while waiting.
+func waitForRateLimit(ctx context.Context, operation string) error {
+	cnsRateLimiterLock.RLock()
+	limiter, failFast := cnsRateLimiter, cnsRateLimit.failFast
+	cnsRateLimiterLock.RUnlock()
+	if limiter == nil {
+		return nil
+	}
+	if failFast {
+		if !limiter.TryAccept() {
+			logger.GetLogger(ctx).Errorf("CNS %s call rejected by the rate limit", operation)
+			return fmt.Errorf("CNS %s call rejected: %w", operation, ErrRateLimited)
+		}
+		return nil
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		logger.GetLogger(ctx).Errorf("failed waiting for the rate limit of the CNS %s call. err: %v", operation, err)
+		return err
+	}
+	return nil
+}
+
+// provisioningRateLimiter tracks the CNS create tasks started within the last
+// minute, and rejects the ones above a limit so that mass scale-ups don't
+// overwhelm vCenter.
+type provisioningRateLimiter struct {
+	mutex sync.Mutex
+	// limit is the maximum number of create tasks per minute, or 0 if they are
+	// not limited.
+	limit int
+	// starts holds the start times of the create tasks within the window, oldest
+	// first.
+	starts []time.Time
+	// now returns the current time; overridden in tests.
+	now func() time.Time
+}
+
+// volumeProvisionings limits the CNS create tasks of the driver.
+var volumeProvisionings = &provisioningRateLimiter{now: time.Now}
+
+// trim forgets the create tasks started before the window. The mutex must be held.
+func (l *provisioningRateLimiter) trim(now time.Time) {
+	i := 0
+	for i < len(l.starts) && now.Sub(l.starts[i]) >= provisioningRateWindow {
+		i++
+	}
+	l.starts = l.starts[i:]
+}
+
+// tryStart records the start of a create task. Returns false if the number of
+// create tasks started within the last minute has reached the limit.
+func (l *provisioningRateLimiter) tryStart() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.trim(now)
+	if l.limit > 0 && len(l.starts) >= l.limit {
+		return false
+	}
+	l.starts = append(l.starts, now)
+	return true
+}
+
+// SetProvisioningRateLimit limits the CNS create tasks to perMinute per minute. The
+// create tasks over the limit fail with ErrProvisioningRateLimited. The create tasks
+// are not limited if perMinute is not positive.
+func SetProvisioningRateLimit(ctx context.Context, perMinute int) {
+	log := logger.GetLogger(ctx)
+	if perMinute < 0 {
+		perMinute = 0
+	}
+	volumeProvisionings.mutex.Lock()
+	defer volumeProvisionings.mutex.Unlock()
+	if volumeProvisionings.limit == perMinute {
+		return
+	}
+	volumeProvisionings.limit = perMinute
+	if perMinute == 0 {
+		log.Infof("Volume provisionings are not rate limited")
+		return
+	}
+	log.Infof("Volume provisionings are rate limited to %d per minute", perMinute)
+}
+
+// ProvisioningRate returns the number of CNS create tasks started within the last minute.
+func ProvisioningRate() int {
+	volumeProvisionings.mutex.Lock()
+	defer volumeProvisionings.mutex.Unlock()
+	volumeProvisionings.trim(volumeProvisionings.now())
+	return len(volumeProvisionings.starts)
+}
+
+// startVolumeProvisioning records the start of a CNS create task for the given
+// volume. Returns an error wrapping ErrProvisioningRateLimited if the volume
+// provisioning rate limit is reached.
+func startVolumeProvisioning(ctx context.Context, volumeName string) error {
+	if !volumeProvisionings.tryStart() {
+		logger.GetLogger(ctx).Errorf("CNS CreateVolume task for volume %q rejected by the provisioning rate limit",
+			volumeName)
+		return fmt.Errorf("CNS CreateVolume task for volume %q rejected: %w", volumeName, ErrProvisioningRateLimited)
+	}
+	return nil
+}
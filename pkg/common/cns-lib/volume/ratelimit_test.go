@@ -0,0 +1,103 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSetRateLimit(t *testing.T) {
+	ctx := context.Background()
+	defer SetRateLimit(ctx, 0, 0, false)
+
+	// A burst over the limit fails fast once the burst is used up.
+	SetRateLimit(ctx, 1, 2, true)
+	for i := 0; i < 2; i++ {
+		if err := waitForRateLimit(ctx, "QueryVolume"); err != nil {
+			t.Fatalf("expected call %d within the burst to be allowed, got err: %v", i, err)
+		}
+	}
+	if err := waitForRateLimit(ctx, "QueryVolume"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected call over the burst to fail with ErrRateLimited, got err: %v", err)
+	}
+	// Setting the same limit again keeps the token bucket.
+	SetRateLimit(ctx, 1, 2, true)
+	if err := waitForRateLimit(ctx, "QueryVolume"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected call over the unchanged limit to fail with ErrRateLimited, got err: %v", err)
+	}
+
+	// A burst over the limit waits for its turn.
+	SetRateLimit(ctx, 1, 1, false)
+	if err := waitForRateLimit(ctx, "QueryVolume"); err != nil {
+		t.Fatalf("expected first call to be allowed, got err: %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := waitForRateLimit(waitCtx, "QueryVolume"); err == nil || errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected call over the limit to wait past the deadline, got err: %v", err)
+	}
+
+	// No limit lets all the calls through.
+	SetRateLimit(ctx, 0, 0, true)
+	for i := 0; i < 10; i++ {
+		if err := waitForRateLimit(ctx, "QueryVolume"); err != nil {
+			t.Fatalf("expected call %d to be allowed without a limit, got err: %v", i, err)
+		}
+	}
+}
+
+func TestProvisioningRateLimit(t *testing.T) {
+	ctx := context.Background()
+	defer func(orig *provisioningRateLimiter) { volumeProvisionings = orig }(volumeProvisionings)
+	now := time.Now()
+	volumeProvisionings = &provisioningRateLimiter{now: func() time.Time { return now }}
+
+	// Provisionings are not limited until the limit is set
+	for i := 0; i < 5; i++ {
+		if err := startVolumeProvisioning(ctx, "pvc"); err != nil {
+			t.Fatalf("expected provisioning %d to be started without a limit, got err: %v", i+1, err)
+		}
+	}
+	if rate := ProvisioningRate(); rate != 5 {
+		t.Errorf("expected a provisioning rate of 5, got %d", rate)
+	}
+
+	// Provisionings over the limit are rejected and not counted
+	SetProvisioningRateLimit(ctx, 6)
+	if err := startVolumeProvisioning(ctx, "pvc"); err != nil {
+		t.Fatalf("expected provisioning below the limit to be started, got err: %v", err)
+	}
+	err := startVolumeProvisioning(ctx, "pvc")
+	if !errors.Is(err, ErrProvisioningRateLimited) || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrProvisioningRateLimited over the limit, got err: %v", err)
+	}
+	if rate := ProvisioningRate(); rate != 6 {
+		t.Errorf("expected rejected provisionings not to count towards the rate, got %d", rate)
+	}
+
+	// The limit is released once the provisionings fall out of the window
+	now = now.Add(provisioningRateWindow)
+	if rate := ProvisioningRate(); rate != 0 {
+		t.Errorf("expected a provisioning rate of 0 after a minute, got %d", rate)
+	}
+	if err := startVolumeProvisioning(ctx, "pvc"); err != nil {
+		t.Errorf("expected provisioning to be started after a minute, got err: %v", err)
+	}
+}
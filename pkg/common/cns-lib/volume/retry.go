@@ -0,0 +1,207 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+
+	vim25types "github.com/vmware/govmomi/vim25/types"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
+)
+
+// defaultRetryableFaults are the names of the fault types which are treated as
+// transient by default.
+var defaultRetryableFaults = []string{
+	"ConcurrentAccess",
+	"HostCommunication",
+	"InvalidState",
+	"TaskInProgress",
+}
+
+// hostUnreachableFaults are the names of the fault types a CNS operation fails
+// with when the host managing the volume is unreachable, e.g. isolated by vSphere HA.
+var hostUnreachableFaults = newFaultSet([]string{
+	"HostCommunication",
+	"HostNotConnected",
+	"HostNotReachable",
+}, nil)
+
+// resourceBusyFaults are the names of the fault types a CNS operation fails with
+// when the entity it operates on, e.g. the VM a volume is attached to, is locked
+// by another operation.
+var resourceBusyFaults = newFaultSet([]string{
+	"ConcurrentAccess",
+	"ResourceInUse",
+	"TaskInProgress",
+}, nil)
+
+// placementFaults are the names of the fault types a volume creation fails with
+// when the datastore chosen for the volume cannot hold it, e.g. as it is full.
+var placementFaults = newFaultSet([]string{
+	"DatastoreNotWritableOnHost",
+	"InaccessibleDatastore",
+	"InsufficientStorageSpace",
+	"NoDiskSpace",
+}, nil)
+
+var (
+	// retryableFaults is the set of fault type names which are treated as transient.
+	retryableFaults = newFaultSet(defaultRetryableFaults, nil)
+	// retryableFaultsLock protects retryableFaults.
+	retryableFaultsLock sync.RWMutex
+)
+
+// RetryableError is returned when a CNS operation fails with a fault which is
+// treated as transient, so that the operation can be retried by the caller.
+type RetryableError struct {
+	// Fault is the name of the fault type the operation failed with.
+	Fault string
+	err   error
+}
+
+func (e *RetryableError) Error() string {
+	return e.err.Error()
+}
+
+// IsRetryableError returns true if the given error was caused by a fault which
+// is treated as transient.
+func IsRetryableError(err error) bool {
+	_, ok := err.(*RetryableError)
+	return ok
+}
+
+// FaultError is returned when a CNS operation fails with a fault which is not
+// treated as transient.
+type FaultError struct {
+	// Fault is the name of the fault type the operation failed with.
+	Fault string
+	err   error
+}
+
+func (e *FaultError) Error() string {
+	return e.err.Error()
+}
+
+// IsHostUnreachableError returns true if the given error was caused by the host
+// managing the volume being unreachable.
+func IsHostUnreachableError(err error) bool {
+	return hostUnreachableFaults[getErrorFault(err)]
+}
+
+// IsResourceBusyError returns true if the given error was caused by the entity
+// the operation was performed on being locked by another operation.
+func IsResourceBusyError(err error) bool {
+	return resourceBusyFaults[getErrorFault(err)]
+}
+
+// IsPlacementError returns true if the given error was caused by the datastore
+// chosen for a new volume being unable to hold it.
+func IsPlacementError(err error) bool {
+	return placementFaults[getErrorFault(err)]
+}
+
+// serviceUnavailableStatus is the status of the HTTP responses of vCenter while it is
+// unavailable, e.g. during maintenance.
+var serviceUnavailableStatus = fmt.Sprintf("%d %s", http.StatusServiceUnavailable,
+	http.StatusText(http.StatusServiceUnavailable))
+
+// IsServiceUnavailableError returns true if the given error was caused by vCenter
+// responding that it is unavailable. The SOAP client returns the unexpected HTTP
+// responses as a *url.Error wrapping an error with the status of the response.
+func IsServiceUnavailableError(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && urlErr.Err != nil && urlErr.Err.Error() == serviceUnavailableStatus
+}
+
+// getErrorFault returns the name of the fault type the CNS operation which
+// returned the given error failed with.
+func getErrorFault(err error) string {
+	switch e := err.(type) {
+	case *RetryableError:
+		return e.Fault
+	case *FaultError:
+		return e.Fault
+	}
+	return ""
+}
+
+// SetRetryableFaults sets the fault types which are treated as transient to the
+// built-in defaults merged with the given fault type names.
+func SetRetryableFaults(ctx context.Context, faults []string) {
+	log := logger.GetLogger(ctx)
+	faultSet := newFaultSet(defaultRetryableFaults, faults)
+	retryableFaultsLock.Lock()
+	defer retryableFaultsLock.Unlock()
+	retryableFaults = faultSet
+	log.Debugf("Fault types treated as retryable: %v", faultSet)
+}
+
+// IsRetryableFault returns true if the type of the given fault is treated as
+// transient.
+func IsRetryableFault(fault *vim25types.LocalizedMethodFault) bool {
+	faultName := getFaultName(fault)
+	if faultName == "" {
+		return false
+	}
+	retryableFaultsLock.RLock()
+	defer retryableFaultsLock.RUnlock()
+	return retryableFaults[faultName]
+}
+
+// newOperationError returns the error for a CNS operation which failed with the
+// given fault. A RetryableError is returned if the fault is treated as transient,
+// and a FaultError otherwise.
+func newOperationError(fault *vim25types.LocalizedMethodFault, msg string) error {
+	if IsRetryableFault(fault) {
+		return &RetryableError{Fault: getFaultName(fault), err: errors.New(msg)}
+	}
+	if faultName := getFaultName(fault); faultName != "" {
+		return &FaultError{Fault: faultName, err: errors.New(msg)}
+	}
+	return errors.New(msg)
+}
+
+// getFaultName returns the name of the type of the given fault.
+func getFaultName(fault *vim25types.LocalizedMethodFault) string {
+	if fault == nil || fault.Fault == nil {
+		return ""
+	}
+	faultType := reflect.TypeOf(fault.Fault)
+	if faultType.Kind() == reflect.Ptr {
+		faultType = faultType.Elem()
+	}
+	return faultType.Name()
+}
+
+// newFaultSet returns the set of the given fault type names.
+func newFaultSet(defaults []string, faults []string) map[string]bool {
+	faultSet := make(map[string]bool)
+	for _, fault := range append(append([]string{}, defaults...), faults...) {
+		if fault = strings.TrimSpace(fault); fault != "" {
+			faultSet[fault] = true
+		}
+	}
+	return faultSet
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	vim25types "github.com/vmware/govmomi/vim25/types"
+)
+
+func TestSetRetryableFaults(t *testing.T) {
+	ctx := context.Background()
+	defer SetRetryableFaults(ctx, nil)
+
+	notFoundFault := &vim25types.LocalizedMethodFault{Fault: &vim25types.NotFound{}}
+	taskInProgressFault := &vim25types.LocalizedMethodFault{Fault: &vim25types.TaskInProgress{}}
+	if IsRetryableFault(notFoundFault) {
+		t.Fatal("expected NotFound fault to not be retryable by default")
+	}
+	if !IsRetryableFault(taskInProgressFault) {
+		t.Fatal("expected TaskInProgress fault to be retryable by default")
+	}
+
+	SetRetryableFaults(ctx, []string{" NotFound ", ""})
+	if !IsRetryableFault(notFoundFault) {
+		t.Error("expected config-specified NotFound fault to be retryable")
+	}
+	if !IsRetryableFault(taskInProgressFault) {
+		t.Error("expected built-in TaskInProgress fault to remain retryable")
+	}
+	if err := newOperationError(notFoundFault, "failed"); !IsRetryableError(err) {
+		t.Errorf("expected error for NotFound fault to be retryable, got %v", err)
+	}
+	if IsRetryableFault(nil) {
+		t.Error("expected nil fault to not be retryable")
+	}
+}
+
+func TestIsHostUnreachableError(t *testing.T) {
+	hostCommunicationFault := &vim25types.LocalizedMethodFault{Fault: &vim25types.HostCommunication{}}
+	hostNotConnectedFault := &vim25types.LocalizedMethodFault{Fault: &vim25types.HostNotConnected{}}
+	notFoundFault := &vim25types.LocalizedMethodFault{Fault: &vim25types.NotFound{}}
+	if !IsHostUnreachableError(newOperationError(hostCommunicationFault, "failed")) {
+		t.Error("expected error for retryable HostCommunication fault to be a host unreachable error")
+	}
+	if !IsHostUnreachableError(newOperationError(hostNotConnectedFault, "failed")) {
+		t.Error("expected error for HostNotConnected fault to be a host unreachable error")
+	}
+	if IsHostUnreachableError(newOperationError(notFoundFault, "failed")) {
+		t.Error("expected error for NotFound fault to not be a host unreachable error")
+	}
+	if IsHostUnreachableError(newOperationError(nil, "failed")) {
+		t.Error("expected error without fault to not be a host unreachable error")
+	}
+}
+
+func TestIsResourceBusyError(t *testing.T) {
+	resourceInUseFault := &vim25types.LocalizedMethodFault{Fault: &vim25types.ResourceInUse{}}
+	taskInProgressFault := &vim25types.LocalizedMethodFault{Fault: &vim25types.TaskInProgress{}}
+	notFoundFault := &vim25types.LocalizedMethodFault{Fault: &vim25types.NotFound{}}
+	if !IsResourceBusyError(newOperationError(resourceInUseFault, "failed")) {
+		t.Error("expected error for ResourceInUse fault to be a resource busy error")
+	}
+	if !IsResourceBusyError(newOperationError(taskInProgressFault, "failed")) {
+		t.Error("expected error for retryable TaskInProgress fault to be a resource busy error")
+	}
+	if IsResourceBusyError(newOperationError(notFoundFault, "failed")) {
+		t.Error("expected error for NotFound fault to not be a resource busy error")
+	}
+}
+
+func TestIsPlacementError(t *testing.T) {
+	noDiskSpaceFault := &vim25types.LocalizedMethodFault{Fault: &vim25types.NoDiskSpace{}}
+	notFoundFault := &vim25types.LocalizedMethodFault{Fault: &vim25types.NotFound{}}
+	if !IsPlacementError(newOperationError(noDiskSpaceFault, "failed")) {
+		t.Error("expected error for NoDiskSpace fault to be a placement error")
+	}
+	if IsPlacementError(newOperationError(notFoundFault, "failed")) {
+		t.Error("expected error for NotFound fault to not be a placement error")
+	}
+	if IsPlacementError(newOperationError(nil, "failed")) {
+		t.Error("expected error without fault to not be a placement error")
+	}
+}
+
+func TestIsServiceUnavailableError(t *testing.T) {
+	// vCenter in maintenance answers every request with a 503
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL + "/sdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := soap.NewClient(u, true)
+	_, err = methods.RetrieveServiceContent(context.Background(), client, &vim25types.RetrieveServiceContent{
+		This: vim25types.ManagedObjectReference{Type: "ServiceInstance", Value: "ServiceInstance"},
+	})
+	if !IsServiceUnavailableError(err) {
+		t.Errorf("expected the error of a 503 response to be a service unavailable error, got err: %v", err)
+	}
+	if !IsServiceUnavailableError(fmt.Errorf("failed to create volume. err: %w", err)) {
+		t.Errorf("expected a wrapped 503 error to be a service unavailable error")
+	}
+	if IsServiceUnavailableError(errors.New("503 Service Unavailable")) ||
+		IsServiceUnavailableError(errors.New("500 Internal Server Error")) || IsServiceUnavailableError(nil) {
+		t.Errorf("expected other errors to not be service unavailable errors")
+	}
+}
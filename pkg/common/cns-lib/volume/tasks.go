@@ -0,0 +1,57 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+
+	vim25types "github.com/vmware/govmomi/vim25/types"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
+)
+
+type cnsTaskIDKey struct{}
+
+// CnsTaskID holds the ID of the vCenter task of a CNS operation, e.g. "task-1234",
+// to cross-reference the operation with the vCenter task history.
+type CnsTaskID struct {
+	id string
+}
+
+// WithCnsTaskID returns a child context in which the ID of the vCenter task of the
+// CNS operation performed with it is recorded to the returned CnsTaskID.
+func WithCnsTaskID(ctx context.Context) (context.Context, *CnsTaskID) {
+	taskID := &CnsTaskID{}
+	return context.WithValue(ctx, cnsTaskIDKey{}, taskID), taskID
+}
+
+// String returns the recorded task ID, or an empty string if no task was recorded.
+func (t *CnsTaskID) String() string {
+	return t.id
+}
+
+// recordCnsTask logs the formatted message about a CNS operation along with the IDs
+// of its vCenter task and of the operation, and records the task ID if the context
+// was created with WithCnsTaskID.
+func recordCnsTask(ctx context.Context, taskInfo *vim25types.TaskInfo, format string, args ...interface{}) {
+	logger.GetLogger(ctx).Infof("%s, taskId: %q, opId: %q", fmt.Sprintf(format, args...),
+		taskInfo.Task.Value, taskInfo.ActivationId)
+	if taskID, ok := ctx.Value(cnsTaskIDKey{}).(*CnsTaskID); ok {
+		taskID.id = taskInfo.Task.Value
+	}
+}
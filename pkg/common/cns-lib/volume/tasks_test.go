@@ -0,0 +1,58 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"testing"
+
+	vim25types "github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
+)
+
+func TestRecordCnsTask(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	ctx := logger.WithLogger(context.Background(), zap.New(core))
+	taskInfo := &vim25types.TaskInfo{
+		Task:         vim25types.ManagedObjectReference{Type: "Task", Value: "task-1234"},
+		ActivationId: "op-1",
+	}
+
+	// The task ID is logged even if it isn't recorded
+	recordCnsTask(ctx, taskInfo, "DeleteVolume: volumeID: %q", "vol-1")
+	entries := logs.TakeAll()
+	if len(entries) != 1 || entries[0].Message != `DeleteVolume: volumeID: "vol-1", taskId: "task-1234", opId: "op-1"` {
+		t.Errorf("expected the task ID to be logged, got %v", entries)
+	}
+
+	ctx, taskID := WithCnsTaskID(ctx)
+	if taskID.String() != "" {
+		t.Errorf("expected no task ID before the task is recorded, got %q", taskID)
+	}
+	recordCnsTask(ctx, taskInfo, "CreateVolume: VolumeName: %q", "pvc-1")
+	if taskID.String() != "task-1234" {
+		t.Errorf("expected the task ID to be recorded, got %q", taskID)
+	}
+	if entries = logs.TakeAll(); len(entries) != 1 ||
+		entries[0].Message != `CreateVolume: VolumeName: "pvc-1", taskId: "task-1234", opId: "op-1"` {
+		t.Errorf("expected the task ID to be logged, got %v", entries)
+	}
+}
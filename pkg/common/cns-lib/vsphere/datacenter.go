@@ -71,7 +71,7 @@ func (dc *Datacenter) GetDatastoreByURL(ctx context.Context, datastoreURL string
 		return nil, err
 	}
 	for _, dsMo := range dsMoList {
-		if dsMo.Info.GetDatastoreInfo().Url == datastoreURL {
+		if NormalizeDatastoreURL(dsMo.Info.GetDatastoreInfo().Url) == NormalizeDatastoreURL(datastoreURL) {
 			return &Datastore{object.NewDatastore(dc.Client(), dsMo.Reference()),
 				dc}, nil
 		}
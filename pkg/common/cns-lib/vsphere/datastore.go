@@ -57,3 +57,16 @@ func (ds *Datastore) GetDatastoreURL(ctx context.Context) (string, error) {
 	}
 	return dsMo.Summary.Url, nil
 }
+
+// GetCapacity returns the capacity of the datastore in bytes
+func (ds *Datastore) GetCapacity(ctx context.Context) (int64, error) {
+	log := logger.GetLogger(ctx)
+	var dsMo mo.Datastore
+	pc := property.DefaultCollector(ds.Client())
+	err := pc.RetrieveOne(ctx, ds.Datastore.Reference(), []string{"summary"}, &dsMo)
+	if err != nil {
+		log.Errorf("failed to retrieve datastore summary property: %v", err)
+		return 0, err
+	}
+	return dsMo.Summary.Capacity, nil
+}
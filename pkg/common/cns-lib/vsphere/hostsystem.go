@@ -18,6 +18,7 @@ package vsphere
 
 import (
 	"context"
+	"fmt"
 
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
 
@@ -81,3 +82,18 @@ func (host *HostSystem) GetHostVsanNodeUUID(ctx context.Context) (string, error)
 	}
 	return vsan.Config.ClusterInfo.NodeUuid, nil
 }
+
+// GetHostVersion gets the ESXi version of this host, such as "7.0.0".
+func (host *HostSystem) GetHostVersion(ctx context.Context) (string, error) {
+	log := logger.GetLogger(ctx)
+	var hostSystemMo mo.HostSystem
+	err := host.Properties(ctx, host.Reference(), []string{"config.product"}, &hostSystemMo)
+	if err != nil {
+		log.Errorf("failed to retrieve product info for host %v with err: %v", host, err)
+		return "", err
+	}
+	if hostSystemMo.Config == nil {
+		return "", fmt.Errorf("product info not available for host %v", host)
+	}
+	return hostSystemMo.Config.Product.Version, nil
+}
@@ -18,11 +18,19 @@ package vsphere
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/vmware/govmomi/pbm"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
 )
 
+// ErrStoragePolicyNotFound is wrapped by the error GetStoragePolicyIDByName returns
+// when no storage policy with the given name exists.
+var ErrStoragePolicyNotFound = errors.New("storage policy not found")
+
 // ConnectPbm creates a PBM client for the virtual center.
 func (vc *VirtualCenter) ConnectPbm(ctx context.Context) error {
 	log := logger.GetLogger(ctx)
@@ -57,7 +65,67 @@ func (vc *VirtualCenter) GetStoragePolicyIDByName(ctx context.Context, storagePo
 	storagePolicyID, err := vc.PbmClient.ProfileIDByName(ctx, storagePolicyName)
 	if err != nil {
 		log.Errorf("failed to get StoragePolicyID from StoragePolicyName %s with err: %v", storagePolicyName, err)
+		// PBM doesn't fault on unknown profile names, the PBM client returns a plain
+		// error after not finding the name in the profiles.
+		if strings.Contains(err.Error(), "no pbm profile found") {
+			return "", fmt.Errorf("%w: %q", ErrStoragePolicyNotFound, storagePolicyName)
+		}
 		return "", err
 	}
 	return storagePolicyID, nil
 }
+
+// GetStoragePolicyNameByID gets storage policy name by ID.
+func (vc *VirtualCenter) GetStoragePolicyNameByID(ctx context.Context, storagePolicyID string) (string, error) {
+	log := logger.GetLogger(ctx)
+	if err := vc.ConnectPbm(ctx); err != nil {
+		return "", err
+	}
+	profiles, err := vc.PbmClient.RetrieveContent(ctx, []pbmtypes.PbmProfileId{{UniqueId: storagePolicyID}})
+	if err != nil {
+		log.Errorf("failed to get StoragePolicyName from StoragePolicyID %s with err: %v", storagePolicyID, err)
+		return "", err
+	}
+	if len(profiles) == 0 {
+		return "", fmt.Errorf("storage policy with ID %s not found", storagePolicyID)
+	}
+	return profiles[0].GetPbmProfile().Name, nil
+}
+
+// GetCompatibleDatastores returns the datastores from the given list which are
+// compatible with the given storage policy ID.
+func (vc *VirtualCenter) GetCompatibleDatastores(ctx context.Context, storagePolicyID string,
+	datastores []*DatastoreInfo) ([]*DatastoreInfo, error) {
+	log := logger.GetLogger(ctx)
+	if err := vc.ConnectPbm(ctx); err != nil {
+		return nil, err
+	}
+	var hubs []pbmtypes.PbmPlacementHub
+	for _, ds := range datastores {
+		hubs = append(hubs, pbmtypes.PbmPlacementHub{
+			HubType: ds.Reference().Type,
+			HubId:   ds.Reference().Value,
+		})
+	}
+	req := []pbmtypes.BasePbmPlacementRequirement{
+		&pbmtypes.PbmPlacementCapabilityProfileRequirement{
+			ProfileId: pbmtypes.PbmProfileId{UniqueId: storagePolicyID},
+		},
+	}
+	res, err := vc.PbmClient.CheckRequirements(ctx, hubs, nil, req)
+	if err != nil {
+		log.Errorf("failed to check compatibility of datastores with storage policy %s with err: %v", storagePolicyID, err)
+		return nil, err
+	}
+	compatibleHubs := make(map[string]bool)
+	for _, hub := range res.CompatibleDatastores() {
+		compatibleHubs[hub.HubId] = true
+	}
+	var compatibleDatastores []*DatastoreInfo
+	for _, ds := range datastores {
+		if compatibleHubs[ds.Reference().Value] {
+			compatibleDatastores = append(compatibleDatastores, ds)
+		}
+	}
+	return compatibleDatastores, nil
+}
@@ -23,6 +23,30 @@ import (
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 )
 
+// datastoreURLPrefix is the prefix of the URL of every datastore.
+const datastoreURLPrefix = "ds:///"
+
+// NormalizeDatastoreURL returns the canonical form of the given datastore URL, which is
+// trimmed, lowercase and ends with a single slash, e.g. "ds:///vmfs/volumes/vsan:52d6.../".
+// Datastore URLs must be compared in their canonical form.
+func NormalizeDatastoreURL(datastoreURL string) string {
+	datastoreURL = strings.ToLower(strings.TrimSpace(datastoreURL))
+	if datastoreURL == "" {
+		return ""
+	}
+	return strings.TrimRight(datastoreURL, "/") + "/"
+}
+
+// ValidateDatastoreURL returns an error if the given datastore URL is not a valid datastore URL.
+func ValidateDatastoreURL(datastoreURL string) error {
+	normalizedURL := NormalizeDatastoreURL(datastoreURL)
+	if !strings.HasPrefix(normalizedURL, datastoreURLPrefix) || normalizedURL == datastoreURLPrefix {
+		return fmt.Errorf("invalid datastore URL %q, expected a URL like %q", datastoreURL,
+			datastoreURLPrefix+"vmfs/volumes/<datastore uuid>/")
+	}
+	return nil
+}
+
 // IsInvalidCredentialsError returns true if error is of type InvalidLogin
 func IsInvalidCredentialsError(err error) bool {
 	isInvalidCredentialsError := false
@@ -102,7 +126,16 @@ func GetVirtualCenterConfig(cfg *config.Config) (*VirtualCenterConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	host := vCenterIPs[0]
+	return GetVirtualCenterConfigForHost(cfg, vCenterIPs[0])
+}
+
+// GetVirtualCenterConfigForHost returns VirtualCenterConfig Object created using the
+// vSphere Configuration of the given vCenter host.
+func GetVirtualCenterConfigForHost(cfg *config.Config, host string) (*VirtualCenterConfig, error) {
+	var err error
+	if _, ok := cfg.VirtualCenter[host]; !ok {
+		return nil, fmt.Errorf("vCenter %q not found in VSphereConfig", host)
+	}
 	port, err := strconv.Atoi(cfg.VirtualCenter[host].VCenterPort)
 	if err != nil {
 		return nil, err
@@ -113,12 +146,19 @@ func GetVirtualCenterConfig(cfg *config.Config) (*VirtualCenterConfig, error) {
 		targetDatastoreUrlsForFile = strings.Split(cfg.VirtualCenter[host].TargetvSANFileShareDatastoreURLs, ",")
 	}
 
+	scheme := cfg.VirtualCenter[host].Scheme
+	if scheme == "" {
+		scheme = DefaultScheme
+	}
+
 	vcConfig := &VirtualCenterConfig{
+		Scheme:                           scheme,
 		Host:                             host,
 		Port:                             port,
 		Username:                         cfg.VirtualCenter[host].User,
 		Password:                         cfg.VirtualCenter[host].Password,
 		Insecure:                         cfg.VirtualCenter[host].InsecureFlag,
+		Thumbprint:                       cfg.VirtualCenter[host].Thumbprint,
 		TargetvSANFileShareDatastoreURLs: targetDatastoreUrlsForFile,
 	}
 
@@ -131,10 +171,10 @@ func GetVirtualCenterConfig(cfg *config.Config) (*VirtualCenterConfig, error) {
 
 	// validate if target file volume datastores present are vsan datastores
 	for idx := range vcConfig.TargetvSANFileShareDatastoreURLs {
-		vcConfig.TargetvSANFileShareDatastoreURLs[idx] = strings.TrimSpace(vcConfig.TargetvSANFileShareDatastoreURLs[idx])
-		if vcConfig.TargetvSANFileShareDatastoreURLs[idx] == "" {
-			return nil, errors.New("Invalid datastore URL specified in targetvSANFileShareDatastoreURLs")
+		if err = ValidateDatastoreURL(vcConfig.TargetvSANFileShareDatastoreURLs[idx]); err != nil {
+			return nil, fmt.Errorf("Invalid datastore URL specified in targetvSANFileShareDatastoreURLs. err: %v", err)
 		}
+		vcConfig.TargetvSANFileShareDatastoreURLs[idx] = NormalizeDatastoreURL(vcConfig.TargetvSANFileShareDatastoreURLs[idx])
 		if !strings.HasPrefix(vcConfig.TargetvSANFileShareDatastoreURLs[idx], "ds:///vmfs/volumes/vsan:") {
 			err = errors.New("Non vSAN datastore specified for targetvSANFileShareDatastoreURLs")
 			return nil, err
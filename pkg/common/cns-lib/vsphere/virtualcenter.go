@@ -89,6 +89,10 @@ type VirtualCenterConfig struct {
 	// Insecure is enabled. Optional; if not configured, the system's CA
 	// certificates will be used.
 	CAFile string
+	// Thumbprint is the SHA-1 thumbprint of the virtual center server certificate.
+	// Optional; if configured, the server certificate is trusted when its
+	// thumbprint matches.
+	Thumbprint string
 	// RoundTripperCount is the SOAP round tripper count. (retries = RoundTripperCount - 1)
 	RoundTripperCount int
 	// DatacenterPaths represents paths of datacenters on the virtual center.
@@ -114,6 +118,9 @@ func (vc *VirtualCenter) newClient(ctx context.Context) (*govmomi.Client, error)
 	}
 
 	soapClient := soap.NewClient(url, vc.Config.Insecure)
+	if vc.Config.Thumbprint != "" {
+		soapClient.SetThumbprint(url.Host, vc.Config.Thumbprint)
+	}
 	if len(vc.Config.CAFile) > 0 && !vc.Config.Insecure {
 		if err := soapClient.SetRootCAs(vc.Config.CAFile); err != nil {
 			log.Errorf("failed to load CA file: %v", err)
@@ -340,6 +347,36 @@ func (vc *VirtualCenter) GetHostsByCluster(ctx context.Context, clusterMorefValu
 	return hostObjList, nil
 }
 
+// WatchClusterHosts calls onChange with the hosts of the cluster with the given moref
+// value, first with the current hosts and then each time hosts are added to or removed
+// from the cluster. It blocks until the context is canceled or the watch fails.
+func (vc *VirtualCenter) WatchClusterHosts(ctx context.Context, clusterMorefValue string,
+	onChange func(hosts []*HostSystem)) error {
+	clusterMoref := types.ManagedObjectReference{
+		Type:  "ClusterComputeResource",
+		Value: clusterMorefValue,
+	}
+	pc := property.DefaultCollector(vc.Client.Client)
+	return property.Wait(ctx, pc, clusterMoref, []string{"host"}, func(changes []types.PropertyChange) bool {
+		for _, change := range changes {
+			if change.Name != "host" {
+				continue
+			}
+			var hostObjList []*HostSystem
+			if hostMorefs, ok := change.Val.(types.ArrayOfManagedObjectReference); ok {
+				for _, hostMoref := range hostMorefs.ManagedObjectReference {
+					hostObjList = append(hostObjList,
+						&HostSystem{
+							HostSystem: object.NewHostSystem(vc.Client.Client, hostMoref),
+						})
+				}
+			}
+			onChange(hostObjList)
+		}
+		return false
+	})
+}
+
 // GetVsanDatastores returns all the vsan datastore exists in the vc inventory
 func (vc *VirtualCenter) GetVsanDatastores(ctx context.Context) ([]mo.Datastore, error) {
 	log := logger.GetLogger(ctx)
@@ -261,6 +261,9 @@ func validateConfig(ctx context.Context, cfg *Config) error {
 		if vcConfig.VCenterPort == "" {
 			vcConfig.VCenterPort = cfg.Global.VCenterPort
 		}
+		if vcConfig.Scheme == "" {
+			vcConfig.Scheme = cfg.Global.Scheme
+		}
 		if vcConfig.Datacenters == "" {
 			if cfg.Global.Datacenters != "" {
 				vcConfig.Datacenters = cfg.Global.Datacenters
@@ -270,6 +273,9 @@ func validateConfig(ctx context.Context, cfg *Config) error {
 		if !insecure {
 			vcConfig.InsecureFlag = cfg.Global.InsecureFlag
 		}
+		if vcConfig.Thumbprint == "" {
+			vcConfig.Thumbprint = cfg.Global.Thumbprint
+		}
 	}
 	if cfg.NetPermissions == nil {
 		// If no net permissions are given, assume default
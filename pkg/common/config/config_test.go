@@ -158,3 +158,22 @@ func isConfigEqual(actual *Config, expected *Config) bool {
 	}
 	return true
 }
+
+func TestValidateConfigWithScheme(t *testing.T) {
+	cfg := &Config{
+		VirtualCenter: map[string]*VirtualCenterConfig{
+			"1.1.1.1": {User: "Admin", Password: "Password"},
+			"2.2.2.2": {User: "Admin", Password: "Password", Scheme: "https"},
+		},
+	}
+	cfg.Global.Scheme = "http"
+	if err := validateConfig(ctx, cfg); err != nil {
+		t.Fatalf("failed to validate config %+v. Received error: %v", *cfg, err)
+	}
+	if scheme := cfg.VirtualCenter["1.1.1.1"].Scheme; scheme != "http" {
+		t.Errorf("expected the global scheme %q for vCenter 1.1.1.1, got %q", "http", scheme)
+	}
+	if scheme := cfg.VirtualCenter["2.2.2.2"].Scheme; scheme != "https" {
+		t.Errorf("expected the scheme of vCenter 2.2.2.2 to be kept, got %q", scheme)
+	}
+}
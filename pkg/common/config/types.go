@@ -31,6 +31,8 @@ type Config struct {
 		Password string `gcfg:"password"`
 		// vCenter port.
 		VCenterPort string `gcfg:"port"`
+		// vCenter connection scheme, e.g. "https". Defaults to "https".
+		Scheme string `gcfg:"scheme"`
 		// Specifies whether to verify the server's certificate chain. Set to true to
 		// skip verification.
 		InsecureFlag bool `gcfg:"insecure-flag"`
@@ -38,8 +40,151 @@ type Config struct {
 		// InsecureFlag is enabled. Optional; if not configured, the system's CA
 		// certificates will be used.
 		CAFile string `gcfg:"ca-file"`
+		// SHA-1 thumbprint of the vCenter server certificate. Optional; if configured,
+		// the server certificate is trusted when its thumbprint matches.
+		Thumbprint string `gcfg:"thumbprint"`
 		// Datacenter in which Node VMs are located.
 		Datacenters string `gcfg:"datacenters"`
+		// Specifies whether DeleteVolume should only remove the CNS registration of
+		// a volume and retain its backing disk. Intended for debugging only.
+		RetainBackingDisk bool `gcfg:"retainbackingdisk"`
+		// Specifies whether DeleteVolume queries CNS after deleting a volume to verify
+		// that it is gone, failing the request if the volume still exists, so that the
+		// deletion is retried.
+		VerifyVolumeDeletion bool `gcfg:"verify-volume-deletion"`
+		// Interval in minutes at which the CNS metadata of volumes is reconciled with
+		// the labels of the corresponding PVs. Reconciliation is disabled if not set.
+		VolumeMetadataReconcileIntervalInMin int `gcfg:"volume-metadata-reconcile-interval-minutes"`
+		// Interval in minutes at which the in-memory inventory of the CNS volumes of the
+		// cluster, used by ListVolumes, is refreshed from CNS. The volumes created or
+		// expanded since the last refresh are queried from CNS. The inventory is
+		// disabled if not set.
+		VolumeInventoryRefreshIntervalInMin int `gcfg:"volume-inventory-refresh-interval-minutes"`
+		// Comma separated list of fault types, such as "NotFound,InvalidState", which
+		// are treated as transient in addition to the built-in defaults, so that
+		// the CNS operations failing with them are retried.
+		RetryableFaults string `gcfg:"retryable-faults"`
+		// Average number of CNS calls per second the controller makes to vCenter.
+		// The CNS calls are not rate limited if not set.
+		CnsClientQPS int `gcfg:"cns-client-qps"`
+		// Number of CNS calls which can be made at once above cns-client-qps.
+		// Defaults to 1.
+		CnsClientBurst int `gcfg:"cns-client-burst"`
+		// If set, the CNS calls over the rate limit fail immediately instead of
+		// waiting for their turn.
+		CnsClientRateLimitFailFast bool `gcfg:"cns-client-rate-limit-fail-fast"`
+		// Comma separated list of mount flags, such as "inode64,largeio", accepted in
+		// the volume capabilities in addition to the built-in allowlist of supported
+		// flags.
+		AllowedMountFlags string `gcfg:"allowed-mount-flags"`
+		// Comma separated list of per namespace capacity quotas in MB, such as
+		// "team-a:102400,team-b:51200". CreateVolume rejects requests which would
+		// exceed the quota of the namespace of the PVC. The namespace is taken from
+		// the csi.storage.k8s.io/pvc/namespace parameter, which requires the
+		// external-provisioner to run with --extra-create-metadata.
+		NamespaceCapacityQuotas string `gcfg:"namespace-capacity-quotas"`
+		// Comma separated list of per RPC log levels, such as
+		// "ControllerGetCapabilities:debug,GetCapacity:debug", to demote the logging
+		// of high frequency RPC calls. RPC calls are logged at info level by default.
+		RPCLogLevels string `gcfg:"rpc-log-levels"`
+		// Output format of the logs of the controller, either "text" (default) or
+		// "json". In JSON format, RPC calls are logged with the rpc, volumeID,
+		// requestID and duration fields instead of formatted messages.
+		LogFormat string `gcfg:"log-format"`
+		// Set to true during planned storage maintenance to reject the creation and
+		// the attachment of volumes, while still allowing them to be detached and
+		// deleted. Can be toggled by updating the config.
+		MaintenanceMode bool `gcfg:"maintenance-mode"`
+		// Number of seconds CreateVolume waits for shared datastores to appear when
+		// none are found, e.g. while hosts are rebooting. CreateVolume fails
+		// immediately if not set.
+		SharedDatastoreWaitTimeoutInSec int `gcfg:"shared-datastore-wait-timeout-seconds"`
+		// Number of seconds CreateVolume waits for the CNS task creating a block volume.
+		// If the task is still running, CreateVolume fails with Aborted so that the
+		// request is retried, and the retry returns the volume once the task completed.
+		// CreateVolume waits for the task to complete if not set.
+		CreateVolumeAsyncWaitInSec int `gcfg:"create-volume-async-wait-seconds"`
+		// Maximum number of CreateVolume requests which can be in progress concurrently
+		// for a single storage policy. Requests over the limit are rejected with
+		// ResourceExhausted. Not limited if not set.
+		MaxConcurrentCreateVolumesPerPolicy int `gcfg:"max-concurrent-create-volumes-per-policy"`
+		// Maximum number of CNS create volume tasks the controller starts per minute,
+		// so that mass scale-ups don't overwhelm vCenter. CreateVolume requests
+		// starting a task over the limit are rejected with ResourceExhausted. Requests
+		// for volumes which already exist or are being created are not counted. Not
+		// limited if not set.
+		MaxVolumeProvisioningsPerMinute int `gcfg:"max-volume-provisionings-per-minute"`
+		// Maximum number of ControllerPublishVolume requests attaching volumes to the same
+		// PodVM concurrently in WCP, as vSphere serializes the hot-add of disks to a VM.
+		// Requests over the limit wait for the attaches in progress. Defaults to 1.
+		MaxConcurrentAttachesPerNode int `gcfg:"max-concurrent-attaches-per-node"`
+		// Number of times an attach is retried with exponential backoff while the VM
+		// is locked by another operation. Defaults to 3 if not set.
+		AttachBusyRetryCount int `gcfg:"attach-busy-retry-count"`
+		// Version of the Kubernetes or WCP cluster, such as "v1.18.2". If set, it is
+		// recorded in the CNS metadata of the volumes created by the driver.
+		ClusterVersion string `gcfg:"cluster-version"`
+		// Comma separated list of the IDs of other WCP clusters in the same vCenter
+		// the controller provisions volumes for, in addition to cluster-id. The
+		// cluster of a volume is selected with the clusterid CreateVolume parameter.
+		AdditionalClusterIDs string `gcfg:"additional-cluster-ids"`
+		// Names of the publish context keys holding the disk type and the FCD UUID
+		// of a published volume, for node plugins expecting different names than
+		// "type" and "diskUUID". The node plugin of this driver expects the defaults.
+		PublishContextDiskTypeKey string `gcfg:"publish-context-disk-type-key"`
+		PublishContextDiskUUIDKey string `gcfg:"publish-context-disk-uuid-key"`
+		// Format of the FCD UUID in the publish context: "compact" (the default),
+		// "compact-upper", "dashed" or "dashed-upper", for node plugins expecting the
+		// UUID with dashes or in upper case. The node plugin of this driver accepts
+		// all of them.
+		DiskUUIDFormat string `gcfg:"disk-uuid-format"`
+		// Comma separated list of key=value labels, such as "cost-center=1234,team=storage",
+		// recorded in the CNS metadata of the volumes created and updated by the driver,
+		// so that cost tooling can attribute them. Labels set on the PV take precedence.
+		ChargebackLabels string `gcfg:"chargeback-labels"`
+		// Minimum ESXi version, such as "6.7.0", of the hosts whose datastores are
+		// considered when computing the datastores shared by the WCP cluster. Older
+		// hosts are left out of the intersection. All hosts are considered if not set.
+		MinHostVersion string `gcfg:"min-host-version"`
+		// Minimum percentage of the capacity of a datastore which must remain free
+		// after a new block volume is placed on it. Datastores which would drop below
+		// it are not considered by CreateVolume. Not enforced if not set.
+		MinDatastoreFreePercent int `gcfg:"min-datastore-free-percent"`
+		// If set, DeleteVolume checks with CNS that a block volume is not attached to
+		// any VM before deleting it, and fails with FailedPrecondition if it is.
+		StrictDelete bool `gcfg:"strict-delete"`
+		// Behavior of ControllerPublishVolume in WCP when the PodVM is powered off,
+		// either "proceed" to attach the volume anyway or "fail" with
+		// FailedPrecondition. Defaults to "proceed".
+		PoweredOffPodVMAttach string `gcfg:"powered-off-podvm-attach"`
+		// If set, ListVolumes in WCP returns all the volumes on the shared datastores,
+		// including the ones of other clusters. By default, only the volumes of the
+		// clusters managed by the controller are returned.
+		ListAllVolumes bool `gcfg:"list-all-volumes"`
+		// Order in which the shared datastores are passed to CNS when creating a block
+		// volume, either "random" or "round-robin", to avoid always favoring the first
+		// datastore of the list. The datastores are passed in the order they are
+		// discovered if not set.
+		DatastoreSelection string `gcfg:"datastore-selection"`
+		// Behavior of CreateVolume when a block volume with the requested name already
+		// exists in the cluster with a different storage policy, either "fail" with
+		// AlreadyExists or "reconfigure" the existing volume to the requested policy.
+		// Existing volumes with the same policy are returned. CreateVolume does not
+		// look up existing volumes if not set.
+		DuplicateVolumeNamePolicy string `gcfg:"duplicate-volume-name-policy"`
+		// How GetCapacity aggregates the free space of the datastores, either "largest"
+		// to report the free space of the datastore with the most free space, which is
+		// the size of the largest volume which can be provisioned as a volume can't span
+		// datastores, or "sum" to report their total free space. Defaults to "largest".
+		CapacityAggregation string `gcfg:"capacity-aggregation"`
+		// If set, CreateVolume reports the reasons the shared datastores were excluded
+		// from the placement of a block volume in the "datastoreexclusions" attribute
+		// of the volume context. The reasons are logged at debug level regardless.
+		ReportDatastoreExclusions bool `gcfg:"report-datastore-exclusions"`
+		// If set, CreateVolume emits an event on the PVC of a block volume naming the
+		// datastore the volume was placed on. Requires the external-provisioner to run
+		// with --extra-create-metadata. Read when the controller starts.
+		PlacementEvents bool `gcfg:"placement-events"`
 	}
 
 	// Multiple sets of Net Permissions applied to all file shares
@@ -86,8 +231,12 @@ type VirtualCenterConfig struct {
 	Password string `gcfg:"password"`
 	// vCenter port.
 	VCenterPort string `gcfg:"port"`
+	// vCenter connection scheme.
+	Scheme string `gcfg:"scheme"`
 	// True if vCenter uses self-signed cert.
 	InsecureFlag bool `gcfg:"insecure-flag"`
+	// SHA-1 thumbprint of the vCenter server certificate.
+	Thumbprint string `gcfg:"thumbprint"`
 	// Datacenter in which VMs are located.
 	Datacenters string `gcfg:"datacenters"`
 	// Target datastore urls for provisioning file volumes.
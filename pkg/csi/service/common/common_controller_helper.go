@@ -21,12 +21,17 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	cnstypes "github.com/vmware/govmomi/cns/types"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 )
 
 // ValidateCreateVolumeRequest is the helper function to validate
@@ -44,11 +49,18 @@ func ValidateCreateVolumeRequest(ctx context.Context, req *csi.CreateVolumeReque
 	// Validate Volume Capabilities
 	volCaps := req.GetVolumeCapabilities()
 	if len(volCaps) == 0 {
+		RecordCreateVolumeRejection(CreateVolumeRejectionCapability)
 		return status.Error(codes.InvalidArgument, "Volume capabilities not provided")
 	}
 	if !IsValidVolumeCapabilities(ctx, volCaps) {
+		RecordCreateVolumeRejection(CreateVolumeRejectionCapability)
 		return status.Error(codes.InvalidArgument, "Volume capabilities not supported")
 	}
+	if err := ValidateMountFlags(volCaps); err != nil {
+		log.Error(err)
+		RecordCreateVolumeRejection(CreateVolumeRejectionCapability)
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
 	return nil
 }
 
@@ -92,6 +104,22 @@ func ValidateControllerPublishVolumeRequest(ctx context.Context, req *csi.Contro
 	return nil
 }
 
+// ValidateVolumeCapabilityForVolumeType returns an InvalidArgument error if the
+// given volume capability is not supported for a CNS volume of the given type,
+// i.e. a multi node access mode for a block volume or a single node access mode
+// for a file volume.
+func ValidateVolumeCapabilityForVolumeType(ctx context.Context, volCap *csi.VolumeCapability, volumeType string) error {
+	log := logger.GetLogger(ctx)
+	isFileVolumeRequest := IsFileVolumeRequest(ctx, []*csi.VolumeCapability{volCap})
+	if isFileVolumeRequest == (volumeType == FileVolumeType) {
+		return nil
+	}
+	msg := fmt.Sprintf("volume capability with access mode %q is not supported for volume of type %q",
+		volCap.GetAccessMode().GetMode(), volumeType)
+	log.Error(msg)
+	return status.Error(codes.InvalidArgument, msg)
+}
+
 // ValidateControllerUnpublishVolumeRequest is the helper function to validate
 // ControllerUnpublishVolumeRequest for all block controllers.
 // Function returns error if validation fails otherwise returns nil.
@@ -158,7 +186,434 @@ func ValidateControllerExpandVolumeRequest(ctx context.Context, req *csi.Control
 		msg := "capacity ranges values cannot be negative"
 		log.Error(msg)
 		return status.Error(codes.InvalidArgument, msg)
+	} else if req.GetCapacityRange().GetRequiredBytes() == 0 {
+		msg := "required bytes in capacity range must be greater than zero"
+		log.Error(msg)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+
+	return nil
+}
+
+// NamespaceQuotas enforces the capacity quotas configured for namespaces with
+// namespace-capacity-quotas. The capacity used by a namespace is the sum of the
+// capacity of the volumes of the cluster with PVC metadata in the namespace, which
+// CreateVolume records when the volume is created. The checks for a namespace are
+// serialized, and the capacity of a volume is reserved from its check until its
+// creation completes, so that concurrent requests can't exceed the quota together. A nil NamespaceQuotas enforces no quotas.
+type NamespaceQuotas struct {
+	mutex sync.Mutex
+	// quotasInMb maps the namespaces to their capacity quota in MB
+	quotasInMb map[string]int64
+	// reservedInMb maps the namespaces to the capacity in MB reserved for the
+	// volumes being created in them
+	reservedInMb map[string]int64
+	// namespaceLocks serialize the checks for each namespace
+	namespaceLocks map[string]*sync.Mutex
+}
+
+// NewNamespaceQuotas returns a NamespaceQuotas enforcing the given comma separated
+// list of "namespace:quotaInMb" pairs.
+func NewNamespaceQuotas(quotas string) (*NamespaceQuotas, error) {
+	quotasInMb, err := ParseNamespaceQuotas(quotas)
+	if err != nil {
+		return nil, err
 	}
+	return &NamespaceQuotas{
+		quotasInMb:     quotasInMb,
+		reservedInMb:   make(map[string]int64),
+		namespaceLocks: make(map[string]*sync.Mutex),
+	}, nil
+}
 
+// SetQuotas replaces the enforced quotas with the given comma separated list of
+// "namespace:quotaInMb" pairs, e.g. when the config is reloaded. The capacity
+// reserved for the volumes being created is kept.
+func (q *NamespaceQuotas) SetQuotas(quotas string) error {
+	quotasInMb, err := ParseNamespaceQuotas(quotas)
+	if err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.quotasInMb = quotasInMb
 	return nil
 }
+
+// Reserve returns a ResourceExhausted error if creating a volume of the given size in
+// the given namespace would exceed the capacity quota of the namespace. Otherwise the
+// capacity is reserved until the returned function is called, which must be done once
+// the creation of the volume completes.
+func (q *NamespaceQuotas) Reserve(ctx context.Context, manager *Manager, namespace string,
+	capacityInMb int64) (func(), error) {
+	log := logger.GetLogger(ctx)
+	release := func() {}
+	if q == nil {
+		return release, nil
+	}
+	q.mutex.Lock()
+	quotaInMb, ok := q.quotasInMb[namespace]
+	quotasConfigured := len(q.quotasInMb) > 0
+	q.mutex.Unlock()
+	if namespace == "" {
+		if quotasConfigured {
+			log.Warnf("namespace capacity quotas are not enforced as parameter %q is not set. "+
+				"Run the external-provisioner with --extra-create-metadata to set it", AttributePVCNamespace)
+		}
+		return release, nil
+	}
+	if !ok {
+		return release, nil
+	}
+	namespaceLock := q.getNamespaceLock(namespace)
+	namespaceLock.Lock()
+	defer namespaceLock.Unlock()
+
+	clusterID := manager.CnsConfig.Global.ClusterID
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{clusterID},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+	if err != nil {
+		msg := fmt.Sprintf("failed to query volumes of cluster %q. Error: %+v", clusterID, err)
+		log.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	usedInMb := getNamespaceUsedCapacityInMb(queryResult.Volumes, clusterID, namespace)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	reservedInMb := q.reservedInMb[namespace]
+	if usedInMb+reservedInMb+capacityInMb > quotaInMb {
+		msg := fmt.Sprintf("creating a volume of %d MB in namespace %q would exceed its capacity quota of %d MB, "+
+			"%d MB is already used and %d MB is reserved for volumes being created",
+			capacityInMb, namespace, quotaInMb, usedInMb, reservedInMb)
+		log.Error(msg)
+		RecordCreateVolumeRejection(CreateVolumeRejectionQuota)
+		return nil, status.Error(codes.ResourceExhausted, msg)
+	}
+	q.reservedInMb[namespace] += capacityInMb
+	return func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		q.reservedInMb[namespace] -= capacityInMb
+		if q.reservedInMb[namespace] <= 0 {
+			delete(q.reservedInMb, namespace)
+		}
+	}, nil
+}
+
+// getNamespaceLock returns the lock serializing the checks for the given namespace.
+func (q *NamespaceQuotas) getNamespaceLock(namespace string) *sync.Mutex {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	namespaceLock, ok := q.namespaceLocks[namespace]
+	if !ok {
+		namespaceLock = &sync.Mutex{}
+		q.namespaceLocks[namespace] = namespaceLock
+	}
+	return namespaceLock
+}
+
+// datastoreReservationExpiration is how long the capacity reserved for a volume is
+// held at most, matching how long the CNS CreateVolume tasks are tracked, so that
+// the reservations of volumes whose creation is never retried don't leak.
+const datastoreReservationExpiration = time.Hour
+
+// DatastoreReservations tracks the capacity tentatively reserved on the datastores for
+// the block volumes being created, so that concurrent creations don't each count the
+// same free space. The capacity of a volume is reserved on the datastore chosen for it
+// until its creation completes, including when the CNS task creating it outlives the
+// CreateVolume call. The creations are not tracked if the DatastoreReservations of
+// the Manager is nil.
+type DatastoreReservations struct {
+	mutex sync.Mutex
+	// reservations maps the names of the volumes being created to their reservation
+	reservations map[string]*datastoreReservation
+}
+
+// datastoreReservation is the capacity reserved for a volume on a datastore.
+type datastoreReservation struct {
+	datastoreURL   string
+	capacityInMb   int64
+	expirationTime time.Time
+}
+
+// NewDatastoreReservations returns a DatastoreReservations without reservations.
+func NewDatastoreReservations() *DatastoreReservations {
+	return &DatastoreReservations{
+		reservations: make(map[string]*datastoreReservation),
+	}
+}
+
+// Reserve reserves the capacity of the volume with the given name on the first of the
+// given datastores whose free space not reserved for other volumes can hold it, and
+// returns that datastore. If the volume already holds a reservation on one of the
+// datastores, e.g. as the CNS task creating it is still in progress, that datastore is
+// returned. The reservation is held until Release is called for the volume. A
+// ResourceExhausted error is returned if none of the datastores can hold the volume.
+func (r *DatastoreReservations) Reserve(ctx context.Context, volumeName string,
+	datastores []*cnsvsphere.DatastoreInfo, capacityInMb int64) (*cnsvsphere.DatastoreInfo, error) {
+	log := logger.GetLogger(ctx)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	for name, reservation := range r.reservations {
+		if now.After(reservation.expirationTime) {
+			log.Debugf("reservation of %d MB on datastore %q for volume %q expired",
+				reservation.capacityInMb, reservation.datastoreURL, name)
+			delete(r.reservations, name)
+		}
+	}
+	if reservation, ok := r.reservations[volumeName]; ok {
+		for _, datastore := range datastores {
+			if datastore.Info.Url == reservation.datastoreURL {
+				return datastore, nil
+			}
+		}
+		delete(r.reservations, volumeName)
+	}
+	reservedInMb := make(map[string]int64)
+	for _, reservation := range r.reservations {
+		reservedInMb[reservation.datastoreURL] += reservation.capacityInMb
+	}
+	for _, datastore := range datastores {
+		if datastore.Info.FreeSpace < (reservedInMb[datastore.Info.Url]+capacityInMb)*MbInBytes {
+			log.Debugf("excluding datastore %q as %d MB of its free space is reserved for volumes being created",
+				datastore.Info.Url, reservedInMb[datastore.Info.Url])
+			RecordDatastoreExclusion(ctx, datastore.Info.Url, DatastoreExclusionInsufficientSpace)
+			continue
+		}
+		r.reservations[volumeName] = &datastoreReservation{
+			datastoreURL:   datastore.Info.Url,
+			capacityInMb:   capacityInMb,
+			expirationTime: now.Add(datastoreReservationExpiration),
+		}
+		return datastore, nil
+	}
+	msg := fmt.Sprintf("no datastore has %d MB of free space not reserved for volumes being created",
+		capacityInMb)
+	log.Error(msg)
+	return nil, status.Error(codes.ResourceExhausted, msg)
+}
+
+// Release releases the capacity reserved for the volume with the given name.
+func (r *DatastoreReservations) Release(volumeName string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.reservations, volumeName)
+}
+
+// getDatastoreFreeSpace is used to look up the free space of a datastore.
+// It is a variable so that tests can replace it.
+var getDatastoreFreeSpace = GetDatastoreFreeSpace
+
+// ValidateDatastoreCapacityForExpansion returns a ResourceExhausted error if the
+// datastore with the given URL does not have enough free space to grow a volume
+// from currentSizeInMb to requestedSizeInMb. The check is advisory: if the free
+// space of the datastore cannot be looked up, the expansion is left to CNS.
+func ValidateDatastoreCapacityForExpansion(ctx context.Context, manager *Manager, datastoreURL string,
+	currentSizeInMb int64, requestedSizeInMb int64) error {
+	log := logger.GetLogger(ctx)
+	freeSpace, err := getDatastoreFreeSpace(ctx, manager, datastoreURL)
+	if err != nil {
+		log.Warnf("failed to get free space of datastore %q, skipping the free space check of the expansion. Error: %+v",
+			datastoreURL, err)
+		return nil
+	}
+	growthInBytes := (requestedSizeInMb - currentSizeInMb) * MbInBytes
+	if growthInBytes > freeSpace {
+		msg := fmt.Sprintf("datastore %q has %d MB of free space, which is not enough to grow the volume from %d MB to %d MB",
+			datastoreURL, freeSpace/MbInBytes, currentSizeInMb, requestedSizeInMb)
+		log.Error(msg)
+		return status.Error(codes.ResourceExhausted, msg)
+	}
+	return nil
+}
+
+// ValidateVolumeNotAttached returns a FailedPrecondition error if strict-delete is
+// enabled and CNS reports the given block volume as attached to a VM. It guards
+// against deleting volumes which are still in use when the attachment state of
+// the sidecars is inconsistent.
+func ValidateVolumeNotAttached(ctx context.Context, manager *Manager, volumeID string) error {
+	log := logger.GetLogger(ctx)
+	if !manager.CnsConfig.Global.StrictDelete {
+		return nil
+	}
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+	if err != nil {
+		msg := fmt.Sprintf("failed to query volume %q. Error: %+v", volumeID, err)
+		log.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+	if len(queryResult.Volumes) == 0 || queryResult.Volumes[0].VolumeType != BlockVolumeType {
+		// Nothing to check for volumes which are already gone and for file volumes
+		return nil
+	}
+	queryVolumeInfoResult, err := manager.VolumeManager.QueryVolumeInfo(ctx, []cnstypes.CnsVolumeId{{Id: volumeID}})
+	if err != nil {
+		msg := fmt.Sprintf("failed to query attachments of volume %q. Error: %+v", volumeID, err)
+		log.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+	blockVolumeInfo, ok := queryVolumeInfoResult.VolumeInfo.(*cnstypes.CnsBlockVolumeInfo)
+	if !ok {
+		return nil
+	}
+	var consumerIDs []string
+	for _, consumerID := range blockVolumeInfo.VStorageObject.Config.ConsumerId {
+		consumerIDs = append(consumerIDs, consumerID.Id)
+	}
+	if len(consumerIDs) > 0 {
+		msg := fmt.Sprintf("volume %q is still attached to VMs %v", volumeID, consumerIDs)
+		log.Error(msg)
+		return status.Error(codes.FailedPrecondition, msg)
+	}
+	return nil
+}
+
+// ValidateNotInMaintenanceMode returns an Unavailable error if maintenance-mode is
+// enabled, so that the given operation, which would add load to the storage, is
+// retried once the maintenance is over.
+func ValidateNotInMaintenanceMode(ctx context.Context, manager *Manager, operation string) error {
+	if !manager.CnsConfig.Global.MaintenanceMode {
+		return nil
+	}
+	msg := fmt.Sprintf("%s is rejected as the controller is in maintenance mode", operation)
+	logger.GetLogger(ctx).Warn(msg)
+	return status.Error(codes.Unavailable, msg)
+}
+
+var (
+	// createVolumeValidator is the admission logic CreateVolume requests are
+	// validated with before the volume is provisioned.
+	createVolumeValidator CreateVolumeValidator = NoopCreateVolumeValidator{}
+	// createVolumeValidatorLock protects createVolumeValidator.
+	createVolumeValidatorLock sync.RWMutex
+)
+
+// SetCreateVolumeValidator sets the admission logic CreateVolume requests are
+// validated with. Passing nil restores the NoopCreateVolumeValidator.
+func SetCreateVolumeValidator(validator CreateVolumeValidator) {
+	if validator == nil {
+		validator = NoopCreateVolumeValidator{}
+	}
+	createVolumeValidatorLock.Lock()
+	defer createVolumeValidatorLock.Unlock()
+	createVolumeValidator = validator
+}
+
+// ValidateCreateVolumeAdmission runs the CreateVolumeValidator set with
+// SetCreateVolumeValidator against the given request, and returns a
+// FailedPrecondition error if it rejects the request.
+func ValidateCreateVolumeAdmission(ctx context.Context, req *csi.CreateVolumeRequest) error {
+	createVolumeValidatorLock.RLock()
+	validator := createVolumeValidator
+	createVolumeValidatorLock.RUnlock()
+	if err := validator.ValidateCreateVolume(ctx, req); err != nil {
+		msg := fmt.Sprintf("volume %q is rejected by admission validation. err: %v", req.Name, err)
+		logger.GetLogger(ctx).Error(msg)
+		return status.Error(codes.FailedPrecondition, msg)
+	}
+	return nil
+}
+
+// getDatastoreCapacity is used to look up the capacity of a datastore.
+// It is a variable so that tests can replace it.
+var getDatastoreCapacity = func(ctx context.Context, datastore *cnsvsphere.DatastoreInfo) (int64, error) {
+	return datastore.GetCapacity(ctx)
+}
+
+// FilterDatastoresByFreeSpaceHeadroom returns the given datastores which keep at
+// least the MinDatastoreFreePercent of their capacity free after a volume of the
+// given size is placed on them. All datastores are returned if no minimum is
+// configured. A ResourceExhausted error is returned if none of them qualifies.
+func FilterDatastoresByFreeSpaceHeadroom(ctx context.Context, manager *Manager,
+	datastores []*cnsvsphere.DatastoreInfo, capacityInMb int64) ([]*cnsvsphere.DatastoreInfo, error) {
+	log := logger.GetLogger(ctx)
+	minFreePercent := int64(manager.CnsConfig.Global.MinDatastoreFreePercent)
+	if minFreePercent <= 0 {
+		return datastores, nil
+	}
+	var filteredDatastores []*cnsvsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		hasHeadroom, err := hasFreeSpaceHeadroom(ctx, datastore, capacityInMb, minFreePercent)
+		if err != nil {
+			return nil, err
+		}
+		if !hasHeadroom {
+			log.Debugf("excluding datastore %q as less than %d%% of its capacity would remain free",
+				datastore.Info.Url, minFreePercent)
+			RecordDatastoreExclusion(ctx, datastore.Info.Url, DatastoreExclusionInsufficientSpace)
+			continue
+		}
+		filteredDatastores = append(filteredDatastores, datastore)
+	}
+	if len(filteredDatastores) == 0 {
+		msg := fmt.Sprintf("no datastore would keep %d%% of its capacity free after creating a volume of %d MB",
+			minFreePercent, capacityInMb)
+		log.Error(msg)
+		return nil, status.Error(codes.ResourceExhausted, msg)
+	}
+	return filteredDatastores, nil
+}
+
+// ValidateDatastoreFreeSpaceHeadroom returns a ResourceExhausted error if the given
+// datastore, e.g. the one a StorageClass pins volumes to, would not keep at least the
+// MinDatastoreFreePercent of its capacity free after a volume of the given size is
+// placed on it.
+func ValidateDatastoreFreeSpaceHeadroom(ctx context.Context, manager *Manager,
+	datastore *cnsvsphere.DatastoreInfo, capacityInMb int64) error {
+	log := logger.GetLogger(ctx)
+	minFreePercent := int64(manager.CnsConfig.Global.MinDatastoreFreePercent)
+	if minFreePercent <= 0 {
+		return nil
+	}
+	hasHeadroom, err := hasFreeSpaceHeadroom(ctx, datastore, capacityInMb, minFreePercent)
+	if err != nil {
+		return err
+	}
+	if !hasHeadroom {
+		msg := fmt.Sprintf("datastore %q would not keep %d%% of its capacity free after creating a volume of %d MB",
+			datastore.Info.Url, minFreePercent, capacityInMb)
+		log.Error(msg)
+		return status.Error(codes.ResourceExhausted, msg)
+	}
+	return nil
+}
+
+// hasFreeSpaceHeadroom returns true if the given datastore keeps at least the given
+// percentage of its capacity free after a volume of the given size is placed on it.
+func hasFreeSpaceHeadroom(ctx context.Context, datastore *cnsvsphere.DatastoreInfo, capacityInMb int64,
+	minFreePercent int64) (bool, error) {
+	capacity, err := getDatastoreCapacity(ctx, datastore)
+	if err != nil {
+		msg := fmt.Sprintf("failed to get capacity of datastore %q. Error: %+v", datastore.Info.Url, err)
+		logger.GetLogger(ctx).Error(msg)
+		return false, status.Error(codes.Internal, msg)
+	}
+	freeSpaceAfter := datastore.Info.FreeSpace - capacityInMb*MbInBytes
+	return freeSpaceAfter*100 >= minFreePercent*capacity, nil
+}
+
+// getNamespaceUsedCapacityInMb returns the sum of the capacity of the given volumes
+// with PVC metadata of the given cluster in the given namespace.
+func getNamespaceUsedCapacityInMb(volumes []cnstypes.CnsVolume, clusterID string, namespace string) int64 {
+	var usedInMb int64
+	for _, volume := range volumes {
+		for _, metadata := range volume.Metadata.EntityMetadata {
+			entityMetadata, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata)
+			if !ok || entityMetadata.EntityType != string(cnstypes.CnsKubernetesEntityTypePVC) ||
+				entityMetadata.ClusterID != clusterID || entityMetadata.Namespace != namespace {
+				continue
+			}
+			if backingObjectDetails, ok := volume.BackingObjectDetails.(cnstypes.BaseCnsBackingObjectDetails); ok {
+				usedInMb += backingObjectDetails.GetCnsBackingObjectDetails().CapacityInMb
+			}
+			break
+		}
+	}
+	return usedInMb
+}
@@ -0,0 +1,416 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+// fakeQueryVolumeManager is a volume manager which only implements QueryVolume.
+type fakeQueryVolumeManager struct {
+	cnsvolume.Manager
+	volumes []cnstypes.CnsVolume
+}
+
+func (f *fakeQueryVolumeManager) QueryVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+	return &cnstypes.CnsQueryResult{Volumes: f.volumes}, nil
+}
+
+// fakeQueryVolumeInfoManager is a volume manager which only implements QueryVolume
+// and QueryVolumeInfo.
+type fakeQueryVolumeInfoManager struct {
+	fakeQueryVolumeManager
+	volumeInfo cnstypes.BaseCnsVolumeInfo
+}
+
+func (f *fakeQueryVolumeInfoManager) QueryVolumeInfo(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId) (*cnstypes.CnsQueryVolumeInfoResult, error) {
+	return &cnstypes.CnsQueryVolumeInfoResult{VolumeInfo: f.volumeInfo}, nil
+}
+
+func newPVCVolume(namespace string, capacityInMb int64) cnstypes.CnsVolume {
+	return cnstypes.CnsVolume{
+		BackingObjectDetails: &cnstypes.CnsBlockBackingDetails{
+			CnsBackingObjectDetails: cnstypes.CnsBackingObjectDetails{CapacityInMb: capacityInMb},
+		},
+		Metadata: cnstypes.CnsVolumeMetadata{
+			EntityMetadata: []cnstypes.BaseCnsEntityMetadata{
+				cnsvsphere.GetCnsKubernetesEntityMetaData("pvc", nil, false, string(cnstypes.CnsKubernetesEntityTypePVC),
+					namespace, "cluster", nil),
+			},
+		},
+	}
+}
+
+func TestValidateControllerExpandVolumeRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		capacityRange *csi.CapacityRange
+		expectedCode  codes.Code
+	}{
+		{"nil capacity range", nil, codes.InvalidArgument},
+		{"zero required bytes", &csi.CapacityRange{}, codes.InvalidArgument},
+		{"negative required bytes", &csi.CapacityRange{RequiredBytes: -1}, codes.InvalidArgument},
+		{"valid capacity range", &csi.CapacityRange{RequiredBytes: GbInBytes}, codes.OK},
+	}
+	for _, test := range tests {
+		req := &csi.ControllerExpandVolumeRequest{
+			VolumeId:      "volume-id",
+			CapacityRange: test.capacityRange,
+		}
+		err := ValidateControllerExpandVolumeRequest(ctx, req)
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s: expected code %v, got %v (err: %v)", test.name, test.expectedCode, code, err)
+		}
+	}
+}
+
+func TestNamespaceQuotasReserve(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Global.ClusterID = "cluster"
+	manager := &Manager{
+		CnsConfig: cfg,
+		VolumeManager: &fakeQueryVolumeManager{
+			volumes: []cnstypes.CnsVolume{newPVCVolume("team-a", 1024), newPVCVolume("team-a", 1024), newPVCVolume("team-b", 1024)},
+		},
+	}
+	quotas, err := NewNamespaceQuotas("team-a:3072, team-b:1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		namespace    string
+		capacityInMb int64
+		expectedCode codes.Code
+	}{
+		{"team-a", 1024, codes.OK},
+		{"team-a", 1025, codes.ResourceExhausted},
+		{"team-b", 1, codes.ResourceExhausted},
+		{"team-c", 4096, codes.OK},
+		{"", 4096, codes.OK},
+	}
+	for _, test := range tests {
+		release, err := quotas.Reserve(ctx, manager, test.namespace, test.capacityInMb)
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("namespace %q, capacity %d MB: expected code %v, got %v (err: %v)",
+				test.namespace, test.capacityInMb, test.expectedCode, code, err)
+		}
+		if err == nil {
+			release()
+		}
+	}
+
+	// The capacity reserved for a volume being created counts against the quota
+	// until the creation completes
+	release, err := quotas.Reserve(ctx, manager, "team-a", 512)
+	if err != nil {
+		t.Fatalf("failed to reserve capacity. err: %v", err)
+	}
+	if _, err = quotas.Reserve(ctx, manager, "team-a", 1024); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected reservation over the quota to fail with ResourceExhausted, got %v", err)
+	}
+	release()
+	if release, err = quotas.Reserve(ctx, manager, "team-a", 1024); err != nil {
+		t.Errorf("expected reservation to succeed once the reserved capacity is released, got %v", err)
+	} else {
+		release()
+	}
+
+	if err = quotas.SetQuotas("team-a:1024"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = quotas.Reserve(ctx, manager, "team-a", 1); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected reloaded quota to be enforced, got %v", err)
+	}
+
+	var noQuotas *NamespaceQuotas
+	if _, err = noQuotas.Reserve(ctx, manager, "team-b", 4096); err != nil {
+		t.Errorf("expected no quota to be enforced by a nil NamespaceQuotas, got %v", err)
+	}
+}
+
+func TestValidateDatastoreCapacityForExpansion(t *testing.T) {
+	datastoreFreeSpace := map[string]int64{"ds:///vmfs/volumes/ds1/": 1024 * MbInBytes}
+	getDatastoreFreeSpace = func(ctx context.Context, manager *Manager, datastoreURL string) (int64, error) {
+		freeSpace, ok := datastoreFreeSpace[datastoreURL]
+		if !ok {
+			return 0, fmt.Errorf("datastore %q not found", datastoreURL)
+		}
+		return freeSpace, nil
+	}
+	defer func() { getDatastoreFreeSpace = GetDatastoreFreeSpace }()
+
+	tests := []struct {
+		name              string
+		datastoreURL      string
+		currentSizeInMb   int64
+		requestedSizeInMb int64
+		expectedCode      codes.Code
+	}{
+		{"enough free space", "ds:///vmfs/volumes/ds1/", 1024, 2048, codes.OK},
+		{"insufficient free space", "ds:///vmfs/volumes/ds1/", 1024, 2049, codes.ResourceExhausted},
+		{"unknown datastore", "ds:///vmfs/volumes/ds2/", 1024, 2048, codes.OK},
+	}
+	for _, test := range tests {
+		err := ValidateDatastoreCapacityForExpansion(ctx, &Manager{}, test.datastoreURL,
+			test.currentSizeInMb, test.requestedSizeInMb)
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s: expected code %v, got %v (err: %v)", test.name, test.expectedCode, code, err)
+		}
+	}
+}
+
+func TestValidateVolumeCapabilityForVolumeType(t *testing.T) {
+	newVolumeCapability := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	tests := []struct {
+		name         string
+		volCap       *csi.VolumeCapability
+		volumeType   string
+		expectedCode codes.Code
+	}{
+		{"single node writer for block volume", newVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			BlockVolumeType, codes.OK},
+		{"multi node writer for file volume", newVolumeCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			FileVolumeType, codes.OK},
+		{"multi node writer for block volume", newVolumeCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			BlockVolumeType, codes.InvalidArgument},
+		{"single node writer for file volume", newVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			FileVolumeType, codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		err := ValidateVolumeCapabilityForVolumeType(ctx, test.volCap, test.volumeType)
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s: expected code %v, got %v (err: %v)", test.name, test.expectedCode, code, err)
+		}
+	}
+}
+
+func TestFilterDatastoresByFreeSpaceHeadroom(t *testing.T) {
+	defer func(orig func(context.Context, *cnsvsphere.DatastoreInfo) (int64, error)) {
+		getDatastoreCapacity = orig
+	}(getDatastoreCapacity)
+	getDatastoreCapacity = func(ctx context.Context, datastore *cnsvsphere.DatastoreInfo) (int64, error) {
+		return 100 * GbInBytes, nil
+	}
+	newDatastore := func(url string, freeSpace int64) *cnsvsphere.DatastoreInfo {
+		return &cnsvsphere.DatastoreInfo{Info: &vimtypes.DatastoreInfo{Url: url, FreeSpace: freeSpace}}
+	}
+	datastores := []*cnsvsphere.DatastoreInfo{
+		newDatastore("ds:///vmfs/volumes/ds1/", 30*GbInBytes),
+		newDatastore("ds:///vmfs/volumes/ds2/", 25*GbInBytes),
+	}
+	cfg := &config.Config{}
+	cfg.Global.MinDatastoreFreePercent = 20
+	manager := &Manager{CnsConfig: cfg}
+
+	// ds1 stays exactly at the threshold, ds2 drops below it
+	filtered, err := FilterDatastoresByFreeSpaceHeadroom(ctx, manager, datastores, 10*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 1 || filtered[0].Info.Url != "ds:///vmfs/volumes/ds1/" {
+		t.Errorf("expected only datastore ds1, got %v", filtered)
+	}
+	// Both datastores drop below the threshold
+	_, err = FilterDatastoresByFreeSpaceHeadroom(ctx, manager, datastores, 10*1024+1)
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Errorf("expected code %v, got %v (err: %v)", codes.ResourceExhausted, code, err)
+	}
+	// A pinned datastore is checked on its own
+	if err = ValidateDatastoreFreeSpaceHeadroom(ctx, manager, datastores[0], 10*1024); err != nil {
+		t.Errorf("expected datastore ds1 to have enough headroom, got %v", err)
+	}
+	err = ValidateDatastoreFreeSpaceHeadroom(ctx, manager, datastores[1], 10*1024)
+	if code := status.Code(err); code != codes.ResourceExhausted || !strings.Contains(err.Error(), "ds2") {
+		t.Errorf("expected code %v naming datastore ds2, got %v (err: %v)", codes.ResourceExhausted, code, err)
+	}
+	// No threshold configured
+	cfg.Global.MinDatastoreFreePercent = 0
+	filtered, err = FilterDatastoresByFreeSpaceHeadroom(ctx, manager, datastores, 100*1024)
+	if err != nil || len(filtered) != len(datastores) {
+		t.Errorf("expected all datastores without a threshold, got %v (err: %v)", filtered, err)
+	}
+	if err = ValidateDatastoreFreeSpaceHeadroom(ctx, manager, datastores[1], 100*1024); err != nil {
+		t.Errorf("expected no headroom check without a threshold, got %v", err)
+	}
+}
+
+func TestValidateVolumeNotAttached(t *testing.T) {
+	newBlockVolumeInfo := func(consumerIDs ...string) *cnstypes.CnsBlockVolumeInfo {
+		volumeInfo := &cnstypes.CnsBlockVolumeInfo{}
+		for _, consumerID := range consumerIDs {
+			volumeInfo.VStorageObject.Config.ConsumerId = append(volumeInfo.VStorageObject.Config.ConsumerId,
+				vimtypes.ID{Id: consumerID})
+		}
+		return volumeInfo
+	}
+	tests := []struct {
+		name         string
+		strictDelete bool
+		volumeType   string
+		volumeInfo   *cnstypes.CnsBlockVolumeInfo
+		expectedCode codes.Code
+	}{
+		{"attached volume", true, BlockVolumeType, newBlockVolumeInfo("vm-1"), codes.FailedPrecondition},
+		{"detached volume", true, BlockVolumeType, newBlockVolumeInfo(), codes.OK},
+		{"attached volume without strict delete", false, BlockVolumeType, newBlockVolumeInfo("vm-1"), codes.OK},
+		{"file volume", true, FileVolumeType, newBlockVolumeInfo("vm-1"), codes.OK},
+	}
+	for _, test := range tests {
+		cfg := &config.Config{}
+		cfg.Global.StrictDelete = test.strictDelete
+		manager := &Manager{
+			CnsConfig: cfg,
+			VolumeManager: &fakeQueryVolumeInfoManager{
+				fakeQueryVolumeManager: fakeQueryVolumeManager{
+					volumes: []cnstypes.CnsVolume{{VolumeType: test.volumeType}},
+				},
+				volumeInfo: test.volumeInfo,
+			},
+		}
+		err := ValidateVolumeNotAttached(ctx, manager, "volume-id")
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s: expected code %v, got %v (err: %v)", test.name, test.expectedCode, code, err)
+		}
+	}
+}
+
+func TestValidateNotInMaintenanceMode(t *testing.T) {
+	cfg := &config.Config{}
+	manager := &Manager{CnsConfig: cfg}
+	if err := ValidateNotInMaintenanceMode(ctx, manager, "CreateVolume"); err != nil {
+		t.Errorf("expected CreateVolume to be allowed outside of maintenance mode, got err: %v", err)
+	}
+	cfg.Global.MaintenanceMode = true
+	err := ValidateNotInMaintenanceMode(ctx, manager, "CreateVolume")
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("expected code %v in maintenance mode, got %v (err: %v)", codes.Unavailable, code, err)
+	}
+}
+
+// namePrefixValidator is a CreateVolumeValidator which rejects volumes whose
+// name doesn't start with the given prefix.
+type namePrefixValidator struct {
+	prefix string
+}
+
+func (v namePrefixValidator) ValidateCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) error {
+	if len(req.Name) < len(v.prefix) || req.Name[:len(v.prefix)] != v.prefix {
+		return fmt.Errorf("volume name must start with %q", v.prefix)
+	}
+	return nil
+}
+
+func TestValidateCreateVolumeAdmission(t *testing.T) {
+	defer SetCreateVolumeValidator(nil)
+	if err := ValidateCreateVolumeAdmission(ctx, &csi.CreateVolumeRequest{Name: "vol"}); err != nil {
+		t.Errorf("expected the default validator to admit the request, got err: %v", err)
+	}
+
+	SetCreateVolumeValidator(namePrefixValidator{prefix: "pvc-"})
+	err := ValidateCreateVolumeAdmission(ctx, &csi.CreateVolumeRequest{Name: "vol"})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected code %v for a rejected request, got %v (err: %v)", codes.FailedPrecondition, code, err)
+	}
+	if err := ValidateCreateVolumeAdmission(ctx, &csi.CreateVolumeRequest{Name: "pvc-1"}); err != nil {
+		t.Errorf("expected the validator to admit the request, got err: %v", err)
+	}
+}
+
+func TestDatastoreReservationsReserve(t *testing.T) {
+	ctx := context.Background()
+	datastore1 := &cnsvsphere.DatastoreInfo{Info: &vimtypes.DatastoreInfo{Url: "ds-1", FreeSpace: 5 * 1024 * MbInBytes}}
+	datastore2 := &cnsvsphere.DatastoreInfo{Info: &vimtypes.DatastoreInfo{Url: "ds-2", FreeSpace: 1024 * MbInBytes}}
+	reservations := NewDatastoreReservations()
+
+	// Concurrent creations can't reserve more than the free space of the datastore.
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var reserved []string
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(volumeName string) {
+			defer wg.Done()
+			_, err := reservations.Reserve(ctx, volumeName, []*cnsvsphere.DatastoreInfo{datastore1}, 1024)
+			if err != nil {
+				if status.Code(err) != codes.ResourceExhausted {
+					t.Errorf("expected code %v, got err: %v", codes.ResourceExhausted, err)
+				}
+				return
+			}
+			mutex.Lock()
+			reserved = append(reserved, volumeName)
+			mutex.Unlock()
+		}(fmt.Sprintf("pvc-%d", i))
+	}
+	wg.Wait()
+	if len(reserved) != 5 {
+		t.Fatalf("expected 5 reservations of 1024 MB on a datastore with 5120 MB free, got %d", len(reserved))
+	}
+
+	// The capacity is only reserved on the chosen datastore, the first with enough
+	// free space not reserved for other volumes.
+	datastore, err := reservations.Reserve(ctx, "pvc-a", []*cnsvsphere.DatastoreInfo{datastore1, datastore2}, 1024)
+	if err != nil || datastore != datastore2 {
+		t.Fatalf("expected ds-2 to be chosen, got %v (err: %v)", datastore, err)
+	}
+	if _, err = reservations.Reserve(ctx, "pvc-b", []*cnsvsphere.DatastoreInfo{datastore2}, 1024); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected the capacity reserved on ds-2 to be counted, got err: %v", err)
+	}
+
+	// A volume holding a reservation, e.g. while its creation is in progress, keeps it.
+	if datastore, err = reservations.Reserve(ctx, "pvc-a", []*cnsvsphere.DatastoreInfo{datastore1, datastore2}, 1024); err != nil ||
+		datastore != datastore2 {
+		t.Errorf("expected pvc-a to keep its reservation on ds-2, got %v (err: %v)", datastore, err)
+	}
+	reservations.Release("pvc-a")
+
+	// Released capacity can be reserved again.
+	reservations.Release(reserved[0])
+	if datastore, err = reservations.Reserve(ctx, "pvc-b", []*cnsvsphere.DatastoreInfo{datastore1, datastore2}, 1024); err != nil ||
+		datastore != datastore1 {
+		t.Errorf("expected ds-1 to be chosen after the release, got %v (err: %v)", datastore, err)
+	}
+
+	// Expired reservations are dropped.
+	for _, reservation := range reservations.reservations {
+		reservation.expirationTime = time.Now().Add(-time.Second)
+	}
+	if datastore, err = reservations.Reserve(ctx, "pvc-c", []*cnsvsphere.DatastoreInfo{datastore1}, 5*1024); err != nil ||
+		datastore != datastore1 {
+		t.Errorf("expected the expired reservations to be dropped, got %v (err: %v)", datastore, err)
+	}
+}
@@ -27,6 +27,48 @@ const (
 	// TODO: will make the DefaultGbDiskSize configurable in the future
 	DefaultGbDiskSize = int64(10)
 
+	// DiskUUIDFormatCompact formats disk UUIDs in lower case without dashes, e.g.
+	// "6000c29c0a5a3b8e7e9e6a0c12345678". This is the format of the disk IDs under
+	// /dev/disk/by-id the node plugin looks the published disks up with.
+	DiskUUIDFormatCompact = "compact"
+
+	// DiskUUIDFormatCompactUpper formats disk UUIDs in upper case without dashes
+	DiskUUIDFormatCompactUpper = "compact-upper"
+
+	// DiskUUIDFormatDashed formats disk UUIDs in lower case with dashes, e.g.
+	// "6000c29c-0a5a-3b8e-7e9e-6a0c12345678"
+	DiskUUIDFormatDashed = "dashed"
+
+	// DiskUUIDFormatDashedUpper formats disk UUIDs in upper case with dashes
+	DiskUUIDFormatDashedUpper = "dashed-upper"
+
+	// PoweredOffPodVMAttachProceed attaches volumes to powered off PodVMs
+	PoweredOffPodVMAttachProceed = "proceed"
+
+	// PoweredOffPodVMAttachFail fails attaching volumes to powered off PodVMs
+	PoweredOffPodVMAttachFail = "fail"
+
+	// DatastoreSelectionRandom shuffles the shared datastores passed to CNS for each new volume
+	DatastoreSelectionRandom = "random"
+
+	// DatastoreSelectionRoundRobin rotates the shared datastores passed to CNS for each new volume
+	DatastoreSelectionRoundRobin = "round-robin"
+
+	// DuplicateVolumeNameFail fails the creation of a block volume whose name is used by a
+	// volume with a different storage policy
+	DuplicateVolumeNameFail = "fail"
+
+	// DuplicateVolumeNameReconfigure reconfigures the existing volume with the name of a new
+	// block volume to the requested storage policy
+	DuplicateVolumeNameReconfigure = "reconfigure"
+
+	// CapacityAggregationLargest reports the free space of the datastore with the most free
+	// space in GetCapacity, i.e. the size of the largest volume which can be provisioned
+	CapacityAggregationLargest = "largest"
+
+	// CapacityAggregationSum reports the total free space of the datastores in GetCapacity
+	CapacityAggregationSum = "sum"
+
 	// DiskTypeBlockVolume is the value for the PersistentVolume's attribute "type"
 	DiskTypeBlockVolume = "vSphere CNS Block Volume"
 
@@ -48,6 +90,12 @@ const (
 	// For Example: StoragePolicyId: "251bce41-cb24-41df-b46b-7c75aed3c4ee"
 	AttributeStoragePolicyID = "storagepolicyid"
 
+	// AttributePreferredStoragePolicyID represents the Id of the Storage Policy in the
+	// Storage Class which volumes are provisioned with when possible. If no shared
+	// datastore can hold a volume with it, the volume is provisioned with the policy of
+	// storagepolicyid, or the default policy of the datastore, instead.
+	AttributePreferredStoragePolicyID = "preferredstoragepolicyid"
+
 	// AttributeSupervisorStorageClass represents name of the Storage Class
 	// For example: StorageClassName: "silver"
 	AttributeSupervisorStorageClass = "svstorageclass"
@@ -56,6 +104,9 @@ const (
 	// For Example: FsType: "ext4"
 	AttributeFsType = "fstype"
 
+	// AttributeClusterID represents the ID of the WCP cluster the volume is provisioned for
+	AttributeClusterID = "clusterid"
+
 	// AttributeAffineToHost represents the ESX host moid to which this PV should be affinitized
 	// For Example: AffineToHost: "host-25"
 	AttributeAffineToHost = "affinetohost"
@@ -76,6 +127,85 @@ const (
 	// AttributeFirstClassDiskUUID is the SCSI Disk Identifier
 	AttributeFirstClassDiskUUID = "diskUUID"
 
+	// AttributeDatastoreMoref is the managed object reference of the datastore backing the volume
+	// For Example: DatastoreMoref: "datastore-12"
+	AttributeDatastoreMoref = "datastoremoref"
+
+	// AttributeAntiAffinityGroup represents the anti-affinity group of the volume in the Storage Class.
+	// Volumes of the same group are placed on different datastores when possible.
+	AttributeAntiAffinityGroup = "antiaffinitygroup"
+
+	// AntiAffinityGroupLabel is the label recorded in the CNS PV metadata of a volume
+	// provisioned with an anti-affinity group
+	AntiAffinityGroupLabel = "csi.vsphere.vmware.com/anti-affinity-group"
+
+	// AttributeValidateAttachable represents the Storage Class parameter requesting CreateVolume
+	// to place the block volume only on datastores accessible from at least one node of the
+	// cluster, so that it is attachable
+	AttributeValidateAttachable = "validateattachable"
+
+	// AttributeClusterVersion represents the version of the cluster which provisioned the volume
+	AttributeClusterVersion = "clusterversion"
+
+	// ClusterVersionLabel is the label recorded in the CNS PV metadata of a volume
+	// carrying the version of the cluster which provisioned the volume
+	ClusterVersionLabel = "csi.vsphere.vmware.com/cluster-version"
+
+	// ExpandedCapacityLabel is the label recorded in the CNS PV metadata of a volume
+	// carrying its capacity in MB after its last expansion
+	ExpandedCapacityLabel = "csi.vsphere.vmware.com/expanded-capacity-mb"
+
+	// LastExpandedAtLabel is the label recorded in the CNS PV metadata of a volume
+	// carrying the time of its last expansion
+	LastExpandedAtLabel = "csi.vsphere.vmware.com/last-expanded-at"
+
+	// AttributePVCNamespace is the reserved CreateVolume parameter carrying the namespace of the PVC
+	AttributePVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+
+	// AttributePVCName is the reserved CreateVolume parameter carrying the name of the PVC
+	AttributePVCName = "csi.storage.k8s.io/pvc/name"
+
+	// AttributePVName is the reserved CreateVolume parameter carrying the name of the PV
+	AttributePVName = "csi.storage.k8s.io/pv/name"
+
+	// TemplateVarClusterID is the parameter template variable expanded to the cluster ID
+	TemplateVarClusterID = "ClusterID"
+
+	// TemplateVarZone is the parameter template variable expanded to the zone of the volume
+	TemplateVarZone = "Zone"
+
+	// TemplateVarRegion is the parameter template variable expanded to the region of the volume
+	TemplateVarRegion = "Region"
+
+	// AttributeAccessMode represents the access mode the block volume was provisioned with
+	AttributeAccessMode = "accessmode"
+
+	// AttributeCreationTime represents the time the CNS volume was created at, in RFC 3339 format
+	AttributeCreationTime = "creationtime"
+
+	// AttributeDatastoreExclusions represents the reasons the shared datastores were excluded from
+	// the placement of the volume, set if report-datastore-exclusions is enabled
+	AttributeDatastoreExclusions = "datastoreexclusions"
+
+	// AttributeWarnings represents the caveats of the creation of the volume, e.g. a fallback
+	// from the placement requested by the storage class, separated by "; "
+	AttributeWarnings = "warnings"
+
+	// AttributeCnsTaskID represents the ID of the vCenter task which created the volume in CNS,
+	// to look up the creation in the vCenter task history
+	AttributeCnsTaskID = "cnstaskid"
+
+	// AttributeVolumeUnbound is set in the volume context of the volumes returned by ListVolumes
+	// which were provisioned by the cluster but are neither bound to a PV nor in use by a pod
+	AttributeVolumeUnbound = "unbound"
+
+	// AttributeVolumeAbnormal is set in the volume context of the volumes returned by ListVolumes
+	// which are in an abnormal condition, e.g. attached to a PodVM which no longer exists
+	AttributeVolumeAbnormal = "abnormal"
+
+	// AttributeVolumeConditionMessage describes the abnormal condition of the volume
+	AttributeVolumeConditionMessage = "conditionmessage"
+
 	// BlockVolumeType is the VolumeType for CNS Volume
 	BlockVolumeType = "BLOCK"
 
@@ -88,6 +218,10 @@ const (
 	// Nfsv4AccessPoint is the access point of file volume
 	Nfsv4AccessPoint = "Nfsv4AccessPoint"
 
+	// SnapshotIDSeparator separates the CNS volume ID and the CNS snapshot ID in a CSI snapshot ID
+	// For Example: "4d3eb9e5-5c3f-4b3c-8ef1-6b1f3a5e9f10+0b5b3c7e-1f2a-4d6b-9c8e-2a7d4e5f6a1b"
+	SnapshotIDSeparator = "+"
+
 	// MinSupportedVCenterMajor is the minimum, major version of vCenter
 	// on which CNS is supported.
 	MinSupportedVCenterMajor int = 6
@@ -0,0 +1,97 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+// Errors wrapped by the errors the utils return, so that the handlers can map the
+// failures to gRPC codes without matching error messages. Use errors.Is to check
+// whether an error wraps one of them.
+var (
+	// ErrVolumeNotFound is returned when the volume is not found in CNS.
+	ErrVolumeNotFound = errors.New("volume not found")
+	// ErrDatastoreNotFound is returned when the datastore requested for a volume
+	// is not found.
+	ErrDatastoreNotFound = errors.New("datastore not found")
+	// ErrDatastoreNotAccessible is returned when the datastore requested for a
+	// volume can't be used for it, e.g. as it is not accessible to all nodes.
+	ErrDatastoreNotAccessible = errors.New("datastore not accessible")
+	// ErrNoEligibleDatastore is returned when none of the datastores can hold a
+	// new volume.
+	ErrNoEligibleDatastore = errors.New("no eligible datastore")
+	// ErrVolumeNotDeleted is returned when a volume is still found in CNS after it
+	// was deleted.
+	ErrVolumeNotDeleted = errors.New("volume not deleted")
+	// ErrDuplicateVolumeID is returned when CNS reports a volume on more than one
+	// datastore, so that which of them holds the volume is ambiguous.
+	ErrDuplicateVolumeID = errors.New("volume ID on multiple datastores")
+	// ErrVolumeAlreadyExists is returned when a volume with the name of a new volume
+	// already exists with incompatible properties.
+	ErrVolumeAlreadyExists = errors.New("volume already exists")
+)
+
+// utilError is an error returned by the utils which wraps one of the errors above
+// while keeping the message describing the failure.
+type utilError struct {
+	err error
+	msg string
+}
+
+func (e *utilError) Error() string {
+	return e.msg
+}
+
+func (e *utilError) Unwrap() error {
+	return e.err
+}
+
+// newUtilError returns an error with the formatted message which wraps the given error.
+func newUtilError(err error, format string, args ...interface{}) error {
+	return &utilError{err: err, msg: fmt.Sprintf(format, args...)}
+}
+
+// GetErrorCode returns the gRPC code the given error returned by the utils maps to,
+// or the given default code if the error doesn't identify the failure.
+func GetErrorCode(err error, defaultCode codes.Code) codes.Code {
+	switch {
+	case errors.Is(err, ErrVolumeNotFound):
+		return codes.NotFound
+	case errors.Is(err, ErrDatastoreNotFound), errors.Is(err, ErrDatastoreNotAccessible),
+		errors.Is(err, cnsvsphere.ErrStoragePolicyNotFound):
+		return codes.InvalidArgument
+	case errors.Is(err, ErrNoEligibleDatastore), cnsvolume.IsPlacementError(err),
+		errors.Is(err, cnsvolume.ErrRateLimited):
+		return codes.ResourceExhausted
+	case errors.Is(err, ErrVolumeAlreadyExists):
+		return codes.AlreadyExists
+	case errors.Is(err, ErrDuplicateVolumeID):
+		return codes.Internal
+	case errors.Is(err, cnsvolume.ErrCreateVolumeInProgress):
+		return codes.Aborted
+	case cnsvolume.IsServiceUnavailableError(err):
+		return codes.Unavailable
+	}
+	return defaultCode
+}
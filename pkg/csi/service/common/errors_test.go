@@ -0,0 +1,61 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestGetErrorCode(t *testing.T) {
+	// Errors returned by the utils for volumes missing in CNS
+	_, _, volumeDatastoreErr := GetVolumeDatastore(ctx, &Manager{VolumeManager: &fakeQueryVolumeManager{}}, "volume-id")
+	if volumeDatastoreErr == nil {
+		t.Fatal("expected GetVolumeDatastore to fail for a missing volume")
+	}
+
+	tests := []struct {
+		name         string
+		err          error
+		expectedCode codes.Code
+	}{
+		{"volume not found", volumeDatastoreErr, codes.NotFound},
+		{"wrapped volume not found", fmt.Errorf("failed to publish volume: %w", volumeDatastoreErr), codes.NotFound},
+		{"datastore not found", newUtilError(ErrDatastoreNotFound, "datastore %q not found", "ds-1"),
+			codes.InvalidArgument},
+		{"datastore not accessible", newUtilError(ErrDatastoreNotAccessible, "datastore %q not shared", "ds-1"),
+			codes.InvalidArgument},
+		{"no eligible datastore", newUtilError(ErrNoEligibleDatastore, "no healthy datastore"), codes.ResourceExhausted},
+		{"storage policy not found", fmt.Errorf("failed to create volume: %w",
+			fmt.Errorf("%w: %q", cnsvsphere.ErrStoragePolicyNotFound, "gold")), codes.InvalidArgument},
+		{"vCenter unavailable", errors.New("503 Service Unavailable"), codes.Unavailable},
+		{"untyped error", errors.New("failed"), codes.Internal},
+	}
+	for _, test := range tests {
+		if code := GetErrorCode(test.err, codes.Internal); code != test.expectedCode {
+			t.Errorf("%s: expected code %v, got %v", test.name, test.expectedCode, code)
+		}
+	}
+	if msg := newUtilError(ErrVolumeNotFound, "volumeID %q not found", "volume-id").Error(); msg != `volumeID "volume-id" not found` {
+		t.Errorf("expected the message of the error to be kept, got %q", msg)
+	}
+}
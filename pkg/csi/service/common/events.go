@@ -0,0 +1,82 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
+)
+
+// EventReasonVolumePlaced is the reason of the events naming the datastore a volume
+// was placed on.
+const EventReasonVolumePlaced = "VolumePlaced"
+
+// PlacementEventRecorder emits events on the PVCs of the provisioned volumes naming
+// the datastores they were placed on. A nil PlacementEventRecorder emits no events.
+type PlacementEventRecorder struct {
+	client   clientset.Interface
+	recorder record.EventRecorder
+}
+
+// NewPlacementEventRecorder returns a PlacementEventRecorder which looks up the PVCs
+// and records the events with the given Kubernetes client.
+func NewPlacementEventRecorder(client clientset.Interface) *PlacementEventRecorder {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(
+		&typedcorev1.EventSinkImpl{
+			Interface: client.CoreV1().Events(""),
+		},
+	)
+	return &PlacementEventRecorder{
+		client:   client,
+		recorder: eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: csitypes.Name}),
+	}
+}
+
+// Record emits an event on the PVC with the given namespace and name naming the
+// datastore the given volume was placed on. Failures are logged, as the event is
+// informational only.
+func (r *PlacementEventRecorder) Record(ctx context.Context, namespace string, name string,
+	volumeID string, datastoreURL string) {
+	log := logger.GetLogger(ctx)
+	if r == nil {
+		return
+	}
+	if namespace == "" || name == "" {
+		log.Debugf("not recording the placement of volume %q as parameters %q and %q are not set",
+			volumeID, AttributePVCNamespace, AttributePVCName)
+		return
+	}
+	pvc, err := r.client.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		log.Warnf("failed to get PVC %s/%s to record the placement of volume %q. Error: %+v",
+			namespace, name, volumeID, err)
+		return
+	}
+	r.recorder.Eventf(pvc, v1.EventTypeNormal, EventReasonVolumePlaced,
+		"volume %s was placed on datastore %s", volumeID, datastoreURL)
+}
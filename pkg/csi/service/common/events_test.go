@@ -0,0 +1,60 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestPlacementEventRecorder(t *testing.T) {
+	ctx := context.Background()
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Namespace: "ns-1"},
+	}
+	recorder := record.NewFakeRecorder(10)
+	r := &PlacementEventRecorder{client: fake.NewSimpleClientset(pvc), recorder: recorder}
+
+	r.Record(ctx, "ns-1", "pvc-1", "vol-1", "ds:///vmfs/volumes/ds-1/")
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, EventReasonVolumePlaced) || !strings.Contains(event, "ds:///vmfs/volumes/ds-1/") {
+			t.Errorf("unexpected placement event %q", event)
+		}
+	default:
+		t.Fatal("expected a placement event")
+	}
+
+	// No event without the PVC name, or for a missing PVC.
+	r.Record(ctx, "ns-1", "", "vol-2", "ds:///vmfs/volumes/ds-1/")
+	r.Record(ctx, "ns-1", "pvc-2", "vol-3", "ds:///vmfs/volumes/ds-1/")
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("unexpected event %q", event)
+	default:
+	}
+
+	// A nil recorder records nothing.
+	var nilRecorder *PlacementEventRecorder
+	nilRecorder.Record(ctx, "ns-1", "pvc-1", "vol-1", "ds:///vmfs/volumes/ds-1/")
+}
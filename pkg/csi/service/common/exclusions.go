@@ -0,0 +1,73 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Reasons a shared datastore is excluded from the placement of a new volume.
+const (
+	// DatastoreExclusionUnhealthy is recorded for datastores which are not
+	// accessible, in maintenance or in alert state
+	DatastoreExclusionUnhealthy = "unhealthy"
+	// DatastoreExclusionPolicyIncompatible is recorded for datastores which are not
+	// compatible with the storage policy of the new volume
+	DatastoreExclusionPolicyIncompatible = "policy-incompatible"
+	// DatastoreExclusionInsufficientSpace is recorded for datastores which would
+	// not keep the min-datastore-free-percent of their capacity free
+	DatastoreExclusionInsufficientSpace = "insufficient-space"
+	// DatastoreExclusionAntiAffinity is recorded for datastores which already hold
+	// a volume of the anti-affinity group of the new volume
+	DatastoreExclusionAntiAffinity = "anti-affinity"
+)
+
+type datastoreExclusionsKey struct{}
+
+// DatastoreExclusions holds the reasons the shared datastores were excluded from
+// the placement of a volume, keyed by datastore URL.
+type DatastoreExclusions map[string]string
+
+// WithDatastoreExclusions returns a child context in which the reasons the shared
+// datastores are excluded from the placement of a volume are recorded to the
+// returned DatastoreExclusions.
+func WithDatastoreExclusions(ctx context.Context) (context.Context, DatastoreExclusions) {
+	exclusions := make(DatastoreExclusions)
+	return context.WithValue(ctx, datastoreExclusionsKey{}, exclusions), exclusions
+}
+
+// RecordDatastoreExclusion records the reason the given datastore was excluded from
+// the placement of a volume, if the context was created with WithDatastoreExclusions.
+func RecordDatastoreExclusion(ctx context.Context, datastoreURL string, reason string) {
+	if exclusions, ok := ctx.Value(datastoreExclusionsKey{}).(DatastoreExclusions); ok {
+		exclusions[datastoreURL] = reason
+	}
+}
+
+// String returns the exclusions as "<datastore URL>: <reason>" entries sorted by
+// datastore URL and separated by "; ".
+func (e DatastoreExclusions) String() string {
+	entries := make([]string, 0, len(e))
+	for datastoreURL, reason := range e {
+		entries = append(entries, fmt.Sprintf("%s: %s", datastoreURL, reason))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, "; ")
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+func TestDatastoreExclusions(t *testing.T) {
+	defer func(orig func(context.Context, *cnsvsphere.DatastoreInfo) (int64, error)) {
+		getDatastoreCapacity = orig
+	}(getDatastoreCapacity)
+	getDatastoreCapacity = func(ctx context.Context, datastore *cnsvsphere.DatastoreInfo) (int64, error) {
+		return 100 * GbInBytes, nil
+	}
+	newDatastore := func(url string, freeSpace int64) *cnsvsphere.DatastoreInfo {
+		return &cnsvsphere.DatastoreInfo{Info: &vimtypes.DatastoreInfo{Url: url, FreeSpace: freeSpace}}
+	}
+	datastores := []*cnsvsphere.DatastoreInfo{
+		newDatastore("ds:///vmfs/volumes/ds1/", 50*GbInBytes),
+		newDatastore("ds:///vmfs/volumes/ds2/", 50*GbInBytes),
+		newDatastore("ds:///vmfs/volumes/ds3/", 5*GbInBytes),
+	}
+	cfg := &config.Config{}
+	cfg.Global.MinDatastoreFreePercent = 20
+	manager := &Manager{CnsConfig: cfg}
+
+	exclusionsCtx, exclusions := WithDatastoreExclusions(ctx)
+	filtered, err := FilterDatastoresByFreeSpaceHeadroom(exclusionsCtx, manager, datastores, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes := []cnstypes.CnsVolume{newAntiAffinityVolume("ds:///vmfs/volumes/ds1/", "web")}
+	filtered = filterAntiAffinityDatastores(exclusionsCtx, volumes, "web", filtered)
+	if len(filtered) != 1 || filtered[0].Info.Url != "ds:///vmfs/volumes/ds2/" {
+		t.Errorf("expected only datastore ds2 to remain, got %v", filtered)
+	}
+	expected := "ds:///vmfs/volumes/ds1/: " + DatastoreExclusionAntiAffinity +
+		"; ds:///vmfs/volumes/ds3/: " + DatastoreExclusionInsufficientSpace
+	if len(exclusions) != 2 || exclusions.String() != expected {
+		t.Errorf("expected exclusions %q, got %q", expected, exclusions.String())
+	}
+
+	// Exclusions are not recorded without WithDatastoreExclusions
+	if _, err := FilterDatastoresByFreeSpaceHeadroom(ctx, manager, datastores, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if len(exclusions) != 2 {
+		t.Errorf("expected exclusions to only be recorded to the context they were requested in, got %v", exclusions)
+	}
+}
@@ -0,0 +1,362 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
+)
+
+// ConcurrencyLimiter limits the number of operations which can be in progress
+// concurrently for each key, e.g. for each storage policy. A nil ConcurrencyLimiter
+// does not limit operations.
+type ConcurrencyLimiter struct {
+	mutex    sync.Mutex
+	limit    int
+	inFlight map[string]int
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter which allows up to limit
+// concurrent operations for each key. Returns nil if limit is not positive.
+func NewConcurrencyLimiter(limit int) *ConcurrencyLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &ConcurrencyLimiter{
+		limit:    limit,
+		inFlight: make(map[string]int),
+	}
+}
+
+// TryAcquire starts an operation for the given key. Returns false if the limit
+// of concurrent operations for the key has been reached.
+func (l *ConcurrencyLimiter) TryAcquire(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.inFlight[key] >= l.limit {
+		return false
+	}
+	l.inFlight[key]++
+	return true
+}
+
+// Release completes an operation for the given key started by TryAcquire.
+func (l *ConcurrencyLimiter) Release(key string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.inFlight[key] <= 1 {
+		delete(l.inFlight, key)
+		return
+	}
+	l.inFlight[key]--
+}
+
+// KeyedSemaphore allows up to a limit of operations to be in progress concurrently
+// for each key, e.g. for each node, and makes the other operations for the key wait
+// until one of them completes. A nil KeyedSemaphore does not limit operations.
+type KeyedSemaphore struct {
+	mutex   sync.Mutex
+	limit   int
+	entries map[string]*keyedSemaphoreEntry
+}
+
+// keyedSemaphoreEntry holds the slots of the operations in progress for a key, and
+// the number of operations holding or waiting for a slot.
+type keyedSemaphoreEntry struct {
+	slots chan struct{}
+	users int
+}
+
+// NewKeyedSemaphore returns a KeyedSemaphore which allows up to limit concurrent
+// operations for each key. Returns nil if limit is not positive.
+func NewKeyedSemaphore(limit int) *KeyedSemaphore {
+	if limit <= 0 {
+		return nil
+	}
+	return &KeyedSemaphore{
+		limit:   limit,
+		entries: make(map[string]*keyedSemaphoreEntry),
+	}
+}
+
+// Acquire starts an operation for the given key, waiting until fewer than the limit
+// of operations for the key are in progress. Returns a function to call once the
+// operation completes, or the error of the given context if it is done first.
+func (s *KeyedSemaphore) Acquire(ctx context.Context, key string) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	s.mutex.Lock()
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &keyedSemaphoreEntry{slots: make(chan struct{}, s.limit)}
+		s.entries[key] = entry
+	}
+	entry.users++
+	s.mutex.Unlock()
+	select {
+	case entry.slots <- struct{}{}:
+		return func() {
+			<-entry.slots
+			s.done(key, entry)
+		}, nil
+	case <-ctx.Done():
+		s.done(key, entry)
+		return nil, ctx.Err()
+	}
+}
+
+// done removes the entry of the given key once no operation holds or waits for one
+// of its slots.
+func (s *KeyedSemaphore) done(key string, entry *keyedSemaphoreEntry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry.users--
+	if entry.users == 0 {
+		delete(s.entries, key)
+	}
+}
+
+// InFlightCalls deduplicates concurrent calls for the same key, e.g. for the same
+// volume ID. A call arriving while another call for the key is in progress waits for
+// it to complete and returns its result instead of running again. A nil InFlightCalls
+// runs every call.
+//
+// Calls are removed by a deferred function, including when they panic, so entries
+// can't leak and no janitor expiring stale entries is needed.
+type InFlightCalls struct {
+	mutex sync.Mutex
+	calls map[string]*inFlightCall
+}
+
+// inFlightCall is a call in progress, whose err is set before done is closed
+type inFlightCall struct {
+	done chan struct{}
+	err  error
+}
+
+// NewInFlightCalls returns an InFlightCalls without calls in progress.
+func NewInFlightCalls() *InFlightCalls {
+	return &InFlightCalls{
+		calls: make(map[string]*inFlightCall),
+	}
+}
+
+// Do runs fn for the given key and returns its error, unless a call for the key is
+// already in progress, in which case it waits for that call and returns its error.
+// As its result is shared, fn runs on a context detached from the cancellation of
+// the caller, which keeps the values of ctx. A waiting caller stops waiting and
+// returns the error of its context when it is cancelled.
+func (c *InFlightCalls) Do(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	if c == nil {
+		return fn(ctx)
+	}
+	c.mutex.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mutex.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	// The waiters get this error if fn panics instead of returning
+	call := &inFlightCall{
+		done: make(chan struct{}),
+		err:  fmt.Errorf("in-flight call for %q did not complete", key),
+	}
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.calls, key)
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+	call.err = fn(detachedContext{ctx})
+	return call.err
+}
+
+// detachedContext keeps the values of its parent context, e.g. the logger, but
+// is never cancelled and has no deadline.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+// redactedValue replaces the values of the sensitive parameters of in-flight operations.
+const redactedValue = "<redacted>"
+
+// sensitiveParameterKeywords are the keywords of the parameter keys whose values are
+// redacted from in-flight operations.
+var sensitiveParameterKeywords = []string{"secret", "password", "passwd", "token", "credential", "key"}
+
+// InFlightOperationsPath is the path the operations in progress are served at by the
+// metrics server.
+const InFlightOperationsPath = "/debug/inflight"
+
+// InFlightOperation describes an operation in progress.
+type InFlightOperation struct {
+	// Name of the operation, e.g. "CreateVolume"
+	Name string `json:"name"`
+	// ID of the volume the operation is on, or name of the volume being created
+	Volume string `json:"volume"`
+	// ID of the node the operation is on, if any
+	Node string `json:"node,omitempty"`
+	// Parameters of the operation, with the values of the sensitive ones redacted
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// Time the operation started at
+	StartTime time.Time `json:"startTime"`
+}
+
+// InFlightOperationsReporter is implemented by the CnsControllers which track their
+// operations in progress. The operations are served at InFlightOperationsPath of the
+// metrics server.
+type InFlightOperationsReporter interface {
+	ListInFlightOperations(ctx context.Context) []InFlightOperation
+}
+
+// NewInFlightOperationsHandler returns an http.Handler which responds with the
+// operations in progress listed by the given function, as a JSON array.
+func NewInFlightOperationsHandler(list func(ctx context.Context) []InFlightOperation) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operations := list(r.Context())
+		if operations == nil {
+			operations = []InFlightOperation{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(operations); err != nil {
+			logger.GetLogger(r.Context()).Errorf("failed to write the in-flight operations. err: %v", err)
+		}
+	})
+}
+
+// InFlightOperations tracks the operations in progress so that operators can see what
+// the controller is doing, e.g. during a hang. A nil InFlightOperations tracks nothing.
+type InFlightOperations struct {
+	mutex      sync.Mutex
+	nextID     uint64
+	operations map[uint64]InFlightOperation
+}
+
+// NewInFlightOperations returns an InFlightOperations without operations in progress.
+func NewInFlightOperations() *InFlightOperations {
+	return &InFlightOperations{
+		operations: make(map[uint64]InFlightOperation),
+	}
+}
+
+// Start records the given operation as in progress since now, and returns a function
+// to call once the operation completes.
+func (o *InFlightOperations) Start(operation InFlightOperation) func() {
+	if o == nil {
+		return func() {}
+	}
+	operation.Parameters = redactParameters(operation.Parameters)
+	operation.StartTime = time.Now()
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	id := o.nextID
+	o.nextID++
+	o.operations[id] = operation
+	return func() {
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+		delete(o.operations, id)
+	}
+}
+
+// List returns the operations in progress, oldest first.
+func (o *InFlightOperations) List() []InFlightOperation {
+	if o == nil {
+		return nil
+	}
+	o.mutex.Lock()
+	ids := make([]uint64, 0, len(o.operations))
+	for id := range o.operations {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	operations := make([]InFlightOperation, 0, len(ids))
+	for _, id := range ids {
+		operations = append(operations, o.operations[id])
+	}
+	o.mutex.Unlock()
+	return operations
+}
+
+// redactParameters returns a copy of the given parameters in which the values of the
+// sensitive parameters are redacted.
+func redactParameters(params map[string]string) map[string]string {
+	if len(params) == 0 {
+		return nil
+	}
+	redacted := make(map[string]string, len(params))
+	for key, value := range params {
+		redacted[key] = value
+		for _, keyword := range sensitiveParameterKeywords {
+			if strings.Contains(strings.ToLower(key), keyword) {
+				redacted[key] = redactedValue
+				break
+			}
+		}
+	}
+	return redacted
+}
+
+// AcquireCreateVolumeSlot starts a CreateVolume request for the given storage policy
+// on the given limiter, which allows up to limit concurrent requests per policy. The
+// requests without a storage policy share the limit of a single policy. Returns a
+// ResourceExhausted error if the limit is reached, and otherwise a function to call
+// once the request completes.
+func AcquireCreateVolumeSlot(ctx context.Context, limiter *ConcurrencyLimiter, limit int,
+	storagePolicy string) (func(), error) {
+	if !limiter.TryAcquire(storagePolicy) {
+		msg := fmt.Sprintf("too many concurrent CreateVolume requests for storage policy %q. Limit: %d",
+			storagePolicy, limit)
+		if storagePolicy == "" {
+			msg = fmt.Sprintf("too many concurrent CreateVolume requests without a storage policy. Limit: %d", limit)
+		}
+		logger.GetLogger(ctx).Error(msg)
+		return nil, status.Error(codes.ResourceExhausted, msg)
+	}
+	return func() { limiter.Release(storagePolicy) }, nil
+}
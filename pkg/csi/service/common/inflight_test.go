@@ -0,0 +1,272 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := NewConcurrencyLimiter(2)
+	for i := 0; i < 2; i++ {
+		if !limiter.TryAcquire("policy-a") {
+			t.Fatalf("expected acquire %d for policy-a to succeed", i+1)
+		}
+	}
+	if limiter.TryAcquire("policy-a") {
+		t.Errorf("expected acquire over the limit for policy-a to fail")
+	}
+	if !limiter.TryAcquire("policy-b") {
+		t.Errorf("expected acquire for policy-b to succeed while policy-a is at its limit")
+	}
+	limiter.Release("policy-a")
+	if !limiter.TryAcquire("policy-a") {
+		t.Errorf("expected acquire for policy-a to succeed after release")
+	}
+
+	unlimited := NewConcurrencyLimiter(0)
+	for i := 0; i < 10; i++ {
+		if !unlimited.TryAcquire("policy-a") {
+			t.Fatalf("expected acquire to succeed when no limit is configured")
+		}
+	}
+}
+
+func TestKeyedSemaphore(t *testing.T) {
+	semaphore := NewKeyedSemaphore(1)
+	// Two attaches to the same node run one after the other
+	var mutex sync.Mutex
+	var inProgress, maxInProgress int
+	attach := func() {
+		release, err := semaphore.Acquire(context.Background(), "node-1")
+		if err != nil {
+			t.Errorf("expected the attach to node-1 to proceed, got %v", err)
+			return
+		}
+		defer release()
+		mutex.Lock()
+		inProgress++
+		if inProgress > maxInProgress {
+			maxInProgress = inProgress
+		}
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		inProgress--
+		mutex.Unlock()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attach()
+		}()
+	}
+	wg.Wait()
+	if maxInProgress != 1 {
+		t.Errorf("expected the attaches to node-1 to be serialized, got %d in progress concurrently", maxInProgress)
+	}
+
+	// An attach to another node doesn't wait, and an attach giving up waiting fails
+	release, err := semaphore.Acquire(context.Background(), "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseOther, err := semaphore.Acquire(context.Background(), "node-2")
+	if err != nil {
+		t.Errorf("expected the attach to node-2 to proceed while node-1 is at its limit, got %v", err)
+	} else {
+		releaseOther()
+	}
+	waitCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = semaphore.Acquire(waitCtx, "node-1"); err != context.DeadlineExceeded {
+		t.Errorf("expected the attach to node-1 to give up waiting, got %v", err)
+	}
+	release()
+	if len(semaphore.entries) != 0 {
+		t.Errorf("expected no entries once no attach is in progress, got %d", len(semaphore.entries))
+	}
+
+	var unlimited *KeyedSemaphore
+	if _, err = unlimited.Acquire(context.Background(), "node-1"); err != nil {
+		t.Errorf("expected a nil semaphore not to limit attaches, got %v", err)
+	}
+}
+
+func TestAcquireCreateVolumeSlot(t *testing.T) {
+	limiter := NewConcurrencyLimiter(1)
+	// Requests without a storage policy share a single slot pool
+	release, err := AcquireCreateVolumeSlot(ctx, limiter, 1, "")
+	if err != nil {
+		t.Fatalf("expected the first request without a storage policy to proceed, got %v", err)
+	}
+	if _, err = AcquireCreateVolumeSlot(ctx, limiter, 1, ""); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected code %v for a request without a storage policy over the limit, got %v",
+			codes.ResourceExhausted, err)
+	}
+	releasePolicy, err := AcquireCreateVolumeSlot(ctx, limiter, 1, "policy-a")
+	if err != nil {
+		t.Errorf("expected a request for policy-a not to be limited by the requests without a policy, got %v", err)
+	} else {
+		releasePolicy()
+	}
+	release()
+	if release, err = AcquireCreateVolumeSlot(ctx, limiter, 1, ""); err != nil {
+		t.Errorf("expected a request without a storage policy to proceed after release, got %v", err)
+	} else {
+		release()
+	}
+
+	// Nothing is limited without a limit
+	for i := 0; i < 3; i++ {
+		if _, err = AcquireCreateVolumeSlot(ctx, NewConcurrencyLimiter(0), 0, ""); err != nil {
+			t.Fatalf("expected requests not to be limited without a limit, got %v", err)
+		}
+	}
+}
+
+func TestInFlightOperations(t *testing.T) {
+	operations := NewInFlightOperations()
+	doneCreate := operations.Start(InFlightOperation{Name: "CreateVolume", Volume: "pvc-1",
+		Parameters: map[string]string{"storagepolicyname": "gold", "csi.storage.k8s.io/provisioner-secret-name": "vc-creds"}})
+	doneAttach := operations.Start(InFlightOperation{Name: "ControllerPublishVolume", Volume: "vol-1", Node: "node-1"})
+
+	inFlight := operations.List()
+	if len(inFlight) != 2 || inFlight[0].Name != "CreateVolume" || inFlight[1].Name != "ControllerPublishVolume" {
+		t.Fatalf("expected the create and attach operations to be in flight, oldest first, got %+v", inFlight)
+	}
+	expectedParams := map[string]string{"storagepolicyname": "gold", "csi.storage.k8s.io/provisioner-secret-name": redactedValue}
+	if !reflect.DeepEqual(inFlight[0].Parameters, expectedParams) {
+		t.Errorf("expected the sensitive parameters to be redacted, got %v", inFlight[0].Parameters)
+	}
+
+	recorder := httptest.NewRecorder()
+	NewInFlightOperationsHandler(func(ctx context.Context) []InFlightOperation { return operations.List() }).
+		ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, InFlightOperationsPath, nil))
+	var served []InFlightOperation
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil {
+		t.Fatalf("expected the operations as JSON, got %q. err: %v", recorder.Body.String(), err)
+	}
+	if len(served) != 2 || served[1].Node != "node-1" || served[0].Parameters["storagepolicyname"] != "gold" {
+		t.Errorf("expected the in-flight operations to be served, got %+v", served)
+	}
+
+	doneCreate()
+	if inFlight = operations.List(); len(inFlight) != 1 || inFlight[0].Name != "ControllerPublishVolume" {
+		t.Errorf("expected only the attach operation to be in flight, got %+v", inFlight)
+	}
+	doneAttach()
+	if inFlight = operations.List(); len(inFlight) != 0 {
+		t.Errorf("expected no operation in flight, got %+v", inFlight)
+	}
+}
+
+func TestInFlightCallsPanic(t *testing.T) {
+	calls := NewInFlightCalls()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { _ = recover() }()
+		_ = calls.Do(context.Background(), "volume-1", func(ctx context.Context) error {
+			close(started)
+			<-release
+			panic("CNS call panicked")
+		})
+	}()
+	<-started
+	waiterErr := make(chan error)
+	go func() {
+		waiterErr <- calls.Do(context.Background(), "volume-1", func(ctx context.Context) error { return nil })
+	}()
+	// Give the waiter time to find the call in progress
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if err := <-waiterErr; err == nil {
+		t.Error("expected the waiter of a panicked call to get an error")
+	}
+	// The entry of the panicked call is not leaked
+	ran := false
+	if err := calls.Do(context.Background(), "volume-1", func(ctx context.Context) error {
+		ran = true
+		return nil
+	}); err != nil || !ran {
+		t.Errorf("expected a later call to run, got ran %t, err %v", ran, err)
+	}
+}
+
+func TestInFlightCallsCancelledCaller(t *testing.T) {
+	calls := NewInFlightCalls()
+	callerCtx, cancelCaller := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	callerErr := make(chan error)
+	go func() {
+		callerErr <- calls.Do(callerCtx, "volume-1", func(ctx context.Context) error {
+			close(started)
+			<-release
+			return ctx.Err()
+		})
+	}()
+	<-started
+	waiterCtx, cancelWaiter := context.WithCancel(context.Background())
+	waiterErr := make(chan error)
+	go func() {
+		waiterErr <- calls.Do(waiterCtx, "volume-1", func(ctx context.Context) error { return nil })
+	}()
+	// Give the waiter time to find the call in progress
+	time.Sleep(10 * time.Millisecond)
+	cancelCaller()
+	close(release)
+	if err := <-waiterErr; err != nil {
+		t.Errorf("expected the cancellation of the first caller not to be shared with the waiter, got %v", err)
+	}
+	if err := <-callerErr; err != nil {
+		t.Errorf("expected the call to run on a detached context, got %v", err)
+	}
+
+	// A cancelled waiter stops waiting for the call in progress
+	started = make(chan struct{})
+	release = make(chan struct{})
+	defer close(release)
+	go func() {
+		_ = calls.Do(context.Background(), "volume-1", func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	go func() {
+		waiterErr <- calls.Do(waiterCtx, "volume-1", func(ctx context.Context) error { return nil })
+	}()
+	cancelWaiter()
+	if err := <-waiterErr; err != context.Canceled {
+		t.Errorf("expected the cancelled waiter to get %v, got %v", context.Canceled, err)
+	}
+}
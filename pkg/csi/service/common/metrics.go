@@ -0,0 +1,136 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
+)
+
+const (
+	// metricsNamespace is the namespace of the metrics of the driver.
+	metricsNamespace = "vsphere_csi"
+	// metricsPath is the path the metrics are served at.
+	metricsPath = "/metrics"
+)
+
+// Validation stages of CreateVolume at which requests are rejected, recorded by
+// RecordCreateVolumeRejection.
+const (
+	// CreateVolumeRejectionCapability is recorded for requests with volume
+	// capabilities which are missing or not supported.
+	CreateVolumeRejectionCapability = "capability"
+	// CreateVolumeRejectionPolicy is recorded for requests with a storage policy
+	// which doesn't exist or which no shared datastore is compatible with.
+	CreateVolumeRejectionPolicy = "policy"
+	// CreateVolumeRejectionQuota is recorded for requests exceeding the capacity
+	// quota of their namespace.
+	CreateVolumeRejectionQuota = "quota"
+	// CreateVolumeRejectionRate is recorded for requests exceeding the volume
+	// provisioning rate limit.
+	CreateVolumeRejectionRate = "rate"
+	// CreateVolumeRejectionTopology is recorded for requests with accessibility
+	// requirements which can't be satisfied.
+	CreateVolumeRejectionTopology = "topology"
+)
+
+var (
+	// sharedDatastoresDuration is the duration of the computations of the datastores
+	// shared by the nodes of the cluster, by result.
+	sharedDatastoresDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "shared_datastores_duration_seconds",
+		Help:      "Duration of the computations of the datastores shared by the nodes of the cluster.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"result"})
+	// sharedDatastoresCacheLookups is the number of lookups of the shared datastores in
+	// their cache, by result.
+	sharedDatastoresCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "shared_datastores_cache_lookups_total",
+		Help:      "Number of lookups of the datastores shared by the nodes of the cluster in their cache.",
+	}, []string{"result"})
+	// createVolumeRejections is the number of CreateVolume requests rejected, by the
+	// validation stage they were rejected at.
+	createVolumeRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "create_volume_rejections_total",
+		Help:      "Number of CreateVolume requests rejected by validation stage.",
+	}, []string{"stage"})
+	// volumeProvisioningRate is the number of CNS create tasks started by the
+	// controller within the last minute.
+	volumeProvisioningRate = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_provisioning_rate_per_minute",
+		Help:      "Number of volume provisionings started within the last minute.",
+	}, func() float64 { return float64(cnsvolume.ProvisioningRate()) })
+)
+
+func init() {
+	prometheus.MustRegister(sharedDatastoresDuration, sharedDatastoresCacheLookups, createVolumeRejections,
+		volumeProvisioningRate)
+}
+
+// ObserveSharedDatastoresDuration records the duration of a computation of the shared
+// datastores which started at the given time, and failed if err is not nil.
+func ObserveSharedDatastoresDuration(start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	sharedDatastoresDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// RecordSharedDatastoresCacheLookup records a lookup of the shared datastores in their
+// cache, which is a hit if they were found in the cache.
+func RecordSharedDatastoresCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	sharedDatastoresCacheLookups.WithLabelValues(result).Inc()
+}
+
+// RecordCreateVolumeRejection records a CreateVolume request rejected at the given
+// validation stage, one of the CreateVolumeRejection constants.
+func RecordCreateVolumeRejection(stage string) {
+	createVolumeRejections.WithLabelValues(stage).Inc()
+}
+
+// ServeMetrics serves the metrics at /metrics on the given address in the background,
+// along with the given handlers keyed by path.
+func ServeMetrics(ctx context.Context, address string, handlers map[string]http.Handler) {
+	log := logger.GetLogger(ctx)
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.Handler())
+	for path, handler := range handlers {
+		mux.Handle(path, handler)
+	}
+	go func() {
+		log.Infof("serving metrics at %s%s", address, metricsPath)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Errorf("failed to serve metrics at %s. err: %v", address, err)
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+func TestSharedDatastoresMetrics(t *testing.T) {
+	start := time.Now()
+	ObserveSharedDatastoresDuration(start, nil)
+	ObserveSharedDatastoresDuration(start, nil)
+	ObserveSharedDatastoresDuration(start, errors.New("no shared datastores"))
+	RecordSharedDatastoresCacheLookup(false)
+	RecordSharedDatastoresCacheLookup(true)
+	RecordSharedDatastoresCacheLookup(true)
+
+	server := httptest.NewServer(promhttp.Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + metricsPath)
+	if err != nil {
+		t.Fatalf("failed to scrape the metrics. err: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the metrics. err: %v", err)
+	}
+	for _, sample := range []string{
+		`vsphere_csi_shared_datastores_duration_seconds_count{result="success"} 2`,
+		`vsphere_csi_shared_datastores_duration_seconds_count{result="failure"} 1`,
+		`vsphere_csi_shared_datastores_cache_lookups_total{result="hit"} 2`,
+		`vsphere_csi_shared_datastores_cache_lookups_total{result="miss"} 1`,
+	} {
+		if !strings.Contains(string(body), sample+"\n") {
+			t.Errorf("expected sample %q in the metrics, got:\n%s", sample, body)
+		}
+	}
+}
+
+func TestCreateVolumeRejectionMetrics(t *testing.T) {
+	ctx := context.Background()
+	rejections := func(stage string) float64 {
+		return testutil.ToFloat64(createVolumeRejections.WithLabelValues(stage))
+	}
+	before := make(map[string]float64)
+	for _, stage := range []string{CreateVolumeRejectionCapability, CreateVolumeRejectionQuota,
+		CreateVolumeRejectionTopology} {
+		before[stage] = rejections(stage)
+	}
+
+	// Requests without volume capabilities
+	if err := ValidateCreateVolumeRequest(ctx, &csi.CreateVolumeRequest{Name: "pvc"}); err == nil {
+		t.Error("expected the request without volume capabilities to be rejected")
+	}
+
+	// Requests exceeding the capacity quota of their namespace
+	quotas, err := NewNamespaceQuotas("ns-a:100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	cfg.Global.ClusterID = "cluster"
+	manager := &Manager{CnsConfig: cfg, VolumeManager: &fakeInventoryVolumeManager{}}
+	if _, err := quotas.Reserve(ctx, manager, "ns-a", 200); err == nil {
+		t.Error("expected the request exceeding the namespace quota to be rejected")
+	}
+
+	// Requests with unsatisfiable accessibility requirements are rejected by the
+	// controllers
+	RecordCreateVolumeRejection(CreateVolumeRejectionTopology)
+
+	for stage, count := range before {
+		if after := rejections(stage); after != count+1 {
+			t.Errorf("expected 1 rejection recorded at stage %q, got %v", stage, after-count)
+		}
+	}
+}
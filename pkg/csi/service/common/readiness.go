@@ -0,0 +1,88 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
+)
+
+// ReadinessRetryInterval is the interval at which the shared datastores are computed
+// again until the controller is ready.
+const ReadinessRetryInterval = 10 * time.Second
+
+// ReadinessPath is the path the readiness of the controller is served at by the
+// metrics server, e.g. for a readiness probe. The readiness is not reported by the
+// CSI Probe, which is used by the liveness probe, so that a controller which is not
+// ready yet, e.g. while vCenter is unreachable, is not restarted.
+const ReadinessPath = "/readyz"
+
+// Readiness tracks whether a controller is ready to serve RPCs, which it is once its
+// initialization completed and the shared datastores were computed successfully once.
+// The zero Readiness is not ready.
+type Readiness struct {
+	ready int32
+}
+
+// IsReady returns true once the controller is ready to serve RPCs.
+func (r *Readiness) IsReady() bool {
+	return atomic.LoadInt32(&r.ready) == 1
+}
+
+// SetReady marks the controller ready to serve RPCs.
+func (r *Readiness) SetReady() {
+	atomic.StoreInt32(&r.ready, 1)
+}
+
+// SetReadyAfterSharedDatastores computes the shared datastores with the given function
+// until it succeeds, retrying at the given interval, and then marks the controller
+// ready. It returns early if the context is done. Meant to be run in a goroutine once
+// the initialization of the controller completed.
+func (r *Readiness) SetReadyAfterSharedDatastores(ctx context.Context, interval time.Duration,
+	getSharedDatastores func(ctx context.Context) error) {
+	log := logger.GetLogger(ctx)
+	for {
+		err := getSharedDatastores(ctx)
+		if err == nil {
+			log.Infof("shared datastores computed, the controller is ready")
+			r.SetReady()
+			return
+		}
+		log.Warnf("failed to compute the shared datastores, the controller is not ready yet. err: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// NewReadinessHandler returns an http.Handler which responds with 200 OK if the given
+// function reports the controller is ready, and with 503 Service Unavailable otherwise.
+func NewReadinessHandler(isReady func(ctx context.Context) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReady(r.Context()) {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+}
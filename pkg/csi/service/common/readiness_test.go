@@ -0,0 +1,75 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadinessSetReadyAfterSharedDatastores(t *testing.T) {
+	ctx := context.Background()
+	var readiness Readiness
+	calls := 0
+	readiness.SetReadyAfterSharedDatastores(ctx, time.Millisecond, func(ctx context.Context) error {
+		calls++
+		if readiness.IsReady() {
+			t.Errorf("expected the controller to not be ready before the shared datastores were computed")
+		}
+		if calls == 1 {
+			return errors.New("vCenter not reachable")
+		}
+		return nil
+	})
+	if !readiness.IsReady() || calls != 2 {
+		t.Errorf("expected the controller to be ready after 2 attempts, ready: %t after %d attempts", readiness.IsReady(), calls)
+	}
+
+	// Canceling the context stops the retries
+	readiness = Readiness{}
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	readiness.SetReadyAfterSharedDatastores(ctx, time.Hour, func(ctx context.Context) error {
+		return errors.New("vCenter not reachable")
+	})
+	if readiness.IsReady() {
+		t.Errorf("expected the controller to not be ready when the shared datastores were never computed")
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	var readiness Readiness
+	handler := NewReadinessHandler(func(ctx context.Context) bool { return readiness.IsReady() })
+	for _, ready := range []bool{false, true} {
+		if ready {
+			readiness.SetReady()
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ReadinessPath, nil))
+		expectedCode := http.StatusServiceUnavailable
+		if ready {
+			expectedCode = http.StatusOK
+		}
+		if recorder.Code != expectedCode {
+			t.Errorf("expected status %d when ready is %t, got %d", expectedCode, ready, recorder.Code)
+		}
+	}
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package common
 
 import (
+	"context"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
@@ -25,12 +27,15 @@ import (
 
 var (
 	// BlockVolumeCaps represents how the block volume could be accessed.
-	// CNS block volumes support only SINGLE_NODE_WRITER where the volume is
-	// attached to a single node at any given time.
+	// CNS block volumes support SINGLE_NODE_WRITER and SINGLE_NODE_READER_ONLY
+	// where the volume is attached to a single node at any given time.
 	BlockVolumeCaps = []csi.VolumeCapability_AccessMode{
 		{
 			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 		},
+		{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		},
 	}
 
 	// FileVolumeCaps represents how the file volume could be accessed.
@@ -47,6 +52,24 @@ var (
 			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 		},
 	}
+
+	// defaultSupportedMountFlags is the allowlist of mount flags accepted in the mount
+	// volume capability, extended with allowed-mount-flags. Flags taking a value,
+	// such as "nfsvers=4.1", are matched on the name preceding "=". Flags changing
+	// how the volume is attached to the mount tree of the node, such as "bind", are
+	// not supported.
+	defaultSupportedMountFlags = []string{
+		// Generic flags
+		"defaults", "ro", "rw", "sync", "async", "dirsync",
+		"atime", "noatime", "diratime", "nodiratime", "relatime", "norelatime", "strictatime", "lazytime",
+		"dev", "nodev", "exec", "noexec", "suid", "nosuid", "discard", "nodiscard", "_netdev",
+		// ext4 and xfs flags
+		"errors", "data", "barrier", "nobarrier", "commit", "journal_checksum", "nouuid",
+		"user_xattr", "acl", "noacl",
+		// NFS flags
+		"hard", "soft", "nolock", "vers", "nfsvers", "minorversion",
+		"rsize", "wsize", "timeo", "retrans", "actimeo", "sec",
+	}
 )
 
 // Manager type comprises VirtualCenterConfig, CnsConfig, VolumeManager and VirtualCenterManager
@@ -55,6 +78,11 @@ type Manager struct {
 	CnsConfig      *config.Config
 	VolumeManager  cnsvolume.Manager
 	VcenterManager cnsvsphere.VirtualCenterManager
+	// VolumeInventory caches the CNS volumes of the cluster. It is nil if disabled.
+	VolumeInventory *VolumeInventory
+	// DatastoreReservations tracks the capacity reserved for the block volumes being
+	// created. It is nil if disabled.
+	DatastoreReservations *DatastoreReservations
 }
 
 // CreateVolumeSpec is the Volume Spec used by CSI driver
@@ -67,6 +95,9 @@ type CreateVolumeSpec struct {
 	// TODO: Move this StorageClassParams
 	AffineToHost string
 	VolumeType   string
+	// ClusterID is the ID of the cluster the volume is provisioned for.
+	// Defaults to the cluster ID in the config.
+	ClusterID string
 }
 
 // StorageClassParams represents the storage class parameterss
@@ -75,4 +106,56 @@ type StorageClassParams struct {
 	StoragePolicyName string
 	CSIMigration      string
 	Datastore         string
+	AntiAffinityGroup string
+	PVCNamespace      string
+	PVCName           string
+	// ValidateAttachable requests CreateVolume to place the volume only on datastores
+	// accessible from at least one node of the cluster, so that it is attachable
+	ValidateAttachable bool
+}
+
+// StorageClassParam describes a storage class parameter recognized by CreateVolume
+type StorageClassParam struct {
+	// Name is the lower case name of the parameter
+	Name string
+	// Type is the type of the value accepted for the parameter
+	Type string
+	// Values lists the accepted values, empty if any value of Type is accepted
+	Values []string
+	// Description describes the parameter
+	Description string
+}
+
+// ReadinessCheck is the result of a single check of a ReadinessReport
+type ReadinessCheck struct {
+	// Name identifies the check
+	Name string
+	// Passed is true if the check succeeded
+	Passed bool
+	// Message describes the outcome of the check
+	Message string
+}
+
+// ReadinessReport reports whether the driver is ready to provision volumes
+type ReadinessReport struct {
+	// Ready is true if all the checks passed
+	Ready bool
+	// Checks lists the checks in the order they were run
+	Checks []ReadinessCheck
+}
+
+// CreateVolumeValidator lets deployments plug custom admission logic into CreateVolume,
+// e.g. to enforce naming or label conventions, which runs before the volume is provisioned
+type CreateVolumeValidator interface {
+	// ValidateCreateVolume returns an error describing why the volume must not be
+	// provisioned, or nil to admit the request
+	ValidateCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) error
+}
+
+// NoopCreateVolumeValidator is the default CreateVolumeValidator, which admits all requests
+type NoopCreateVolumeValidator struct{}
+
+// ValidateCreateVolume admits the request
+func (NoopCreateVolumeValidator) ValidateCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) error {
+	return nil
 }
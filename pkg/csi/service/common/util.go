@@ -19,7 +19,11 @@ package common
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	csictx "github.com/rexray/gocsi/context"
 	cnstypes "github.com/vmware/govmomi/cns/types"
@@ -32,6 +36,7 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/vmware/govmomi/vim25/types"
 	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
 
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 )
@@ -54,6 +59,35 @@ func GetVCenter(ctx context.Context, manager *Manager) (*cnsvsphere.VirtualCente
 	return vcenter, nil
 }
 
+// FormatSnapshotID returns the CSI snapshot ID for the CNS snapshot with the given
+// ID of the CNS volume with the given ID.
+func FormatSnapshotID(volumeID string, cnsSnapshotID string) string {
+	return volumeID + SnapshotIDSeparator + cnsSnapshotID
+}
+
+// ParseSnapshotID returns the CNS volume ID and the CNS snapshot ID from the given
+// CSI snapshot ID. An error is returned if the snapshot ID is malformed.
+func ParseSnapshotID(snapshotID string) (string, string, error) {
+	parts := strings.Split(snapshotID, SnapshotIDSeparator)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+		return "", "", fmt.Errorf("snapshot ID %q is malformed. Expected format: <volume-id>%s<snapshot-id>",
+			snapshotID, SnapshotIDSeparator)
+	}
+	return parts[0], parts[1], nil
+}
+
+// IsVirtualCenterConfigChanged returns true if the given vCenter configs differ
+// in any of the fields used to connect to vCenter, in which case the vCenter
+// needs to be registered again.
+func IsVirtualCenterConfigChanged(oldConfig *cnsvsphere.VirtualCenterConfig, newConfig *cnsvsphere.VirtualCenterConfig) bool {
+	return oldConfig.Host != newConfig.Host ||
+		oldConfig.Port != newConfig.Port ||
+		oldConfig.Scheme != newConfig.Scheme ||
+		oldConfig.Username != newConfig.Username ||
+		oldConfig.Password != newConfig.Password ||
+		oldConfig.Thumbprint != newConfig.Thumbprint
+}
+
 // GetUUIDFromProviderID Returns VM UUID from Node's providerID
 func GetUUIDFromProviderID(providerID string) string {
 	return strings.TrimPrefix(providerID, ProviderPrefix)
@@ -67,6 +101,32 @@ func FormatDiskUUID(uuid string) string {
 	return strings.ToLower(uuidWithNoHypens)
 }
 
+// FormatDiskUUIDAs returns the given disk UUID in the given format. The UUID is
+// formatted as DiskUUIDFormatCompact, like FormatDiskUUID does, for an empty format.
+// UUIDs which don't have 32 hex digits are not dashed.
+func FormatDiskUUIDAs(uuid string, format string) string {
+	formattedUUID := FormatDiskUUID(uuid)
+	if (format == DiskUUIDFormatDashed || format == DiskUUIDFormatDashedUpper) && len(formattedUUID) == 32 {
+		formattedUUID = fmt.Sprintf("%s-%s-%s-%s-%s", formattedUUID[0:8], formattedUUID[8:12],
+			formattedUUID[12:16], formattedUUID[16:20], formattedUUID[20:32])
+	}
+	if format == DiskUUIDFormatCompactUpper || format == DiskUUIDFormatDashedUpper {
+		formattedUUID = strings.ToUpper(formattedUUID)
+	}
+	return formattedUUID
+}
+
+// ValidateDiskUUIDFormat returns an error if the given disk UUID format is not
+// supported. An empty format selects the default of DiskUUIDFormatCompact.
+func ValidateDiskUUIDFormat(format string) error {
+	switch format {
+	case "", DiskUUIDFormatCompact, DiskUUIDFormatCompactUpper, DiskUUIDFormatDashed, DiskUUIDFormatDashedUpper:
+		return nil
+	}
+	return fmt.Errorf("unsupported disk UUID format %q. Supported values are %q, %q, %q and %q", format,
+		DiskUUIDFormatCompact, DiskUUIDFormatCompactUpper, DiskUUIDFormatDashed, DiskUUIDFormatDashedUpper)
+}
+
 // RoundUpSize calculates how many allocation units are needed to accommodate
 // a volume of given size.
 func RoundUpSize(volumeSizeBytes int64, allocationUnitBytes int64) int64 {
@@ -77,6 +137,164 @@ func RoundUpSize(volumeSizeBytes int64, allocationUnitBytes int64) int64 {
 	return roundedUp
 }
 
+// ValidateDatastoreSelection returns an error if the given datastore selection is
+// not supported. An empty selection keeps the order the datastores are discovered in.
+func ValidateDatastoreSelection(selection string) error {
+	switch selection {
+	case "", DatastoreSelectionRandom, DatastoreSelectionRoundRobin:
+		return nil
+	}
+	return fmt.Errorf("unsupported datastore selection %q. Supported values are %q and %q",
+		selection, DatastoreSelectionRandom, DatastoreSelectionRoundRobin)
+}
+
+// ValidateDuplicateVolumeNamePolicy returns an error if the given behavior on duplicate
+// volume names is not supported. An empty behavior disables the lookup of existing volumes.
+func ValidateDuplicateVolumeNamePolicy(policy string) error {
+	switch policy {
+	case "", DuplicateVolumeNameFail, DuplicateVolumeNameReconfigure:
+		return nil
+	}
+	return fmt.Errorf("unsupported duplicate volume name policy %q. Supported values are %q and %q",
+		policy, DuplicateVolumeNameFail, DuplicateVolumeNameReconfigure)
+}
+
+// ValidateCapacityAggregation returns an error if the given aggregation of the free
+// space of the datastores is not supported.
+func ValidateCapacityAggregation(aggregation string) error {
+	switch aggregation {
+	case "", CapacityAggregationLargest, CapacityAggregationSum:
+		return nil
+	}
+	return fmt.Errorf("unsupported capacity aggregation %q. Supported values are %q and %q",
+		aggregation, CapacityAggregationLargest, CapacityAggregationSum)
+}
+
+// AggregateAvailableCapacity returns the capacity available to new volumes on the given
+// datastores with the given aggregation of their free space. The free space of the
+// datastore with the most free space is returned unless the aggregation is
+// CapacityAggregationSum, in which case their total free space is returned.
+func AggregateAvailableCapacity(datastores []*cnsvsphere.DatastoreInfo, aggregation string) int64 {
+	var availableCapacity int64
+	for _, datastore := range datastores {
+		if aggregation == CapacityAggregationSum {
+			availableCapacity += datastore.Info.FreeSpace
+		} else if datastore.Info.FreeSpace > availableCapacity {
+			availableCapacity = datastore.Info.FreeSpace
+		}
+	}
+	return availableCapacity
+}
+
+// GetPublishContextDiskTypeKey returns the publish context key of the disk type,
+// which is AttributeDiskType unless overridden in the given config.
+func GetPublishContextDiskTypeKey(cfg *cnsconfig.Config) string {
+	if cfg != nil && cfg.Global.PublishContextDiskTypeKey != "" {
+		return cfg.Global.PublishContextDiskTypeKey
+	}
+	return AttributeDiskType
+}
+
+// GetPublishContextDiskUUIDKey returns the publish context key of the FCD UUID,
+// which is AttributeFirstClassDiskUUID unless overridden in the given config.
+func GetPublishContextDiskUUIDKey(cfg *cnsconfig.Config) string {
+	if cfg != nil && cfg.Global.PublishContextDiskUUIDKey != "" {
+		return cfg.Global.PublishContextDiskUUIDKey
+	}
+	return AttributeFirstClassDiskUUID
+}
+
+// GetBlockVolumePublishContext returns the publish context of a block volume
+// attached with the given disk UUID, using the key names and the disk UUID format
+// of the given config.
+func GetBlockVolumePublishContext(cfg *cnsconfig.Config, diskUUID string) map[string]string {
+	var diskUUIDFormat string
+	if cfg != nil {
+		diskUUIDFormat = cfg.Global.DiskUUIDFormat
+	}
+	return map[string]string{
+		GetPublishContextDiskTypeKey(cfg): DiskTypeBlockVolume,
+		GetPublishContextDiskUUIDKey(cfg): FormatDiskUUIDAs(diskUUID, diskUUIDFormat),
+	}
+}
+
+// pvAttributeLabels maps the volume attributes recorded in the CNS PV metadata when
+// a volume is provisioned to the labels they are recorded as.
+var pvAttributeLabels = map[string]string{
+	AttributeAntiAffinityGroup: AntiAffinityGroupLabel,
+	AttributeClusterVersion:    ClusterVersionLabel,
+}
+
+// DriverOwnedPVLabels are the labels the controller records in the CNS PV metadata
+// of a volume after it was provisioned, e.g. when it is expanded. As they are not
+// on the PV, they are carried over from the CNS metadata when it is rebuilt from
+// the PV, so that they are not dropped.
+var DriverOwnedPVLabels = []string{ExpandedCapacityLabel, LastExpandedAtLabel}
+
+// GetPVLabels returns the labels to be recorded in the CNS metadata of the given PV.
+// The anti-affinity group and the cluster version the volume was provisioned with
+// are added to the PV labels, so that they are not dropped from CNS when the PV
+// metadata is updated.
+func GetPVLabels(pv *v1.PersistentVolume) map[string]string {
+	pvLabels := make(map[string]string)
+	for key, value := range pv.GetLabels() {
+		pvLabels[key] = value
+	}
+	if pv.Spec.CSI == nil {
+		return pvLabels
+	}
+	for attribute, label := range pvAttributeLabels {
+		if value := pv.Spec.CSI.VolumeAttributes[attribute]; value != "" {
+			pvLabels[label] = value
+		}
+	}
+	return pvLabels
+}
+
+// AddDriverOwnedPVLabels adds the DriverOwnedPVLabels of the given labels of the CNS
+// PV metadata of a volume to the given PV labels, unless the PV sets them.
+func AddDriverOwnedPVLabels(pvLabels map[string]string, cnsLabels map[string]string) {
+	for _, label := range DriverOwnedPVLabels {
+		value, ok := cnsLabels[label]
+		if _, set := pvLabels[label]; ok && !set {
+			pvLabels[label] = value
+		}
+	}
+}
+
+// ParseChargebackLabels parses the given chargeback-labels of the config, a comma
+// separated list of key=value pairs such as "cost-center=1234,team=storage", into
+// a map. Returns an error if a pair has no key or no value.
+func ParseChargebackLabels(chargebackLabels string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(chargebackLabels, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 || strings.TrimSpace(keyValue[0]) == "" || strings.TrimSpace(keyValue[1]) == "" {
+			return nil, fmt.Errorf("invalid chargeback label %q. Expected a key=value pair", pair)
+		}
+		labels[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+	return labels, nil
+}
+
+// AddChargebackLabels adds the chargeback labels of the given config to the given
+// labels of the CNS metadata of a volume, unless they set them. Invalid chargeback
+// labels, which the controller rejects on startup, are not added.
+func AddChargebackLabels(labels map[string]string, cfg *cnsconfig.Config) {
+	chargebackLabels, err := ParseChargebackLabels(cfg.Global.ChargebackLabels)
+	if err != nil {
+		return
+	}
+	for key, value := range chargebackLabels {
+		if _, set := labels[key]; !set {
+			labels[key] = value
+		}
+	}
+}
+
 // GetLabelsMapFromKeyValue creates a  map object from given parameter
 func GetLabelsMapFromKeyValue(labels []types.KeyValue) map[string]string {
 	labelsMap := make(map[string]string)
@@ -128,6 +346,24 @@ func IsVolumeReadOnly(capability *csi.VolumeCapability) bool {
 	return ro
 }
 
+// GetBlockVolumeAccessMode returns SINGLE_NODE_READER_ONLY if all of the given
+// volume capabilities request read-only access, and SINGLE_NODE_WRITER otherwise.
+func GetBlockVolumeAccessMode(volCaps []*csi.VolumeCapability) csi.VolumeCapability_AccessMode_Mode {
+	for _, volCap := range volCaps {
+		if volCap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY {
+			return csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+		}
+	}
+	return csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+}
+
+// IsNodeExpansionRequired returns whether the node has to expand a volume with the
+// given capability after its expansion by the controller, i.e. unless the volume is
+// a raw block volume. The expansion is required if the capability is not known.
+func IsNodeExpansionRequired(volCap *csi.VolumeCapability) bool {
+	return volCap.GetBlock() == nil
+}
+
 // validateVolumeCapabilities validates the access mode in given volume capabilities in validAccessModes.
 func validateVolumeCapabilities(volCaps []*csi.VolumeCapability, validAccessModes []csi.VolumeCapability_AccessMode) bool {
 	// Validate if all capabilities of the volume
@@ -160,6 +396,56 @@ func IsValidVolumeCapabilities(ctx context.Context, volCaps []*csi.VolumeCapabil
 	return validateVolumeCapabilities(volCaps, BlockVolumeCaps)
 }
 
+var (
+	// supportedMountFlags are the names of the mount flags accepted in volume capabilities
+	supportedMountFlags = newMountFlagSet(defaultSupportedMountFlags)
+	// supportedMountFlagsLock guards supportedMountFlags
+	supportedMountFlagsLock sync.RWMutex
+)
+
+// newMountFlagSet returns the set of the given mount flag names.
+func newMountFlagSet(flags []string) map[string]bool {
+	flagSet := make(map[string]bool)
+	for _, flag := range flags {
+		if flag = strings.ToLower(strings.TrimSpace(flag)); flag != "" {
+			flagSet[flag] = true
+		}
+	}
+	return flagSet
+}
+
+// SetAllowedMountFlags sets the mount flags accepted in volume capabilities to the
+// built-in allowlist extended with the given comma separated list of flag names.
+func SetAllowedMountFlags(ctx context.Context, flags string) {
+	log := logger.GetLogger(ctx)
+	flagSet := newMountFlagSet(append(strings.Split(flags, ","), defaultSupportedMountFlags...))
+	supportedMountFlagsLock.Lock()
+	defer supportedMountFlagsLock.Unlock()
+	supportedMountFlags = flagSet
+	log.Debugf("Mount flags accepted in volume capabilities: %v", flagSet)
+}
+
+// ValidateMountFlags returns an error if any of the given volume capabilities
+// requests a mount flag which is not supported by the driver. Flags taking a
+// value, such as "errors=remount-ro", are matched on the name preceding "=".
+func ValidateMountFlags(volCaps []*csi.VolumeCapability) error {
+	supportedMountFlagsLock.RLock()
+	defer supportedMountFlagsLock.RUnlock()
+	var unsupportedFlags []string
+	for _, volCap := range volCaps {
+		for _, flag := range volCap.GetMount().GetMountFlags() {
+			flagName := strings.TrimSpace(strings.SplitN(flag, "=", 2)[0])
+			if !supportedMountFlags[strings.ToLower(flagName)] {
+				unsupportedFlags = append(unsupportedFlags, flag)
+			}
+		}
+	}
+	if len(unsupportedFlags) > 0 {
+		return fmt.Errorf("unsupported mount flags: %v", unsupportedFlags)
+	}
+	return nil
+}
+
 // IsFileVolumeMount loops through the list of mount points and
 // checks if the target path mount point is a file volume type or not
 // Returns an error if the target path is not found in the mount points
@@ -192,6 +478,87 @@ func IsTargetInMounts(ctx context.Context, target string, mnts []gofsutil.Info)
 	return false
 }
 
+// GetSupportedStorageClassParams returns the storage class parameters recognized by
+// ParseStorageClassParams. In-tree migration parameters are included only when the
+// CSI migration feature is enabled.
+func GetSupportedStorageClassParams() []StorageClassParam {
+	params := []StorageClassParam{
+		{Name: AttributeDatastoreURL, Type: "string", Description: "URL of the datastore to provision the volume on"},
+		{Name: AttributeStoragePolicyName, Type: "string", Description: "name of the storage policy to provision the volume with"},
+		{Name: AttributeAntiAffinityGroup, Type: "string",
+			Description: "volumes of the same group are placed on different datastores when possible"},
+		{Name: AttributeValidateAttachable, Type: "bool", Values: []string{"true", "false"},
+			Description: "place the block volume only on datastores accessible from a node of the cluster"},
+		{Name: AttributeFsType, Type: "string", Description: "deprecated, use csi.storage.k8s.io/fstype instead"},
+	}
+	if !CSIMigrationFeatureEnabled {
+		return params
+	}
+	params = append(params,
+		StorageClassParam{Name: CSIMigrationParams, Type: "bool", Values: []string{"true", "false"},
+			Description: "set by the in-tree migration plugin for volumes requested by an in-tree storage class"},
+		StorageClassParam{Name: DatastoreMigrationParam, Type: "string", Description: "name of the datastore to provision the volume on"},
+		StorageClassParam{Name: DiskFormatMigrationParam, Type: "string", Values: []string{"thin", "zeroedthick", "eagerzeroedthick"},
+			Description: "accepted for compatibility, ignored"},
+		StorageClassParam{Name: HostFailuresToTolerateMigrationParam, Type: "int", Description: "accepted for compatibility, ignored"},
+		StorageClassParam{Name: ForceProvisioningMigrationParam, Type: "bool", Description: "accepted for compatibility, ignored"},
+		StorageClassParam{Name: CacheReservationMigrationParam, Type: "int", Description: "accepted for compatibility, ignored"},
+		StorageClassParam{Name: DiskstripesMigrationParam, Type: "int", Description: "accepted for compatibility, ignored"},
+		StorageClassParam{Name: ObjectspacereservationMigrationParam, Type: "int", Description: "accepted for compatibility, ignored"},
+		StorageClassParam{Name: IopslimitMigrationParam, Type: "int", Description: "accepted for compatibility, ignored"},
+	)
+	return params
+}
+
+// paramTemplateRegexp matches a template variable reference such as "{{.ClusterID}}"
+// in a parameter value.
+var paramTemplateRegexp = regexp.MustCompile(`\{\{\s*\.(\w+)\s*\}\}`)
+
+// ExpandParamTemplates returns a copy of the given parameters with the template
+// variables referenced in their values, such as "{{.ClusterID}}", replaced by the
+// values of the given variables. An error is returned if a parameter value references
+// an unknown variable or contains any other template expression.
+func ExpandParamTemplates(params map[string]string, vars map[string]string) (map[string]string, error) {
+	expandedParams := make(map[string]string, len(params))
+	for param, value := range params {
+		for _, match := range paramTemplateRegexp.FindAllStringSubmatch(value, -1) {
+			if _, ok := vars[match[1]]; !ok {
+				return nil, fmt.Errorf("unknown template variable %q in value %q of param %q", match[1], value, param)
+			}
+		}
+		remainder := paramTemplateRegexp.ReplaceAllString(value, "")
+		if strings.Contains(remainder, "{{") || strings.Contains(remainder, "}}") {
+			return nil, fmt.Errorf("unsupported template expression in value %q of param %q", value, param)
+		}
+		expandedParams[param] = paramTemplateRegexp.ReplaceAllStringFunc(value, func(match string) string {
+			return vars[paramTemplateRegexp.FindStringSubmatch(match)[1]]
+		})
+	}
+	return expandedParams, nil
+}
+
+// ParseNamespaceQuotas parses the comma separated list of "namespace:quotaInMb"
+// pairs into a map of namespace to capacity quota in MB.
+func ParseNamespaceQuotas(quotas string) (map[string]int64, error) {
+	namespaceQuotas := make(map[string]int64)
+	for _, quota := range strings.Split(quotas, ",") {
+		quota = strings.TrimSpace(quota)
+		if quota == "" {
+			continue
+		}
+		parts := strings.Split(quota, ":")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid namespace capacity quota %q, expected <namespace>:<quotaInMb>", quota)
+		}
+		quotaInMb, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil || quotaInMb < 0 {
+			return nil, fmt.Errorf("invalid capacity quota %q for namespace %q", parts[1], parts[0])
+		}
+		namespaceQuotas[strings.TrimSpace(parts[0])] = quotaInMb
+	}
+	return namespaceQuotas, nil
+}
+
 // ParseStorageClassParams parses the params in the CSI CreateVolumeRequest API call back
 // to StorageClassParams structure.
 func ParseStorageClassParams(ctx context.Context, params map[string]string) (*StorageClassParams, error) {
@@ -204,9 +571,26 @@ func ParseStorageClassParams(ctx context.Context, params map[string]string) (*St
 		for param, value := range params {
 			param = strings.ToLower(param)
 			if param == AttributeDatastoreURL {
-				scParams.DatastoreURL = value
+				if err := cnsvsphere.ValidateDatastoreURL(value); err != nil {
+					return nil, fmt.Errorf("Invalid value: %q for param: %q. err: %v", value, param, err)
+				}
+				scParams.DatastoreURL = cnsvsphere.NormalizeDatastoreURL(value)
 			} else if param == AttributeStoragePolicyName {
 				scParams.StoragePolicyName = value
+			} else if param == AttributeAntiAffinityGroup {
+				scParams.AntiAffinityGroup = value
+			} else if param == AttributeValidateAttachable {
+				validateAttachable, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid value: %q for param: %q", value, param)
+				}
+				scParams.ValidateAttachable = validateAttachable
+			} else if param == AttributePVCNamespace {
+				scParams.PVCNamespace = value
+			} else if param == AttributePVCName {
+				scParams.PVCName = value
+			} else if param == AttributePVName {
+				log.Debugf("ignoring reserved param %q with value %q", param, value)
 			} else if param == AttributeFsType {
 				log.Warnf("param 'fstype' is deprecated, please use 'csi.storage.k8s.io/fstype' instead")
 			} else {
@@ -218,9 +602,26 @@ func ParseStorageClassParams(ctx context.Context, params map[string]string) (*St
 		for param, value := range params {
 			param = strings.ToLower(param)
 			if param == AttributeDatastoreURL {
-				scParams.DatastoreURL = value
+				if err := cnsvsphere.ValidateDatastoreURL(value); err != nil {
+					return nil, fmt.Errorf("Invalid value: %q for param: %q. err: %v", value, param, err)
+				}
+				scParams.DatastoreURL = cnsvsphere.NormalizeDatastoreURL(value)
 			} else if param == AttributeStoragePolicyName {
 				scParams.StoragePolicyName = value
+			} else if param == AttributeAntiAffinityGroup {
+				scParams.AntiAffinityGroup = value
+			} else if param == AttributeValidateAttachable {
+				validateAttachable, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid value: %q for param: %q", value, param)
+				}
+				scParams.ValidateAttachable = validateAttachable
+			} else if param == AttributePVCNamespace {
+				scParams.PVCNamespace = value
+			} else if param == AttributePVCName {
+				scParams.PVCName = value
+			} else if param == AttributePVName {
+				log.Debugf("ignoring reserved param %q with value %q", param, value)
 			} else if param == AttributeFsType {
 				log.Warnf("param 'fstype' is deprecated, please use 'csi.storage.k8s.io/fstype' instead")
 			} else if param == CSIMigrationParams {
@@ -303,6 +704,39 @@ func GetFeatureStates(ctx context.Context, cfg *cnsconfig.Config) error {
 	return err
 }
 
+// ReloadConfigReadAttempts is the number of attempts to read the configuration when it
+// is reloaded, as a read can fail transiently, e.g. while the secret is being rewritten.
+const ReloadConfigReadAttempts = 4
+
+// ReloadConfigReadBackoff is the delay before the second attempt to read the configuration
+// when it is reloaded, doubled for each next attempt.
+const ReloadConfigReadBackoff = 500 * time.Millisecond
+
+// getConfig reads the configuration. Overridden in tests.
+var getConfig = GetConfig
+
+// GetConfigWithRetry loads the configuration like GetConfig, making up to the given number
+// of attempts. The delay between the attempts starts at the given backoff and doubles
+// after each attempt. Returns the error of the last attempt if all of them fail.
+func GetConfigWithRetry(ctx context.Context, attempts int, backoff time.Duration) (*cnsconfig.Config, error) {
+	log := logger.GetLogger(ctx)
+	var cfg *cnsconfig.Config
+	var err error
+	for attempt := 1; ; attempt++ {
+		cfg, err = getConfig(ctx)
+		if err == nil || attempt >= attempts {
+			return cfg, err
+		}
+		log.Warnf("failed to read config, attempt %d of %d. Retrying in %v. Error: %+v", attempt, attempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return cfg, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
 // GetConfig loads configuration from secret and returns config object
 func GetConfig(ctx context.Context) (*cnsconfig.Config, error) {
 	log := logger.GetLogger(ctx)
@@ -18,9 +18,15 @@ package common
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 )
 
 var (
@@ -133,6 +139,72 @@ func TestValidVolumeCapabilitiesForBlock(t *testing.T) {
 	if !IsValidVolumeCapabilities(ctx, volCap) {
 		t.Errorf("Block VolCap = %+v failed validation!", volCap)
 	}
+	// fstype=ext4 and mode=SINGLE_NODE_READER_ONLY
+	volCap = []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					FsType: "ext4",
+				},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+			},
+		},
+	}
+	if !IsValidVolumeCapabilities(ctx, volCap) {
+		t.Errorf("Block VolCap = %+v failed validation!", volCap)
+	}
+}
+
+func TestGetBlockVolumeAccessMode(t *testing.T) {
+	newVolCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: mode,
+			},
+		}
+	}
+	readerOnly := newVolCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)
+	writer := newVolCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	tests := []struct {
+		volCaps  []*csi.VolumeCapability
+		expected csi.VolumeCapability_AccessMode_Mode
+	}{
+		{[]*csi.VolumeCapability{readerOnly}, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY},
+		{[]*csi.VolumeCapability{writer}, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		{[]*csi.VolumeCapability{readerOnly, writer}, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	for _, test := range tests {
+		if mode := GetBlockVolumeAccessMode(test.volCaps); mode != test.expected {
+			t.Errorf("VolCap = %+v: expected access mode %v, got %v", test.volCaps, test.expected, mode)
+		}
+	}
+}
+
+func TestIsNodeExpansionRequired(t *testing.T) {
+	blockVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+	}
+	mountVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+		},
+	}
+	if IsNodeExpansionRequired(blockVolCap) {
+		t.Errorf("expected node expansion to not be required for a block volume")
+	}
+	if !IsNodeExpansionRequired(mountVolCap) {
+		t.Errorf("expected node expansion to be required for a mount volume")
+	}
+	if !IsNodeExpansionRequired(nil) {
+		t.Errorf("expected node expansion to be required when the volume capability is not known")
+	}
 }
 
 func TestInvalidVolumeCapabilitiesForBlock(t *testing.T) {
@@ -270,6 +342,157 @@ func isStorageClassParamsEqual(expected *StorageClassParams, actual *StorageClas
 	return true
 }
 
+func TestValidateMountFlags(t *testing.T) {
+	// Allowed flags
+	volCap := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					FsType:     "ext4",
+					MountFlags: []string{"noatime", "nodiratime", "discard", "errors=remount-ro", "data=ordered", "barrier"},
+				},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					FsType:     "nfs4",
+					MountFlags: []string{"hard", "nfsvers=4.1", "rsize=1048576"},
+				},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+			},
+		},
+	}
+	if err := ValidateMountFlags(volCap); err != nil {
+		t.Errorf("VolCap = %+v failed mount flag validation: %v", volCap, err)
+	}
+	// Disallowed flags
+	volCap = []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					FsType:     "ext4",
+					MountFlags: []string{"noatime", "uid=1000", "bind"},
+				},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	if err := ValidateMountFlags(volCap); err == nil {
+		t.Errorf("VolCap = %+v with unsupported mount flags passed validation!", volCap)
+	}
+	// Raw block volume without mount flags
+	volCap = []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	if err := ValidateMountFlags(volCap); err != nil {
+		t.Errorf("VolCap = %+v failed mount flag validation: %v", volCap, err)
+	}
+}
+
+func TestSetAllowedMountFlags(t *testing.T) {
+	defer SetAllowedMountFlags(ctx, "")
+	newVolCap := func(flags ...string) []*csi.VolumeCapability {
+		return []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{
+						FsType:     "xfs",
+						MountFlags: flags,
+					},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		}
+	}
+	if err := ValidateMountFlags(newVolCap("nouuid", "inode64")); err == nil {
+		t.Error("expected mount flag inode64 outside of the allowlist to be rejected")
+	}
+	SetAllowedMountFlags(ctx, "Inode64, largeio")
+	if err := ValidateMountFlags(newVolCap("nouuid", "inode64", "largeio")); err != nil {
+		t.Errorf("expected mount flags to be accepted once allowed-mount-flags is configured, got %v", err)
+	}
+	if err := ValidateMountFlags(newVolCap("bind")); err == nil {
+		t.Error("expected mount flag bind outside of the allowlist to be rejected")
+	}
+	SetAllowedMountFlags(ctx, "")
+	if err := ValidateMountFlags(newVolCap("inode64")); err == nil {
+		t.Error("expected the default allowlist to be restored")
+	}
+}
+
+func TestIsVirtualCenterConfigChanged(t *testing.T) {
+	oldConfig := &cnsvsphere.VirtualCenterConfig{
+		Scheme:     "https",
+		Host:       "vcenter.example.com",
+		Port:       443,
+		Username:   "administrator@vsphere.local",
+		Password:   "password",
+		Thumbprint: "AA:BB:CC",
+	}
+	newConfig := *oldConfig
+	if IsVirtualCenterConfigChanged(oldConfig, &newConfig) {
+		t.Errorf("identical vCenter configs reported as changed")
+	}
+	// Port-only change
+	newConfig = *oldConfig
+	newConfig.Port = 8443
+	if !IsVirtualCenterConfigChanged(oldConfig, &newConfig) {
+		t.Errorf("vCenter port change from %d to %d not detected", oldConfig.Port, newConfig.Port)
+	}
+	// Thumbprint-only change
+	newConfig = *oldConfig
+	newConfig.Thumbprint = "DD:EE:FF"
+	if !IsVirtualCenterConfigChanged(oldConfig, &newConfig) {
+		t.Errorf("vCenter thumbprint change from %q to %q not detected", oldConfig.Thumbprint, newConfig.Thumbprint)
+	}
+}
+
+func TestSnapshotIDRoundTrip(t *testing.T) {
+	volumeID := "4d3eb9e5-5c3f-4b3c-8ef1-6b1f3a5e9f10"
+	cnsSnapshotID := "0b5b3c7e-1f2a-4d6b-9c8e-2a7d4e5f6a1b"
+	snapshotID := FormatSnapshotID(volumeID, cnsSnapshotID)
+	parsedVolumeID, parsedSnapshotID, err := ParseSnapshotID(snapshotID)
+	if err != nil {
+		t.Fatalf("ParseSnapshotID(%q) failed with err: %v", snapshotID, err)
+	}
+	if parsedVolumeID != volumeID || parsedSnapshotID != cnsSnapshotID {
+		t.Errorf("ParseSnapshotID(%q) = (%q, %q), expected (%q, %q)",
+			snapshotID, parsedVolumeID, parsedSnapshotID, volumeID, cnsSnapshotID)
+	}
+}
+
+func TestParseMalformedSnapshotID(t *testing.T) {
+	for _, snapshotID := range []string{
+		"",
+		"+",
+		"volume-id",
+		"volume-id+",
+		"+snapshot-id",
+		"volume-id+snapshot-id+extra",
+	} {
+		if _, _, err := ParseSnapshotID(snapshotID); err == nil {
+			t.Errorf("expected ParseSnapshotID(%q) to fail", snapshotID)
+		}
+	}
+}
+
 func TestParseStorageClassParamsWithDeprecatedFSType(t *testing.T) {
 	params := map[string]string{
 		"fstype": "ext4",
@@ -286,11 +509,11 @@ func TestParseStorageClassParamsWithDeprecatedFSType(t *testing.T) {
 
 func TestParseStorageClassParamsWithValidParams(t *testing.T) {
 	params := map[string]string{
-		AttributeDatastoreURL:      "ds1",
+		AttributeDatastoreURL:      "ds:///vmfs/volumes/ds1/",
 		AttributeStoragePolicyName: "policy1",
 	}
 	expectedScParams := &StorageClassParams{
-		DatastoreURL:      "ds1",
+		DatastoreURL:      "ds:///vmfs/volumes/ds1/",
 		StoragePolicyName: "policy1",
 	}
 
@@ -303,6 +526,27 @@ func TestParseStorageClassParamsWithValidParams(t *testing.T) {
 	}
 }
 
+func TestParseStorageClassParamsNormalizesDatastoreURL(t *testing.T) {
+	for _, datastoreURL := range []string{
+		"ds:///vmfs/volumes/vsan:52d6a6e3/",
+		"ds:///vmfs/volumes/vsan:52d6a6e3",
+		"ds:///vmfs/volumes/vsan:52d6a6e3//",
+		" DS:///vmfs/volumes/VSAN:52D6A6E3/ ",
+	} {
+		scParams, err := ParseStorageClassParams(ctx, map[string]string{AttributeDatastoreURL: datastoreURL})
+		if err != nil {
+			t.Errorf("failed to parse datastore URL %q. err: %v", datastoreURL, err)
+		} else if scParams.DatastoreURL != "ds:///vmfs/volumes/vsan:52d6a6e3/" {
+			t.Errorf("expected datastore URL %q to be normalized, got %q", datastoreURL, scParams.DatastoreURL)
+		}
+	}
+	for _, datastoreURL := range []string{"ds1", "ds:///", "/vmfs/volumes/vsan:52d6a6e3/"} {
+		if _, err := ParseStorageClassParams(ctx, map[string]string{AttributeDatastoreURL: datastoreURL}); err == nil {
+			t.Errorf("expected invalid datastore URL %q to be rejected", datastoreURL)
+		}
+	}
+}
+
 func TestParseStorageClassParamsWithMigrationEnabled(t *testing.T) {
 	CSIMigrationFeatureEnabled = true
 	params := map[string]string{
@@ -344,3 +588,189 @@ func TestParseStorageClassParamsWithMigrationDisabled(t *testing.T) {
 	}
 	t.Logf("expected err received. err: %v", err)
 }
+
+func TestGetSupportedStorageClassParams(t *testing.T) {
+	for _, migrationEnabled := range []bool{false, true} {
+		CSIMigrationFeatureEnabled = migrationEnabled
+		supported := make(map[string]bool)
+		for _, param := range GetSupportedStorageClassParams() {
+			supported[param.Name] = true
+		}
+		for _, name := range []string{AttributeDatastoreURL, AttributeStoragePolicyName, AttributeFsType} {
+			if !supported[name] {
+				t.Errorf("migration enabled: %t, expected %q to be a supported parameter", migrationEnabled, name)
+			}
+		}
+		if supported[CSIMigrationParams] != migrationEnabled {
+			t.Errorf("migration enabled: %t, unexpected support for %q", migrationEnabled, CSIMigrationParams)
+		}
+		// Every listed parameter must be accepted by ParseStorageClassParams.
+		params := make(map[string]string)
+		for name := range supported {
+			params[name] = "1"
+		}
+		params[CSIMigrationParams] = "true"
+		if !migrationEnabled {
+			delete(params, CSIMigrationParams)
+		}
+		if _, err := ParseStorageClassParams(ctx, params); err != nil {
+			t.Errorf("migration enabled: %t, failed to parse supported params %v. err: %v", migrationEnabled, params, err)
+		}
+	}
+}
+
+func TestParseNamespaceQuotas(t *testing.T) {
+	quotas, err := ParseNamespaceQuotas("team-a:1024, team-b : 2048,")
+	if err != nil {
+		t.Fatalf("failed to parse namespace quotas. err: %v", err)
+	}
+	if len(quotas) != 2 || quotas["team-a"] != 1024 || quotas["team-b"] != 2048 {
+		t.Errorf("unexpected namespace quotas: %v", quotas)
+	}
+	for _, invalid := range []string{"team-a", "team-a:1G", ":1024", "team-a:-1"} {
+		if _, err := ParseNamespaceQuotas(invalid); err == nil {
+			t.Errorf("expected parsing %q to fail", invalid)
+		}
+	}
+}
+
+func TestExpandParamTemplates(t *testing.T) {
+	vars := map[string]string{
+		TemplateVarClusterID: "cluster-1",
+		TemplateVarZone:      "zone-a",
+	}
+	params := map[string]string{
+		AttributeAntiAffinityGroup: "{{.ClusterID}}-{{ .Zone }}-web",
+		AttributeStoragePolicyName: "policy",
+	}
+	expandedParams, err := ExpandParamTemplates(params, vars)
+	if err != nil {
+		t.Fatalf("failed to expand params %v. err: %v", params, err)
+	}
+	if expandedParams[AttributeAntiAffinityGroup] != "cluster-1-zone-a-web" || expandedParams[AttributeStoragePolicyName] != "policy" {
+		t.Errorf("unexpected expanded params: %v", expandedParams)
+	}
+	if params[AttributeAntiAffinityGroup] != "{{.ClusterID}}-{{ .Zone }}-web" {
+		t.Errorf("expected the given params to be left unchanged, got %v", params)
+	}
+
+	for _, value := range []string{"{{.Region}}", "{{.Env \"HOME\"}}", "{{printf \"%s\" .ClusterID}}", "{{.ClusterID"} {
+		if _, err := ExpandParamTemplates(map[string]string{AttributeAntiAffinityGroup: value}, vars); err == nil {
+			t.Errorf("expected expanding %q to fail", value)
+		}
+	}
+}
+
+func TestGetConfigWithRetry(t *testing.T) {
+	defer func(orig func(context.Context) (*cnsconfig.Config, error)) {
+		getConfig = orig
+	}(getConfig)
+	reads := 0
+	getConfig = func(ctx context.Context) (*cnsconfig.Config, error) {
+		reads++
+		if reads == 1 {
+			return nil, errors.New("secret is being rewritten")
+		}
+		return &cnsconfig.Config{}, nil
+	}
+
+	// The first read fails and the second one succeeds
+	cfg, err := GetConfigWithRetry(context.Background(), 3, time.Millisecond)
+	if err != nil || cfg == nil || reads != 2 {
+		t.Errorf("expected the config to be read on the second attempt, got %v after %d reads (err: %v)", cfg, reads, err)
+	}
+
+	// All the reads fail
+	reads = 0
+	getConfig = func(ctx context.Context) (*cnsconfig.Config, error) {
+		reads++
+		return nil, errors.New("secret not found")
+	}
+	if _, err = GetConfigWithRetry(context.Background(), 3, time.Millisecond); err == nil || reads != 3 {
+		t.Errorf("expected the read to fail after 3 attempts, got %d reads (err: %v)", reads, err)
+	}
+}
+
+func TestAggregateAvailableCapacity(t *testing.T) {
+	datastores := []*cnsvsphere.DatastoreInfo{
+		{Info: &vimtypes.DatastoreInfo{FreeSpace: 10 * GbInBytes}},
+		{Info: &vimtypes.DatastoreInfo{FreeSpace: 30 * GbInBytes}},
+		{Info: &vimtypes.DatastoreInfo{FreeSpace: 20 * GbInBytes}},
+	}
+	tests := []struct {
+		aggregation      string
+		expectedCapacity int64
+	}{
+		{"", 30 * GbInBytes},
+		{CapacityAggregationLargest, 30 * GbInBytes},
+		{CapacityAggregationSum, 60 * GbInBytes},
+	}
+	for _, test := range tests {
+		if capacity := AggregateAvailableCapacity(datastores, test.aggregation); capacity != test.expectedCapacity {
+			t.Errorf("aggregation %q: expected capacity %d, got %d", test.aggregation, test.expectedCapacity, capacity)
+		}
+	}
+	if capacity := AggregateAvailableCapacity(nil, CapacityAggregationLargest); capacity != 0 {
+		t.Errorf("expected no capacity without datastores, got %d", capacity)
+	}
+	if err := ValidateCapacityAggregation("average"); err == nil {
+		t.Errorf("expected unsupported capacity aggregation to be rejected")
+	}
+}
+
+func TestGetBlockVolumePublishContext(t *testing.T) {
+	diskUUID := "6000c29c0a5a3b8e7e9e6a0c12345678"
+	publishContext := GetBlockVolumePublishContext(&cnsconfig.Config{}, diskUUID)
+	if publishContext[AttributeDiskType] != DiskTypeBlockVolume ||
+		publishContext[AttributeFirstClassDiskUUID] != FormatDiskUUID(diskUUID) {
+		t.Errorf("unexpected publish context with default key names: %+v", publishContext)
+	}
+
+	cfg := &cnsconfig.Config{}
+	cfg.Global.PublishContextDiskTypeKey = "diskType"
+	cfg.Global.PublishContextDiskUUIDKey = "fcdUUID"
+	publishContext = GetBlockVolumePublishContext(cfg, diskUUID)
+	if len(publishContext) != 2 || publishContext["diskType"] != DiskTypeBlockVolume ||
+		publishContext["fcdUUID"] != FormatDiskUUID(diskUUID) {
+		t.Errorf("unexpected publish context with renamed keys: %+v", publishContext)
+	}
+	cfg.Global.DiskUUIDFormat = DiskUUIDFormatDashedUpper
+	publishContext = GetBlockVolumePublishContext(cfg, diskUUID)
+	if publishContext["fcdUUID"] != "6000C29C-0A5A-3B8E-7E9E-6A0C12345678" {
+		t.Errorf("unexpected disk UUID with format %q: %q", DiskUUIDFormatDashedUpper, publishContext["fcdUUID"])
+	}
+}
+
+func TestFormatDiskUUIDAs(t *testing.T) {
+	uuid := "6000C29C0a5a3b8e 7e9e6a0c-12345678"
+	tests := []struct {
+		format       string
+		expectedUUID string
+	}{
+		{"", "6000c29c0a5a3b8e7e9e6a0c12345678"},
+		{DiskUUIDFormatCompact, "6000c29c0a5a3b8e7e9e6a0c12345678"},
+		{DiskUUIDFormatCompactUpper, "6000C29C0A5A3B8E7E9E6A0C12345678"},
+		{DiskUUIDFormatDashed, "6000c29c-0a5a-3b8e-7e9e-6a0c12345678"},
+		{DiskUUIDFormatDashedUpper, "6000C29C-0A5A-3B8E-7E9E-6A0C12345678"},
+	}
+	for _, test := range tests {
+		if err := ValidateDiskUUIDFormat(test.format); err != nil {
+			t.Errorf("expected disk UUID format %q to be valid. err: %v", test.format, err)
+		}
+		formattedUUID := FormatDiskUUIDAs(uuid, test.format)
+		if formattedUUID != test.expectedUUID {
+			t.Errorf("format %q: expected %q, got %q", test.format, test.expectedUUID, formattedUUID)
+		}
+		// Every format converts back to the format of the disk IDs on the node
+		if FormatDiskUUIDAs(formattedUUID, DiskUUIDFormatCompact) != FormatDiskUUID(uuid) {
+			t.Errorf("format %q: expected %q to convert back to %q", test.format, formattedUUID, FormatDiskUUID(uuid))
+		}
+	}
+	// UUIDs without 32 hex digits are not dashed
+	if formattedUUID := FormatDiskUUIDAs("abc-def", DiskUUIDFormatDashed); formattedUUID != "abcdef" {
+		t.Errorf("expected a short UUID not to be dashed, got %q", formattedUUID)
+	}
+	if err := ValidateDiskUUIDFormat("braces"); err == nil {
+		t.Error("expected disk UUID format \"braces\" to be rejected")
+	}
+}
@@ -0,0 +1,349 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
+)
+
+// volumeInventoryQueryLimit is the number of volumes queried from CNS at once
+// when the volume inventory is refreshed.
+const volumeInventoryQueryLimit = 500
+
+// VolumeInventory is an in-memory cache of the CNS volumes of the clusters managed
+// by the controller, keyed by volume ID and by cluster ID and volume name. It is
+// refreshed periodically from CNS, so that ListVolumes doesn't query all the volumes
+// from CNS every time. As volumes can be deleted, expanded or created by other
+// controllers without the inventory noticing, its volumes are only hints which
+// callers verify against CNS, and a volume missing in it may exist. The volumes
+// created or changed by the controller since the last refresh are marked stale,
+// and are queried from CNS until the next refresh. The inventory is not populated
+// until its first refresh, and after it is invalidated. A nil VolumeInventory is
+// never populated.
+type VolumeInventory struct {
+	mutex     sync.RWMutex
+	populated bool
+	volumes   map[string]cnstypes.CnsVolume
+	names     map[string]string
+	// stale holds the IDs of the volumes created or changed since the last refresh.
+	stale map[string]bool
+	// generation is incremented when the inventory is invalidated, so that a
+	// refresh started before doesn't populate it with volumes queried with the
+	// previous configuration.
+	generation uint64
+	refreshing bool
+	// changed and removed hold the volumes created or changed and deleted while a
+	// refresh is in progress, which the volumes queried by the refresh may not reflect.
+	changed map[string]bool
+	removed map[string]bool
+}
+
+// NewVolumeInventory returns an empty VolumeInventory.
+func NewVolumeInventory() *VolumeInventory {
+	return &VolumeInventory{
+		volumes: make(map[string]cnstypes.CnsVolume),
+		names:   make(map[string]string),
+		stale:   make(map[string]bool),
+	}
+}
+
+// volumeNameKey returns the key of the volume with the given name in the cluster
+// with the given ID.
+func volumeNameKey(clusterID string, name string) string {
+	return clusterID + "/" + name
+}
+
+// getVolumeClusterIDs returns the IDs of the clusters the given volume belongs to.
+func getVolumeClusterIDs(volume cnstypes.CnsVolume) []string {
+	var clusterIDs []string
+	if volume.Metadata.ContainerCluster.ClusterId != "" {
+		clusterIDs = append(clusterIDs, volume.Metadata.ContainerCluster.ClusterId)
+	}
+	for _, containerCluster := range volume.Metadata.ContainerClusterArray {
+		if containerCluster.ClusterId != "" && containerCluster.ClusterId != volume.Metadata.ContainerCluster.ClusterId {
+			clusterIDs = append(clusterIDs, containerCluster.ClusterId)
+		}
+	}
+	return clusterIDs
+}
+
+// GetManagedClusterIDs returns cluster-id and additional-cluster-ids from the config
+// of the given manager.
+func GetManagedClusterIDs(manager *Manager) []string {
+	clusterIDs := []string{manager.CnsConfig.Global.ClusterID}
+	for _, clusterID := range strings.Split(manager.CnsConfig.Global.AdditionalClusterIDs, ",") {
+		if clusterID = strings.TrimSpace(clusterID); clusterID != "" {
+			clusterIDs = append(clusterIDs, clusterID)
+		}
+	}
+	return clusterIDs
+}
+
+// Refresh replaces the volumes in the inventory with the volumes of the clusters
+// managed by the controller queried from CNS. Returns without querying CNS if
+// another refresh is in progress.
+func (i *VolumeInventory) Refresh(ctx context.Context, manager *Manager) error {
+	if i == nil {
+		return nil
+	}
+	log := logger.GetLogger(ctx)
+	i.mutex.Lock()
+	if i.refreshing {
+		i.mutex.Unlock()
+		log.Debugf("volume inventory refresh already in progress")
+		return nil
+	}
+	i.refreshing = true
+	i.changed = make(map[string]bool)
+	i.removed = make(map[string]bool)
+	generation := i.generation
+	i.mutex.Unlock()
+
+	start := time.Now()
+	volumes, err := queryClusterVolumes(ctx, manager)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	changed, removed := i.changed, i.removed
+	i.refreshing = false
+	i.changed = nil
+	i.removed = nil
+	if err != nil {
+		log.Errorf("failed to refresh the volume inventory. err: %+v", err)
+		return err
+	}
+	// The inventory is emptied if a volume is reported on multiple datastores, so
+	// that the callers query CNS and report the ambiguity instead of picking one
+	if volumeID, datastoreURLs := findDuplicateVolumeID(volumes); volumeID != "" {
+		i.populated = false
+		i.volumes = make(map[string]cnstypes.CnsVolume)
+		i.names = make(map[string]string)
+		i.stale = make(map[string]bool)
+		err = newUtilError(ErrDuplicateVolumeID, "volume %q is reported by CNS on multiple datastores %v",
+			volumeID, datastoreURLs)
+		log.Errorf("failed to refresh the volume inventory. err: %+v", err)
+		return err
+	}
+	if i.generation != generation {
+		log.Infof("volume inventory was invalidated during the refresh, discarding the %d queried volumes", len(volumes))
+		return nil
+	}
+	i.volumes = make(map[string]cnstypes.CnsVolume)
+	i.names = make(map[string]string)
+	for _, volume := range volumes {
+		if !removed[volume.VolumeId.Id] {
+			i.add(volume)
+		}
+	}
+	i.stale = changed
+	i.populated = true
+	log.Debugf("refreshed the volume inventory with %d volumes in %v", len(i.volumes), time.Since(start))
+	return nil
+}
+
+// queryClusterVolumes returns the CNS volumes of the clusters managed by the
+// controller, querying them from CNS page by page.
+func queryClusterVolumes(ctx context.Context, manager *Manager) ([]cnstypes.CnsVolume, error) {
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: GetManagedClusterIDs(manager),
+		Cursor: &cnstypes.CnsCursor{
+			Limit: volumeInventoryQueryLimit,
+		},
+	}
+	var volumes []cnstypes.CnsVolume
+	for {
+		queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+		if err != nil {
+			return nil, err
+		}
+		if queryResult == nil {
+			break
+		}
+		volumes = append(volumes, queryResult.Volumes...)
+		if len(queryResult.Volumes) == 0 || queryResult.Cursor.Offset >= queryResult.Cursor.TotalRecords {
+			break
+		}
+		queryFilter.Cursor = &queryResult.Cursor
+	}
+	return volumes, nil
+}
+
+// refreshPeriodically refreshes the inventory every interval until the given
+// context is done.
+func (i *VolumeInventory) refreshPeriodically(ctx context.Context, manager *Manager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_ = i.Refresh(ctx, manager)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// StartVolumeInventory returns a VolumeInventory of the volumes managed by the given
+// manager which is refreshed every interval until the given context is done, or
+// nil if the interval is not positive.
+func StartVolumeInventory(ctx context.Context, manager *Manager, interval time.Duration) *VolumeInventory {
+	if interval <= 0 {
+		return nil
+	}
+	inventory := NewVolumeInventory()
+	go inventory.refreshPeriodically(ctx, manager, interval)
+	return inventory
+}
+
+// add adds the given volume to the inventory. The mutex must be held.
+func (i *VolumeInventory) add(volume cnstypes.CnsVolume) {
+	i.volumes[volume.VolumeId.Id] = volume
+	for _, clusterID := range getVolumeClusterIDs(volume) {
+		i.names[volumeNameKey(clusterID, volume.Name)] = volume.VolumeId.Id
+	}
+}
+
+// MarkStale marks the volume with the given ID, which was just created or changed,
+// e.g. expanded, as stale, so that it is queried from CNS until the next refresh.
+func (i *VolumeInventory) MarkStale(volumeID string) {
+	if i == nil {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.refreshing {
+		i.changed[volumeID] = true
+	}
+	i.stale[volumeID] = true
+}
+
+// Remove removes the volume with the given ID, which was just deleted, from the
+// inventory.
+func (i *VolumeInventory) Remove(volumeID string) {
+	if i == nil {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.refreshing {
+		delete(i.changed, volumeID)
+		i.removed[volumeID] = true
+	}
+	delete(i.stale, volumeID)
+	volume, ok := i.volumes[volumeID]
+	if !ok {
+		return
+	}
+	delete(i.volumes, volumeID)
+	for _, clusterID := range getVolumeClusterIDs(volume) {
+		if key := volumeNameKey(clusterID, volume.Name); i.names[key] == volumeID {
+			delete(i.names, key)
+		}
+	}
+}
+
+// Invalidate empties the inventory until its next refresh, e.g. after the
+// configuration of the controller changed.
+func (i *VolumeInventory) Invalidate() {
+	if i == nil {
+		return
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.generation++
+	i.populated = false
+	i.volumes = make(map[string]cnstypes.CnsVolume)
+	i.names = make(map[string]string)
+	i.stale = make(map[string]bool)
+}
+
+// Populated returns true if the inventory holds the volumes queried by its last
+// refresh.
+func (i *VolumeInventory) Populated() bool {
+	if i == nil {
+		return false
+	}
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.populated
+}
+
+// GetByName returns the volume with the given name in the cluster with the given
+// ID, as a hint to verify against CNS. Returns false if the inventory is not
+// populated, doesn't hold the volume or the volume is stale, in which case CNS
+// should be queried for it.
+func (i *VolumeInventory) GetByName(clusterID string, name string) (cnstypes.CnsVolume, bool) {
+	if i == nil {
+		return cnstypes.CnsVolume{}, false
+	}
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	volumeID, ok := i.names[volumeNameKey(clusterID, name)]
+	if !ok || !i.populated || i.stale[volumeID] {
+		return cnstypes.CnsVolume{}, false
+	}
+	volume, ok := i.volumes[volumeID]
+	return volume, ok
+}
+
+// GetByID returns the volume with the given ID, as a hint to verify against CNS.
+// Returns false if the inventory is not populated, doesn't hold the volume or the
+// volume is stale.
+func (i *VolumeInventory) GetByID(volumeID string) (cnstypes.CnsVolume, bool) {
+	if i == nil {
+		return cnstypes.CnsVolume{}, false
+	}
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if !i.populated || i.stale[volumeID] {
+		return cnstypes.CnsVolume{}, false
+	}
+	volume, ok := i.volumes[volumeID]
+	return volume, ok
+}
+
+// List returns the volumes in the inventory which are not stale along with the IDs
+// of the stale volumes, which should be queried from CNS, or false if the inventory
+// is not populated.
+func (i *VolumeInventory) List() ([]cnstypes.CnsVolume, []string, bool) {
+	if i == nil {
+		return nil, nil, false
+	}
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	if !i.populated {
+		return nil, nil, false
+	}
+	volumes := make([]cnstypes.CnsVolume, 0, len(i.volumes))
+	for volumeID, volume := range i.volumes {
+		if !i.stale[volumeID] {
+			volumes = append(volumes, volume)
+		}
+	}
+	staleVolumeIDs := make([]string, 0, len(i.stale))
+	for volumeID := range i.stale {
+		staleVolumeIDs = append(staleVolumeIDs, volumeID)
+	}
+	return volumes, staleVolumeIDs, true
+}
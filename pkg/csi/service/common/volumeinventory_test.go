@@ -0,0 +1,193 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+// fakeInventoryVolumeManager is a volume manager which only implements QueryVolume,
+// counting the queries and calling onQuery before returning the volumes.
+type fakeInventoryVolumeManager struct {
+	cnsvolume.Manager
+	volumes []cnstypes.CnsVolume
+	queries int
+	onQuery func()
+}
+
+func (f *fakeInventoryVolumeManager) QueryVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (
+	*cnstypes.CnsQueryResult, error) {
+	f.queries++
+	if f.onQuery != nil {
+		f.onQuery()
+	}
+	var volumes []cnstypes.CnsVolume
+	for _, volume := range f.volumes {
+		if (len(queryFilter.Names) == 0 || queryFilter.Names[0] == volume.Name) &&
+			(len(queryFilter.VolumeIds) == 0 || queryFilter.VolumeIds[0] == volume.VolumeId) {
+			volumes = append(volumes, volume)
+		}
+	}
+	return &cnstypes.CnsQueryResult{Volumes: volumes}, nil
+}
+
+func newClusterVolume(volumeID string, name string, clusterID string) cnstypes.CnsVolume {
+	return cnstypes.CnsVolume{
+		VolumeId:        cnstypes.CnsVolumeId{Id: volumeID},
+		Name:            name,
+		StoragePolicyId: "gold",
+		Metadata: cnstypes.CnsVolumeMetadata{
+			ContainerCluster: cnstypes.CnsContainerCluster{ClusterId: clusterID},
+		},
+	}
+}
+
+func TestVolumeInventory(t *testing.T) {
+	volumeManager := &fakeInventoryVolumeManager{
+		volumes: []cnstypes.CnsVolume{
+			newClusterVolume("vol-1", "pvc-1", "cluster"),
+			newClusterVolume("vol-2", "pvc-2", "cluster"),
+		},
+	}
+	cfg := &config.Config{}
+	cfg.Global.ClusterID = "cluster"
+	cfg.Global.DuplicateVolumeNamePolicy = DuplicateVolumeNameFail
+	inventory := NewVolumeInventory()
+	manager := &Manager{CnsConfig: cfg, VolumeManager: volumeManager, VolumeInventory: inventory}
+
+	// Misses until the inventory is refreshed
+	if _, ok := inventory.GetByName("cluster", "pvc-1"); ok {
+		t.Error("expected a miss before the inventory is refreshed")
+	}
+	if _, _, ok := inventory.List(); ok {
+		t.Error("expected the inventory not to be populated before it is refreshed")
+	}
+	if err := inventory.Refresh(context.Background(), manager); err != nil {
+		t.Fatal(err)
+	}
+	if volume, ok := inventory.GetByName("cluster", "pvc-1"); !ok || volume.VolumeId.Id != "vol-1" {
+		t.Errorf("expected a hit for pvc-1, got %v, %v", volume.VolumeId.Id, ok)
+	}
+	if _, ok := inventory.GetByName("other-cluster", "pvc-1"); ok {
+		t.Error("expected a miss for the volume name of another cluster")
+	}
+	if volume, ok := inventory.GetByID("vol-2"); !ok || volume.Name != "pvc-2" {
+		t.Errorf("expected a hit for vol-2, got %v, %v", volume.Name, ok)
+	}
+	if volumes, _, ok := inventory.List(); !ok || len(volumes) != 2 {
+		t.Errorf("expected 2 volumes, got %d, %v", len(volumes), ok)
+	}
+
+	// The volumes of the inventory are verified against CNS, and the volumes missing
+	// in it are queried from CNS, e.g. when they were created by another controller
+	volumeManager.volumes = append(volumeManager.volumes, newClusterVolume("vol-3", "pvc-3", "cluster"))
+	for name, expectedVolumeID := range map[string]string{"pvc-1": "vol-1", "pvc-3": "vol-3", "pvc-4": ""} {
+		spec := &CreateVolumeSpec{Name: name, StoragePolicyID: "gold"}
+		if volumeID, err := getExistingBlockVolume(ctx, manager, nil, spec); err != nil || volumeID != expectedVolumeID {
+			t.Errorf("expected volume %q for %q, got %q (err: %v)", expectedVolumeID, name, volumeID, err)
+		}
+	}
+
+	// A volume deleted without the inventory noticing is not returned
+	volumeManager.volumes = volumeManager.volumes[1:]
+	spec := &CreateVolumeSpec{Name: "pvc-1", StoragePolicyID: "gold"}
+	if volumeID, err := getExistingBlockVolume(ctx, manager, nil, spec); err != nil || volumeID != "" {
+		t.Errorf("expected no volume for the deleted pvc-1, got %q (err: %v)", volumeID, err)
+	}
+	if _, ok := inventory.GetByID("vol-1"); ok {
+		t.Error("expected the deleted volume to be removed from the inventory")
+	}
+
+	// The volumes created or changed since the last refresh are stale
+	inventory.MarkStale("vol-2")
+	inventory.MarkStale("vol-3")
+	if _, ok := inventory.GetByName("cluster", "pvc-2"); ok {
+		t.Error("expected a miss for the stale volume")
+	}
+	volumes, staleVolumeIDs, ok := inventory.List()
+	if !ok || len(volumes) != 0 || len(staleVolumeIDs) != 2 {
+		t.Errorf("expected 2 stale volumes and no other volume, got %v and %v, %v", staleVolumeIDs, volumes, ok)
+	}
+	if err := inventory.Refresh(context.Background(), manager); err != nil {
+		t.Fatal(err)
+	}
+	if volumes, staleVolumeIDs, ok = inventory.List(); !ok || len(volumes) != 2 || len(staleVolumeIDs) != 0 {
+		t.Errorf("expected 2 volumes and no stale volume after the refresh, got %v and %v, %v", volumes, staleVolumeIDs, ok)
+	}
+
+	// Invalidation empties the inventory until the next refresh
+	inventory.Invalidate()
+	if _, ok := inventory.GetByName("cluster", "pvc-2"); ok {
+		t.Error("expected a miss after the inventory is invalidated")
+	}
+
+	// A nil inventory is never populated
+	var nilInventory *VolumeInventory
+	nilInventory.MarkStale("vol-4")
+	nilInventory.Remove("vol-4")
+	nilInventory.Invalidate()
+	if _, ok := nilInventory.GetByName("cluster", "pvc-4"); ok || nilInventory.Populated() {
+		t.Error("expected a nil inventory not to be populated")
+	}
+}
+
+func TestVolumeInventoryChangesDuringRefresh(t *testing.T) {
+	volumeManager := &fakeInventoryVolumeManager{
+		volumes: []cnstypes.CnsVolume{newClusterVolume("vol-1", "pvc-1", "cluster")},
+	}
+	cfg := &config.Config{}
+	cfg.Global.ClusterID = "cluster"
+	inventory := NewVolumeInventory()
+	manager := &Manager{CnsConfig: cfg, VolumeManager: volumeManager, VolumeInventory: inventory}
+
+	// Volumes deleted while CNS is queried are dropped, and volumes created are stale
+	volumeManager.onQuery = func() {
+		inventory.Remove("vol-1")
+		inventory.MarkStale("vol-2")
+	}
+	if err := inventory.Refresh(context.Background(), manager); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := inventory.GetByID("vol-1"); ok {
+		t.Error("expected the volume deleted during the refresh not to be in the inventory")
+	}
+	if _, staleVolumeIDs, _ := inventory.List(); len(staleVolumeIDs) != 1 || staleVolumeIDs[0] != "vol-2" {
+		t.Errorf("expected the volume created during the refresh to be stale, got %v", staleVolumeIDs)
+	}
+
+	// Volumes queried before an invalidation are discarded
+	volumeManager.onQuery = inventory.Invalidate
+	if err := inventory.Refresh(context.Background(), manager); err != nil {
+		t.Fatal(err)
+	}
+	if inventory.Populated() {
+		t.Error("expected the inventory invalidated during the refresh not to be populated")
+	}
+	volumeManager.onQuery = nil
+	if err := inventory.Refresh(context.Background(), manager); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := inventory.GetByID("vol-1"); !ok {
+		t.Error("expected the volume to be in the inventory after the next refresh")
+	}
+}
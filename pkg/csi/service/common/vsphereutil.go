@@ -19,6 +19,11 @@ package common
 import (
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	cnstypes "github.com/vmware/govmomi/cns/types"
@@ -30,10 +35,52 @@ import (
 	vsanfstypes "github.com/vmware/govmomi/vsan/vsanfs/types"
 	"golang.org/x/net/context"
 
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
 )
 
+var (
+	// cnsRetryCount is the number of attempts made for a CNS operation which
+	// fails with a retryable fault.
+	cnsRetryCount = 3
+	// cnsRetryInterval is the interval between the attempts of a CNS operation.
+	cnsRetryInterval = 5 * time.Second
+	// deleteVerificationRetryCount is the number of times CNS is queried to verify
+	// that a deleted volume is gone.
+	deleteVerificationRetryCount = 3
+	// deleteVerificationRetryInterval is the interval between the queries verifying
+	// that a deleted volume is gone.
+	deleteVerificationRetryInterval = time.Second
+	// attachBusyRetryInterval is the initial interval between the attempts of an
+	// attach while the VM is busy. The interval is doubled after each attempt.
+	attachBusyRetryInterval = 2 * time.Second
+	// isRetryableError returns true if an operation failed with a fault which is
+	// treated as transient.
+	isRetryableError = cnsvolume.IsRetryableError
+	// isResourceBusyError returns true if an operation failed as the entity it
+	// was performed on is locked by another operation.
+	isResourceBusyError = cnsvolume.IsResourceBusyError
+	// isPlacementError returns true if a volume creation failed as the datastore
+	// chosen for the volume cannot hold it.
+	isPlacementError = cnsvolume.IsPlacementError
+	// datastoreSelectionRand shuffles the shared datastores with the "random"
+	// datastore-selection. Tests replace it with a seeded source so that the
+	// order is deterministic.
+	datastoreSelectionRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	// datastoreSelectionNext is the offset the shared datastores are rotated by
+	// with the "round-robin" datastore-selection.
+	datastoreSelectionNext int
+	// datastoreSelectionLock protects datastoreSelectionRand and datastoreSelectionNext.
+	datastoreSelectionLock sync.Mutex
+)
+
+const (
+	// defaultAttachBusyRetryCount is the number of times an attach is retried
+	// while the VM is busy, if not set in the config.
+	defaultAttachBusyRetryCount = 3
+)
+
 // CreateBlockVolumeUtil is the helper function to create CNS block volume.
 func CreateBlockVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsClusterFlavor, manager *Manager, spec *CreateVolumeSpec, sharedDatastores []*vsphere.DatastoreInfo) (string, error) {
 	log := logger.GetLogger(ctx)
@@ -52,13 +99,43 @@ func CreateBlockVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluste
 		spec.StoragePolicyID, err = vc.GetStoragePolicyIDByName(ctx, spec.ScParams.StoragePolicyName)
 		if err != nil {
 			log.Errorf("Error occurred while getting Profile Id from Profile Name: %s, err: %+v", spec.ScParams.StoragePolicyName, err)
+			if errors.Is(err, vsphere.ErrStoragePolicyNotFound) {
+				RecordCreateVolumeRejection(CreateVolumeRejectionPolicy)
+			}
 			return "", err
 		}
 	}
+	if manager.CnsConfig.Global.DuplicateVolumeNamePolicy != "" {
+		volumeID, err := getExistingBlockVolume(ctx, manager, vc, spec)
+		if err != nil || volumeID != "" {
+			return volumeID, err
+		}
+	}
 	var datastores []vim25types.ManagedObjectReference
+	var placements [][]vim25types.ManagedObjectReference
+	// candidates are the datastores the volume can be placed on, in order
+	var candidates []*vsphere.DatastoreInfo
 	if spec.ScParams.DatastoreURL == "" {
+		sharedDatastores, err = filterUnhealthyDatastores(ctx, vc, sharedDatastores)
+		if err != nil {
+			log.Errorf("failed to filter unhealthy datastores, err: %+v", err)
+			return "", err
+		}
+		if len(sharedDatastores) == 0 {
+			return "", newUtilError(ErrNoEligibleDatastore, "no healthy shared datastores found to create the volume")
+		}
+		if spec.ScParams.AntiAffinityGroup != "" {
+			sharedDatastores, err = getAntiAffinityDatastores(ctx, manager, spec.ScParams.AntiAffinityGroup, sharedDatastores)
+			if err != nil {
+				log.Errorf("failed to get datastores for anti-affinity group %q, err: %+v", spec.ScParams.AntiAffinityGroup, err)
+				return "", err
+			}
+		}
+		sharedDatastores = orderDatastoresForSelection(sharedDatastores, manager.CnsConfig.Global.DatastoreSelection)
 		//  If DatastoreURL is not specified in StorageClass, get all shared datastores
 		datastores = getDatastoreMoRefs(sharedDatastores)
+		placements = getPlacementCandidates(sharedDatastores)
+		candidates = sharedDatastores
 	} else {
 		// Check datastore specified in the StorageClass should be shared datastore across all nodes.
 
@@ -80,8 +157,9 @@ func CreateBlockVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluste
 				continue
 			}
 			for _, sharedDatastore := range sharedDatastores {
-				if sharedDatastore.Info.Url == spec.ScParams.DatastoreURL {
+				if vsphere.NormalizeDatastoreURL(sharedDatastore.Info.Url) == vsphere.NormalizeDatastoreURL(spec.ScParams.DatastoreURL) {
 					isSharedDatastoreURL = true
+					candidates = []*vsphere.DatastoreInfo{sharedDatastore}
 					break
 				}
 			}
@@ -92,18 +170,23 @@ func CreateBlockVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluste
 		if datastoreObj == nil {
 			errMsg := fmt.Sprintf("DatastoreURL: %s specified in the storage class is not found.", spec.ScParams.DatastoreURL)
 			log.Errorf(errMsg)
-			return "", errors.New(errMsg)
+			return "", newUtilError(ErrDatastoreNotFound, "%s", errMsg)
 		}
 		if isSharedDatastoreURL {
 			datastores = append(datastores, datastoreObj.Reference())
+			placements = append(placements, datastores)
 		} else {
 			errMsg := fmt.Sprintf("Datastore: %s specified in the storage class is not accessible to all nodes.", spec.ScParams.DatastoreURL)
 			log.Errorf(errMsg)
-			return "", errors.New(errMsg)
+			return "", newUtilError(ErrDatastoreNotAccessible, "%s", errMsg)
 		}
 	}
+	clusterID := manager.CnsConfig.Global.ClusterID
+	if spec.ClusterID != "" {
+		clusterID = spec.ClusterID
+	}
 	var containerClusterArray []cnstypes.CnsContainerCluster
-	containerCluster := vsphere.GetContainerCluster(manager.CnsConfig.Global.ClusterID, manager.CnsConfig.VirtualCenter[vc.Config.Host].User, clusterFlavor)
+	containerCluster := vsphere.GetContainerCluster(clusterID, manager.CnsConfig.VirtualCenter[vc.Config.Host].User, clusterFlavor)
 	containerClusterArray = append(containerClusterArray, containerCluster)
 	createSpec := &cnstypes.CnsVolumeCreateSpec{
 		Name:       spec.Name,
@@ -119,6 +202,14 @@ func CreateBlockVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluste
 			ContainerClusterArray: containerClusterArray,
 		},
 	}
+	if labels := getCreateVolumeLabels(manager, spec); len(labels) > 0 {
+		createSpec.Metadata.EntityMetadata = append(createSpec.Metadata.EntityMetadata,
+			vsphere.GetCnsKubernetesEntityMetaData(spec.Name, labels, false, string(cnstypes.CnsKubernetesEntityTypePV),
+				"", clusterID, nil))
+	}
+	if pvcMetadata := getCreateVolumePVCMetadata(spec, clusterID); pvcMetadata != nil {
+		createSpec.Metadata.EntityMetadata = append(createSpec.Metadata.EntityMetadata, pvcMetadata)
+	}
 	if spec.StoragePolicyID != "" {
 		profileSpec := &vim25types.VirtualMachineDefinedProfileSpec{
 			ProfileId: spec.StoragePolicyID,
@@ -138,14 +229,255 @@ func CreateBlockVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluste
 	}
 
 	log.Debugf("vSphere CNS driver creating volume %s with create spec %+v", spec.Name, spew.Sdump(createSpec))
-	volumeID, err := manager.VolumeManager.CreateVolume(ctx, createSpec)
+	var volumeID *cnstypes.CnsVolumeId
+	if manager.DatastoreReservations != nil {
+		volumeID, err = createVolumeOnReservedDatastore(ctx, manager, createSpec, candidates, spec.CapacityMB)
+	} else {
+		volumeID, err = createVolumeWithPlacementRetry(ctx, manager, createSpec, placements)
+	}
 	if err != nil {
 		log.Errorf("failed to create disk %s with error %+v", spec.Name, err)
+		if errors.Is(err, cnsvolume.ErrProvisioningRateLimited) {
+			RecordCreateVolumeRejection(CreateVolumeRejectionRate)
+		}
 		return "", err
 	}
+	manager.VolumeInventory.MarkStale(volumeID.Id)
 	return volumeID.Id, nil
 }
 
+// getDatastoreByURL is used to look up the managed object reference of a datastore.
+// It is a variable so that tests can replace it.
+var getDatastoreByURL = getDatastore
+
+// getExistingBlockVolume returns the ID of the volume of the cluster with the name of
+// the new volume, or an empty ID if there is none. If the existing volume has a
+// different capacity than the requested one, an error wrapping ErrVolumeAlreadyExists
+// is returned. If it has a different storage policy than the requested one, it is
+// either reconfigured to the requested policy or an error wrapping
+// ErrVolumeAlreadyExists is returned, depending on the duplicate-volume-name-policy. The volume found in the volume inventory, if
+// any, is verified against CNS, and CNS is queried by name otherwise.
+func getExistingBlockVolume(ctx context.Context, manager *Manager, vc *vsphere.VirtualCenter,
+	spec *CreateVolumeSpec) (string, error) {
+	log := logger.GetLogger(ctx)
+	clusterID := manager.CnsConfig.Global.ClusterID
+	if spec.ClusterID != "" {
+		clusterID = spec.ClusterID
+	}
+	var volumes []cnstypes.CnsVolume
+	if hint, ok := manager.VolumeInventory.GetByName(clusterID, spec.Name); ok {
+		queryFilter := cnstypes.CnsQueryFilter{
+			VolumeIds: []cnstypes.CnsVolumeId{hint.VolumeId},
+		}
+		queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+		if err != nil {
+			log.Errorf("failed to query volume %q with name %q, err: %+v", hint.VolumeId.Id, spec.Name, err)
+			return "", err
+		}
+		for _, volume := range queryResult.Volumes {
+			if volume.Name == spec.Name {
+				volumes = append(volumes, volume)
+			}
+		}
+		if len(volumes) == 0 {
+			log.Debugf("volume %q with name %q in the volume inventory no longer exists", hint.VolumeId.Id, spec.Name)
+			manager.VolumeInventory.Remove(hint.VolumeId.Id)
+		}
+	}
+	if len(volumes) == 0 {
+		queryFilter := cnstypes.CnsQueryFilter{
+			Names:               []string{spec.Name},
+			ContainerClusterIds: []string{clusterID},
+		}
+		queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+		if err != nil {
+			log.Errorf("failed to query volumes with name %q, err: %+v", spec.Name, err)
+			return "", err
+		}
+		volumes = queryResult.Volumes
+	}
+	if len(volumes) == 0 {
+		return "", nil
+	}
+	if volumeID, datastoreURLs := findDuplicateVolumeID(volumes); volumeID != "" {
+		return "", newUtilError(ErrDuplicateVolumeID, "volume %q with name %q is reported by CNS on multiple "+
+			"datastores %v, refusing to pick one of them", volumeID, spec.Name, datastoreURLs)
+	}
+	volume := volumes[0]
+	if volume.BackingObjectDetails != nil {
+		capacityInMb := volume.BackingObjectDetails.(cnstypes.BaseCnsBackingObjectDetails).GetCnsBackingObjectDetails().CapacityInMb
+		if capacityInMb != spec.CapacityMB {
+			return "", newUtilError(ErrVolumeAlreadyExists, "volume %q with name %q already exists with capacity %d MB "+
+				"instead of the requested %d MB", volume.VolumeId.Id, spec.Name, capacityInMb, spec.CapacityMB)
+		}
+	}
+	if spec.StoragePolicyID == "" || volume.StoragePolicyId == spec.StoragePolicyID {
+		log.Infof("volume %q with name %q already exists, returning it", volume.VolumeId.Id, spec.Name)
+		return volume.VolumeId.Id, nil
+	}
+	if manager.CnsConfig.Global.DuplicateVolumeNamePolicy != DuplicateVolumeNameReconfigure {
+		return "", newUtilError(ErrVolumeAlreadyExists, "volume %q with name %q already exists with storage policy %q "+
+			"instead of the requested %q", volume.VolumeId.Id, spec.Name, volume.StoragePolicyId, spec.StoragePolicyID)
+	}
+	datastore, err := getDatastoreByURL(ctx, vc, volume.DatastoreUrl)
+	if err != nil {
+		log.Errorf("failed to find datastore %q of volume %q, err: %+v", volume.DatastoreUrl, volume.VolumeId.Id, err)
+		return "", err
+	}
+	log.Infof("volume %q with name %q already exists with storage policy %q, reconfiguring it to %q",
+		volume.VolumeId.Id, spec.Name, volume.StoragePolicyId, spec.StoragePolicyID)
+	err = manager.VolumeManager.UpdateVolumePolicy(ctx, volume.VolumeId.Id, datastore, spec.StoragePolicyID)
+	if err != nil {
+		log.Errorf("failed to reconfigure volume %q to storage policy %q, err: %+v",
+			volume.VolumeId.Id, spec.StoragePolicyID, err)
+		return "", err
+	}
+	manager.VolumeInventory.MarkStale(volume.VolumeId.Id)
+	return volume.VolumeId.Id, nil
+}
+
+// findDuplicateVolumeID returns the ID of a volume which the given CNS volumes hold
+// on more than one datastore along with the URLs of these datastores, or an empty
+// ID if every volume is on a single datastore.
+func findDuplicateVolumeID(volumes []cnstypes.CnsVolume) (string, []string) {
+	datastores := make(map[string]map[string]bool)
+	datastoreURLs := make(map[string][]string)
+	for _, volume := range volumes {
+		volumeID := volume.VolumeId.Id
+		if datastores[volumeID] == nil {
+			datastores[volumeID] = make(map[string]bool)
+		}
+		if !datastores[volumeID][volume.DatastoreUrl] {
+			datastores[volumeID][volume.DatastoreUrl] = true
+			datastoreURLs[volumeID] = append(datastoreURLs[volumeID], volume.DatastoreUrl)
+		}
+	}
+	for _, volume := range volumes {
+		if urls := datastoreURLs[volume.VolumeId.Id]; len(urls) > 1 {
+			return volume.VolumeId.Id, urls
+		}
+	}
+	return "", nil
+}
+
+// getPlacementCandidates returns the datastores to attempt the creation of a block
+// volume on, in order. The first attempt lets CNS pick any of the given datastores.
+// If there is more than one datastore, each of them is attempted on its own after
+// that, the one with the most free space first.
+func getPlacementCandidates(datastores []*vsphere.DatastoreInfo) [][]vim25types.ManagedObjectReference {
+	placements := [][]vim25types.ManagedObjectReference{getDatastoreMoRefs(datastores)}
+	if len(datastores) <= 1 {
+		return placements
+	}
+	sorted := append([]*vsphere.DatastoreInfo{}, datastores...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Info.FreeSpace > sorted[j].Info.FreeSpace
+	})
+	for _, datastore := range sorted {
+		placements = append(placements, []vim25types.ManagedObjectReference{datastore.Reference()})
+	}
+	return placements
+}
+
+// orderDatastoresForSelection returns the given datastores in the order they are
+// passed to CNS with the given datastore-selection, so that new volumes are not
+// always placed on the first datastore of the list.
+func orderDatastoresForSelection(datastores []*vsphere.DatastoreInfo, selection string) []*vsphere.DatastoreInfo {
+	if len(datastores) <= 1 {
+		return datastores
+	}
+	ordered := make([]*vsphere.DatastoreInfo, 0, len(datastores))
+	switch selection {
+	case DatastoreSelectionRandom:
+		datastoreSelectionLock.Lock()
+		perm := datastoreSelectionRand.Perm(len(datastores))
+		datastoreSelectionLock.Unlock()
+		for _, idx := range perm {
+			ordered = append(ordered, datastores[idx])
+		}
+	case DatastoreSelectionRoundRobin:
+		datastoreSelectionLock.Lock()
+		offset := datastoreSelectionNext % len(datastores)
+		datastoreSelectionNext++
+		datastoreSelectionLock.Unlock()
+		ordered = append(ordered, datastores[offset:]...)
+		ordered = append(ordered, datastores[:offset]...)
+	default:
+		return datastores
+	}
+	return ordered
+}
+
+// createVolumeWithPlacementRetry creates the volume of the given create spec on the
+// given placement candidates in order. The next candidate is only attempted if the
+// creation failed as the datastore chosen for the volume cannot hold it. The wait for
+// the volume is bounded by create-volume-async-wait-seconds, if set.
+func createVolumeWithPlacementRetry(ctx context.Context, manager *Manager, createSpec *cnstypes.CnsVolumeCreateSpec,
+	placements [][]vim25types.ManagedObjectReference) (*cnstypes.CnsVolumeId, error) {
+	log := logger.GetLogger(ctx)
+	createCtx := ctx
+	if wait := manager.CnsConfig.Global.CreateVolumeAsyncWaitInSec; wait > 0 {
+		var cancel context.CancelFunc
+		createCtx, cancel = context.WithTimeout(ctx, time.Duration(wait)*time.Second)
+		defer cancel()
+	}
+	var volumeID *cnstypes.CnsVolumeId
+	var err error
+	for idx, datastores := range placements {
+		createSpec.Datastores = datastores
+		err = retryOnFault(ctx, "CreateVolume", isRetryableCreateError, func() error {
+			var err error
+			volumeID, err = manager.VolumeManager.CreateVolume(createCtx, createSpec)
+			return err
+		})
+		if err == nil || !isPlacementError(err) || idx == len(placements)-1 {
+			break
+		}
+		log.Warnf("failed to place volume %q on datastores %v, attempting the next candidate. err: %+v",
+			createSpec.Name, datastores, err)
+	}
+	return volumeID, err
+}
+
+// createVolumeOnReservedDatastore creates the volume of the given create spec on the
+// first of the given datastores the capacity of the volume can be reserved on. The
+// next datastore is only attempted if the creation failed as the datastore cannot
+// hold the volume. The reservation is released once the creation completes, but held
+// while the CNS task creating the volume is still in progress.
+func createVolumeOnReservedDatastore(ctx context.Context, manager *Manager, createSpec *cnstypes.CnsVolumeCreateSpec,
+	datastores []*vsphere.DatastoreInfo, capacityInMb int64) (*cnstypes.CnsVolumeId, error) {
+	log := logger.GetLogger(ctx)
+	for {
+		datastore, err := manager.DatastoreReservations.Reserve(ctx, createSpec.Name, datastores, capacityInMb)
+		if err != nil {
+			return nil, err
+		}
+		volumeID, err := createVolumeWithPlacementRetry(ctx, manager, createSpec,
+			[][]vim25types.ManagedObjectReference{{datastore.Reference()}})
+		if errors.Is(err, cnsvolume.ErrCreateVolumeInProgress) {
+			log.Infof("holding the reservation of %d MB on datastore %q for volume %q until its creation completes",
+				capacityInMb, datastore.Info.Url, createSpec.Name)
+			return nil, err
+		}
+		manager.DatastoreReservations.Release(createSpec.Name)
+		if err == nil || !isPlacementError(err) {
+			return volumeID, err
+		}
+		var remaining []*vsphere.DatastoreInfo
+		for _, candidate := range datastores {
+			if candidate != datastore {
+				remaining = append(remaining, candidate)
+			}
+		}
+		if len(remaining) == 0 {
+			return nil, err
+		}
+		log.Warnf("failed to place volume %q on datastore %q, attempting the next candidate. err: %+v",
+			createSpec.Name, datastore.Info.Url, err)
+		datastores = remaining
+	}
+}
+
 // CreateFileVolumeUtil is the helper function to create CNS file volume.
 func CreateFileVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsClusterFlavor, manager *Manager, spec *CreateVolumeSpec) (string, error) {
 	log := logger.GetLogger(ctx)
@@ -164,6 +496,9 @@ func CreateFileVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluster
 		spec.StoragePolicyID, err = vc.GetStoragePolicyIDByName(ctx, spec.ScParams.StoragePolicyName)
 		if err != nil {
 			log.Errorf("Error occurred while getting Profile Id from Profile Name: %q, err: %+v", spec.ScParams.StoragePolicyName, err)
+			if errors.Is(err, vsphere.ErrStoragePolicyNotFound) {
+				RecordCreateVolumeRejection(CreateVolumeRejectionPolicy)
+			}
 			return "", err
 		}
 	}
@@ -195,7 +530,7 @@ func CreateFileVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluster
 			if len(datastores) == 0 {
 				msg := "No file service enabled vsan datastore is present in the environment."
 				log.Error(msg)
-				return "", errors.New(msg)
+				return "", newUtilError(ErrNoEligibleDatastore, "%s", msg)
 			}
 		} else {
 			// If DatastoreURL is not specified in StorageClass, get all datastores from TargetvSANFileShareDatastoreURLs
@@ -224,7 +559,7 @@ func CreateFileVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluster
 			// If datastoreUrl is set in storage class, then check if this is in the allowed list.
 			found := false
 			for _, targetVSANFSDsURL := range manager.VcenterConfig.TargetvSANFileShareDatastoreURLs {
-				if spec.ScParams.DatastoreURL == targetVSANFSDsURL {
+				if vsphere.NormalizeDatastoreURL(spec.ScParams.DatastoreURL) == vsphere.NormalizeDatastoreURL(targetVSANFSDsURL) {
 					found = true
 					break
 				}
@@ -233,7 +568,7 @@ func CreateFileVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluster
 				msg := fmt.Sprintf("Datastore URL %q specified in storage class is not in the allowed list %+v",
 					spec.ScParams.DatastoreURL, manager.VcenterConfig.TargetvSANFileShareDatastoreURLs)
 				log.Error(msg)
-				return "", errors.New(msg)
+				return "", newUtilError(ErrDatastoreNotAccessible, "%s", msg)
 			}
 			datastoreMoref, err := getDatastore(ctx, vc, spec.ScParams.DatastoreURL)
 			if err != nil {
@@ -277,6 +612,14 @@ func CreateFileVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluster
 			Permission:    netPerms,
 		},
 	}
+	if labels := getCreateVolumeLabels(manager, spec); len(labels) > 0 {
+		createSpec.Metadata.EntityMetadata = append(createSpec.Metadata.EntityMetadata,
+			vsphere.GetCnsKubernetesEntityMetaData(spec.Name, labels, false, string(cnstypes.CnsKubernetesEntityTypePV),
+				"", manager.CnsConfig.Global.ClusterID, nil))
+	}
+	if pvcMetadata := getCreateVolumePVCMetadata(spec, manager.CnsConfig.Global.ClusterID); pvcMetadata != nil {
+		createSpec.Metadata.EntityMetadata = append(createSpec.Metadata.EntityMetadata, pvcMetadata)
+	}
 	if spec.StoragePolicyID != "" {
 		profileSpec := &vim25types.VirtualMachineDefinedProfileSpec{
 			ProfileId: spec.StoragePolicyID,
@@ -288,11 +631,45 @@ func CreateFileVolumeUtil(ctx context.Context, clusterFlavor cnstypes.CnsCluster
 	volumeID, err := manager.VolumeManager.CreateVolume(ctx, createSpec)
 	if err != nil {
 		log.Errorf("failed to create file volume %q with error %+v", spec.Name, err)
+		if errors.Is(err, cnsvolume.ErrProvisioningRateLimited) {
+			RecordCreateVolumeRejection(CreateVolumeRejectionRate)
+		}
 		return "", err
 	}
+	manager.VolumeInventory.MarkStale(volumeID.Id)
 	return volumeID.Id, nil
 }
 
+// getCreateVolumeLabels returns the labels to be recorded in the CNS PV metadata
+// of a new volume, i.e. the anti-affinity group of the volume, used to place the
+// next volumes of the group, and the version of the cluster provisioning it.
+func getCreateVolumeLabels(manager *Manager, spec *CreateVolumeSpec) map[string]string {
+	labels := make(map[string]string)
+	if spec.ScParams.AntiAffinityGroup != "" {
+		labels[AntiAffinityGroupLabel] = spec.ScParams.AntiAffinityGroup
+	}
+	if manager.CnsConfig.Global.ClusterVersion != "" {
+		labels[ClusterVersionLabel] = manager.CnsConfig.Global.ClusterVersion
+	}
+	AddChargebackLabels(labels, manager.CnsConfig)
+	return labels
+}
+
+// getCreateVolumePVCMetadata returns the CNS PVC metadata of a new volume, or nil if
+// the PVC is not known, i.e. the external-provisioner doesn't pass the PVC name and
+// namespace. Recording it at creation lets the namespace capacity quotas count the
+// volume before the syncer updates its metadata.
+func getCreateVolumePVCMetadata(spec *CreateVolumeSpec, clusterID string) *cnstypes.CnsKubernetesEntityMetadata {
+	if spec.ScParams == nil || spec.ScParams.PVCNamespace == "" || spec.ScParams.PVCName == "" {
+		return nil
+	}
+	pvReference := vsphere.CreateCnsKuberenetesEntityReference(string(cnstypes.CnsKubernetesEntityTypePV),
+		spec.Name, "", clusterID)
+	return vsphere.GetCnsKubernetesEntityMetaData(spec.ScParams.PVCName, nil, false,
+		string(cnstypes.CnsKubernetesEntityTypePVC), spec.ScParams.PVCNamespace, clusterID,
+		[]cnstypes.CnsKubernetesEntityReference{pvReference})
+}
+
 // getHostVsanUUID returns the config.clusterInfo.nodeUuid of the ESX host's HostVsanSystem
 func getHostVsanUUID(ctx context.Context, hostMoID string, vc *vsphere.VirtualCenter) (string, error) {
 	log := logger.GetLogger(ctx)
@@ -312,19 +689,124 @@ func getHostVsanUUID(ctx context.Context, hostMoID string, vc *vsphere.VirtualCe
 	return nodeUUID, nil
 }
 
-// AttachVolumeUtil is the helper function to attach CNS volume to specified vm
+// AttachVolumeUtil is the helper function to attach CNS volume to specified vm.
+// The attach is retried with backoff while the VM is busy, up to
+// attach-busy-retry-count times, and up to cnsRetryCount attempts while it fails
+// with a retryable fault, until the given context is done.
 func AttachVolumeUtil(ctx context.Context, manager *Manager,
 	vm *vsphere.VirtualMachine,
 	volumeID string) (string, error) {
 	log := logger.GetLogger(ctx)
 	log.Debugf("vSphere CNS driver is attaching volume: %q to vm: %q", volumeID, vm.String())
-	diskUUID, err := manager.VolumeManager.AttachVolume(ctx, vm, volumeID)
+	busyRetryCount := manager.CnsConfig.Global.AttachBusyRetryCount
+	if busyRetryCount <= 0 {
+		busyRetryCount = defaultAttachBusyRetryCount
+	}
+	busyInterval := attachBusyRetryInterval
+	busyRetries := 0
+	faultAttempts := 1
+	for {
+		diskUUID, err := manager.VolumeManager.AttachVolume(ctx, vm, volumeID)
+		if err == nil {
+			log.Debugf("Successfully attached disk %s to VM %v. Disk UUID is %s", volumeID, vm, diskUUID)
+			return diskUUID, nil
+		}
+		var interval time.Duration
+		switch {
+		case isResourceBusyError(err) && busyRetries < busyRetryCount:
+			busyRetries++
+			interval = busyInterval
+			busyInterval *= 2
+			log.Warnf("VM %q is busy, retrying attach of volume %q in %v (retry %d of %d). err: %+v",
+				vm.String(), volumeID, interval, busyRetries, busyRetryCount, err)
+		case isRetryableError(err) && faultAttempts < cnsRetryCount:
+			interval = cnsRetryInterval
+			log.Warnf("AttachVolume failed with retryable fault on attempt %d of %d. Retrying in %v. err: %+v",
+				faultAttempts, cnsRetryCount, interval, err)
+			faultAttempts++
+		default:
+			log.Errorf("failed to attach disk %q with VM: %q. err: %+v", volumeID, vm.String(), err)
+			return "", err
+		}
+		if waitErr := waitForRetry(ctx, interval); waitErr != nil {
+			log.Errorf("gave up attaching disk %q to VM: %q. err: %+v", volumeID, vm.String(), err)
+			return "", err
+		}
+	}
+}
+
+// waitForRetry waits for the given interval before retrying an operation. Returns
+// the error of the given context if it is done first.
+func waitForRetry(ctx context.Context, interval time.Duration) error {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetVolumeDatastore returns the URL and the managed object reference of the
+// datastore the given CNS volume is placed on.
+func GetVolumeDatastore(ctx context.Context, manager *Manager, volumeID string) (string, string, error) {
+	log := logger.GetLogger(ctx)
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
 	if err != nil {
-		log.Errorf("failed to attach disk %q with VM: %q. err: %+v", volumeID, vm.String(), err)
-		return "", err
+		return "", "", err
+	}
+	if len(queryResult.Volumes) == 0 {
+		return "", "", newUtilError(ErrVolumeNotFound, "volumeID %q not found in QueryVolume", volumeID)
+	}
+	datastoreURL := queryResult.Volumes[0].DatastoreUrl
+	vc, err := GetVCenter(ctx, manager)
+	if err != nil {
+		return "", "", err
+	}
+	datacenters, err := vc.GetDatacenters(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	for _, datacenter := range datacenters {
+		datastore, err := datacenter.GetDatastoreByURL(ctx, datastoreURL)
+		if err != nil {
+			log.Debugf("datastore with URL %q not found in datacenter %q. err: %+v",
+				datastoreURL, datacenter.InventoryPath, err)
+			continue
+		}
+		return datastoreURL, datastore.Reference().Value, nil
+	}
+	return "", "", fmt.Errorf("datastore with URL %q of volume %q not found in VC %q",
+		datastoreURL, volumeID, vc.Config.Host)
+}
+
+// GetDatastoreFreeSpace returns the free space in bytes of the datastore with the
+// given URL, looking it up in all the datacenters of the VC.
+func GetDatastoreFreeSpace(ctx context.Context, manager *Manager, datastoreURL string) (int64, error) {
+	log := logger.GetLogger(ctx)
+	vc, err := GetVCenter(ctx, manager)
+	if err != nil {
+		return 0, err
+	}
+	datacenters, err := vc.GetDatacenters(ctx)
+	if err != nil {
+		return 0, err
 	}
-	log.Debugf("Successfully attached disk %s to VM %v. Disk UUID is %s", volumeID, vm, diskUUID)
-	return diskUUID, nil
+	for _, datacenter := range datacenters {
+		datastores, err := datacenter.GetAllDatastores(ctx)
+		if err != nil {
+			log.Debugf("failed to get datastores of datacenter %q. err: %+v", datacenter.InventoryPath, err)
+			continue
+		}
+		if datastore, ok := datastores[datastoreURL]; ok {
+			return datastore.Info.FreeSpace, nil
+		}
+	}
+	return 0, fmt.Errorf("datastore with URL %q not found in VC %q", datastoreURL, vc.Config.Host)
 }
 
 // DetachVolumeUtil is the helper function to detach CNS volume from specified vm
@@ -347,15 +829,55 @@ func DeleteVolumeUtil(ctx context.Context, manager *Manager, volumeID string, de
 	log := logger.GetLogger(ctx)
 	var err error
 	log.Debugf("vSphere Cloud Provider deleting volume: %s", volumeID)
-	err = manager.VolumeManager.DeleteVolume(ctx, volumeID, deleteDisk)
+	err = retryOnRetryableFault(ctx, "DeleteVolume", func() error {
+		return manager.VolumeManager.DeleteVolume(ctx, volumeID, deleteDisk)
+	})
 	if err != nil {
 		log.Errorf("failed to delete disk %s with error %+v", volumeID, err)
 		return err
 	}
+	if manager.CnsConfig.Global.VerifyVolumeDeletion {
+		if err = verifyVolumeDeleted(ctx, manager, volumeID); err != nil {
+			log.Errorf("failed to verify the deletion of volume %s with error %+v", volumeID, err)
+			return err
+		}
+	}
+	manager.VolumeInventory.Remove(volumeID)
 	log.Debugf("Successfully deleted disk for volumeid: %s", volumeID)
 	return nil
 }
 
+// verifyVolumeDeleted queries CNS until the deleted volume with the given ID is gone,
+// up to deleteVerificationRetryCount times. Returns an error wrapping
+// ErrVolumeNotDeleted if the volume still exists. The deletion is considered verified
+// if CNS can't be queried, as the delete call itself succeeded.
+func verifyVolumeDeleted(ctx context.Context, manager *Manager, volumeID string) error {
+	log := logger.GetLogger(ctx)
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	}
+	for attempt := 1; ; attempt++ {
+		queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+		if err != nil {
+			log.Warnf("failed to query volume %q to verify its deletion, assuming it is deleted. err: %+v", volumeID, err)
+			return nil
+		}
+		if len(queryResult.Volumes) == 0 {
+			return nil
+		}
+		if attempt >= deleteVerificationRetryCount {
+			return newUtilError(ErrVolumeNotDeleted, "volume %q still exists in CNS after it was deleted", volumeID)
+		}
+		log.Infof("volume %q still exists in CNS after it was deleted, checking again in %v",
+			volumeID, deleteVerificationRetryInterval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(deleteVerificationRetryInterval):
+		}
+	}
+}
+
 // ExpandVolumeUtil is the helper function to extend CNS volume for given volumeId
 func ExpandVolumeUtil(ctx context.Context, manager *Manager, volumeID string, capacityInMb int64) error {
 	var err error
@@ -366,10 +888,99 @@ func ExpandVolumeUtil(ctx context.Context, manager *Manager, volumeID string, ca
 		log.Errorf("failed to expand volume %q with error %+v", volumeID, err)
 		return err
 	}
+	manager.VolumeInventory.MarkStale(volumeID)
 	log.Debugf("Successfully expanded volume for volumeid %q to new size %d MB.", volumeID, capacityInMb)
 	return nil
 }
 
+// UpdateVolumeMetadataAfterExpand records the new capacity of the given volume and
+// the time it was expanded at in the labels of its CNS PV metadata, so that the
+// expansion is visible in vSphere. Volumes without PV metadata of the cluster are
+// left as is.
+func UpdateVolumeMetadataAfterExpand(ctx context.Context, manager *Manager, clusterFlavor cnstypes.CnsClusterFlavor,
+	volumeID string, capacityInMb int64, expandedAt time.Time) error {
+	log := logger.GetLogger(ctx)
+	clusterID := manager.CnsConfig.Global.ClusterID
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+	if err != nil {
+		return err
+	}
+	if len(queryResult.Volumes) == 0 {
+		return newUtilError(ErrVolumeNotFound, "volumeID %q not found in QueryVolume", volumeID)
+	}
+	var pvMetadata *cnstypes.CnsKubernetesEntityMetadata
+	for _, metadata := range queryResult.Volumes[0].Metadata.EntityMetadata {
+		entityMetadata, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata)
+		if ok && entityMetadata.EntityType == string(cnstypes.CnsKubernetesEntityTypePV) &&
+			entityMetadata.ClusterID == clusterID {
+			pvMetadata = entityMetadata
+			break
+		}
+	}
+	if pvMetadata == nil {
+		log.Debugf("volume %q has no PV metadata of cluster %q. Skipping metadata update after expansion",
+			volumeID, clusterID)
+		return nil
+	}
+	labels := GetLabelsMapFromKeyValue(pvMetadata.Labels)
+	labels[ExpandedCapacityLabel] = strconv.FormatInt(capacityInMb, 10)
+	labels[LastExpandedAtLabel] = expandedAt.UTC().Format(time.RFC3339)
+	AddChargebackLabels(labels, manager.CnsConfig)
+	newPVMetadata := vsphere.GetCnsKubernetesEntityMetaData(pvMetadata.EntityName, labels, false,
+		string(cnstypes.CnsKubernetesEntityTypePV), "", clusterID, nil)
+	containerCluster := vsphere.GetContainerCluster(clusterID, manager.VcenterConfig.Username, clusterFlavor)
+	updateSpec := &cnstypes.CnsVolumeMetadataUpdateSpec{
+		VolumeId: cnstypes.CnsVolumeId{
+			Id: volumeID,
+		},
+		Metadata: cnstypes.CnsVolumeMetadata{
+			ContainerCluster:      containerCluster,
+			ContainerClusterArray: []cnstypes.CnsContainerCluster{containerCluster},
+			EntityMetadata:        []cnstypes.BaseCnsEntityMetadata{newPVMetadata},
+		},
+	}
+	log.Debugf("updating metadata of volume %q after expansion with updateSpec: %+v", volumeID, spew.Sdump(updateSpec))
+	return manager.VolumeManager.UpdateVolumeMetadata(ctx, updateSpec)
+}
+
+// retryOnRetryableFault calls the given idempotent CNS operation and retries it as
+// long as it fails with a fault which is treated as transient, up to cnsRetryCount
+// attempts, until the given context is done.
+func retryOnRetryableFault(ctx context.Context, operation string, fn func() error) error {
+	return retryOnFault(ctx, operation, isRetryableError, fn)
+}
+
+// isRetryableCreateError returns true if a volume creation failed with a fault
+// which is treated as transient and is raised before the volume is created, as
+// the entity the creation operates on is locked by another operation. The other
+// transient faults, such as InvalidState or HostCommunication, may be raised after
+// the volume was created, so retrying the creation could create it twice.
+func isRetryableCreateError(err error) bool {
+	return isRetryableError(err) && isResourceBusyError(err)
+}
+
+// retryOnFault calls the given CNS operation and retries it as long as it fails
+// with an error for which isRetryable returns true, up to cnsRetryCount attempts,
+// until the given context is done. Returns the error of the last attempt.
+func retryOnFault(ctx context.Context, operation string, isRetryable func(error) bool, fn func() error) error {
+	log := logger.GetLogger(ctx)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || attempt >= cnsRetryCount {
+			return err
+		}
+		log.Warnf("%s failed with retryable fault on attempt %d of %d. Retrying in %v. err: %+v",
+			operation, attempt, cnsRetryCount, cnsRetryInterval, err)
+		if waitErr := waitForRetry(ctx, cnsRetryInterval); waitErr != nil {
+			log.Warnf("%s is not retried as the request is done. err: %+v", operation, waitErr)
+			return err
+		}
+	}
+}
+
 // Helper function to get DatastoreMoRefs
 func getDatastoreMoRefs(datastores []*vsphere.DatastoreInfo) []vim25types.ManagedObjectReference {
 	var datastoreMoRefs []vim25types.ManagedObjectReference
@@ -379,6 +990,112 @@ func getDatastoreMoRefs(datastores []*vsphere.DatastoreInfo) []vim25types.Manage
 	return datastoreMoRefs
 }
 
+// filterUnhealthyDatastores returns the datastores from the given list which are
+// healthy enough to receive new volumes. Excluded datastores are logged.
+func filterUnhealthyDatastores(ctx context.Context, vc *vsphere.VirtualCenter,
+	datastores []*vsphere.DatastoreInfo) ([]*vsphere.DatastoreInfo, error) {
+	log := logger.GetLogger(ctx)
+	if len(datastores) == 0 {
+		return datastores, nil
+	}
+	dsList := getDatastoreMoRefs(datastores)
+	var dsMoList []mo.Datastore
+	properties := []string{"summary", "overallStatus"}
+	pc := property.DefaultCollector(vc.Client.Client)
+	err := pc.Retrieve(ctx, dsList, properties, &dsMoList)
+	if err != nil {
+		log.Errorf("failed to get Datastore managed objects from datastore objects."+
+			" dsObjList: %+v, properties: %+v, err: %v", dsList, properties, err)
+		return nil, err
+	}
+	healthyDatastores := make(map[string]bool)
+	for _, dsMo := range dsMoList {
+		if reason := getDatastoreUnhealthyReason(dsMo); reason != "" {
+			log.Warnf("excluding datastore %q from volume placement: %s", dsMo.Summary.Url, reason)
+			RecordDatastoreExclusion(ctx, dsMo.Summary.Url, fmt.Sprintf("%s: %s", DatastoreExclusionUnhealthy, reason))
+			continue
+		}
+		healthyDatastores[dsMo.Reference().Value] = true
+	}
+	var filteredDatastores []*vsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		if healthyDatastores[datastore.Reference().Value] {
+			filteredDatastores = append(filteredDatastores, datastore)
+		}
+	}
+	return filteredDatastores, nil
+}
+
+// getDatastoreUnhealthyReason returns the reason the given datastore should not
+// receive new volumes, or an empty string if the datastore is healthy.
+func getDatastoreUnhealthyReason(dsMo mo.Datastore) string {
+	if !dsMo.Summary.Accessible {
+		return "datastore is not accessible"
+	}
+	if dsMo.Summary.MaintenanceMode != "" &&
+		dsMo.Summary.MaintenanceMode != string(vim25types.DatastoreSummaryMaintenanceModeStateNormal) {
+		return fmt.Sprintf("datastore maintenance mode is %q", dsMo.Summary.MaintenanceMode)
+	}
+	if dsMo.OverallStatus == vim25types.ManagedEntityStatusRed {
+		return "datastore is in alert state"
+	}
+	return ""
+}
+
+// getAntiAffinityDatastores returns the datastores from the given list which are not
+// used by any volume of the given anti-affinity group in the cluster.
+func getAntiAffinityDatastores(ctx context.Context, manager *Manager, group string,
+	datastores []*vsphere.DatastoreInfo) ([]*vsphere.DatastoreInfo, error) {
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{manager.CnsConfig.Global.ClusterID},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+	if err != nil {
+		return nil, err
+	}
+	return filterAntiAffinityDatastores(ctx, queryResult.Volumes, group, datastores), nil
+}
+
+// filterAntiAffinityDatastores returns the datastores from the given list which do not
+// hold any of the given volumes recorded with the given anti-affinity group. Placement
+// is best effort, all the given datastores are returned if every one of them is used
+// by the group.
+func filterAntiAffinityDatastores(ctx context.Context, volumes []cnstypes.CnsVolume, group string,
+	datastores []*vsphere.DatastoreInfo) []*vsphere.DatastoreInfo {
+	log := logger.GetLogger(ctx)
+	usedDatastoreURLs := make(map[string]bool)
+	for _, volume := range volumes {
+		for _, metadata := range volume.Metadata.EntityMetadata {
+			entityMetadata, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata)
+			if !ok || entityMetadata.EntityType != string(cnstypes.CnsKubernetesEntityTypePV) {
+				continue
+			}
+			if GetLabelsMapFromKeyValue(entityMetadata.Labels)[AntiAffinityGroupLabel] == group {
+				usedDatastoreURLs[volume.DatastoreUrl] = true
+			}
+		}
+	}
+	var candidates []*vsphere.DatastoreInfo
+	var excludedDatastoreURLs []string
+	for _, datastore := range datastores {
+		if !usedDatastoreURLs[datastore.Info.Url] {
+			candidates = append(candidates, datastore)
+		} else {
+			excludedDatastoreURLs = append(excludedDatastoreURLs, datastore.Info.Url)
+		}
+	}
+	if len(candidates) == 0 {
+		recordCreateVolumeWarning(ctx, "all datastores are used by anti-affinity group %q, "+
+			"fell back to all shared datastores", group)
+		return datastores
+	}
+	for _, datastoreURL := range excludedDatastoreURLs {
+		RecordDatastoreExclusion(ctx, datastoreURL, DatastoreExclusionAntiAffinity)
+	}
+	log.Debugf("datastores not used by anti-affinity group %q: %v", group, candidates)
+	return candidates
+}
+
 // Helper function to get DatastoreMoRef for given datastoreURL in the given virtual center.
 func getDatastore(ctx context.Context, vc *vsphere.VirtualCenter, datastoreURL string) (vim25types.ManagedObjectReference, error) {
 	log := logger.GetLogger(ctx)
@@ -397,8 +1114,8 @@ func getDatastore(ctx context.Context, vc *vsphere.VirtualCenter, datastoreURL s
 		}
 	}
 
-	msg := fmt.Sprintf("Unable to find datastore for datastore URL %s in VC %+v", datastoreURL, vc)
-	return vim25types.ManagedObjectReference{}, errors.New(msg)
+	return vim25types.ManagedObjectReference{}, newUtilError(ErrDatastoreNotFound,
+		"Unable to find datastore for datastore URL %s in VC %+v", datastoreURL, vc)
 }
 
 // IsFileServiceEnabled checks if file sevice is enabled on the specified datastoreUrls.
@@ -424,7 +1141,7 @@ func IsFileServiceEnabled(ctx context.Context, datastoreUrls []string, manager *
 	// Now create a map of datastores which are queried in the method.
 	dsToFSEnabledMapToReturn := make(map[string]bool)
 	for _, datastoreURL := range datastoreUrls {
-		if val, ok := dsToFileServiceEnabledMap[datastoreURL]; ok {
+		if val, ok := dsToFileServiceEnabledMap[vsphere.NormalizeDatastoreURL(datastoreURL)]; ok {
 			if !val {
 				msg := fmt.Sprintf("File service is not enabled on the datastore: %s", datastoreURL)
 				log.Debugf(msg)
@@ -492,7 +1209,8 @@ func getDsToFileServiceEnabledMap(ctx context.Context, vc *vsphere.VirtualCenter
 			}
 			for _, dsMo := range dsMoList {
 				if dsMo.Summary.Type == VsanDatastoreType {
-					dsToFileServiceEnabledMap[dsMo.Info.GetDatastoreInfo().Url] = config.FileServiceConfig.Enabled
+					dsToFileServiceEnabledMap[vsphere.NormalizeDatastoreURL(dsMo.Info.GetDatastoreInfo().Url)] =
+						config.FileServiceConfig.Enabled
 				}
 			}
 		}
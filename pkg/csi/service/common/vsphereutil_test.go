@@ -0,0 +1,795 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	vim25types "github.com/vmware/govmomi/vim25/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+func newAntiAffinityVolume(datastoreURL string, group string) cnstypes.CnsVolume {
+	labels := map[string]string{AntiAffinityGroupLabel: group}
+	return cnstypes.CnsVolume{
+		DatastoreUrl: datastoreURL,
+		Metadata: cnstypes.CnsVolumeMetadata{
+			EntityMetadata: []cnstypes.BaseCnsEntityMetadata{
+				vsphere.GetCnsKubernetesEntityMetaData("pv", labels, false, string(cnstypes.CnsKubernetesEntityTypePV), "", "cluster", nil),
+			},
+		},
+	}
+}
+
+func TestFilterAntiAffinityDatastores(t *testing.T) {
+	datastores := []*vsphere.DatastoreInfo{
+		{Info: &vim25types.DatastoreInfo{Url: "ds:///vmfs/volumes/datastore-1/"}},
+		{Info: &vim25types.DatastoreInfo{Url: "ds:///vmfs/volumes/datastore-2/"}},
+	}
+
+	// Volumes of the group are spread to the datastores not used by the group
+	volumes := []cnstypes.CnsVolume{
+		newAntiAffinityVolume("ds:///vmfs/volumes/datastore-1/", "web"),
+		newAntiAffinityVolume("ds:///vmfs/volumes/datastore-2/", "db"),
+	}
+	warningsCtx, warnings := WithCreateVolumeWarnings(ctx)
+	candidates := filterAntiAffinityDatastores(warningsCtx, volumes, "web", datastores)
+	if len(candidates) != 1 || candidates[0].Info.Url != "ds:///vmfs/volumes/datastore-2/" {
+		t.Errorf("expected only datastore-2 to be a candidate, got %v", candidates)
+	}
+	if warnings.Len() != 0 {
+		t.Errorf("expected no warnings without a fallback, got %q", warnings)
+	}
+
+	// All datastores are used by the group, fall back to all of them with a warning
+	volumes = append(volumes, newAntiAffinityVolume("ds:///vmfs/volumes/datastore-2/", "web"))
+	candidates = filterAntiAffinityDatastores(warningsCtx, volumes, "web", datastores)
+	if len(candidates) != len(datastores) {
+		t.Errorf("expected all datastores to be candidates, got %v", candidates)
+	}
+	if warnings.Len() != 1 || !strings.Contains(warnings.String(), `anti-affinity group "web"`) {
+		t.Errorf("expected a warning about the anti-affinity fallback, got %q", warnings)
+	}
+}
+
+func TestGetDatastoreUnhealthyReason(t *testing.T) {
+	healthy := mo.Datastore{
+		Summary: vim25types.DatastoreSummary{
+			Accessible:      true,
+			MaintenanceMode: string(vim25types.DatastoreSummaryMaintenanceModeStateNormal),
+		},
+	}
+	healthy.OverallStatus = vim25types.ManagedEntityStatusGreen
+	if reason := getDatastoreUnhealthyReason(healthy); reason != "" {
+		t.Errorf("expected datastore to be healthy, got %q", reason)
+	}
+
+	inaccessible := healthy
+	inaccessible.Summary.Accessible = false
+	inMaintenance := healthy
+	inMaintenance.Summary.MaintenanceMode = string(vim25types.DatastoreSummaryMaintenanceModeStateInMaintenance)
+	inAlert := healthy
+	inAlert.OverallStatus = vim25types.ManagedEntityStatusRed
+	for _, dsMo := range []mo.Datastore{inaccessible, inMaintenance, inAlert} {
+		if reason := getDatastoreUnhealthyReason(dsMo); reason == "" {
+			t.Errorf("expected datastore %+v to be unhealthy", dsMo.Summary)
+		}
+	}
+}
+
+// fakeAttachVolumeManager is a volume manager which only implements AttachVolume.
+type fakeAttachVolumeManager struct {
+	cnsvolume.Manager
+	attachVolume func() (string, error)
+}
+
+func (f *fakeAttachVolumeManager) AttachVolume(ctx context.Context, vm *vsphere.VirtualMachine, volumeID string) (string, error) {
+	return f.attachVolume()
+}
+
+func TestAttachVolumeUtilRetryOnBusy(t *testing.T) {
+	errBusy := errors.New("VM is busy")
+	defer func(origInterval time.Duration, origIsBusy func(error) bool) {
+		attachBusyRetryInterval = origInterval
+		isResourceBusyError = origIsBusy
+	}(attachBusyRetryInterval, isResourceBusyError)
+	attachBusyRetryInterval = time.Millisecond
+	isResourceBusyError = func(err error) bool {
+		return err == errBusy
+	}
+	cfg := &config.Config{}
+	cfg.Global.AttachBusyRetryCount = 2
+	tests := []struct {
+		name          string
+		busyAttempts  int
+		expectedError error
+	}{
+		{"not busy", 0, nil},
+		{"busy then succeeds", 2, nil},
+		{"busy beyond retry count", 3, errBusy},
+	}
+	for _, test := range tests {
+		attempts := 0
+		manager := &Manager{
+			CnsConfig: cfg,
+			VolumeManager: &fakeAttachVolumeManager{
+				attachVolume: func() (string, error) {
+					attempts++
+					if attempts <= test.busyAttempts {
+						return "", errBusy
+					}
+					return "disk-uuid", nil
+				},
+			},
+		}
+		diskUUID, err := AttachVolumeUtil(context.Background(), manager, &vsphere.VirtualMachine{}, "volume-id")
+		if err != test.expectedError {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.expectedError, err)
+		}
+		if err == nil && diskUUID != "disk-uuid" {
+			t.Errorf("%s: expected disk UUID %q, got %q", test.name, "disk-uuid", diskUUID)
+		}
+	}
+
+	// The backoff stops once the context of the request is done
+	attachBusyRetryInterval = time.Hour
+	attempts := 0
+	manager := &Manager{
+		CnsConfig: cfg,
+		VolumeManager: &fakeAttachVolumeManager{
+			attachVolume: func() (string, error) {
+				attempts++
+				return "", errBusy
+			},
+		},
+	}
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := AttachVolumeUtil(cancelledCtx, manager, &vsphere.VirtualMachine{}, "volume-id"); err != errBusy {
+		t.Errorf("expected error %v once the context is done, got %v", errBusy, err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected no retry once the context is done, got %d attempts", attempts)
+	}
+}
+
+func TestGetCreateVolumeLabels(t *testing.T) {
+	cfg := &config.Config{}
+	manager := &Manager{CnsConfig: cfg}
+	spec := &CreateVolumeSpec{ScParams: &StorageClassParams{}}
+	if labels := getCreateVolumeLabels(manager, spec); len(labels) != 0 {
+		t.Errorf("expected no labels, got %v", labels)
+	}
+
+	cfg.Global.ClusterVersion = "v1.18.2"
+	labels := getCreateVolumeLabels(manager, spec)
+	if len(labels) != 1 || labels[ClusterVersionLabel] != "v1.18.2" {
+		t.Errorf("expected cluster version label %q, got %v", "v1.18.2", labels)
+	}
+
+	spec.ScParams.AntiAffinityGroup = "group-a"
+	labels = getCreateVolumeLabels(manager, spec)
+	if labels[ClusterVersionLabel] != "v1.18.2" || labels[AntiAffinityGroupLabel] != "group-a" {
+		t.Errorf("expected cluster version and anti-affinity group labels, got %v", labels)
+	}
+}
+
+func TestGetCreateVolumePVCMetadata(t *testing.T) {
+	spec := &CreateVolumeSpec{Name: "pvc-1234", ScParams: &StorageClassParams{}}
+	if metadata := getCreateVolumePVCMetadata(spec, "cluster"); metadata != nil {
+		t.Errorf("expected no PVC metadata without the PVC name and namespace, got %+v", metadata)
+	}
+
+	// The volume counts against the quota of its namespace as soon as it's created
+	spec.ScParams.PVCName = "data"
+	spec.ScParams.PVCNamespace = "team-a"
+	metadata := getCreateVolumePVCMetadata(spec, "cluster")
+	if metadata == nil || metadata.EntityName != "data" || len(metadata.ReferredEntity) != 1 ||
+		metadata.ReferredEntity[0].EntityName != "pvc-1234" {
+		t.Fatalf("expected PVC metadata referring to the PV, got %+v", metadata)
+	}
+	volume := cnstypes.CnsVolume{
+		BackingObjectDetails: &cnstypes.CnsBlockBackingDetails{
+			CnsBackingObjectDetails: cnstypes.CnsBackingObjectDetails{CapacityInMb: 1024},
+		},
+		Metadata: cnstypes.CnsVolumeMetadata{EntityMetadata: []cnstypes.BaseCnsEntityMetadata{metadata}},
+	}
+	if used := getNamespaceUsedCapacityInMb([]cnstypes.CnsVolume{volume}, "cluster", "team-a"); used != 1024 {
+		t.Errorf("expected 1024 MB used in namespace team-a, got %d", used)
+	}
+}
+
+// fakeUpdateMetadataVolumeManager is a volume manager which only implements
+// QueryVolume and UpdateVolumeMetadata, recording the update specs.
+type fakeUpdateMetadataVolumeManager struct {
+	cnsvolume.Manager
+	volume      cnstypes.CnsVolume
+	updateSpecs []*cnstypes.CnsVolumeMetadataUpdateSpec
+}
+
+func (f *fakeUpdateMetadataVolumeManager) QueryVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+	return &cnstypes.CnsQueryResult{Volumes: []cnstypes.CnsVolume{f.volume}}, nil
+}
+
+func (f *fakeUpdateMetadataVolumeManager) UpdateVolumeMetadata(ctx context.Context, spec *cnstypes.CnsVolumeMetadataUpdateSpec) error {
+	f.updateSpecs = append(f.updateSpecs, spec)
+	return nil
+}
+
+func TestUpdateVolumeMetadataAfterExpand(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Global.ClusterID = "cluster"
+	volumeManager := &fakeUpdateMetadataVolumeManager{
+		volume: cnstypes.CnsVolume{
+			Metadata: cnstypes.CnsVolumeMetadata{
+				EntityMetadata: []cnstypes.BaseCnsEntityMetadata{
+					vsphere.GetCnsKubernetesEntityMetaData("pv-1", map[string]string{"app": "db"}, false,
+						string(cnstypes.CnsKubernetesEntityTypePV), "", "cluster", nil),
+				},
+			},
+		},
+	}
+	manager := &Manager{
+		CnsConfig:     cfg,
+		VcenterConfig: &vsphere.VirtualCenterConfig{Username: "user"},
+		VolumeManager: volumeManager,
+	}
+	expandedAt := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	err := UpdateVolumeMetadataAfterExpand(ctx, manager, cnstypes.CnsClusterFlavorVanilla, "volume-id", 2048, expandedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumeManager.updateSpecs) != 1 {
+		t.Fatalf("expected 1 metadata update after expand, got %d", len(volumeManager.updateSpecs))
+	}
+	updateSpec := volumeManager.updateSpecs[0]
+	pvMetadata := updateSpec.Metadata.EntityMetadata[0].(*cnstypes.CnsKubernetesEntityMetadata)
+	labels := vsphere.GetLabelsMapFromKeyValue(pvMetadata.Labels)
+	if updateSpec.VolumeId.Id != "volume-id" || pvMetadata.EntityName != "pv-1" || labels["app"] != "db" ||
+		labels[ExpandedCapacityLabel] != "2048" || labels[LastExpandedAtLabel] != "2020-06-01T12:00:00Z" {
+		t.Errorf("unexpected metadata update %+v with labels %v", updateSpec, labels)
+	}
+
+	// Volumes without PV metadata of the cluster are not updated
+	volumeManager.updateSpecs = nil
+	cfg.Global.ClusterID = "other-cluster"
+	err = UpdateVolumeMetadataAfterExpand(ctx, manager, cnstypes.CnsClusterFlavorVanilla, "volume-id", 2048, expandedAt)
+	if err != nil || len(volumeManager.updateSpecs) != 0 {
+		t.Errorf("expected no metadata update for a volume of another cluster, got %d (err: %v)",
+			len(volumeManager.updateSpecs), err)
+	}
+}
+
+func TestChargebackLabels(t *testing.T) {
+	labels, err := ParseChargebackLabels(" cost-center=1234, team = storage ,")
+	if err != nil || len(labels) != 2 || labels["cost-center"] != "1234" || labels["team"] != "storage" {
+		t.Errorf("unexpected chargeback labels %v (err: %v)", labels, err)
+	}
+	for _, invalid := range []string{"cost-center", "=1234", "cost-center="} {
+		if _, err := ParseChargebackLabels(invalid); err == nil {
+			t.Errorf("expected chargeback labels %q to be rejected", invalid)
+		}
+	}
+
+	cfg := &config.Config{}
+	cfg.Global.ClusterID = "cluster"
+	cfg.Global.ChargebackLabels = "cost-center=1234,app=chargeback"
+	volumeManager := &fakeUpdateMetadataVolumeManager{
+		volume: cnstypes.CnsVolume{
+			Metadata: cnstypes.CnsVolumeMetadata{
+				EntityMetadata: []cnstypes.BaseCnsEntityMetadata{
+					vsphere.GetCnsKubernetesEntityMetaData("pv-1", map[string]string{"app": "db"}, false,
+						string(cnstypes.CnsKubernetesEntityTypePV), "", "cluster", nil),
+				},
+			},
+		},
+	}
+	manager := &Manager{
+		CnsConfig:     cfg,
+		VcenterConfig: &vsphere.VirtualCenterConfig{Username: "user"},
+		VolumeManager: volumeManager,
+	}
+
+	// The labels are recorded when volumes are created
+	labels = getCreateVolumeLabels(manager, &CreateVolumeSpec{ScParams: &StorageClassParams{}})
+	if labels["cost-center"] != "1234" || labels["app"] != "chargeback" {
+		t.Errorf("expected the chargeback labels on create, got %v", labels)
+	}
+
+	// and when their metadata is updated after expansion, without overriding labels
+	// already set
+	err = UpdateVolumeMetadataAfterExpand(ctx, manager, cnstypes.CnsClusterFlavorVanilla, "volume-id", 2048, time.Now())
+	if err != nil || len(volumeManager.updateSpecs) != 1 {
+		t.Fatalf("expected 1 metadata update after expand, got %d (err: %v)", len(volumeManager.updateSpecs), err)
+	}
+	pvMetadata := volumeManager.updateSpecs[0].Metadata.EntityMetadata[0].(*cnstypes.CnsKubernetesEntityMetadata)
+	labels = vsphere.GetLabelsMapFromKeyValue(pvMetadata.Labels)
+	if labels["cost-center"] != "1234" || labels["app"] != "db" {
+		t.Errorf("expected the chargeback labels on expand, got %v", labels)
+	}
+}
+
+// fakeCreateVolumeManager is a volume manager which only implements CreateVolume.
+type fakeCreateVolumeManager struct {
+	cnsvolume.Manager
+	createVolume func(ctx context.Context, spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error)
+}
+
+func (f *fakeCreateVolumeManager) CreateVolume(ctx context.Context, spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error) {
+	return f.createVolume(ctx, spec)
+}
+
+func TestCreateVolumeWithPlacementRetry(t *testing.T) {
+	errNoSpace := errors.New("datastore is full")
+	errNotFound := errors.New("not found")
+	defer func(orig func(error) bool) { isPlacementError = orig }(isPlacementError)
+	isPlacementError = func(err error) bool {
+		return err == errNoSpace
+	}
+	newDatastore := func(name string, freeSpace int64) *vsphere.DatastoreInfo {
+		return &vsphere.DatastoreInfo{
+			Datastore: &vsphere.Datastore{
+				Datastore: object.NewDatastore(nil, vim25types.ManagedObjectReference{Type: "Datastore", Value: name}),
+			},
+			Info: &vim25types.DatastoreInfo{Url: "ds:///vmfs/volumes/" + name + "/", FreeSpace: freeSpace},
+		}
+	}
+	placements := getPlacementCandidates([]*vsphere.DatastoreInfo{
+		newDatastore("datastore-1", 10*GbInBytes),
+		newDatastore("datastore-2", 20*GbInBytes),
+	})
+
+	tests := []struct {
+		name               string
+		failingDatastores  map[string]error
+		expectedAttempts   []string
+		expectedError      error
+		expectedDatastores string
+	}{
+		{"first attempt succeeds", nil, []string{"datastore-2,datastore-1"}, nil, "datastore-2,datastore-1"},
+		{"first datastore fails, second succeeds",
+			map[string]error{"datastore-2,datastore-1": errNoSpace, "datastore-2": errNoSpace},
+			[]string{"datastore-2,datastore-1", "datastore-2", "datastore-1"}, nil, "datastore-1"},
+		{"all datastores fail",
+			map[string]error{"datastore-2,datastore-1": errNoSpace, "datastore-2": errNoSpace, "datastore-1": errNoSpace},
+			[]string{"datastore-2,datastore-1", "datastore-2", "datastore-1"}, errNoSpace, ""},
+		{"non placement error is not retried", map[string]error{"datastore-2,datastore-1": errNotFound},
+			[]string{"datastore-2,datastore-1"}, errNotFound, ""},
+	}
+	for _, test := range tests {
+		var attempts []string
+		manager := &Manager{
+			CnsConfig: &config.Config{},
+			VolumeManager: &fakeCreateVolumeManager{
+				createVolume: func(ctx context.Context, spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error) {
+					var names []string
+					for _, datastore := range spec.Datastores {
+						names = append(names, datastore.Value)
+					}
+					attempt := strings.Join(names, ",")
+					attempts = append(attempts, attempt)
+					if err := test.failingDatastores[attempt]; err != nil {
+						return nil, err
+					}
+					return &cnstypes.CnsVolumeId{Id: attempt}, nil
+				},
+			},
+		}
+		volumeID, err := createVolumeWithPlacementRetry(ctx, manager, &cnstypes.CnsVolumeCreateSpec{Name: "pvc"}, placements)
+		if err != test.expectedError {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.expectedError, err)
+		}
+		if err == nil && volumeID.Id != test.expectedDatastores {
+			t.Errorf("%s: expected volume to be created on %q, got %q", test.name, test.expectedDatastores, volumeID.Id)
+		}
+		if !reflect.DeepEqual(attempts, test.expectedAttempts) {
+			t.Errorf("%s: expected attempts %v, got %v", test.name, test.expectedAttempts, attempts)
+		}
+	}
+}
+
+func TestRetryOnFault(t *testing.T) {
+	errBusy := errors.New("ConcurrentAccess")
+	errInvalidState := errors.New("InvalidState")
+	defer func(origInterval time.Duration, origIsRetryable, origIsBusy func(error) bool) {
+		cnsRetryInterval = origInterval
+		isRetryableError = origIsRetryable
+		isResourceBusyError = origIsBusy
+	}(cnsRetryInterval, isRetryableError, isResourceBusyError)
+	cnsRetryInterval = time.Millisecond
+	isRetryableError = func(err error) bool {
+		return err == errBusy || err == errInvalidState
+	}
+	isResourceBusyError = func(err error) bool {
+		return err == errBusy
+	}
+	newFailingOperation := func(attempts *int, errs ...error) func() error {
+		return func() error {
+			*attempts++
+			if *attempts <= len(errs) {
+				return errs[*attempts-1]
+			}
+			return nil
+		}
+	}
+
+	// Idempotent operations are retried on all the retryable faults
+	attempts := 0
+	if err := retryOnRetryableFault(context.Background(), "DeleteVolume",
+		newFailingOperation(&attempts, errInvalidState, errBusy)); err != nil || attempts != 3 {
+		t.Errorf("expected DeleteVolume to succeed on the third attempt, got %d attempts, err %v", attempts, err)
+	}
+
+	// Creations are not retried on the faults which may be raised once the volume is created
+	attempts = 0
+	if err := retryOnFault(context.Background(), "CreateVolume", isRetryableCreateError,
+		newFailingOperation(&attempts, errInvalidState)); err != errInvalidState || attempts != 1 {
+		t.Errorf("expected CreateVolume not to be retried on InvalidState, got %d attempts, err %v", attempts, err)
+	}
+	attempts = 0
+	if err := retryOnFault(context.Background(), "CreateVolume", isRetryableCreateError,
+		newFailingOperation(&attempts, errBusy)); err != nil || attempts != 2 {
+		t.Errorf("expected CreateVolume to be retried while busy, got %d attempts, err %v", attempts, err)
+	}
+
+	// The retries stop once the context of the request is done
+	cnsRetryInterval = time.Hour
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	if err := retryOnRetryableFault(cancelledCtx, "DeleteVolume",
+		newFailingOperation(&attempts, errBusy)); err != errBusy || attempts != 1 {
+		t.Errorf("expected no retry once the context is done, got %d attempts, err %v", attempts, err)
+	}
+}
+
+func TestCreateVolumeWithPlacementRetryAsync(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Global.CreateVolumeAsyncWaitInSec = 30
+	taskCompleted := false
+	manager := &Manager{
+		CnsConfig: cfg,
+		VolumeManager: &fakeCreateVolumeManager{
+			createVolume: func(ctx context.Context, spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error) {
+				if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > 30*time.Second {
+					t.Errorf("expected the wait for the CreateVolume task to be bounded to 30s, got deadline %v", deadline)
+				}
+				// The CNS task only completes after the first call gave up waiting for it
+				if !taskCompleted {
+					taskCompleted = true
+					return nil, fmt.Errorf("%w. VolumeName: %q", cnsvolume.ErrCreateVolumeInProgress, spec.Name)
+				}
+				return &cnstypes.CnsVolumeId{Id: "volume-id"}, nil
+			},
+		},
+	}
+	placements := [][]vim25types.ManagedObjectReference{{{Type: "Datastore", Value: "datastore-1"}}}
+
+	_, err := createVolumeWithPlacementRetry(ctx, manager, &cnstypes.CnsVolumeCreateSpec{Name: "pvc"}, placements)
+	if code := GetErrorCode(err, codes.Internal); code != codes.Aborted {
+		t.Fatalf("expected the pending creation to map to code %v, got %v (err: %v)", codes.Aborted, code, err)
+	}
+	volumeID, err := createVolumeWithPlacementRetry(ctx, manager, &cnstypes.CnsVolumeCreateSpec{Name: "pvc"}, placements)
+	if err != nil || volumeID.Id != "volume-id" {
+		t.Errorf("expected the retried creation to return the completed volume, got %v (err: %v)", volumeID, err)
+	}
+}
+
+func TestCreateVolumeOnReservedDatastore(t *testing.T) {
+	errNoSpace := errors.New("datastore is full")
+	defer func(orig func(error) bool) { isPlacementError = orig }(isPlacementError)
+	isPlacementError = func(err error) bool {
+		return err == errNoSpace
+	}
+	newDatastore := func(name string) *vsphere.DatastoreInfo {
+		return &vsphere.DatastoreInfo{
+			Datastore: &vsphere.Datastore{
+				Datastore: object.NewDatastore(nil, vim25types.ManagedObjectReference{Type: "Datastore", Value: name}),
+			},
+			Info: &vim25types.DatastoreInfo{Url: "ds:///vmfs/volumes/" + name + "/", FreeSpace: 10 * GbInBytes},
+		}
+	}
+	datastores := []*vsphere.DatastoreInfo{newDatastore("datastore-1"), newDatastore("datastore-2")}
+	taskCompleted := false
+	var attempts []string
+	manager := &Manager{
+		CnsConfig:             &config.Config{},
+		DatastoreReservations: NewDatastoreReservations(),
+		VolumeManager: &fakeCreateVolumeManager{
+			createVolume: func(ctx context.Context, spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error) {
+				attempts = append(attempts, spec.Datastores[0].Value)
+				switch {
+				case spec.Datastores[0].Value == "datastore-1":
+					return nil, errNoSpace
+				case !taskCompleted:
+					// The CNS task only completes after the first call gave up waiting for it
+					taskCompleted = true
+					return nil, fmt.Errorf("%w. VolumeName: %q", cnsvolume.ErrCreateVolumeInProgress, spec.Name)
+				}
+				return &cnstypes.CnsVolumeId{Id: "volume-id"}, nil
+			},
+		},
+	}
+
+	_, err := createVolumeOnReservedDatastore(ctx, manager, &cnstypes.CnsVolumeCreateSpec{Name: "pvc"}, datastores, 8*1024)
+	if !errors.Is(err, cnsvolume.ErrCreateVolumeInProgress) {
+		t.Fatalf("expected the creation to be in progress, got err: %v", err)
+	}
+	if !reflect.DeepEqual(attempts, []string{"datastore-1", "datastore-2"}) {
+		t.Errorf("expected each datastore to be attempted on its own, got %v", attempts)
+	}
+	// The capacity stays reserved on the chosen datastore while the task is running
+	if _, err = manager.DatastoreReservations.Reserve(ctx, "pvc-2", datastores[1:], 8*1024); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected the capacity of the pending volume to stay reserved, got err: %v", err)
+	}
+
+	volumeID, err := createVolumeOnReservedDatastore(ctx, manager, &cnstypes.CnsVolumeCreateSpec{Name: "pvc"},
+		datastores[1:], 8*1024)
+	if err != nil || volumeID.Id != "volume-id" {
+		t.Fatalf("expected the retried creation to return the completed volume, got %v (err: %v)", volumeID, err)
+	}
+	if _, err = manager.DatastoreReservations.Reserve(ctx, "pvc-2", datastores[1:], 8*1024); err != nil {
+		t.Errorf("expected the reservation to be released once the creation completed, got err: %v", err)
+	}
+}
+
+func TestOrderDatastoresForSelection(t *testing.T) {
+	defer func(orig *rand.Rand) { datastoreSelectionRand = orig }(datastoreSelectionRand)
+	datastoreSelectionRand = rand.New(rand.NewSource(1))
+	datastores := []*vsphere.DatastoreInfo{
+		{Info: &vim25types.DatastoreInfo{Url: "ds:///vmfs/volumes/datastore-1/"}},
+		{Info: &vim25types.DatastoreInfo{Url: "ds:///vmfs/volumes/datastore-2/"}},
+		{Info: &vim25types.DatastoreInfo{Url: "ds:///vmfs/volumes/datastore-3/"}},
+	}
+	const creates = 300
+
+	tests := []struct {
+		selection string
+		// minFirst is the minimum number of creates each datastore must come first for
+		minFirst int
+		// maxFirst is the maximum number of creates each datastore may come first for
+		maxFirst int
+	}{
+		{"", 0, creates},
+		{DatastoreSelectionRandom, 70, 130},
+		{DatastoreSelectionRoundRobin, creates / 3, creates / 3},
+	}
+	for _, test := range tests {
+		first := make(map[string]int)
+		for i := 0; i < creates; i++ {
+			ordered := orderDatastoresForSelection(datastores, test.selection)
+			if len(ordered) != len(datastores) {
+				t.Fatalf("selection %q: expected %d datastores, got %d", test.selection, len(datastores), len(ordered))
+			}
+			first[ordered[0].Info.Url]++
+		}
+		for _, datastore := range datastores {
+			count := first[datastore.Info.Url]
+			if count < test.minFirst || count > test.maxFirst {
+				t.Errorf("selection %q: expected datastore %q to come first for %d to %d of %d creates, got %d",
+					test.selection, datastore.Info.Url, test.minFirst, test.maxFirst, creates, count)
+			}
+		}
+	}
+	// Without a selection the datastores keep their order
+	if ordered := orderDatastoresForSelection(datastores, ""); !reflect.DeepEqual(ordered, datastores) {
+		t.Errorf("expected the datastores to keep their order without a selection, got %v", ordered)
+	}
+	if err := ValidateDatastoreSelection("first"); err == nil {
+		t.Error("expected an unsupported datastore selection to be rejected")
+	}
+}
+
+// fakeUpdatePolicyVolumeManager is a volume manager which only implements QueryVolume
+// and UpdateVolumePolicy, recording the storage policies volumes are reconfigured to.
+type fakeUpdatePolicyVolumeManager struct {
+	cnsvolume.Manager
+	volumes         []cnstypes.CnsVolume
+	updatedPolicies map[string]string
+}
+
+func (f *fakeUpdatePolicyVolumeManager) QueryVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+	var volumes []cnstypes.CnsVolume
+	for _, volume := range f.volumes {
+		if len(queryFilter.Names) > 0 && volume.Name == queryFilter.Names[0] {
+			volumes = append(volumes, volume)
+		}
+	}
+	return &cnstypes.CnsQueryResult{Volumes: volumes}, nil
+}
+
+func (f *fakeUpdatePolicyVolumeManager) UpdateVolumePolicy(ctx context.Context, volumeID string,
+	datastore vim25types.ManagedObjectReference, storagePolicyID string) error {
+	f.updatedPolicies[volumeID] = storagePolicyID
+	return nil
+}
+
+func TestGetExistingBlockVolume(t *testing.T) {
+	defer func(orig func(context.Context, *vsphere.VirtualCenter, string) (vim25types.ManagedObjectReference, error)) {
+		getDatastoreByURL = orig
+	}(getDatastoreByURL)
+	getDatastoreByURL = func(ctx context.Context, vc *vsphere.VirtualCenter, datastoreURL string) (
+		vim25types.ManagedObjectReference, error) {
+		return vim25types.ManagedObjectReference{Type: "Datastore", Value: "datastore-1"}, nil
+	}
+	volumeManager := &fakeUpdatePolicyVolumeManager{
+		volumes: []cnstypes.CnsVolume{{
+			VolumeId:        cnstypes.CnsVolumeId{Id: "vol-1"},
+			Name:            "pvc-1",
+			StoragePolicyId: "gold",
+			DatastoreUrl:    "ds:///vmfs/volumes/datastore-1/",
+			BackingObjectDetails: &cnstypes.CnsBlockBackingDetails{
+				CnsBackingObjectDetails: cnstypes.CnsBackingObjectDetails{CapacityInMb: 1024},
+			},
+		}},
+		updatedPolicies: make(map[string]string),
+	}
+	cfg := &config.Config{}
+	cfg.Global.ClusterID = "cluster"
+	manager := &Manager{CnsConfig: cfg, VolumeManager: volumeManager}
+
+	tests := []struct {
+		name             string
+		policy           string
+		volumeName       string
+		storagePolicyID  string
+		capacityMB       int64
+		expectedVolumeID string
+		expectedCode     codes.Code
+		expectedUpdate   string
+	}{
+		{name: "no existing volume", policy: DuplicateVolumeNameFail, volumeName: "pvc-2", storagePolicyID: "silver"},
+		{name: "same policy", policy: DuplicateVolumeNameFail, volumeName: "pvc-1", storagePolicyID: "gold",
+			expectedVolumeID: "vol-1"},
+		{name: "different policy fails", policy: DuplicateVolumeNameFail, volumeName: "pvc-1", storagePolicyID: "silver",
+			expectedCode: codes.AlreadyExists},
+		{name: "different policy reconfigures", policy: DuplicateVolumeNameReconfigure, volumeName: "pvc-1",
+			storagePolicyID: "silver", expectedVolumeID: "vol-1", expectedUpdate: "silver"},
+		{name: "different capacity fails", policy: DuplicateVolumeNameReconfigure, volumeName: "pvc-1",
+			storagePolicyID: "gold", capacityMB: 2048, expectedCode: codes.AlreadyExists},
+	}
+	for _, test := range tests {
+		cfg.Global.DuplicateVolumeNamePolicy = test.policy
+		volumeManager.updatedPolicies = make(map[string]string)
+		if test.capacityMB == 0 {
+			test.capacityMB = 1024
+		}
+		spec := &CreateVolumeSpec{Name: test.volumeName, StoragePolicyID: test.storagePolicyID, CapacityMB: test.capacityMB}
+		volumeID, err := getExistingBlockVolume(ctx, manager, nil, spec)
+		if test.expectedCode != codes.OK {
+			if code := GetErrorCode(err, codes.Internal); code != test.expectedCode {
+				t.Errorf("%s: expected code %v, got %v (err: %v)", test.name, test.expectedCode, code, err)
+			}
+			continue
+		}
+		if err != nil || volumeID != test.expectedVolumeID {
+			t.Errorf("%s: expected volume %q, got %q (err: %v)", test.name, test.expectedVolumeID, volumeID, err)
+		}
+		if volumeManager.updatedPolicies["vol-1"] != test.expectedUpdate {
+			t.Errorf("%s: expected the volume to be reconfigured to %q, got %v",
+				test.name, test.expectedUpdate, volumeManager.updatedPolicies)
+		}
+	}
+}
+
+func TestGetExistingBlockVolumeDuplicateID(t *testing.T) {
+	volumeOnDatastore1 := newClusterVolume("vol-1", "pvc-1", "cluster")
+	volumeOnDatastore1.DatastoreUrl = "ds:///vmfs/volumes/datastore-1/"
+	volumeOnDatastore2 := newClusterVolume("vol-1", "pvc-1", "cluster")
+	volumeOnDatastore2.DatastoreUrl = "ds:///vmfs/volumes/datastore-2/"
+	volumeManager := &fakeInventoryVolumeManager{
+		volumes: []cnstypes.CnsVolume{volumeOnDatastore1, volumeOnDatastore2},
+	}
+	cfg := &config.Config{}
+	cfg.Global.ClusterID = "cluster"
+	cfg.Global.DuplicateVolumeNamePolicy = DuplicateVolumeNameFail
+	manager := &Manager{CnsConfig: cfg, VolumeManager: volumeManager, VolumeInventory: NewVolumeInventory()}
+
+	spec := &CreateVolumeSpec{Name: "pvc-1", StoragePolicyID: "gold"}
+	volumeID, err := getExistingBlockVolume(ctx, manager, nil, spec)
+	if !errors.Is(err, ErrDuplicateVolumeID) || GetErrorCode(err, codes.Unknown) != codes.Internal {
+		t.Fatalf("expected an internal error for the duplicate volume ID, got %q (err: %v)", volumeID, err)
+	}
+	for _, datastoreURL := range []string{volumeOnDatastore1.DatastoreUrl, volumeOnDatastore2.DatastoreUrl} {
+		if !strings.Contains(err.Error(), datastoreURL) {
+			t.Errorf("expected the error to name datastore %q, got %q", datastoreURL, err)
+		}
+	}
+
+	// The volume inventory isn't populated with the ambiguous volume either
+	if err := manager.VolumeInventory.Refresh(context.Background(), manager); !errors.Is(err, ErrDuplicateVolumeID) {
+		t.Errorf("expected the refresh of the volume inventory to fail, got %v", err)
+	}
+	if manager.VolumeInventory.Populated() {
+		t.Error("expected the volume inventory not to be populated with a duplicate volume ID")
+	}
+
+	// The same volume on a single datastore is not ambiguous
+	volumeManager.volumes = []cnstypes.CnsVolume{volumeOnDatastore1, volumeOnDatastore1}
+	if volumeID, err := getExistingBlockVolume(ctx, manager, nil, spec); err != nil || volumeID != "vol-1" {
+		t.Errorf("expected volume vol-1, got %q (err: %v)", volumeID, err)
+	}
+}
+
+// fakeDeleteVolumeManager is a volume manager which only implements DeleteVolume and
+// QueryVolume.
+type fakeDeleteVolumeManager struct {
+	fakeInventoryVolumeManager
+	deletes int
+}
+
+func (f *fakeDeleteVolumeManager) DeleteVolume(ctx context.Context, volumeID string, deleteDisk bool) error {
+	f.deletes++
+	return nil
+}
+
+func TestDeleteVolumeUtilVerification(t *testing.T) {
+	defer func(orig time.Duration) { deleteVerificationRetryInterval = orig }(deleteVerificationRetryInterval)
+	deleteVerificationRetryInterval = time.Millisecond
+	volumeManager := &fakeDeleteVolumeManager{}
+	cfg := &config.Config{}
+	manager := &Manager{CnsConfig: cfg, VolumeManager: volumeManager}
+	lingeringVolume := newClusterVolume("vol-1", "pvc-1", "cluster")
+
+	// Without verification, CNS is not queried after the delete
+	volumeManager.volumes = []cnstypes.CnsVolume{lingeringVolume}
+	if err := DeleteVolumeUtil(context.Background(), manager, "vol-1", true); err != nil {
+		t.Fatal(err)
+	}
+	if volumeManager.queries != 0 {
+		t.Errorf("expected no CNS query without verification, got %d", volumeManager.queries)
+	}
+
+	// The volume persists after the delete call
+	cfg.Global.VerifyVolumeDeletion = true
+	err := DeleteVolumeUtil(context.Background(), manager, "vol-1", true)
+	if !errors.Is(err, ErrVolumeNotDeleted) {
+		t.Fatalf("expected the lingering volume to fail the deletion, got %v", err)
+	}
+	if volumeManager.queries != deleteVerificationRetryCount {
+		t.Errorf("expected %d verification queries, got %d", deleteVerificationRetryCount, volumeManager.queries)
+	}
+
+	// The volume is gone after a retry
+	volumeManager.queries = 0
+	volumeManager.onQuery = func() {
+		if volumeManager.queries == 2 {
+			volumeManager.volumes = nil
+		}
+	}
+	if err := DeleteVolumeUtil(context.Background(), manager, "vol-1", true); err != nil {
+		t.Fatalf("expected the deletion to be verified once the volume is gone, got %v", err)
+	}
+	if volumeManager.queries != 2 {
+		t.Errorf("expected 2 verification queries, got %d", volumeManager.queries)
+	}
+}
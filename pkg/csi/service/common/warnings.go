@@ -0,0 +1,60 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
+)
+
+type createVolumeWarningsKey struct{}
+
+// CreateVolumeWarnings holds the caveats of a successful volume creation, e.g. the
+// placement falling back from the one requested by the storage class.
+type CreateVolumeWarnings struct {
+	messages []string
+}
+
+// WithCreateVolumeWarnings returns a child context in which the caveats of a volume
+// creation are recorded to the returned CreateVolumeWarnings.
+func WithCreateVolumeWarnings(ctx context.Context) (context.Context, *CreateVolumeWarnings) {
+	warnings := &CreateVolumeWarnings{}
+	return context.WithValue(ctx, createVolumeWarningsKey{}, warnings), warnings
+}
+
+// recordCreateVolumeWarning logs the caveat of a volume creation as a warning, and
+// records it if the context was created with WithCreateVolumeWarnings.
+func recordCreateVolumeWarning(ctx context.Context, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logger.GetLogger(ctx).Warn(msg)
+	if warnings, ok := ctx.Value(createVolumeWarningsKey{}).(*CreateVolumeWarnings); ok {
+		warnings.messages = append(warnings.messages, msg)
+	}
+}
+
+// Len returns the number of recorded warnings.
+func (w *CreateVolumeWarnings) Len() int {
+	return len(w.messages)
+}
+
+// String returns the recorded warnings in the order they were recorded, separated by "; ".
+func (w *CreateVolumeWarnings) String() string {
+	return strings.Join(w.messages, "; ")
+}
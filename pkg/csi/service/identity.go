@@ -20,18 +20,51 @@ import (
 	"context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 )
 
 // Version of the driver. This should be set via ldflags.
 var Version string
 
+// GitCommit the driver is built from. This should be set via ldflags.
+var GitCommit string
+
+// CSISpecVersion is the version of the CSI spec supported by the driver.
+const CSISpecVersion = "1.2.0"
+
+// Keys of the build info in the manifest returned by GetPluginInfo.
+const (
+	manifestKeyGitCommit      = "gitCommit"
+	manifestKeyCSISpecVersion = "csiSpecVersion"
+)
+
+// BuildInfo describes the build of the driver.
+type BuildInfo struct {
+	Version        string
+	GitCommit      string
+	CSISpecVersion string
+}
+
+// GetBuildInfo returns the version and git commit the driver is built from
+// and the version of the CSI spec it supports.
+func GetBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:        Version,
+		GitCommit:      GitCommit,
+		CSISpecVersion: CSISpecVersion,
+	}
+}
+
+// Probe reports that the plugin is ready as long as it is serving RPCs. Probe is used
+// by the liveness probe, so it doesn't report whether the controller completed its
+// initialization, which is reported at the readiness path of the metrics server.
 func (s *service) Probe(
 	ctx context.Context,
 	req *csi.ProbeRequest) (
 	*csi.ProbeResponse, error) {
 
-	return &csi.ProbeResponse{}, nil
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
 }
 
 func (s *service) GetPluginInfo(
@@ -39,9 +72,14 @@ func (s *service) GetPluginInfo(
 	req *csi.GetPluginInfoRequest) (
 	*csi.GetPluginInfoResponse, error) {
 
+	buildInfo := GetBuildInfo()
 	return &csi.GetPluginInfoResponse{
 		Name:          csitypes.Name,
-		VendorVersion: Version,
+		VendorVersion: buildInfo.Version,
+		Manifest: map[string]string{
+			manifestKeyGitCommit:      buildInfo.GitCommit,
+			manifestKeyCSISpecVersion: buildInfo.CSISpecVersion,
+		},
 	}, nil
 }
 
@@ -0,0 +1,72 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+)
+
+func TestGetPluginInfoBuildInfo(t *testing.T) {
+	defer func(version, gitCommit string) {
+		Version, GitCommit = version, gitCommit
+	}(Version, GitCommit)
+	Version, GitCommit = "v2.0.0", "0123456789abcdef"
+
+	buildInfo := GetBuildInfo()
+	if buildInfo.Version != "v2.0.0" || buildInfo.GitCommit != "0123456789abcdef" || buildInfo.CSISpecVersion == "" {
+		t.Errorf("unexpected build info %+v", buildInfo)
+	}
+	resp, err := (&service{}).GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.VendorVersion != buildInfo.Version ||
+		resp.Manifest[manifestKeyGitCommit] != buildInfo.GitCommit ||
+		resp.Manifest[manifestKeyCSISpecVersion] != buildInfo.CSISpecVersion {
+		t.Errorf("unexpected plugin info %+v for build info %+v", resp, buildInfo)
+	}
+}
+
+// fakeReadinessController is a CnsController which reports the given readiness.
+type fakeReadinessController struct {
+	csitypes.CnsController
+	ready bool
+}
+
+func (c *fakeReadinessController) IsReady(ctx context.Context) bool {
+	return c.ready
+}
+
+func TestProbeReadiness(t *testing.T) {
+	ctx := context.Background()
+	controller := &fakeReadinessController{}
+	s := &service{mode: "controller", cnscs: controller}
+
+	// The liveness of the controller doesn't depend on its initialization
+	for _, mode := range []string{"controller", "node"} {
+		s.mode = mode
+		resp, err := s.Probe(ctx, &csi.ProbeRequest{})
+		if err != nil || !resp.GetReady().GetValue() {
+			t.Errorf("expected the %s service to be ready before the controller is ready, got %v (err: %v)", mode, resp, err)
+		}
+	}
+}
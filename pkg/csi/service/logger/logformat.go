@@ -0,0 +1,87 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// LogFormat represents the output format of the logs.
+type LogFormat string
+
+const (
+	// TextLogFormat logs the RPC calls as formatted messages. This is the default.
+	TextLogFormat LogFormat = "text"
+	// JSONLogFormat logs JSON entries, with the RPC calls logged with the rpc,
+	// volumeID, requestID and duration fields, for log aggregation pipelines.
+	JSONLogFormat LogFormat = "json"
+	// LogRequestIDKey holds the request ID for log in JSON format.
+	LogRequestIDKey = "requestID"
+)
+
+var (
+	// logFormat is the output format of the logs.
+	logFormat = TextLogFormat
+	// logFormatLock protects logFormat.
+	logFormatLock sync.RWMutex
+)
+
+// ParseLogFormat parses the given log format, which defaults to text if empty.
+func ParseLogFormat(format string) (LogFormat, error) {
+	switch LogFormat(strings.ToLower(strings.TrimSpace(format))) {
+	case "", TextLogFormat:
+		return TextLogFormat, nil
+	case JSONLogFormat:
+		return JSONLogFormat, nil
+	}
+	return "", fmt.Errorf("invalid log format %q, expected %q or %q", format, TextLogFormat, JSONLogFormat)
+}
+
+// SetLogFormat sets the output format of the logs created after the call.
+func SetLogFormat(ctx context.Context, format string) error {
+	parsed, err := ParseLogFormat(format)
+	if err != nil {
+		return err
+	}
+	logFormatLock.Lock()
+	previous := logFormat
+	logFormat = parsed
+	logFormatLock.Unlock()
+	if previous != parsed {
+		GetLogger(ctx).Infof("Setting log format to %q", parsed)
+	}
+	return nil
+}
+
+// getLogFormat returns the output format of the logs.
+func getLogFormat() LogFormat {
+	logFormatLock.RLock()
+	defer logFormatLock.RUnlock()
+	return logFormat
+}
+
+// getCtxIDKey returns the key of the ID of the context of the logs, which is
+// requestID in JSON format.
+func getCtxIDKey() string {
+	if getLogFormat() == JSONLogFormat {
+		return LogRequestIDKey
+	}
+	return LogCtxIDKey
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLogRPCCallJSONFormat(t *testing.T) {
+	defer func() { _ = SetLogFormat(context.Background(), "") }()
+	if err := SetLogFormat(context.Background(), "json"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	ctx := withLogger(context.Background(), zap.New(zapcore.NewCore(encoder, zapcore.AddSync(&buf), zapcore.InfoLevel)))
+	ctx = NewContextWithLogger(ctx)
+
+	LogRPCCall(ctx, "ControllerPublishVolume", struct{ VolumeId, NodeId string }{"vol-1", "node-1"})()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected the call and the completion of the RPC to be logged, got %q", buf.String())
+	}
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("expected a JSON entry, got %q. err: %v", line, err)
+		}
+		if entry["rpc"] != "ControllerPublishVolume" || entry["volumeID"] != "vol-1" {
+			t.Errorf("expected the rpc and volumeID fields, got %v", entry)
+		}
+		if id, ok := entry[LogRequestIDKey].(string); !ok || id == "" {
+			t.Errorf("expected the requestID field, got %v", entry)
+		}
+		if _, ok := entry["duration"]; ok != (i == 1) {
+			t.Errorf("expected the duration field only in the completion entry, got %v", entry)
+		}
+	}
+
+	if _, err := ParseLogFormat("xml"); err == nil {
+		t.Error("expected log format xml to be rejected")
+	}
+}
@@ -54,17 +54,23 @@ func GetLogger(ctx context.Context) *zap.SugaredLogger {
 
 // NewContextWithLogger returns a new child context with context UUID set using key CtxId
 func NewContextWithLogger(ctx context.Context) context.Context {
-	newCtx := withFields(ctx, zap.String(LogCtxIDKey, uuid.New().String()))
+	newCtx := withFields(ctx, zap.String(getCtxIDKey(), uuid.New().String()))
 	return newCtx
 }
 
 // GetNewContextWithLogger creates a new context with context UUID and logger set
 // func returns both context and logger to the caller.
 func GetNewContextWithLogger() (context.Context, *zap.SugaredLogger) {
-	newCtx := withFields(context.Background(), zap.String(LogCtxIDKey, uuid.New().String()))
+	newCtx := withFields(context.Background(), zap.String(getCtxIDKey(), uuid.New().String()))
 	return newCtx, GetLogger(newCtx)
 }
 
+// WithLogger returns a new context derived from ctx that is associated with the
+// given logger, e.g. to observe the logs of a call in tests.
+func WithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return withLogger(ctx, logger)
+}
+
 // withLogger returns a new context derived from ctx that
 // is associated with the given logger.
 func withLogger(ctx context.Context, logger *zap.Logger) context.Context {
@@ -77,11 +83,15 @@ func withFields(ctx context.Context, fields ...zapcore.Field) context.Context {
 	return withLogger(ctx, getLogger(ctx).With(fields...))
 }
 
-// newLogger creates and return a new logger depending logLevel set
+// newLogger creates and return a new logger depending logLevel and log format set
 func newLogger() *zap.Logger {
 	var logger *zap.Logger
 	if defaultLogLevel == DevelopmentLogLevel {
-		logger, _ = zap.NewDevelopment()
+		loggerConfig := zap.NewDevelopmentConfig()
+		if getLogFormat() == JSONLogFormat {
+			loggerConfig.Encoding = "json"
+		}
+		logger, _ = loggerConfig.Build()
 	} else {
 		loggerConfig := zap.NewProductionConfig()
 		loggerConfig.EncoderConfig.TimeKey = "time"
@@ -0,0 +1,93 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimitedLogger logs repeated identical messages at most once per interval.
+// When a suppressed message is logged again, the number of occurrences which
+// were suppressed in the meantime is appended to it.
+type RateLimitedLogger struct {
+	interval time.Duration
+	mutex    sync.Mutex
+	messages map[string]*messageState
+	// now returns the current time; overridden in tests.
+	now func() time.Time
+}
+
+// messageState tracks when a message was last logged and how many times it
+// was suppressed since.
+type messageState struct {
+	lastLogged time.Time
+	suppressed int
+}
+
+// NewRateLimitedLogger returns a RateLimitedLogger which logs identical messages
+// at most once per the given interval.
+func NewRateLimitedLogger(interval time.Duration) *RateLimitedLogger {
+	return &RateLimitedLogger{
+		interval: interval,
+		messages: make(map[string]*messageState),
+		now:      time.Now,
+	}
+}
+
+// Errorf logs the formatted message at error level with the logger associated
+// with the given context, unless it was already logged within the interval.
+func (l *RateLimitedLogger) Errorf(ctx context.Context, template string, args ...interface{}) {
+	if msg, ok := l.allow(fmt.Sprintf(template, args...)); ok {
+		GetLogger(ctx).Error(msg)
+	}
+}
+
+// Warnf logs the formatted message at warn level with the logger associated
+// with the given context, unless it was already logged within the interval.
+func (l *RateLimitedLogger) Warnf(ctx context.Context, template string, args ...interface{}) {
+	if msg, ok := l.allow(fmt.Sprintf(template, args...)); ok {
+		GetLogger(ctx).Warn(msg)
+	}
+}
+
+// allow returns true along with the message to log if the given message was not
+// logged within the interval, otherwise records the message as suppressed.
+func (l *RateLimitedLogger) allow(msg string) (string, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	state, exists := l.messages[msg]
+	if exists && now.Sub(state.lastLogged) < l.interval {
+		state.suppressed++
+		return "", false
+	}
+	// Forget the messages which were not repeated within the interval
+	for key, s := range l.messages {
+		if now.Sub(s.lastLogged) >= l.interval && s.suppressed == 0 {
+			delete(l.messages, key)
+		}
+	}
+	logMsg := msg
+	if exists && state.suppressed > 0 {
+		logMsg = fmt.Sprintf("%s (suppressed %d identical messages in the last %v)", msg, state.suppressed, now.Sub(state.lastLogged).Round(time.Second))
+	}
+	l.messages[msg] = &messageState{lastLogged: now}
+	return logMsg, true
+}
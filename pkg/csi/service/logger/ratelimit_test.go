@@ -0,0 +1,52 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logger
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedLoggerSuppressesDuplicates(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimitedLogger(time.Minute)
+	l.now = func() time.Time { return now }
+
+	msg := "failed to query volumes on datastore: \"ds:///vmfs/volumes/datastore-1/\""
+	if _, ok := l.allow(msg); !ok {
+		t.Fatal("expected first occurrence of the message to be logged")
+	}
+	for i := 0; i < 3; i++ {
+		now = now.Add(10 * time.Second)
+		if _, ok := l.allow(msg); ok {
+			t.Fatalf("expected occurrence %d of the message within the interval to be suppressed", i+2)
+		}
+	}
+	if _, ok := l.allow("another message"); !ok {
+		t.Error("expected a different message to be logged")
+	}
+
+	now = now.Add(time.Minute)
+	logMsg, ok := l.allow(msg)
+	if !ok {
+		t.Fatal("expected message to be logged after the interval")
+	}
+	if !strings.Contains(logMsg, "suppressed 3 identical messages") {
+		t.Errorf("expected suppressed count summary in message, got %q", logMsg)
+	}
+}
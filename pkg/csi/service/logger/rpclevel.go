@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	// rpcLogLevels holds the levels the calls of the RPCs are logged at, keyed
+	// by RPC name. RPCs which are not present are logged at info level.
+	rpcLogLevels = make(map[string]zapcore.Level)
+	// rpcLogLevelsLock protects rpcLogLevels.
+	rpcLogLevelsLock sync.RWMutex
+)
+
+// ParseRPCLogLevels parses a comma separated list of per RPC log levels, such as
+// "ControllerGetCapabilities:debug,GetCapacity:debug".
+func ParseRPCLogLevels(rpcLevels string) (map[string]zapcore.Level, error) {
+	levels := make(map[string]zapcore.Level)
+	for _, entry := range strings.Split(rpcLevels, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid RPC log level %q, expected <rpc>:<level>", entry)
+		}
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(parts[1]))); err != nil {
+			return nil, fmt.Errorf("invalid log level for RPC %q. err: %v", parts[0], err)
+		}
+		levels[strings.TrimSpace(parts[0])] = level
+	}
+	return levels, nil
+}
+
+// SetRPCLogLevels sets the levels the calls of the RPCs are logged at from the
+// given comma separated list of per RPC log levels.
+func SetRPCLogLevels(ctx context.Context, rpcLevels string) error {
+	levels, err := ParseRPCLogLevels(rpcLevels)
+	if err != nil {
+		return err
+	}
+	rpcLogLevelsLock.Lock()
+	defer rpcLogLevelsLock.Unlock()
+	rpcLogLevels = levels
+	GetLogger(ctx).Debugf("RPC log levels: %v", levels)
+	return nil
+}
+
+// LogRPCCall logs the call of the given RPC with its request, at the level
+// configured for the RPC. In JSON format, the call is logged with the rpc and
+// volumeID fields, and the returned func logs the completion of the call with
+// its duration, so it should be deferred by the RPC.
+func LogRPCCall(ctx context.Context, rpc string, req interface{}) func() {
+	rpcLogLevelsLock.RLock()
+	level, ok := rpcLogLevels[rpc]
+	rpcLogLevelsLock.RUnlock()
+	if !ok {
+		level = zapcore.InfoLevel
+	}
+	logger := getLogger(ctx)
+	if getLogFormat() != JSONLogFormat {
+		if ce := logger.Check(level, fmt.Sprintf("%s: called with args %+v", rpc, req)); ce != nil {
+			ce.Write()
+		}
+		return func() {}
+	}
+	logger = logger.With(zap.String("rpc", rpc))
+	if volumeID := getRequestVolumeID(req); volumeID != "" {
+		logger = logger.With(zap.String("volumeID", volumeID))
+	}
+	if ce := logger.Check(level, rpc+": called"); ce != nil {
+		ce.Write(zap.String("args", fmt.Sprintf("%+v", req)))
+	}
+	start := time.Now()
+	return func() {
+		if ce := logger.Check(level, rpc+": completed"); ce != nil {
+			ce.Write(zap.Duration("duration", time.Since(start)))
+		}
+	}
+}
+
+// getRequestVolumeID returns the VolumeId field of the given RPC request, or
+// an empty string if the request has none.
+func getRequestVolumeID(req interface{}) string {
+	value := reflect.Indirect(reflect.ValueOf(req))
+	if value.Kind() != reflect.Struct {
+		return ""
+	}
+	field := value.FieldByName("VolumeId")
+	if !field.IsValid() || field.Kind() != reflect.String {
+		return ""
+	}
+	return field.String()
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logger
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogRPCCall(t *testing.T) {
+	defer func() { _ = SetRPCLogLevels(context.Background(), "") }()
+	if err := SetRPCLogLevels(context.Background(), "ControllerGetCapabilities:debug"); err != nil {
+		t.Fatal(err)
+	}
+	core, logs := observer.New(zapcore.InfoLevel)
+	ctx := withLogger(context.Background(), zap.New(core))
+
+	LogRPCCall(ctx, "ControllerGetCapabilities", struct{}{})
+	if logs.Len() != 0 {
+		t.Errorf("expected demoted RPC to not be logged at info level, got %v", logs.All())
+	}
+	LogRPCCall(ctx, "CreateVolume", struct{ Name string }{"pvc"})
+	entries := logs.TakeAll()
+	if len(entries) != 1 || entries[0].Level != zapcore.InfoLevel ||
+		entries[0].Message != "CreateVolume: called with args {Name:pvc}" {
+		t.Errorf("expected CreateVolume to be logged at info level, got %v", entries)
+	}
+}
+
+func TestParseRPCLogLevels(t *testing.T) {
+	levels, err := ParseRPCLogLevels(" ControllerGetCapabilities:debug, GetCapacity:warn ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 || levels["ControllerGetCapabilities"] != zapcore.DebugLevel ||
+		levels["GetCapacity"] != zapcore.WarnLevel {
+		t.Errorf("unexpected RPC log levels %v", levels)
+	}
+	for _, invalid := range []string{"ControllerGetCapabilities", ":debug", "GetCapacity:verbose"} {
+		if _, err := ParseRPCLogLevels(invalid); err == nil {
+			t.Errorf("expected RPC log levels %q to be rejected", invalid)
+		}
+	}
+}
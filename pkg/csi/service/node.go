@@ -109,6 +109,10 @@ func (s *service) NodeStageVolume(
 		// Retrieve accessmode - RO/RW
 		ro: common.IsVolumeReadOnly(req.GetVolumeCapability()),
 	}
+	// Volumes provisioned as reader-only are always staged read-only
+	if req.GetVolumeContext()[common.AttributeAccessMode] == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY.String() {
+		params.ro = true
+	}
 	// TODO: Verify if volume exists and return a NotFound error in negative scenario
 
 	// Check if this is a MountVolume or Raw BlockVolume
@@ -1284,7 +1288,8 @@ func getDiskID(pubCtx map[string]string) (string, error) {
 			"Attribute: %s required in publish context",
 			common.AttributeFirstClassDiskUUID)
 	}
-	return diskID, nil
+	// The controller may publish the disk UUID in another format, see disk-uuid-format
+	return common.FormatDiskUUIDAs(diskID, common.DiskUUIDFormatCompact), nil
 }
 
 func getDevFromMount(target string) (*Device, error) {
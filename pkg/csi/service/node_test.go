@@ -21,6 +21,8 @@ import (
 	"path/filepath"
 	"testing"
 	"time"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 )
 
 func TestGetDisk(t *testing.T) {
@@ -70,6 +72,21 @@ func TestGetDisk(t *testing.T) {
 	}
 }
 
+func TestGetDiskIDFormats(t *testing.T) {
+	for _, diskUUID := range []string{"6000c29c0a5a3b8e7e9e6a0c12345678", "6000C29C-0A5A-3B8E-7E9E-6A0C12345678"} {
+		diskID, err := getDiskID(map[string]string{common.AttributeFirstClassDiskUUID: diskUUID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diskID != "6000c29c0a5a3b8e7e9e6a0c12345678" {
+			t.Errorf("expected disk UUID %q to be converted to the disk ID format, got %q", diskUUID, diskID)
+		}
+	}
+	if _, err := getDiskID(map[string]string{}); err == nil {
+		t.Error("expected an error without the disk UUID in the publish context")
+	}
+}
+
 type FakeFileInfo struct {
 	name string
 }
@@ -19,6 +19,7 @@ package service
 import (
 	"context"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 
@@ -122,6 +123,17 @@ func (s *service) BeforeServe(
 			log.Errorf("failed to init controller. Error: %+v", err)
 			return err
 		}
+		if metricsAddress := os.Getenv(csitypes.EnvMetricsAddress); metricsAddress != "" {
+			handlers := make(map[string]http.Handler)
+			if readinessReporter, ok := s.cnscs.(csitypes.ReadinessReporter); ok {
+				handlers[common.ReadinessPath] = common.NewReadinessHandler(readinessReporter.IsReady)
+			}
+			if inFlightReporter, ok := s.cnscs.(common.InFlightOperationsReporter); ok {
+				handlers[common.InFlightOperationsPath] = common.NewInFlightOperationsHandler(
+					inFlightReporter.ListInFlightOperations)
+			}
+			common.ServeMetrics(ctx, metricsAddress, handlers)
+		}
 	}
 	return nil
 }
@@ -20,7 +20,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
 	"path/filepath"
 	"strings"
 	"time"
@@ -43,6 +42,7 @@ import (
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
 )
 
 // NodeManagerInterface provides functionality to manage nodes.
@@ -52,11 +52,24 @@ type NodeManagerInterface interface {
 	GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneKey string, regionKey string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error)
 	GetNodeByName(ctx context.Context, nodeName string) (*cnsvsphere.VirtualMachine, error)
 	GetAllNodes(ctx context.Context) ([]*cnsvsphere.VirtualMachine, error)
+	GetTopologySegments(ctx context.Context, zoneKey string, regionKey string) ([]map[string]string, error)
 }
 
 type controller struct {
 	manager *common.Manager
 	nodeMgr NodeManagerInterface
+	// createVolumeLimiter limits the concurrent CreateVolume requests per storage policy
+	createVolumeLimiter *common.ConcurrencyLimiter
+	// namespaceQuotas enforces the capacity quotas of the namespaces
+	namespaceQuotas *common.NamespaceQuotas
+	// deleteVolumeCalls deduplicates the concurrent DeleteVolume requests for the same volume
+	deleteVolumeCalls *common.InFlightCalls
+	// inFlightOperations tracks the create, delete, attach and detach operations in progress
+	inFlightOperations *common.InFlightOperations
+	// readiness reports whether the controller is ready to serve RPCs
+	readiness common.Readiness
+	// placementEvents records the datastores the block volumes are placed on
+	placementEvents *common.PlacementEventRecorder
 }
 
 // timedmap of deleted volumes. This map used to resolve race between detach and delete volume
@@ -71,6 +84,7 @@ var (
 	VSAN67u3ControllerServiceCapability = []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 	}
 
 	// VSAN7ControllerServiceCapability represents the capability of controller service
@@ -79,6 +93,7 @@ var (
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 	}
 )
 
@@ -120,6 +135,48 @@ func (c *controller) Init(config *config.Config) error {
 		log.Errorf("failed to get vcenter. err=%v", err)
 		return err
 	}
+	if c.namespaceQuotas, err = common.NewNamespaceQuotas(config.Global.NamespaceCapacityQuotas); err != nil {
+		log.Errorf("failed to parse namespace-capacity-quotas. err=%v", err)
+		return err
+	}
+	if err := common.ValidateDatastoreSelection(config.Global.DatastoreSelection); err != nil {
+		log.Errorf("invalid datastore-selection. err=%v", err)
+		return err
+	}
+	if err := common.ValidateDuplicateVolumeNamePolicy(config.Global.DuplicateVolumeNamePolicy); err != nil {
+		log.Errorf("invalid duplicate-volume-name-policy. err=%v", err)
+		return err
+	}
+	if err := common.ValidateCapacityAggregation(config.Global.CapacityAggregation); err != nil {
+		log.Errorf("invalid capacity-aggregation. err=%v", err)
+		return err
+	}
+	if err := common.ValidateDiskUUIDFormat(config.Global.DiskUUIDFormat); err != nil {
+		log.Errorf("invalid disk-uuid-format. err=%v", err)
+		return err
+	}
+	if _, err := common.ParseChargebackLabels(config.Global.ChargebackLabels); err != nil {
+		log.Errorf("invalid chargeback-labels. err=%v", err)
+		return err
+	}
+	c.createVolumeLimiter = common.NewConcurrencyLimiter(config.Global.MaxConcurrentCreateVolumesPerPolicy)
+	c.deleteVolumeCalls = common.NewInFlightCalls()
+	c.inFlightOperations = common.NewInFlightOperations()
+	c.manager.DatastoreReservations = common.NewDatastoreReservations()
+	if config.Global.VolumeInventoryRefreshIntervalInMin > 0 {
+		log.Infof("Volume inventory is enabled with refresh interval of %d minutes",
+			config.Global.VolumeInventoryRefreshIntervalInMin)
+		c.manager.VolumeInventory = common.StartVolumeInventory(logger.NewContextWithLogger(context.Background()),
+			c.manager, time.Duration(config.Global.VolumeInventoryRefreshIntervalInMin)*time.Minute)
+	}
+	if config.Global.PlacementEvents {
+		k8sClient, err := k8s.NewClient(ctx)
+		if err != nil {
+			log.Warnf("failed to create kubernetes client, placement events will not be recorded. err=%v", err)
+		} else {
+			c.placementEvents = common.NewPlacementEventRecorder(k8sClient)
+		}
+	}
 
 	if len(c.manager.VcenterConfig.TargetvSANFileShareDatastoreURLs) > 0 {
 		// Check if file service is enabled on datastore present in targetvSANFileShareDatastoreURLs.
@@ -150,6 +207,22 @@ func (c *controller) Init(config *config.Config) error {
 		log.Errorf("failed to initialize nodeMgr. err=%v", err)
 		return err
 	}
+	cnsvolume.SetRetryableFaults(ctx, strings.Split(config.Global.RetryableFaults, ","))
+	cnsvolume.SetRateLimit(ctx, config.Global.CnsClientQPS, config.Global.CnsClientBurst,
+		config.Global.CnsClientRateLimitFailFast)
+	common.SetAllowedMountFlags(ctx, config.Global.AllowedMountFlags)
+	cnsvolume.SetProvisioningRateLimit(ctx, config.Global.MaxVolumeProvisioningsPerMinute)
+	if err := logger.SetRPCLogLevels(ctx, config.Global.RPCLogLevels); err != nil {
+		log.Errorf("failed to parse rpc-log-levels. err=%v", err)
+		return err
+	}
+	if err := logger.SetLogFormat(ctx, config.Global.LogFormat); err != nil {
+		log.Errorf("failed to parse log-format. err=%v", err)
+		return err
+	}
+	if config.Global.RetainBackingDisk {
+		log.Warnf("retainbackingdisk is enabled. Backing disks of deleted volumes will NOT be deleted and must be cleaned up manually")
+	}
 	go cnsvolume.ClearTaskInfoObjects()
 	cfgPath := common.GetConfigPath(ctx)
 	watcher, err := fsnotify.NewWatcher()
@@ -198,14 +271,32 @@ func (c *controller) Init(config *config.Config) error {
 			return err
 		}
 	}
+	go c.readiness.SetReadyAfterSharedDatastores(logger.NewContextWithLogger(context.Background()),
+		common.ReadinessRetryInterval, func(ctx context.Context) error {
+			_, err := c.nodeMgr.GetSharedDatastoresInK8SCluster(ctx)
+			return err
+		})
 	return nil
 }
 
+// IsReady returns true once the controller is initialized and computed the shared
+// datastores successfully.
+func (c *controller) IsReady(ctx context.Context) bool {
+	return c.readiness.IsReady()
+}
+
+// ListInFlightOperations returns the create, delete, attach and detach operations in
+// progress, oldest first, so that operators can see what the controller is doing.
+// They are served at the in-flight operations path of the metrics server.
+func (c *controller) ListInFlightOperations(ctx context.Context) []common.InFlightOperation {
+	return c.inFlightOperations.List()
+}
+
 // ReloadConfiguration reloads configuration from the secret, and update controller's config cache
 // and VolumeManager's VC Config cache.
 func (c *controller) ReloadConfiguration(ctx context.Context) {
 	log := logger.GetLogger(ctx)
-	cfg, err := common.GetConfig(ctx)
+	cfg, err := common.GetConfigWithRetry(ctx, common.ReloadConfigReadAttempts, common.ReloadConfigReadBackoff)
 	if err != nil {
 		log.Errorf("failed to read config. Error: %+v", err)
 		return
@@ -217,9 +308,12 @@ func (c *controller) ReloadConfiguration(ctx context.Context) {
 	}
 	if newVCConfig != nil {
 		var vcenter *cnsvsphere.VirtualCenter
-		if c.manager.VcenterConfig.Host != newVCConfig.Host ||
-			c.manager.VcenterConfig.Username != newVCConfig.Username ||
-			c.manager.VcenterConfig.Password != newVCConfig.Password {
+		if common.IsVirtualCenterConfigChanged(c.manager.VcenterConfig, newVCConfig) {
+			thumbprintChanged := c.manager.VcenterConfig.Thumbprint != newVCConfig.Thumbprint
+			if thumbprintChanged {
+				log.Infof("Certificate thumbprint of virtual center: %q has changed. Re-establishing connection with the new thumbprint",
+					newVCConfig.Host)
+			}
 			log.Debugf("Unregistering virtual center: %q from virtualCenterManager", c.manager.VcenterConfig.Host)
 			err = c.manager.VcenterManager.UnregisterAllVirtualCenters(ctx)
 			if err != nil {
@@ -232,6 +326,13 @@ func (c *controller) ReloadConfiguration(ctx context.Context) {
 				log.Errorf("failed to register VC with virtualCenterManager. err=%v", err)
 				return
 			}
+			if thumbprintChanged {
+				if err = vcenter.Connect(ctx); err != nil {
+					log.Errorf("failed to connect to virtual center: %q using the new thumbprint. err=%v", newVCConfig.Host, err)
+				} else {
+					log.Infof("Successfully connected to virtual center: %q using the new thumbprint", newVCConfig.Host)
+				}
+			}
 			c.manager.VcenterManager = cnsvsphere.GetVirtualCenterManager(ctx)
 		} else {
 			vcenter, err = c.manager.VcenterManager.GetVirtualCenter(ctx, newVCConfig.Host)
@@ -247,6 +348,28 @@ func (c *controller) ReloadConfiguration(ctx context.Context) {
 	if cfg != nil {
 		log.Debugf("Updating manager.CnsConfig")
 		c.manager.CnsConfig = cfg
+		cnsvolume.SetRetryableFaults(ctx, strings.Split(cfg.Global.RetryableFaults, ","))
+		cnsvolume.SetRateLimit(ctx, cfg.Global.CnsClientQPS, cfg.Global.CnsClientBurst,
+			cfg.Global.CnsClientRateLimitFailFast)
+		common.SetAllowedMountFlags(ctx, cfg.Global.AllowedMountFlags)
+		cnsvolume.SetProvisioningRateLimit(ctx, cfg.Global.MaxVolumeProvisioningsPerMinute)
+		// The vCenter or the cluster IDs may have changed, so the volume inventory is
+		// queried again
+		c.manager.VolumeInventory.Invalidate()
+		go func() {
+			_ = c.manager.VolumeInventory.Refresh(ctx, c.manager)
+		}()
+		if err := logger.SetRPCLogLevels(ctx, cfg.Global.RPCLogLevels); err != nil {
+			log.Warnf("failed to parse rpc-log-levels, keeping the previous RPC log levels. err=%v", err)
+		}
+		if err := logger.SetLogFormat(ctx, cfg.Global.LogFormat); err != nil {
+			log.Warnf("failed to parse log-format, keeping the previous log format. err=%v", err)
+		}
+		if c.namespaceQuotas != nil {
+			if err := c.namespaceQuotas.SetQuotas(cfg.Global.NamespaceCapacityQuotas); err != nil {
+				log.Warnf("failed to parse namespace-capacity-quotas, keeping the previous quotas. err=%v", err)
+			}
+		}
 	}
 }
 
@@ -261,12 +384,23 @@ func (c *controller) createBlockVolume(ctx context.Context, req *csi.CreateVolum
 	}
 	volSizeMB := int64(common.RoundUpSize(volSizeBytes, common.MbInBytes))
 
-	scParams, err := common.ParseStorageClassParams(ctx, req.Parameters)
+	params, err := common.ExpandParamTemplates(req.Parameters, getParamTemplateVars(c.manager.CnsConfig, req.GetAccessibilityRequirements()))
+	if err != nil {
+		msg := fmt.Sprintf("Expanding storage class parameters failed with error: %+v", err)
+		log.Error(msg)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+	scParams, err := common.ParseStorageClassParams(ctx, params)
 	if err != nil {
 		msg := fmt.Sprintf("Parsing storage class parameters failed with error: %+v", err)
 		log.Error(msg)
 		return nil, status.Errorf(codes.InvalidArgument, msg)
 	}
+	releaseQuota, err := c.namespaceQuotas.Reserve(ctx, c.manager, scParams.PVCNamespace, volSizeMB)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseQuota()
 
 	if c.manager.CnsConfig.FeatureStates.CSIMigration && scParams.CSIMigration == "true" {
 		if len(scParams.Datastore) != 0 {
@@ -320,6 +454,12 @@ func (c *controller) createBlockVolume(ctx context.Context, req *csi.CreateVolum
 		ScParams:   scParams,
 		VolumeType: common.BlockVolumeType,
 	}
+	releaseSlot, err := common.AcquireCreateVolumeSlot(ctx, c.createVolumeLimiter,
+		c.manager.CnsConfig.Global.MaxConcurrentCreateVolumesPerPolicy, scParams.StoragePolicyName)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSlot()
 
 	var sharedDatastores []*cnsvsphere.DatastoreInfo
 	var datastoreTopologyMap = make(map[string][]map[string]string)
@@ -333,12 +473,14 @@ func (c *controller) createBlockVolume(ctx context.Context, req *csi.CreateVolum
 			// NotFound error.
 			errMsg := "Zone/Region vsphere category names not specified in the vsphere config secret"
 			log.Errorf(errMsg)
+			common.RecordCreateVolumeRejection(common.CreateVolumeRejectionTopology)
 			return nil, status.Error(codes.NotFound, errMsg)
 		}
 		sharedDatastores, datastoreTopologyMap, err = c.nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement, c.manager.CnsConfig.Labels.Zone, c.manager.CnsConfig.Labels.Region)
 		if err != nil || len(sharedDatastores) == 0 {
 			msg := fmt.Sprintf("failed to get shared datastores in topology: %+v. Error: %+v", topologyRequirement, err)
 			log.Errorf(msg)
+			common.RecordCreateVolumeRejection(common.CreateVolumeRejectionTopology)
 			return nil, status.Error(codes.NotFound, msg)
 		}
 		log.Debugf("Shared datastores [%+v] retrieved for topologyRequirement [%+v] with datastoreTopologyMap [+%v]", sharedDatastores, topologyRequirement, datastoreTopologyMap)
@@ -346,7 +488,8 @@ func (c *controller) createBlockVolume(ctx context.Context, req *csi.CreateVolum
 			// Check datastoreURL specified in the storageclass is accessible from topology
 			isDataStoreAccessible := false
 			for _, sharedDatastore := range sharedDatastores {
-				if sharedDatastore.Info.Url == createVolumeSpec.ScParams.DatastoreURL {
+				if cnsvsphere.NormalizeDatastoreURL(sharedDatastore.Info.Url) ==
+					cnsvsphere.NormalizeDatastoreURL(createVolumeSpec.ScParams.DatastoreURL) {
 					isDataStoreAccessible = true
 					break
 				}
@@ -355,6 +498,7 @@ func (c *controller) createBlockVolume(ctx context.Context, req *csi.CreateVolum
 				errMsg := fmt.Sprintf("DatastoreURL: %s specified in the storage class is not accessible in the topology:[+%v]",
 					createVolumeSpec.ScParams.DatastoreURL, topologyRequirement)
 				log.Errorf(errMsg)
+				common.RecordCreateVolumeRejection(common.CreateVolumeRejectionTopology)
 				return nil, status.Error(codes.InvalidArgument, errMsg)
 			}
 		}
@@ -367,14 +511,65 @@ func (c *controller) createBlockVolume(ctx context.Context, req *csi.CreateVolum
 			return nil, status.Errorf(codes.Internal, msg)
 		}
 	}
+	if scParams.ValidateAttachable {
+		// Only the datastores accessible from a node are candidates, so that the volume
+		// is attachable once created
+		sharedDatastores, err = c.filterAttachableDatastores(ctx, sharedDatastores)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ctx, exclusions := common.WithDatastoreExclusions(ctx)
+	ctx, warnings := common.WithCreateVolumeWarnings(ctx)
+	ctx, cnsTaskID := cnsvolume.WithCnsTaskID(ctx)
+	if createVolumeSpec.ScParams.DatastoreURL != "" {
+		// The volume can only be placed on the datastore pinned by the storage class,
+		// so its headroom is checked instead of filtering it out
+		for _, datastore := range sharedDatastores {
+			if cnsvsphere.NormalizeDatastoreURL(datastore.Info.Url) ==
+				cnsvsphere.NormalizeDatastoreURL(createVolumeSpec.ScParams.DatastoreURL) {
+				if err = common.ValidateDatastoreFreeSpaceHeadroom(ctx, c.manager, datastore, createVolumeSpec.CapacityMB); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	} else {
+		sharedDatastores, err = common.FilterDatastoresByFreeSpaceHeadroom(ctx, c.manager, sharedDatastores, createVolumeSpec.CapacityMB)
+		if err != nil {
+			return nil, err
+		}
+	}
 	volumeID, err := common.CreateBlockVolumeUtil(ctx, cnstypes.CnsClusterFlavorVanilla, c.manager, &createVolumeSpec, sharedDatastores)
+	if len(exclusions) > 0 {
+		log.Debugf("datastores excluded from the placement of volume %q: %s", req.Name, exclusions)
+	}
 	if err != nil {
 		msg := fmt.Sprintf("failed to create volume. Error: %+v", err)
 		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Error(common.GetErrorCode(err, codes.Internal), msg)
 	}
 	attributes := make(map[string]string)
 	attributes[common.AttributeDiskType] = common.DiskTypeBlockVolume
+	attributes[common.AttributeAccessMode] = common.GetBlockVolumeAccessMode(req.GetVolumeCapabilities()).String()
+	if c.manager.CnsConfig.Global.ReportDatastoreExclusions && len(exclusions) > 0 {
+		attributes[common.AttributeDatastoreExclusions] = exclusions.String()
+	}
+	if warnings.Len() > 0 {
+		attributes[common.AttributeWarnings] = warnings.String()
+	}
+	if cnsTaskID.String() != "" {
+		attributes[common.AttributeCnsTaskID] = cnsTaskID.String()
+	}
+	if scParams.AntiAffinityGroup != "" {
+		attributes[common.AttributeAntiAffinityGroup] = scParams.AntiAffinityGroup
+	}
+	if scParams.StoragePolicyName != "" {
+		attributes[common.AttributeStoragePolicyName] = scParams.StoragePolicyName
+	}
+	if c.manager.CnsConfig.Global.ClusterVersion != "" {
+		attributes[common.AttributeClusterVersion] = c.manager.CnsConfig.Global.ClusterVersion
+	}
 	if c.manager.CnsConfig.FeatureStates.CSIMigration && scParams.CSIMigration == "true" {
 		// Return InitialVolumeFilepath in the response for TranslateCSIPVToInTree
 		volumePath, err := volumeMigrationService.GetVolumePath(ctx, volumeID)
@@ -395,35 +590,63 @@ func (c *controller) createBlockVolume(ctx context.Context, req *csi.CreateVolum
 	}
 
 	// Call QueryVolume API and get the datastoreURL of the Provisioned Volume
-	var volumeAccessibleTopology = make(map[string]string)
-	if len(datastoreTopologyMap) > 0 {
+	needsDatastore := len(datastoreTopologyMap) > 0
+	if needsDatastore || c.placementEvents != nil {
 		volumeIds := []cnstypes.CnsVolumeId{{Id: volumeID}}
 		queryFilter := cnstypes.CnsQueryFilter{
 			VolumeIds: volumeIds,
 		}
 		queryResult, err := c.manager.VolumeManager.QueryVolume(ctx, queryFilter)
 		if err != nil {
-			log.Errorf("QueryVolume failed for volumeID: %s", volumeID)
-			return nil, status.Error(codes.Internal, err.Error())
-		}
-		if len(queryResult.Volumes) > 0 {
-			// Find datastore topology from the retrieved datastoreURL
-			datastoreAccessibleTopology := datastoreTopologyMap[queryResult.Volumes[0].DatastoreUrl]
-			log.Debugf("Volume: %s is provisioned on the datastore: %s ", volumeID, queryResult.Volumes[0].DatastoreUrl)
-			if len(datastoreAccessibleTopology) > 0 {
-				rand.Seed(time.Now().Unix())
-				volumeAccessibleTopology = datastoreAccessibleTopology[rand.Intn(len(datastoreAccessibleTopology))]
-				log.Debugf("volumeAccessibleTopology: [%+v] is selected for datastore: %s ", volumeAccessibleTopology, queryResult.Volumes[0].DatastoreUrl)
+			if needsDatastore {
+				log.Errorf("QueryVolume failed for volumeID: %s", volumeID)
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			log.Warnf("QueryVolume failed for volumeID: %s, its placement will not be recorded. Error: %+v",
+				volumeID, err)
+		} else if len(queryResult.Volumes) > 0 {
+			datastoreURL := queryResult.Volumes[0].DatastoreUrl
+			log.Debugf("Volume: %s is provisioned on the datastore: %s ", volumeID, datastoreURL)
+			if len(datastoreTopologyMap) > 0 {
+				// The volume is accessible from all the topologies the datastore is accessible from
+				resp.Volume.AccessibleTopology = getDatastoreAccessibleTopologies(datastoreTopologyMap, datastoreURL)
+				log.Debugf("volumeAccessibleTopology: [%+v] is selected for datastore: %s ",
+					resp.Volume.AccessibleTopology, datastoreURL)
 			}
+			c.placementEvents.Record(ctx, scParams.PVCNamespace, scParams.PVCName, volumeID, datastoreURL)
 		}
 	}
-	if len(volumeAccessibleTopology) != 0 {
-		volumeTopology := &csi.Topology{
-			Segments: volumeAccessibleTopology,
+	return resp, nil
+}
+
+// filterAttachableDatastores returns the given datastores which are accessible from
+// at least one node of the cluster, so that the block volumes placed on them are
+// attachable. FailedPrecondition is returned if none of them is.
+func (c *controller) filterAttachableDatastores(ctx context.Context, datastores []*cnsvsphere.DatastoreInfo) (
+	[]*cnsvsphere.DatastoreInfo, error) {
+	log := logger.GetLogger(ctx)
+	nodes, err := c.nodeMgr.GetAllNodes(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("failed to get the nodes to validate the volume is attachable. Error: %+v", err)
+		log.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	attachable, err := filterDatastoresAccessibleFromNodes(ctx, nodes, datastores)
+	if err != nil {
+		msg := fmt.Sprintf("failed to validate the volume is attachable. Error: %+v", err)
+		log.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	if len(attachable) == 0 {
+		var datastoreURLs []string
+		for _, datastore := range datastores {
+			datastoreURLs = append(datastoreURLs, datastore.Info.Url)
 		}
-		resp.Volume.AccessibleTopology = append(resp.Volume.AccessibleTopology, volumeTopology)
+		msg := fmt.Sprintf("none of the datastores %v is accessible from any node of the cluster", datastoreURLs)
+		log.Error(msg)
+		return nil, status.Error(codes.FailedPrecondition, msg)
 	}
-	return resp, nil
+	return attachable, nil
 }
 
 // createFileVolume creates a file volume based on the CreateVolumeRequest.
@@ -442,12 +665,23 @@ func (c *controller) createFileVolume(ctx context.Context, req *csi.CreateVolume
 	}
 	volSizeMB := int64(common.RoundUpSize(volSizeBytes, common.MbInBytes))
 
-	scParams, err := common.ParseStorageClassParams(ctx, req.Parameters)
+	params, err := common.ExpandParamTemplates(req.Parameters, getParamTemplateVars(c.manager.CnsConfig, req.GetAccessibilityRequirements()))
+	if err != nil {
+		msg := fmt.Sprintf("Expanding storage class parameters failed with error: %+v", err)
+		log.Error(msg)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+	scParams, err := common.ParseStorageClassParams(ctx, params)
 	if err != nil {
 		msg := fmt.Sprintf("Parsing storage class parameters failed with error: %+v", err)
 		log.Error(msg)
 		return nil, status.Errorf(codes.InvalidArgument, msg)
 	}
+	releaseQuota, err := c.namespaceQuotas.Reserve(ctx, c.manager, scParams.PVCNamespace, volSizeMB)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseQuota()
 
 	var createVolumeSpec = common.CreateVolumeSpec{
 		CapacityMB: volSizeMB,
@@ -460,10 +694,13 @@ func (c *controller) createFileVolume(ctx context.Context, req *csi.CreateVolume
 	if err != nil {
 		msg := fmt.Sprintf("failed to create volume. Error: %+v", err)
 		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Error(common.GetErrorCode(err, codes.Internal), msg)
 	}
 	attributes := make(map[string]string)
 	attributes[common.AttributeDiskType] = common.DiskTypeFileVolume
+	if c.manager.CnsConfig.Global.ClusterVersion != "" {
+		attributes[common.AttributeClusterVersion] = c.manager.CnsConfig.Global.ClusterVersion
+	}
 
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
@@ -475,13 +712,26 @@ func (c *controller) createFileVolume(ctx context.Context, req *csi.CreateVolume
 	return resp, nil
 }
 
+// GetSupportedCreateVolumeParameters returns the storage class parameters
+// recognized by CreateVolume along with their accepted values.
+func (c *controller) GetSupportedCreateVolumeParameters(ctx context.Context) []common.StorageClassParam {
+	return common.GetSupportedStorageClassParams()
+}
+
 // CreateVolume is creating CNS Volume using volume request specified
 // in CreateVolumeRequest
 func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (
 	*csi.CreateVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("CreateVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "CreateVolume", *req)()
+	defer c.inFlightOperations.Start(common.InFlightOperation{Name: "CreateVolume", Volume: req.Name, Parameters: req.Parameters})()
+	if err := common.ValidateNotInMaintenanceMode(ctx, c.manager, "CreateVolume"); err != nil {
+		return nil, err
+	}
+	if err := common.ValidateCreateVolumeAdmission(ctx, req); err != nil {
+		return nil, err
+	}
 
 	if common.IsFileVolumeRequest(ctx, req.GetVolumeCapabilities()) {
 		vsan67u3Release, err := isVsan67u3Release(ctx, c)
@@ -492,6 +742,7 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 		if vsan67u3Release {
 			msg := "fileshare volume creation is not supported on vSAN 67u3 release"
 			log.Error(msg)
+			common.RecordCreateVolumeRejection(common.CreateVolumeRejectionCapability)
 			return nil, status.Error(codes.FailedPrecondition, msg)
 		}
 		return c.createFileVolume(ctx, req)
@@ -503,12 +754,25 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (
 	*csi.DeleteVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
+	defer logger.LogRPCCall(ctx, "DeleteVolume", *req)()
+	defer c.inFlightOperations.Start(common.InFlightOperation{Name: "DeleteVolume", Volume: req.VolumeId})()
+	// Concurrent requests for the same volume share the result of a single deletion
+	err := c.deleteVolumeCalls.Do(ctx, req.VolumeId, func(ctx context.Context) error {
+		return c.deleteVolume(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// deleteVolume deletes the volume of the DeleteVolumeRequest.
+func (c *controller) deleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) error {
 	log := logger.GetLogger(ctx)
-	log.Infof("DeleteVolume: called with args: %+v", *req)
 	var err error
 	err = validateVanillaDeleteVolumeRequest(ctx, req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	var volumePath string
 
@@ -524,7 +788,7 @@ func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 			if err != nil {
 				msg := fmt.Sprintf("failed to get VolumeID from volumeMigrationService for volumePath: %q", volumePath)
 				log.Error(msg)
-				return nil, status.Errorf(codes.Internal, msg)
+				return status.Errorf(codes.Internal, msg)
 			}
 		}
 	} else {
@@ -532,27 +796,42 @@ func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 		if volumePath != "" {
 			msg := fmt.Sprintf("volume-migration feature switch is disabled. Cannot use volume with vmdk path :%q", volumeID)
 			log.Error(msg)
-			return nil, status.Errorf(codes.Internal, msg)
+			return status.Errorf(codes.Internal, msg)
 		}
 	}
-	err = common.DeleteVolumeUtil(ctx, c.manager, req.VolumeId, true)
+	err = common.ValidateVolumeNotAttached(ctx, c.manager, req.VolumeId)
 	if err != nil {
+		return err
+	}
+	deleteDisk := true
+	if c.manager.CnsConfig.Global.RetainBackingDisk {
+		log.Warnf("DeleteVolume: retainbackingdisk is enabled. Volume %q will be removed from CNS but its backing disk will be retained", req.VolumeId)
+		deleteDisk = false
+	}
+	err = common.DeleteVolumeUtil(ctx, c.manager, req.VolumeId, deleteDisk)
+	if err != nil {
+		if cnsvolume.IsHostUnreachableError(err) {
+			msg := fmt.Sprintf("failed to delete volume: %q as the host managing it is unreachable, "+
+				"possibly isolated by vSphere HA. Deletion can be retried once the host is reachable. Error: %+v", req.VolumeId, err)
+			log.Error(msg)
+			return status.Errorf(codes.Unavailable, msg)
+		}
 		msg := fmt.Sprintf("failed to delete volume: %q. Error: %+v", req.VolumeId, err)
 		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return status.Error(common.GetErrorCode(err, codes.Internal), msg)
 	}
 	if c.manager.CnsConfig.FeatureStates.CSIMigration && volumePath != "" {
 		err = volumeMigrationService.DeleteVolumeInfo(ctx, req.VolumeId)
 		if err != nil {
 			msg := fmt.Sprintf("failed to delete volumeInfo CR for volume: %q. Error: %+v", req.VolumeId, err)
 			log.Error(msg)
-			return nil, status.Errorf(codes.Internal, msg)
+			return status.Errorf(codes.Internal, msg)
 		}
 		deletedVolumes.Set(volumePath, true, 5*time.Minute)
 	} else {
 		deletedVolumes.Set(req.VolumeId, true, 5*time.Minute)
 	}
-	return &csi.DeleteVolumeResponse{}, nil
+	return nil
 }
 
 // ControllerPublishVolume attaches a volume to the Node VM.
@@ -561,12 +840,16 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 	*csi.ControllerPublishVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ControllerPublishVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerPublishVolume", *req)()
+	defer c.inFlightOperations.Start(common.InFlightOperation{Name: "ControllerPublishVolume", Volume: req.VolumeId, Node: req.NodeId, Parameters: req.VolumeContext})()
+	if err := common.ValidateNotInMaintenanceMode(ctx, c.manager, "ControllerPublishVolume"); err != nil {
+		return nil, err
+	}
 	err := validateVanillaControllerPublishVolumeRequest(ctx, req)
 	if err != nil {
 		msg := fmt.Sprintf("Validation for PublishVolume Request: %+v has failed. Error: %v", *req, err)
 		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
 	}
 	node, err := c.nodeMgr.GetNodeByName(ctx, req.NodeId)
 	if err != nil {
@@ -576,27 +859,48 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 	}
 
 	log.Debugf("Found VirtualMachine for node:%q.", req.NodeId)
-	publishInfo := make(map[string]string)
-	// Check whether its a block or file volume
-	if common.IsFileVolumeRequest(ctx, []*csi.VolumeCapability{req.GetVolumeCapability()}) {
-		// File Volume
-		queryFilter := cnstypes.CnsQueryFilter{
-			VolumeIds: []cnstypes.CnsVolumeId{{Id: req.VolumeId}},
-		}
-		queryResult, err := c.manager.VolumeManager.QueryVolume(ctx, queryFilter)
-		if err != nil {
-			msg := fmt.Sprintf("QueryVolume failed for volumeID: %q. %+v", req.VolumeId, err.Error())
+	// in-tree volume support
+	if strings.Contains(req.VolumeId, ".vmdk") {
+		volumePath := req.VolumeId
+		if !c.manager.CnsConfig.FeatureStates.CSIMigration {
+			msg := fmt.Sprintf("volume-migration feature switch is disabled. Cannot use volume with vmdk path :%q", volumePath)
 			log.Error(msg)
-			return nil, status.Error(codes.Internal, msg)
+			return nil, status.Errorf(codes.Internal, msg)
 		}
-		if len(queryResult.Volumes) == 0 {
-			msg := fmt.Sprintf("volumeID %s not found in QueryVolume", req.VolumeId)
+		req.VolumeId, err = volumeMigrationService.GetVolumeID(ctx, volumePath)
+		if err != nil {
+			msg := fmt.Sprintf("failed to get VolumeID from volumeMigrationService for volumePath: %q", volumePath)
 			log.Error(msg)
-			return nil, status.Error(codes.Internal, msg)
+			return nil, status.Errorf(codes.Internal, msg)
 		}
+	}
+	// Look up the type of the volume, so that the volume capability is validated
+	// against it for block and file volumes alike
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: req.VolumeId}},
+	}
+	queryResult, err := c.manager.VolumeManager.QueryVolume(ctx, queryFilter)
+	if err != nil {
+		msg := fmt.Sprintf("QueryVolume failed for volumeID: %q. %+v", req.VolumeId, err.Error())
+		log.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	if len(queryResult.Volumes) == 0 {
+		msg := fmt.Sprintf("volumeID %s not found in QueryVolume", req.VolumeId)
+		log.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	volume := queryResult.Volumes[0]
+	err = common.ValidateVolumeCapabilityForVolumeType(ctx, req.GetVolumeCapability(), volume.VolumeType)
+	if err != nil {
+		return nil, err
+	}
 
-		vSANFileBackingDetails := queryResult.Volumes[0].BackingObjectDetails.(*cnstypes.CnsVsanFileShareBackingDetails)
-		publishInfo[common.AttributeDiskType] = common.DiskTypeFileVolume
+	publishInfo := make(map[string]string)
+	if volume.VolumeType == common.FileVolumeType {
+		// File Volume
+		vSANFileBackingDetails := volume.BackingObjectDetails.(*cnstypes.CnsVsanFileShareBackingDetails)
+		publishInfo[common.GetPublishContextDiskTypeKey(c.manager.CnsConfig)] = common.DiskTypeFileVolume
 		nfsv4AccessPointFound := false
 		for _, kv := range vSANFileBackingDetails.AccessPoints {
 			if kv.Key == common.Nfsv4AccessPointKey {
@@ -613,38 +917,27 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 		}
 	} else {
 		// Block Volume
-		// in-tree volume support
-		var volumeID string
-		var volumePath string
-		if strings.Contains(req.VolumeId, ".vmdk") {
-			volumePath = req.VolumeId
-		}
-		if c.manager.CnsConfig.FeatureStates.CSIMigration {
-			// Migration feature switch is enabled
-			if volumePath != "" {
-				req.VolumeId, err = volumeMigrationService.GetVolumeID(ctx, volumePath)
-				if err != nil {
-					msg := fmt.Sprintf("failed to get VolumeID from volumeMigrationService for volumePath: %q", volumePath)
-					log.Error(msg)
-					return nil, status.Errorf(codes.Internal, msg)
-				}
-			}
-		} else {
-			// Migration feature switch is disabled
-			if volumePath != "" {
-				msg := fmt.Sprintf("volume-migration feature switch is disabled. Cannot use volume with vmdk path :%q", volumeID)
-				log.Error(msg)
-				return nil, status.Errorf(codes.Internal, msg)
-			}
-		}
 		diskUUID, err := common.AttachVolumeUtil(ctx, c.manager, node, req.VolumeId)
 		if err != nil {
+			if cnsvolume.IsResourceBusyError(err) {
+				msg := fmt.Sprintf("failed to attach disk: %+q with node: %q as the node VM is busy. err %+v",
+					req.VolumeId, req.NodeId, err)
+				log.Error(msg)
+				return nil, status.Errorf(codes.Aborted, msg)
+			}
 			msg := fmt.Sprintf("failed to attach disk: %+q with node: %q err %+v", req.VolumeId, req.NodeId, err)
 			log.Error(msg)
-			return nil, status.Errorf(codes.Internal, msg)
+			return nil, status.Error(common.GetErrorCode(err, codes.Internal), msg)
+		}
+		publishInfo = common.GetBlockVolumePublishContext(c.manager.CnsConfig, diskUUID)
+		// Let the node plugin know which datastore backs the volume
+		datastoreURL, datastoreMoref, err := common.GetVolumeDatastore(ctx, c.manager, req.VolumeId)
+		if err != nil {
+			log.Warnf("failed to get datastore of volume %q. Error: %+v", req.VolumeId, err)
+		} else {
+			publishInfo[common.AttributeDatastoreURL] = datastoreURL
+			publishInfo[common.AttributeDatastoreMoref] = datastoreMoref
 		}
-		publishInfo[common.AttributeDiskType] = common.DiskTypeBlockVolume
-		publishInfo[common.AttributeFirstClassDiskUUID] = common.FormatDiskUUID(diskUUID)
 	}
 	resp := &csi.ControllerPublishVolumeResponse{
 		PublishContext: publishInfo,
@@ -658,7 +951,8 @@ func (c *controller) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 	*csi.ControllerUnpublishVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ControllerUnpublishVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerUnpublishVolume", *req)()
+	defer c.inFlightOperations.Start(common.InFlightOperation{Name: "ControllerUnpublishVolume", Volume: req.VolumeId, Node: req.NodeId})()
 	err := validateVanillaControllerUnpublishVolumeRequest(ctx, req)
 	if err != nil {
 		msg := fmt.Sprintf("Validation for UnpublishVolume Request: %+v has failed. Error: %v", *req, err)
@@ -727,7 +1021,7 @@ func (c *controller) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 		if err != nil {
 			msg := fmt.Sprintf("failed to detach disk: %+q from node: %q err %+v", req.VolumeId, req.NodeId, err)
 			log.Error(msg)
-			return nil, status.Error(codes.Internal, msg)
+			return nil, status.Error(common.GetErrorCode(err, codes.Internal), msg)
 		}
 	} else {
 		log.Info("Skipping ControllerUnpublish for file volume ", req.VolumeId)
@@ -741,13 +1035,13 @@ func (c *controller) ControllerExpandVolume(ctx context.Context, req *csi.Contro
 	*csi.ControllerExpandVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ControllerExpandVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerExpandVolume", *req)()
 
 	err := validateVanillaControllerExpandVolumeRequest(ctx, req)
 	if err != nil {
 		msg := fmt.Sprintf("validation for ExpandVolume Request: %+v has failed. Error: %v", *req, err)
 		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
 	}
 
 	volumeID := req.GetVolumeId()
@@ -787,8 +1081,14 @@ func (c *controller) ControllerExpandVolume(ctx context.Context, req *csi.Contro
 		return nil, status.Errorf(codes.Unimplemented, msg)
 	}
 
-	if currentSize >= volSizeMB {
-		log.Infof("Volume size %d is greater than or equal to the requested size %d for volumeID: %q", currentSize, volSizeMB, volumeID)
+	if currentSize > volSizeMB {
+		// Shrinking volumes is not supported
+		msg := fmt.Sprintf("failed to expand volume: %q to size: %d MB as it is smaller than the current size: %d MB. "+
+			"Shrinking volumes is not supported", volumeID, volSizeMB, currentSize)
+		log.Error(msg)
+		return nil, status.Error(codes.InvalidArgument, msg)
+	} else if currentSize == volSizeMB {
+		log.Infof("Volume size %d is equal to the requested size %d for volumeID: %q", currentSize, volSizeMB, volumeID)
 	} else {
 		// Check if volume is attached to a node
 		log.Infof("Check if volume %q is attached to a node", volumeID)
@@ -817,24 +1117,30 @@ func (c *controller) ControllerExpandVolume(ctx context.Context, req *csi.Contro
 
 		log.Infof("Current volume size is %d, requested size is %d for volumeID: %q. Need volume expansion.", currentSize, volSizeMB, volumeID)
 
+		err = common.ValidateDatastoreCapacityForExpansion(ctx, c.manager, queryResult.Volumes[0].DatastoreUrl,
+			currentSize, volSizeMB)
+		if err != nil {
+			return nil, err
+		}
+
 		err = common.ExpandVolumeUtil(ctx, c.manager, volumeID, volSizeMB)
 		if err != nil {
 			msg := fmt.Sprintf("failed to expand volume: %+q to size: %d err %+v", req.VolumeId, volSizeMB, err)
 			log.Error(msg)
-			return nil, status.Errorf(codes.Internal, msg)
+			return nil, status.Error(common.GetErrorCode(err, codes.Internal), msg)
+		}
+		err = common.UpdateVolumeMetadataAfterExpand(ctx, c.manager, cnstypes.CnsClusterFlavorVanilla,
+			volumeID, volSizeMB, time.Now())
+		if err != nil {
+			log.Warnf("failed to update metadata of volume %q after expansion. Error: %+v", volumeID, err)
 		}
 	}
 
-	// TODO(xyang): In CSI spec 1.2, ControllerExpandVolume will be
-	// passing in VolumeCapability with access_type info indicating
-	// whether it is BlockVolume (raw block mode) or MountVolume (file
-	// system mode). Update this function when CSI spec 1.2 is supported
-	// by external-resizer. For BlockVolume, set NodeExpansionRequired to
-	// false; for MountVolume, set it to true.
-
+	// The file system of a MountVolume has to be expanded on the node, while
+	// a BlockVolume (raw block mode) is expanded once its disk is.
 	resp := &csi.ControllerExpandVolumeResponse{
 		CapacityBytes:         int64(units.FileSize(volSizeMB * common.MbInBytes)),
-		NodeExpansionRequired: true,
+		NodeExpansionRequired: common.IsNodeExpansionRequired(req.GetVolumeCapability()),
 	}
 	return resp, nil
 }
@@ -844,22 +1150,26 @@ func (c *controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ControllerGetCapabilities: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ValidateVolumeCapabilities", *req)()
 	volCaps := req.GetVolumeCapabilities()
-	var confirmed *csi.ValidateVolumeCapabilitiesResponse_Confirmed
-	if common.IsValidVolumeCapabilities(ctx, volCaps) {
-		confirmed = &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps}
+	if !common.IsValidVolumeCapabilities(ctx, volCaps) {
+		msg := fmt.Sprintf("unsupported volume capabilities %+v", volCaps)
+		log.Info(msg)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: msg}, nil
+	}
+	if err := common.ValidateMountFlags(volCaps); err != nil {
+		log.Info(err)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
-		Confirmed: confirmed,
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps},
 	}, nil
 }
 
 func (c *controller) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("ListVolumes: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ListVolumes", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
@@ -867,8 +1177,65 @@ func (c *controller) GetCapacity(ctx context.Context, req *csi.GetCapacityReques
 	*csi.GetCapacityResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("GetCapacity: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+	defer logger.LogRPCCall(ctx, "GetCapacity", *req)()
+	volCaps := req.GetVolumeCapabilities()
+	if len(volCaps) > 0 && !common.IsValidVolumeCapabilities(ctx, volCaps) {
+		msg := fmt.Sprintf("unsupported volume capabilities %+v", volCaps)
+		log.Error(msg)
+		return nil, status.Error(codes.InvalidArgument, msg)
+	}
+	var sharedDatastores []*cnsvsphere.DatastoreInfo
+	var err error
+	// Scope the capacity to the datastores accessible from the given topology segment
+	if topology := req.GetAccessibleTopology(); len(topology.GetSegments()) > 0 {
+		// The capacity of a topology segment can't be computed until the topology
+		// categories are configured
+		if c.manager.CnsConfig.Labels.Zone == "" || c.manager.CnsConfig.Labels.Region == "" {
+			errMsg := fmt.Sprintf("capacity of topology %+v can't be computed as Zone/Region vsphere category names "+
+				"are not specified in the vsphere config secret", topology.GetSegments())
+			log.Error(errMsg)
+			return nil, status.Error(codes.FailedPrecondition, errMsg)
+		}
+		topologyRequirement := &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{topology},
+		}
+		sharedDatastores, _, err = c.nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement,
+			c.manager.CnsConfig.Labels.Zone, c.manager.CnsConfig.Labels.Region)
+		if err != nil {
+			msg := fmt.Sprintf("failed to get shared datastores in topology: %+v. Error: %+v", topology, err)
+			log.Error(msg)
+			return nil, status.Error(codes.Internal, msg)
+		}
+	} else {
+		if c.manager.CnsConfig.Labels.Zone != "" && c.manager.CnsConfig.Labels.Region != "" {
+			// Without a topology segment, volumes can be placed in any of the fault
+			// domains, whose datastores may not be shared across all the nodes
+			segmentDatastores, err := c.getTopologySegmentDatastores(ctx)
+			if err != nil {
+				msg := fmt.Sprintf("failed to get shared datastores in topology segments. Error: %+v", err)
+				log.Error(msg)
+				return nil, status.Error(codes.Internal, msg)
+			}
+			for _, segment := range segmentDatastores {
+				log.Debugf("capacity available in topology segment %v: %d", segment.segments,
+					common.AggregateAvailableCapacity(segment.datastores, c.manager.CnsConfig.Global.CapacityAggregation))
+			}
+			sharedDatastores = mergeSegmentDatastores(segmentDatastores)
+		}
+		// Nodes without topology share the datastores of the cluster
+		if len(sharedDatastores) == 0 {
+			sharedDatastores, err = c.nodeMgr.GetSharedDatastoresInK8SCluster(ctx)
+			if err != nil {
+				msg := fmt.Sprintf("failed to get shared datastores in kubernetes cluster. Error: %+v", err)
+				log.Error(msg)
+				return nil, status.Error(codes.Internal, msg)
+			}
+		}
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: common.AggregateAvailableCapacity(sharedDatastores,
+			c.manager.CnsConfig.Global.CapacityAggregation),
+	}, nil
 }
 
 // isVsan67u3Release returns true if controller is dealing with vSAN 67u3 Release of vCenter.
@@ -894,7 +1261,7 @@ func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.Con
 	*csi.ControllerGetCapabilitiesResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ControllerGetCapabilities: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerGetCapabilities", *req)()
 
 	var controllerCaps []csi.ControllerServiceCapability_RPC_Type
 
@@ -926,23 +1293,20 @@ func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.Con
 func (c *controller) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (
 	*csi.CreateSnapshotResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("CreateSnapshot: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "CreateSnapshot", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (c *controller) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (
 	*csi.DeleteSnapshotResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("DeleteSnapshot: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "DeleteSnapshot", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (c *controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (
 	*csi.ListSnapshotsResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("ListSnapshots: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ListSnapshots", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
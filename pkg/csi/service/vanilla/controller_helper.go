@@ -18,12 +18,23 @@ package vanilla
 
 import (
 	"context"
+	"reflect"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
 
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
 )
 
+// getNodeAccessibleDatastores returns the datastores accessible from the host of the node VM.
+var getNodeAccessibleDatastores = func(ctx context.Context, node *cnsvsphere.VirtualMachine) (
+	[]*cnsvsphere.DatastoreInfo, error) {
+	return node.GetAllAccessibleDatastores(ctx)
+}
+
 // validateVanillaDeleteVolumeRequest is the helper function to validate
 // DeleteVolumeRequest for Vanilla CSI driver.
 // Function returns error if validation fails otherwise returns nil.
@@ -50,3 +61,136 @@ func validateVanillaControllerUnpublishVolumeRequest(ctx context.Context, req *c
 func validateVanillaControllerExpandVolumeRequest(ctx context.Context, req *csi.ControllerExpandVolumeRequest) error {
 	return common.ValidateControllerExpandVolumeRequest(ctx, req)
 }
+
+// getParamTemplateVars returns the variables which can be referenced in the storage
+// class parameter values. Zone and region are taken from the first preferred, or else
+// requisite, topology of the request and are only available if the request has one.
+func getParamTemplateVars(cfg *config.Config, topologyRequirement *csi.TopologyRequirement) map[string]string {
+	vars := map[string]string{
+		common.TemplateVarClusterID: cfg.Global.ClusterID,
+	}
+	var topologies []*csi.Topology
+	topologies = append(topologies, topologyRequirement.GetPreferred()...)
+	topologies = append(topologies, topologyRequirement.GetRequisite()...)
+	if len(topologies) > 0 {
+		segments := topologies[0].GetSegments()
+		if zone, ok := segments[v1.LabelZoneFailureDomain]; ok {
+			vars[common.TemplateVarZone] = zone
+		}
+		if region, ok := segments[v1.LabelZoneRegion]; ok {
+			vars[common.TemplateVarRegion] = region
+		}
+	}
+	return vars
+}
+
+// getDatastoreAccessibleTopologies returns the distinct topologies the datastore with
+// the given URL is accessible from, in the order they appear in datastoreTopologyMap.
+func getDatastoreAccessibleTopologies(datastoreTopologyMap map[string][]map[string]string,
+	datastoreURL string) []*csi.Topology {
+	var topologies []*csi.Topology
+	for _, segments := range datastoreTopologyMap[cnsvsphere.NormalizeDatastoreURL(datastoreURL)] {
+		if len(segments) == 0 {
+			continue
+		}
+		duplicate := false
+		for _, topology := range topologies {
+			if reflect.DeepEqual(topology.Segments, segments) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			topologies = append(topologies, &csi.Topology{Segments: segments})
+		}
+	}
+	return topologies
+}
+
+// filterDatastoresAccessibleFromNodes returns the given datastores which are accessible
+// from the host of at least one of the nodes. Nodes whose datastores cannot be retrieved
+// are skipped; an error is returned only if no node could be checked.
+func filterDatastoresAccessibleFromNodes(ctx context.Context, nodes []*cnsvsphere.VirtualMachine,
+	datastores []*cnsvsphere.DatastoreInfo) ([]*cnsvsphere.DatastoreInfo, error) {
+	log := logger.GetLogger(ctx)
+	var lastErr error
+	checked := 0
+	accessibleURLs := make(map[string]bool)
+	for _, node := range nodes {
+		nodeDatastores, err := getNodeAccessibleDatastores(ctx, node)
+		if err != nil {
+			log.Warnf("failed to get the datastores accessible from node %v. err: %v", node, err)
+			lastErr = err
+			continue
+		}
+		checked++
+		for _, datastore := range nodeDatastores {
+			accessibleURLs[cnsvsphere.NormalizeDatastoreURL(datastore.Info.Url)] = true
+		}
+	}
+	if checked == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	var accessible []*cnsvsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		if accessibleURLs[cnsvsphere.NormalizeDatastoreURL(datastore.Info.Url)] {
+			accessible = append(accessible, datastore)
+		}
+	}
+	return accessible, nil
+}
+
+// topologySegmentDatastores holds the datastores shared across the nodes of a
+// topology segment.
+type topologySegmentDatastores struct {
+	segments   map[string]string
+	datastores []*cnsvsphere.DatastoreInfo
+}
+
+// getTopologySegmentDatastores returns the shared datastores of each of the topology
+// segments of the nodes.
+func (c *controller) getTopologySegmentDatastores(ctx context.Context) ([]topologySegmentDatastores, error) {
+	log := logger.GetLogger(ctx)
+	zoneKey, regionKey := c.manager.CnsConfig.Labels.Zone, c.manager.CnsConfig.Labels.Region
+	segments, err := c.nodeMgr.GetTopologySegments(ctx, zoneKey, regionKey)
+	if err != nil {
+		log.Errorf("failed to get topology segments of the nodes. Error: %+v", err)
+		return nil, err
+	}
+	segmentDatastores := make([]topologySegmentDatastores, 0, len(segments))
+	for _, segment := range segments {
+		topologyRequirement := &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: segment}},
+		}
+		datastores, _, err := c.nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement, zoneKey, regionKey)
+		if err != nil {
+			log.Errorf("failed to get shared datastores in topology segment %v. Error: %+v", segment, err)
+			return nil, err
+		}
+		segmentDatastores = append(segmentDatastores, topologySegmentDatastores{
+			segments:   segment,
+			datastores: datastores,
+		})
+	}
+	return segmentDatastores, nil
+}
+
+// mergeSegmentDatastores returns the datastores of all the given topology segments.
+// Datastores shared across segments are only returned once, so that their free space
+// is not counted more than once.
+func mergeSegmentDatastores(segmentDatastores []topologySegmentDatastores) []*cnsvsphere.DatastoreInfo {
+	var datastores []*cnsvsphere.DatastoreInfo
+	found := make(map[string]bool)
+	for _, segment := range segmentDatastores {
+		for _, datastore := range segment.datastores {
+			if url := cnsvsphere.NormalizeDatastoreURL(datastore.Info.Url); url != "" {
+				if found[url] {
+					continue
+				}
+				found[url] = true
+			}
+			datastores = append(datastores, datastore)
+		}
+	}
+	return datastores
+}
@@ -41,6 +41,9 @@ import (
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 	"github.com/zekroTJA/timedmap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	testclient "k8s.io/client-go/kubernetes/fake"
 	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
@@ -220,6 +223,11 @@ func (f *FakeNodeManager) GetAllNodes(ctx context.Context) ([]*cnsvsphere.Virtua
 	return nil, nil
 }
 
+func (f *FakeNodeManager) GetTopologySegments(ctx context.Context, zoneKey string, regionKey string) (
+	[]map[string]string, error) {
+	return nil, nil
+}
+
 func (f *FakeNodeManager) GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneKey string, regionKey string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error) {
 	return nil, nil, nil
 }
@@ -478,8 +486,54 @@ func TestExtendVolume(t *testing.T) {
 	if respExpand.CapacityBytes < newSize {
 		t.Fatalf("newly expanded volume size %d is smaller than requested size %d for volume with ID: %s", respExpand.CapacityBytes, newSize, volID)
 	}
+	if !respExpand.NodeExpansionRequired {
+		t.Errorf("expected node expansion to be required for a mount volume")
+	}
 	t.Log(fmt.Sprintf("ControllerExpandVolume succeeded: volume is expanded to requested size %d", newSize))
 
+	// The node doesn't have to expand a raw block volume
+	newSize = 3 * common.GbInBytes
+	reqExpand = &csi.ControllerExpandVolumeRequest{
+		VolumeId: volID,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: newSize,
+		},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	respExpand, err = ct.controller.ControllerExpandVolume(ctx, reqExpand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respExpand.NodeExpansionRequired {
+		t.Errorf("expected node expansion to not be required for a block volume")
+	}
+
+	// Expanding to the current size succeeds, shrinking is rejected
+	respExpand, err = ct.controller.ControllerExpandVolume(ctx, reqExpand)
+	if err != nil {
+		t.Fatalf("expected expanding to the current size to succeed, got %v", err)
+	}
+	if respExpand.CapacityBytes != newSize {
+		t.Errorf("expected size %d when expanding to the current size, got %d", newSize, respExpand.CapacityBytes)
+	}
+	reqShrink := &csi.ControllerExpandVolumeRequest{
+		VolumeId: volID,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 512 * common.MbInBytes,
+		},
+	}
+	_, err = ct.controller.ControllerExpandVolume(ctx, reqShrink)
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("expected code %v when shrinking the volume, got %v (err: %v)", codes.InvalidArgument, code, err)
+	}
+
 	//  Query volume after expand volume
 	queryFilter = cnstypes.CnsQueryFilter{
 		VolumeIds: []cnstypes.CnsVolumeId{
@@ -604,6 +658,11 @@ func TestCompleteControllerFlow(t *testing.T) {
 	}
 	diskUUID := respControllerPublishVolume.PublishContext[common.AttributeFirstClassDiskUUID]
 	t.Log(fmt.Sprintf("ControllerPublishVolume succeed, diskUUID %s is returned", diskUUID))
+	if respControllerPublishVolume.PublishContext[common.AttributeDatastoreURL] == "" ||
+		respControllerPublishVolume.PublishContext[common.AttributeDatastoreMoref] == "" {
+		t.Fatalf("ControllerPublishVolume did not return the datastore of the volume: %+v",
+			respControllerPublishVolume.PublishContext)
+	}
 
 	//Detach
 	reqControllerUnpublishVolume := &csi.ControllerUnpublishVolumeRequest{
@@ -636,3 +695,257 @@ func TestCompleteControllerFlow(t *testing.T) {
 		t.Fatalf("Volume should not exist after deletion with ID: %s", volID)
 	}
 }
+
+// topologyNodeManager is a NodeManagerInterface which returns a fixed set of
+// datastores per zone.
+type topologyNodeManager struct {
+	FakeNodeManager
+	zoneDatastores map[string][]*cnsvsphere.DatastoreInfo
+}
+
+func (f *topologyNodeManager) GetSharedDatastoresInK8SCluster(ctx context.Context) ([]*cnsvsphere.DatastoreInfo, error) {
+	var datastores []*cnsvsphere.DatastoreInfo
+	for _, zoneDatastores := range f.zoneDatastores {
+		datastores = append(datastores, zoneDatastores...)
+	}
+	return datastores, nil
+}
+
+func (f *topologyNodeManager) GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneKey string, regionKey string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error) {
+	var datastores []*cnsvsphere.DatastoreInfo
+	for _, topology := range topologyRequirement.GetRequisite() {
+		datastores = append(datastores, f.zoneDatastores[topology.GetSegments()[v1.LabelZoneFailureDomain]]...)
+	}
+	return datastores, nil, nil
+}
+
+func (f *topologyNodeManager) GetTopologySegments(ctx context.Context, zoneKey string, regionKey string) (
+	[]map[string]string, error) {
+	var segments []map[string]string
+	for _, zone := range []string{"zone-a", "zone-b"} {
+		if _, ok := f.zoneDatastores[zone]; ok {
+			segments = append(segments, map[string]string{v1.LabelZoneFailureDomain: zone})
+		}
+	}
+	return segments, nil
+}
+
+func newDatastoreInfoWithFreeSpace(freeSpace int64) *cnsvsphere.DatastoreInfo {
+	return &cnsvsphere.DatastoreInfo{
+		Info: &types.DatastoreInfo{FreeSpace: freeSpace},
+	}
+}
+
+func TestGetCapacityWithTopology(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Labels.Zone = "k8s-zone"
+	cfg.Labels.Region = "k8s-region"
+	c := &controller{
+		manager: &common.Manager{CnsConfig: cfg},
+		nodeMgr: &topologyNodeManager{
+			zoneDatastores: map[string][]*cnsvsphere.DatastoreInfo{
+				"zone-a": {newDatastoreInfoWithFreeSpace(10 * common.GbInBytes), newDatastoreInfoWithFreeSpace(5 * common.GbInBytes)},
+				"zone-b": {newDatastoreInfoWithFreeSpace(20 * common.GbInBytes)},
+			},
+		},
+	}
+	zoneA := &csi.Topology{Segments: map[string]string{v1.LabelZoneFailureDomain: "zone-a"}}
+	zoneB := &csi.Topology{Segments: map[string]string{v1.LabelZoneFailureDomain: "zone-b"}}
+	tests := []struct {
+		name             string
+		aggregation      string
+		topology         *csi.Topology
+		expectedCapacity int64
+	}{
+		{"zone-a", "", zoneA, 10 * common.GbInBytes},
+		{"zone-b", "", zoneB, 20 * common.GbInBytes},
+		{"no topology", "", nil, 20 * common.GbInBytes},
+		{"zone-a sum", common.CapacityAggregationSum, zoneA, 15 * common.GbInBytes},
+		{"zone-b sum", common.CapacityAggregationSum, zoneB, 20 * common.GbInBytes},
+		{"no topology sum", common.CapacityAggregationSum, nil, 35 * common.GbInBytes},
+	}
+	for _, test := range tests {
+		cfg.Global.CapacityAggregation = test.aggregation
+		resp, err := c.GetCapacity(ctx, &csi.GetCapacityRequest{AccessibleTopology: test.topology})
+		if err != nil {
+			t.Fatalf("%s: GetCapacity failed. Error: %+v", test.name, err)
+		}
+		if resp.AvailableCapacity != test.expectedCapacity {
+			t.Errorf("%s: expected capacity %d, got %d", test.name, test.expectedCapacity, resp.AvailableCapacity)
+		}
+	}
+
+	// The capacity of a topology segment can't be computed without the topology categories
+	cfg.Labels.Zone = ""
+	_, err := c.GetCapacity(ctx, &csi.GetCapacityRequest{
+		AccessibleTopology: &csi.Topology{Segments: map[string]string{v1.LabelZoneFailureDomain: "zone-a"}},
+	})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected code %v without topology categories, got %v (err: %v)", codes.FailedPrecondition, code, err)
+	}
+}
+
+func TestGetDatastoreAccessibleTopologies(t *testing.T) {
+	zoneA := map[string]string{v1.LabelZoneFailureDomain: "zone-a", v1.LabelZoneRegion: "region-1"}
+	zoneB := map[string]string{v1.LabelZoneFailureDomain: "zone-b", v1.LabelZoneRegion: "region-1"}
+	zoneC := map[string]string{v1.LabelZoneFailureDomain: "zone-c", v1.LabelZoneRegion: "region-1"}
+	datastoreTopologyMap := map[string][]map[string]string{
+		"ds:///vmfs/volumes/shared/": {zoneA, zoneB, zoneC, zoneA},
+		"ds:///vmfs/volumes/local/":  {zoneB},
+	}
+
+	topologies := getDatastoreAccessibleTopologies(datastoreTopologyMap, "ds:///vmfs/volumes/shared/")
+	if len(topologies) != 3 {
+		t.Fatalf("expected 3 topologies for the datastore shared across zones, got %+v", topologies)
+	}
+	for i, expected := range []map[string]string{zoneA, zoneB, zoneC} {
+		if topologies[i].Segments[v1.LabelZoneFailureDomain] != expected[v1.LabelZoneFailureDomain] {
+			t.Errorf("expected topology %d to be %v, got %v", i, expected, topologies[i].Segments)
+		}
+	}
+	if topologies = getDatastoreAccessibleTopologies(datastoreTopologyMap, "ds:///vmfs/volumes/local/"); len(topologies) != 1 {
+		t.Errorf("expected 1 topology for the datastore in a single zone, got %+v", topologies)
+	}
+}
+
+func TestFilterDatastoresAccessibleFromNodes(t *testing.T) {
+	ctx := context.Background()
+	defer func(orig func(context.Context, *cnsvsphere.VirtualMachine) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getNodeAccessibleDatastores = orig
+	}(getNodeAccessibleDatastores)
+	nodeDatastores := map[string][]string{
+		"node-1": {"ds:///vmfs/volumes/local-1/"},
+		"node-2": {"ds:///vmfs/volumes/local-2/", "ds:///vmfs/volumes/shared/"},
+	}
+	getNodeAccessibleDatastores = func(ctx context.Context, node *cnsvsphere.VirtualMachine) (
+		[]*cnsvsphere.DatastoreInfo, error) {
+		urls, ok := nodeDatastores[node.UUID]
+		if !ok {
+			return nil, fmt.Errorf("node %s not found", node.UUID)
+		}
+		var datastores []*cnsvsphere.DatastoreInfo
+		for _, url := range urls {
+			datastores = append(datastores, &cnsvsphere.DatastoreInfo{Info: &types.DatastoreInfo{Url: url}})
+		}
+		return datastores, nil
+	}
+	nodes := []*cnsvsphere.VirtualMachine{{UUID: "node-missing"}, {UUID: "node-1"}, {UUID: "node-2"}}
+
+	newDatastore := func(url string) *cnsvsphere.DatastoreInfo {
+		return &cnsvsphere.DatastoreInfo{Info: &types.DatastoreInfo{Url: url}}
+	}
+	datastores := []*cnsvsphere.DatastoreInfo{newDatastore("ds:///vmfs/volumes/shared/"),
+		newDatastore("ds:///vmfs/volumes/local-1/"), newDatastore("ds:///vmfs/volumes/other/")}
+
+	accessible, err := filterDatastoresAccessibleFromNodes(ctx, nodes, datastores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accessible) != 2 || accessible[0] != datastores[0] || accessible[1] != datastores[1] {
+		t.Errorf("expected the shared and local-1 datastores to be accessible, got %v", accessible)
+	}
+	if _, err = filterDatastoresAccessibleFromNodes(ctx, nodes[:1], datastores); err == nil {
+		t.Error("expected an error when no node could be checked")
+	}
+}
+
+func TestGetCapacityAcrossTopologySegments(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Labels.Zone = "k8s-zone"
+	cfg.Labels.Region = "k8s-region"
+	sharedDatastore := newDatastoreInfoWithFreeSpace(30 * common.GbInBytes)
+	sharedDatastore.Info.Url = "ds:///vmfs/volumes/shared/"
+	zoneADatastore := newDatastoreInfoWithFreeSpace(10 * common.GbInBytes)
+	zoneADatastore.Info.Url = "ds:///vmfs/volumes/zone-a/"
+	zoneBDatastore := newDatastoreInfoWithFreeSpace(20 * common.GbInBytes)
+	zoneBDatastore.Info.Url = "ds:///vmfs/volumes/zone-b/"
+	c := &controller{
+		manager: &common.Manager{CnsConfig: cfg},
+		nodeMgr: &topologyNodeManager{
+			zoneDatastores: map[string][]*cnsvsphere.DatastoreInfo{
+				"zone-a": {sharedDatastore, zoneADatastore},
+				"zone-b": {sharedDatastore, zoneBDatastore},
+			},
+		},
+	}
+	tests := []struct {
+		name                      string
+		aggregation               string
+		expectedCapacity          int64
+		expectedSegmentCapacities map[string]int64
+	}{
+		{"largest", "", 30 * common.GbInBytes,
+			map[string]int64{"zone-a": 30 * common.GbInBytes, "zone-b": 30 * common.GbInBytes}},
+		// The datastore shared across the segments is only counted once
+		{"sum", common.CapacityAggregationSum, 60 * common.GbInBytes,
+			map[string]int64{"zone-a": 40 * common.GbInBytes, "zone-b": 50 * common.GbInBytes}},
+	}
+	for _, test := range tests {
+		cfg.Global.CapacityAggregation = test.aggregation
+		resp, err := c.GetCapacity(ctx, &csi.GetCapacityRequest{})
+		if err != nil {
+			t.Fatalf("%s: GetCapacity failed. Error: %+v", test.name, err)
+		}
+		if resp.AvailableCapacity != test.expectedCapacity {
+			t.Errorf("%s: expected capacity %d, got %d", test.name, test.expectedCapacity, resp.AvailableCapacity)
+		}
+		// The capacity of each segment is requested with its accessible topology
+		for zone, expectedCapacity := range test.expectedSegmentCapacities {
+			resp, err = c.GetCapacity(ctx, &csi.GetCapacityRequest{
+				AccessibleTopology: &csi.Topology{Segments: map[string]string{v1.LabelZoneFailureDomain: zone}},
+			})
+			if err != nil {
+				t.Fatalf("%s: GetCapacity of %s failed. Error: %+v", test.name, zone, err)
+			}
+			if resp.AvailableCapacity != expectedCapacity {
+				t.Errorf("%s: expected capacity %d for %s, got %d", test.name, expectedCapacity, zone,
+					resp.AvailableCapacity)
+			}
+		}
+	}
+
+	// The capacity of a segment can't be computed without the topology categories
+	cfg.Labels.Zone = ""
+	_, err := c.GetCapacity(ctx, &csi.GetCapacityRequest{
+		AccessibleTopology: &csi.Topology{Segments: map[string]string{v1.LabelZoneFailureDomain: "zone-a"}},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition without topology categories, got %v", err)
+	}
+}
+
+func TestValidateVolumeCapabilitiesUnsupportedMountFlags(t *testing.T) {
+	c := &controller{}
+	volCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					FsType:     "ext4",
+					MountFlags: []string{"noatime", "bind"},
+				},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	resp, err := c.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "vol-1",
+		VolumeCapabilities: volCaps,
+	})
+	if err != nil {
+		t.Fatalf("expected unsupported mount flags to be reported in the response, got %v", err)
+	}
+	if resp.Confirmed != nil || resp.Message == "" {
+		t.Errorf("expected an unconfirmed response with a message, got %+v", resp)
+	}
+
+	volCaps[0].GetMount().MountFlags = []string{"noatime"}
+	resp, err = c.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "vol-1",
+		VolumeCapabilities: volCaps,
+	})
+	if err != nil || resp.Confirmed == nil {
+		t.Errorf("expected supported volume capabilities to be confirmed, got %+v, err: %v", resp, err)
+	}
+}
@@ -19,6 +19,7 @@ package vanilla
 import (
 	"context"
 	"fmt"
+	"time"
 
 	cnsnode "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/node"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
@@ -195,7 +196,8 @@ func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyR
 				if region != "" {
 					accessibleTopology[v1.LabelZoneRegion] = region
 				}
-				datastoreTopologyMap[datastore.Info.Url] = append(datastoreTopologyMap[datastore.Info.Url], accessibleTopology)
+				datastoreURL := cnsvsphere.NormalizeDatastoreURL(datastore.Info.Url)
+				datastoreTopologyMap[datastoreURL] = append(datastoreTopologyMap[datastoreURL], accessibleTopology)
 			}
 			sharedDatastores = append(sharedDatastores, sharedDatastoresInZoneRegion...)
 		}
@@ -223,9 +225,45 @@ func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyR
 	return sharedDatastores, datastoreTopologyMap, nil
 }
 
+// GetTopologySegments returns the distinct topology segments of the node VMs, made of
+// the zone and region they are tagged with. Node VMs without a zone or region are
+// skipped.
+func (nodes *Nodes) GetTopologySegments(ctx context.Context, zoneCategoryName string, regionCategoryName string) (
+	[]map[string]string, error) {
+	log := logger.GetLogger(ctx)
+	nodeVMs, err := nodes.cnsNodeManager.GetAllNodes(ctx)
+	if err != nil {
+		log.Errorf("failed to get Nodes from nodeManager with err %+v", err)
+		return nil, err
+	}
+	var segments []map[string]string
+	found := make(map[string]bool)
+	for _, nodeVM := range nodeVMs {
+		zone, region, err := nodeVM.GetZoneRegion(ctx, zoneCategoryName, regionCategoryName)
+		if err != nil {
+			log.Errorf("failed to get zone and region of node VM %q. Error: %+v", nodeVM.UUID, err)
+			return nil, err
+		}
+		if zone == "" || region == "" {
+			log.Debugf("node VM %q has no zone and region, skipping it", nodeVM.UUID)
+			continue
+		}
+		if key := region + "/" + zone; !found[key] {
+			found[key] = true
+			segments = append(segments, map[string]string{
+				v1.LabelZoneFailureDomain: zone,
+				v1.LabelZoneRegion:        region,
+			})
+		}
+	}
+	return segments, nil
+}
+
 // GetSharedDatastoresInK8SCluster returns list of DatastoreInfo objects for datastores accessible to all
 // kubernetes nodes in the cluster.
-func (nodes *Nodes) GetSharedDatastoresInK8SCluster(ctx context.Context) ([]*cnsvsphere.DatastoreInfo, error) {
+func (nodes *Nodes) GetSharedDatastoresInK8SCluster(ctx context.Context) (
+	sharedDatastores []*cnsvsphere.DatastoreInfo, err error) {
+	defer func(start time.Time) { common.ObserveSharedDatastoresDuration(start, err) }(time.Now())
 	log := logger.GetLogger(ctx)
 	nodeVMs, err := nodes.cnsNodeManager.GetAllNodes(ctx)
 	if err != nil {
@@ -237,7 +275,7 @@ func (nodes *Nodes) GetSharedDatastoresInK8SCluster(ctx context.Context) ([]*cns
 		log.Errorf(errMsg)
 		return make([]*cnsvsphere.DatastoreInfo, 0), fmt.Errorf(errMsg)
 	}
-	sharedDatastores, err := nodes.GetSharedDatastoresForVMs(ctx, nodeVMs)
+	sharedDatastores, err = nodes.GetSharedDatastoresForVMs(ctx, nodeVMs)
 	if err != nil {
 		log.Errorf("failed to get shared datastores for node VMs. Err: %+v", err)
 		return nil, err
@@ -264,7 +302,7 @@ func (nodes *Nodes) GetSharedDatastoresForVMs(ctx context.Context, nodeVMs []*cn
 				// Check if sharedDatastores is found in accessibleDatastores
 				for _, accessibleDs := range accessibleDatastores {
 					// Intersection is performed based on the datastoreUrl as this uniquely identifies the datastore.
-					if sharedDs.Info.Url == accessibleDs.Info.Url {
+					if cnsvsphere.NormalizeDatastoreURL(sharedDs.Info.Url) == cnsvsphere.NormalizeDatastoreURL(accessibleDs.Info.Url) {
 						sharedAccessibleDatastores = append(sharedAccessibleDatastores, sharedDs)
 						break
 					}
@@ -17,9 +17,11 @@ limitations under the License.
 package wcp
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
@@ -30,11 +32,15 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
 )
 
 var (
@@ -42,13 +48,29 @@ var (
 	controllerCaps = []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 	}
 )
 
 var getSharedDatastores = getSharedDatastoresInPodVMK8SCluster
 
+// defaultMaxConcurrentAttachesPerNode is the number of volumes attached to the same
+// PodVM concurrently, if max-concurrent-attaches-per-node is not set.
+const defaultMaxConcurrentAttachesPerNode = 1
+
 type controller struct {
 	manager *common.Manager
+	// createVolumeLimiter limits the concurrent CreateVolume requests per storage policy
+	createVolumeLimiter *common.ConcurrencyLimiter
+	// readiness reports whether the controller is ready to serve RPCs
+	readiness common.Readiness
+	// deleteVolumeCalls deduplicates the concurrent DeleteVolume requests for the same volume
+	deleteVolumeCalls *common.InFlightCalls
+	// inFlightOperations tracks the create, delete, attach and detach operations in progress
+	inFlightOperations *common.InFlightOperations
+	// attachLimiter limits the concurrent attaches per PodVM
+	attachLimiter *common.KeyedSemaphore
 }
 
 // New creates a CNS controller
@@ -94,7 +116,71 @@ func (c *controller) Init(config *config.Config) error {
 		log.Errorf("checkAPI failed for vcenter API version: %s, err=%v", vc.Client.ServiceContent.About.ApiVersion, err)
 		return err
 	}
+	cnsvolume.SetRetryableFaults(ctx, strings.Split(config.Global.RetryableFaults, ","))
+	cnsvolume.SetRateLimit(ctx, config.Global.CnsClientQPS, config.Global.CnsClientBurst,
+		config.Global.CnsClientRateLimitFailFast)
+	common.SetAllowedMountFlags(ctx, config.Global.AllowedMountFlags)
+	cnsvolume.SetProvisioningRateLimit(ctx, config.Global.MaxVolumeProvisioningsPerMinute)
+	if err := logger.SetRPCLogLevels(ctx, config.Global.RPCLogLevels); err != nil {
+		log.Errorf("failed to parse rpc-log-levels. err=%v", err)
+		return err
+	}
+	if err := logger.SetLogFormat(ctx, config.Global.LogFormat); err != nil {
+		log.Errorf("failed to parse log-format. err=%v", err)
+		return err
+	}
+	if err := common.ValidateDatastoreSelection(config.Global.DatastoreSelection); err != nil {
+		log.Errorf("invalid datastore-selection. err=%v", err)
+		return err
+	}
+	if err := common.ValidateDuplicateVolumeNamePolicy(config.Global.DuplicateVolumeNamePolicy); err != nil {
+		log.Errorf("invalid duplicate-volume-name-policy. err=%v", err)
+		return err
+	}
+	if err := common.ValidateCapacityAggregation(config.Global.CapacityAggregation); err != nil {
+		log.Errorf("invalid capacity-aggregation. err=%v", err)
+		return err
+	}
+	if err := common.ValidateDiskUUIDFormat(config.Global.DiskUUIDFormat); err != nil {
+		log.Errorf("invalid disk-uuid-format. err=%v", err)
+		return err
+	}
+	if _, err := common.ParseChargebackLabels(config.Global.ChargebackLabels); err != nil {
+		log.Errorf("invalid chargeback-labels. err=%v", err)
+		return err
+	}
+	if err := validatePoweredOffPodVMAttach(config.Global.PoweredOffPodVMAttach); err != nil {
+		log.Errorf("invalid powered-off-podvm-attach. err=%v", err)
+		return err
+	}
+	c.createVolumeLimiter = common.NewConcurrencyLimiter(config.Global.MaxConcurrentCreateVolumesPerPolicy)
+	maxConcurrentAttaches := config.Global.MaxConcurrentAttachesPerNode
+	if maxConcurrentAttaches <= 0 {
+		maxConcurrentAttaches = defaultMaxConcurrentAttachesPerNode
+	}
+	c.attachLimiter = common.NewKeyedSemaphore(maxConcurrentAttaches)
+	c.deleteVolumeCalls = common.NewInFlightCalls()
+	c.inFlightOperations = common.NewInFlightOperations()
+	c.manager.DatastoreReservations = common.NewDatastoreReservations()
+	if config.Global.VolumeInventoryRefreshIntervalInMin > 0 {
+		log.Infof("Volume inventory is enabled with refresh interval of %d minutes",
+			config.Global.VolumeInventoryRefreshIntervalInMin)
+		c.manager.VolumeInventory = common.StartVolumeInventory(logger.NewContextWithLogger(context.Background()),
+			c.manager, time.Duration(config.Global.VolumeInventoryRefreshIntervalInMin)*time.Minute)
+	}
+	if len(config.VirtualCenter) <= 1 {
+		go c.watchClusterHosts()
+	}
+	if config.Global.RetainBackingDisk {
+		log.Warnf("retainbackingdisk is enabled. Backing disks of deleted volumes will NOT be deleted and must be cleaned up manually")
+	}
 	go cnsvolume.ClearTaskInfoObjects()
+	if config.Global.VolumeMetadataReconcileIntervalInMin > 0 {
+		log.Infof("Volume metadata reconciliation is enabled with interval of %d minutes",
+			config.Global.VolumeMetadataReconcileIntervalInMin)
+		go c.reconcileVolumeMetadataPeriodically(
+			time.Duration(config.Global.VolumeMetadataReconcileIntervalInMin) * time.Minute)
+	}
 	cfgPath := common.GetConfigPath(ctx)
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -129,15 +215,33 @@ func (c *controller) Init(config *config.Config) error {
 		log.Errorf("failed to watch on path: %q. err=%v", cfgDirPath, err)
 		return err
 	}
+	go c.readiness.SetReadyAfterSharedDatastores(logger.NewContextWithLogger(context.Background()),
+		common.ReadinessRetryInterval, func(ctx context.Context) error {
+			_, err := getSharedDatastores(ctx, c)
+			return err
+		})
 	return nil
 }
 
+// IsReady returns true once the controller is initialized and computed the shared
+// datastores successfully.
+func (c *controller) IsReady(ctx context.Context) bool {
+	return c.readiness.IsReady()
+}
+
+// ListInFlightOperations returns the create, delete, attach and detach operations in
+// progress, oldest first, so that operators can see what the controller is doing.
+// They are served at the in-flight operations path of the metrics server.
+func (c *controller) ListInFlightOperations(ctx context.Context) []common.InFlightOperation {
+	return c.inFlightOperations.List()
+}
+
 // ReloadConfiguration reloads configuration from the secret, and update controller's config cache
 // and VolumeManager's VC Config cache.
 func (c *controller) ReloadConfiguration() {
 	ctx, log := logger.GetNewContextWithLogger()
 	log.Info("Reloading Configuration")
-	cfg, err := common.GetConfig(ctx)
+	cfg, err := common.GetConfigWithRetry(ctx, common.ReloadConfigReadAttempts, common.ReloadConfigReadBackoff)
 	if err != nil {
 		log.Errorf("failed to read config. Error: %+v", err)
 		return
@@ -149,9 +253,12 @@ func (c *controller) ReloadConfiguration() {
 	}
 	if newVCConfig != nil {
 		var vcenter *cnsvsphere.VirtualCenter
-		if c.manager.VcenterConfig.Host != newVCConfig.Host ||
-			c.manager.VcenterConfig.Username != newVCConfig.Username ||
-			c.manager.VcenterConfig.Password != newVCConfig.Password {
+		if common.IsVirtualCenterConfigChanged(c.manager.VcenterConfig, newVCConfig) {
+			thumbprintChanged := c.manager.VcenterConfig.Thumbprint != newVCConfig.Thumbprint
+			if thumbprintChanged {
+				log.Infof("Certificate thumbprint of virtual center: %q has changed. Re-establishing connection with the new thumbprint",
+					newVCConfig.Host)
+			}
 			log.Debugf("Unregistering virtual center: %q from virtualCenterManager", c.manager.VcenterConfig.Host)
 			err = c.manager.VcenterManager.UnregisterAllVirtualCenters(ctx)
 			if err != nil {
@@ -164,6 +271,13 @@ func (c *controller) ReloadConfiguration() {
 				log.Errorf("failed to register VC with virtualCenterManager. err=%v", err)
 				return
 			}
+			if thumbprintChanged {
+				if err = vcenter.Connect(ctx); err != nil {
+					log.Errorf("failed to connect to virtual center: %q using the new thumbprint. err=%v", newVCConfig.Host, err)
+				} else {
+					log.Infof("Successfully connected to virtual center: %q using the new thumbprint", newVCConfig.Host)
+				}
+			}
 			c.manager.VcenterManager = cnsvsphere.GetVirtualCenterManager(ctx)
 		} else {
 			vcenter, err = c.manager.VcenterManager.GetVirtualCenter(ctx, newVCConfig.Host)
@@ -179,23 +293,110 @@ func (c *controller) ReloadConfiguration() {
 	if cfg != nil {
 		log.Debugf("updating manager.CnsConfig")
 		c.manager.CnsConfig = cfg
+		cnsvolume.SetRetryableFaults(ctx, strings.Split(cfg.Global.RetryableFaults, ","))
+		cnsvolume.SetRateLimit(ctx, cfg.Global.CnsClientQPS, cfg.Global.CnsClientBurst,
+			cfg.Global.CnsClientRateLimitFailFast)
+		common.SetAllowedMountFlags(ctx, cfg.Global.AllowedMountFlags)
+		cnsvolume.SetProvisioningRateLimit(ctx, cfg.Global.MaxVolumeProvisioningsPerMinute)
+		hostDatastores.invalidate()
+		// The vCenter or the cluster IDs may have changed, so the volume inventory is
+		// queried again
+		c.manager.VolumeInventory.Invalidate()
+		go func() {
+			_ = c.manager.VolumeInventory.Refresh(ctx, c.manager)
+		}()
+		if err := logger.SetRPCLogLevels(ctx, cfg.Global.RPCLogLevels); err != nil {
+			log.Warnf("failed to parse rpc-log-levels, keeping the previous RPC log levels. err=%v", err)
+		}
+		if err := logger.SetLogFormat(ctx, cfg.Global.LogFormat); err != nil {
+			log.Warnf("failed to parse log-format, keeping the previous log format. err=%v", err)
+		}
 	}
 	log.Info("Successfully reloaded configuration")
 }
 
+// ReconcileVolumeMetadata updates the CNS metadata of the volumes backing the
+// given PVs whose labels no longer match the metadata stored in CNS.
+func (c *controller) ReconcileVolumeMetadata(ctx context.Context, pvs []*v1.PersistentVolume) error {
+	log := logger.GetLogger(ctx)
+	var volumeIds []cnstypes.CnsVolumeId
+	for _, pv := range pvs {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == csitypes.Name {
+			volumeIds = append(volumeIds, cnstypes.CnsVolumeId{Id: pv.Spec.CSI.VolumeHandle})
+		}
+	}
+	if len(volumeIds) == 0 {
+		log.Debugf("no CSI volumes to reconcile metadata for")
+		return nil
+	}
+	queryResult, err := c.manager.VolumeManager.QueryVolume(ctx, cnstypes.CnsQueryFilter{VolumeIds: volumeIds})
+	if err != nil {
+		log.Errorf("failed to query volumes for metadata reconciliation. Error: %+v", err)
+		return err
+	}
+	updateSpecs := getVolumeMetadataUpdateSpecs(ctx, pvs, queryResult.Volumes,
+		c.manager.CnsConfig, c.manager.VcenterConfig.Username)
+	var failedVolumes []string
+	for _, updateSpec := range updateSpecs {
+		if err := c.manager.VolumeManager.UpdateVolumeMetadata(ctx, updateSpec); err != nil {
+			log.Errorf("failed to update metadata of volume %q. Error: %+v", updateSpec.VolumeId.Id, err)
+			failedVolumes = append(failedVolumes, updateSpec.VolumeId.Id)
+		}
+	}
+	if len(failedVolumes) > 0 {
+		return fmt.Errorf("failed to update metadata of volumes: %v", failedVolumes)
+	}
+	log.Infof("reconciled metadata of %d volumes", len(updateSpecs))
+	return nil
+}
+
+// reconcileVolumeMetadataPeriodically lists the PVs in the cluster and
+// reconciles the metadata of their CNS volumes every interval.
+func (c *controller) reconcileVolumeMetadataPeriodically(interval time.Duration) {
+	ctx, log := logger.GetNewContextWithLogger()
+	k8sClient, err := k8s.NewClient(ctx)
+	if err != nil {
+		log.Errorf("failed to create kubernetes client for volume metadata reconciliation. Error: %+v", err)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pvList, err := k8sClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+		if err != nil {
+			log.Warnf("failed to list PVs for volume metadata reconciliation. Error: %+v", err)
+			continue
+		}
+		pvs := make([]*v1.PersistentVolume, 0, len(pvList.Items))
+		for i := range pvList.Items {
+			pvs = append(pvs, &pvList.Items[i])
+		}
+		if err := c.ReconcileVolumeMetadata(ctx, pvs); err != nil {
+			log.Warnf("volume metadata reconciliation failed. Error: %+v", err)
+		}
+	}
+}
+
 // CreateVolume is creating CNS Volume using volume request specified
 // in CreateVolumeRequest
 func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (
 	*csi.CreateVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("CreateVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "CreateVolume", *req)()
+	defer c.inFlightOperations.Start(common.InFlightOperation{Name: "CreateVolume", Volume: req.Name, Parameters: req.Parameters})()
+	if err := common.ValidateNotInMaintenanceMode(ctx, c.manager, "CreateVolume"); err != nil {
+		return nil, err
+	}
 	err := validateWCPCreateVolumeRequest(ctx, req)
 	if err != nil {
 		msg := fmt.Sprintf("Validation for CreateVolume Request: %+v has failed. Error: %+v", *req, err)
 		log.Error(msg)
 		return nil, err
 	}
+	if err := common.ValidateCreateVolumeAdmission(ctx, req); err != nil {
+		return nil, err
+	}
 
 	// Volume Size - Default is 10 GiB
 	volSizeBytes := int64(common.DefaultGbDiskSize * common.GbInBytes)
@@ -205,17 +406,31 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	volSizeMB := int64(common.RoundUpSize(volSizeBytes, common.MbInBytes))
 
 	var storagePolicyID string
+	var preferredStoragePolicyID string
 
 	var affineToHost string
+	var clusterID string
 	// Support case insensitive parameters
 	for paramName := range req.Parameters {
 		param := strings.ToLower(paramName)
 		if param == common.AttributeStoragePolicyID {
 			storagePolicyID = req.Parameters[paramName]
+		} else if param == common.AttributePreferredStoragePolicyID {
+			preferredStoragePolicyID = req.Parameters[paramName]
 		} else if param == common.AttributeAffineToHost {
 			affineToHost = req.Parameters[common.AttributeAffineToHost]
+		} else if param == common.AttributeClusterID {
+			clusterID = req.Parameters[paramName]
 		}
 	}
+	if clusterID != "" {
+		if !isManagedClusterID(c.manager.CnsConfig, clusterID) {
+			msg := fmt.Sprintf("cluster %q is not managed by this controller", clusterID)
+			log.Error(msg)
+			return nil, status.Error(codes.InvalidArgument, msg)
+		}
+		ctx = withClusterID(ctx, clusterID)
+	}
 
 	var createVolumeSpec = common.CreateVolumeSpec{
 		CapacityMB:      volSizeMB,
@@ -224,22 +439,98 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 		ScParams:        &common.StorageClassParams{},
 		AffineToHost:    affineToHost,
 		VolumeType:      common.BlockVolumeType,
+		ClusterID:       clusterID,
+	}
+	releaseSlot, err := common.AcquireCreateVolumeSlot(ctx, c.createVolumeLimiter,
+		c.manager.CnsConfig.Global.MaxConcurrentCreateVolumesPerPolicy, storagePolicyID)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSlot()
+	// Get shared datastores for the Kubernetes cluster, or the datastores of the host
+	// the volume is affine to
+	var sharedDatastores []*cnsvsphere.DatastoreInfo
+	if affineToHost != "" {
+		sharedDatastores, err = getAffineHostDatastores(ctx, c, affineToHost)
+	} else {
+		sharedDatastores, err = waitForSharedDatastores(ctx, c)
+	}
+	if err == errAffineHostNotFound {
+		msg := fmt.Sprintf("host %q the volume is requested to be affine to is not a host of cluster %q",
+			affineToHost, getClusterID(ctx, c.manager.CnsConfig))
+		log.Error(msg)
+		common.RecordCreateVolumeRejection(common.CreateVolumeRejectionTopology)
+		return nil, status.Error(codes.InvalidArgument, msg)
+	}
+	if err == errNoClusterHosts {
+		msg := fmt.Sprintf("cluster %q is not ready to provision volumes as it has no hosts yet",
+			getClusterID(ctx, c.manager.CnsConfig))
+		log.Error(msg)
+		return nil, status.Error(codes.Unavailable, msg)
+	}
+	if err == errNoHostsOfMinVersion {
+		msg := fmt.Sprintf("cluster %q has no hosts of the minimum version %s required to provision volumes",
+			getClusterID(ctx, c.manager.CnsConfig), c.manager.CnsConfig.Global.MinHostVersion)
+		log.Error(msg)
+		return nil, status.Error(codes.FailedPrecondition, msg)
+	}
+	if errors.Is(err, errVCenterUnavailable) {
+		msg := fmt.Sprintf("failed to obtain shared datastores as vCenter is unavailable. Error: %+v", err)
+		log.Error(msg)
+		return nil, status.Error(codes.Unavailable, msg)
 	}
-	// Get shared datastores for the Kubernetes cluster
-	sharedDatastores, err := getSharedDatastores(ctx, c)
 	if err != nil {
 		msg := fmt.Sprintf("failed to obtain shared datastores. Error: %+v", err)
 		log.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
-	volumeID, err := common.CreateBlockVolumeUtil(ctx, cnstypes.CnsClusterFlavorWorkload, c.manager, &createVolumeSpec, sharedDatastores)
+	ctx, exclusions := common.WithDatastoreExclusions(ctx)
+	ctx, warnings := common.WithCreateVolumeWarnings(ctx)
+	ctx, cnsTaskID := cnsvolume.WithCnsTaskID(ctx)
+	sharedDatastores, err = common.FilterDatastoresByFreeSpaceHeadroom(ctx, c.manager, sharedDatastores, createVolumeSpec.CapacityMB)
+	if err != nil {
+		return nil, err
+	}
+	volumeID, storagePolicyID, err := createBlockVolumeWithPreferredPolicy(ctx, c, &createVolumeSpec,
+		preferredStoragePolicyID, sharedDatastores)
+	if len(exclusions) > 0 {
+		log.Debugf("datastores excluded from the placement of volume %q: %s", req.Name, exclusions)
+	}
 	if err != nil {
 		msg := fmt.Sprintf("failed to create volume. Error: %+v", err)
 		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Error(common.GetErrorCode(err, codes.Internal), msg)
 	}
 	attributes := make(map[string]string)
 	attributes[common.AttributeDiskType] = common.DiskTypeBlockVolume
+	attributes[common.AttributeAccessMode] = common.GetBlockVolumeAccessMode(req.GetVolumeCapabilities()).String()
+	if c.manager.CnsConfig.Global.ReportDatastoreExclusions && len(exclusions) > 0 {
+		attributes[common.AttributeDatastoreExclusions] = exclusions.String()
+	}
+	if warnings.Len() > 0 {
+		attributes[common.AttributeWarnings] = warnings.String()
+	}
+	if cnsTaskID.String() != "" {
+		attributes[common.AttributeCnsTaskID] = cnsTaskID.String()
+	}
+	if c.manager.CnsConfig.Global.ClusterVersion != "" {
+		attributes[common.AttributeClusterVersion] = c.manager.CnsConfig.Global.ClusterVersion
+	}
+	if storagePolicyID != "" {
+		attributes[common.AttributeStoragePolicyID] = storagePolicyID
+		storagePolicyName, err := getStoragePolicyName(ctx, c, storagePolicyID)
+		if err != nil {
+			log.Warnf("failed to get name of storage policy %q. Error: %+v", storagePolicyID, err)
+		} else {
+			attributes[common.AttributeStoragePolicyName] = storagePolicyName
+		}
+	}
+	creationTime, err := getVolumeCreationTime(ctx, c.manager, volumeID)
+	if err != nil {
+		log.Warnf("failed to get creation time of volume %q. Error: %+v", volumeID, err)
+	} else {
+		attributes[common.AttributeCreationTime] = creationTime.Format(time.RFC3339)
+	}
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
@@ -254,22 +545,50 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (
 	*csi.DeleteVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
+	defer logger.LogRPCCall(ctx, "DeleteVolume", *req)()
+	defer c.inFlightOperations.Start(common.InFlightOperation{Name: "DeleteVolume", Volume: req.VolumeId})()
+	// Concurrent requests for the same volume share the result of a single deletion
+	err := c.deleteVolumeCalls.Do(ctx, req.VolumeId, func(ctx context.Context) error {
+		return c.deleteVolume(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// deleteVolume deletes the volume of the DeleteVolumeRequest.
+func (c *controller) deleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) error {
 	log := logger.GetLogger(ctx)
-	log.Infof("DeleteVolume: called with args: %+v", *req)
 	var err error
 	err = validateWCPDeleteVolumeRequest(ctx, req)
 	if err != nil {
 		msg := fmt.Sprintf("Validation for DeleteVolume Request: %+v has failed. Error: %+v", *req, err)
 		log.Error(msg)
-		return nil, err
+		return err
 	}
-	err = common.DeleteVolumeUtil(ctx, c.manager, req.VolumeId, true)
+	err = common.ValidateVolumeNotAttached(ctx, c.manager, req.VolumeId)
 	if err != nil {
+		return err
+	}
+	deleteDisk := true
+	if c.manager.CnsConfig.Global.RetainBackingDisk {
+		log.Warnf("DeleteVolume: retainbackingdisk is enabled. Volume %q will be removed from CNS but its backing disk will be retained", req.VolumeId)
+		deleteDisk = false
+	}
+	err = common.DeleteVolumeUtil(ctx, c.manager, req.VolumeId, deleteDisk)
+	if err != nil {
+		if cnsvolume.IsHostUnreachableError(err) {
+			msg := fmt.Sprintf("failed to delete volume: %q as the host managing it is unreachable, "+
+				"possibly isolated by vSphere HA. Deletion can be retried once the host is reachable. Error: %+v", req.VolumeId, err)
+			log.Error(msg)
+			return status.Errorf(codes.Unavailable, msg)
+		}
 		msg := fmt.Sprintf("failed to delete volume: %q. Error: %+v", req.VolumeId, err)
 		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return status.Error(common.GetErrorCode(err, codes.Internal), msg)
 	}
-	return &csi.DeleteVolumeResponse{}, nil
+	return nil
 }
 
 // ControllerPublishVolume attaches a volume to the Node VM.
@@ -278,7 +597,11 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 	*csi.ControllerPublishVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ControllerPublishVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerPublishVolume", *req)()
+	defer c.inFlightOperations.Start(common.InFlightOperation{Name: "ControllerPublishVolume", Volume: req.VolumeId, Node: req.NodeId, Parameters: req.VolumeContext})()
+	if err := common.ValidateNotInMaintenanceMode(ctx, c.manager, "ControllerPublishVolume"); err != nil {
+		return nil, err
+	}
 	err := validateWCPControllerPublishVolumeRequest(ctx, req)
 	if err != nil {
 		msg := fmt.Sprintf("Validation for PublishVolume Request: %+v has failed. Error: %v", *req, err)
@@ -292,54 +615,56 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 		log.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
-
-	vcdcMap, err := getDatacenterFromConfig(c.manager.CnsConfig)
-	if err != nil {
-		msg := fmt.Sprintf("failed to get datacenter from config with error: %+v", err)
-		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
-	}
-	var vCenterHost, dcMorefValue string
-	for key, value := range vcdcMap {
-		vCenterHost = key
-		dcMorefValue = value
-	}
-	vc, err := c.manager.VcenterManager.GetVirtualCenter(ctx, vCenterHost)
+	// vSphere serializes the hot-add of disks to a VM, so the attaches to the PodVM
+	// over the limit wait for the ones in progress instead of failing as busy
+	releaseAttach, err := c.attachLimiter.Acquire(ctx, vmuuid)
 	if err != nil {
-		msg := fmt.Sprintf("Cannot get virtual center %s from virtualcentermanager while attaching disk with error %+v",
-			vc.Config.Host, err)
+		msg := fmt.Sprintf("gave up waiting for the attaches in progress to PodVM %s to attach volumeID: %s. Error: %+v",
+			vmuuid, req.VolumeId, err)
 		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Error(codes.Aborted, msg)
 	}
+	defer releaseAttach()
 
 	// Connect to VC
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	err = vc.Connect(ctx)
+	vc, podVM, err := findPodVMInLinkedVCenters(ctx, c.manager, vmuuid)
 	if err != nil {
-		msg := fmt.Sprintf("failed to connect to Virtual Center: %s", vc.Config.Host)
+		msg := fmt.Sprintf("failed to the PodVM Moref from the PodVM UUID: %s with err: %+v", vmuuid, err)
 		log.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
-
-	podVM, err := getVMByInstanceUUIDInDatacenter(ctx, vc, dcMorefValue, vmuuid)
-	if err != nil {
-		msg := fmt.Sprintf("failed to the PodVM Moref from the PodVM UUID: %s in datacenter: %s with err: %+v", vmuuid, dcMorefValue, err)
-		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+	if err = checkPodVMPowerState(ctx, c.manager.CnsConfig, podVM); err != nil {
+		return nil, err
+	}
+	if err = checkPodVMClusterMembership(ctx, c, podVM); err != nil {
+		return nil, err
 	}
 
-	// Attach the volume to the node
-	diskUUID, err := common.AttachVolumeUtil(ctx, c.manager, podVM, req.VolumeId)
+	// Attach the volume to the node through the vCenter the PodVM was found in
+	manager := getManagerForVCenter(c.manager, vc)
+	diskUUID, err := common.AttachVolumeUtil(ctx, manager, podVM, req.VolumeId)
 	if err != nil {
+		if cnsvolume.IsResourceBusyError(err) {
+			msg := fmt.Sprintf("failed to attach volume with volumeID: %s as the PodVM is busy. Error: %+v", req.VolumeId, err)
+			log.Error(msg)
+			return nil, status.Errorf(codes.Aborted, msg)
+		}
 		msg := fmt.Sprintf("failed to attach volume with volumeID: %s. Error: %+v", req.VolumeId, err)
 		log.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Error(common.GetErrorCode(err, codes.Internal), msg)
 	}
 
-	publishInfo := make(map[string]string)
-	publishInfo[common.AttributeDiskType] = common.DiskTypeBlockVolume
-	publishInfo[common.AttributeFirstClassDiskUUID] = common.FormatDiskUUID(diskUUID)
+	publishInfo := common.GetBlockVolumePublishContext(c.manager.CnsConfig, diskUUID)
+	// Let the node plugin know which datastore backs the volume
+	datastoreURL, datastoreMoref, err := common.GetVolumeDatastore(ctx, manager, req.VolumeId)
+	if err != nil {
+		log.Warnf("failed to get datastore of volume %q. Error: %+v", req.VolumeId, err)
+	} else {
+		publishInfo[common.AttributeDatastoreURL] = datastoreURL
+		publishInfo[common.AttributeDatastoreMoref] = datastoreMoref
+	}
 	resp := &csi.ControllerPublishVolumeResponse{
 		PublishContext: publishInfo,
 	}
@@ -353,7 +678,8 @@ func (c *controller) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 	*csi.ControllerUnpublishVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ControllerUnpublishVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerUnpublishVolume", *req)()
+	defer c.inFlightOperations.Start(common.InFlightOperation{Name: "ControllerUnpublishVolume", Volume: req.VolumeId, Node: req.NodeId})()
 	err := validateWCPControllerUnpublishVolumeRequest(ctx, req)
 	if err != nil {
 		msg := fmt.Sprintf("Validation for UnpublishVolume Request: %+v has failed. Error: %v", *req, err)
@@ -368,39 +694,278 @@ func (c *controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ControllerGetCapabilities: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ValidateVolumeCapabilities", *req)()
 	volCaps := req.GetVolumeCapabilities()
-	var confirmed *csi.ValidateVolumeCapabilitiesResponse_Confirmed
-	if common.IsValidVolumeCapabilities(ctx, volCaps) {
-		confirmed = &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps}
+	if !common.IsValidVolumeCapabilities(ctx, volCaps) {
+		msg := fmt.Sprintf("unsupported volume capabilities %+v", volCaps)
+		log.Info(msg)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: msg}, nil
+	}
+	if err := common.ValidateMountFlags(volCaps); err != nil {
+		log.Info(err)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
-		Confirmed: confirmed,
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps},
 	}, nil
 }
 
+// ListVolumes returns the CNS volumes present on the shared datastores of the
+// WCP cluster. Enumeration is best-effort: datastores which fail to be queried
+// are skipped with a warning and the volumes retrieved from the remaining
+// datastores are returned.
 func (c *controller) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ListVolumes: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+	defer logger.LogRPCCall(ctx, "ListVolumes", *req)()
+	err := validateWCPListVolumesRequest(ctx, req)
+	if err != nil {
+		msg := fmt.Sprintf("Validation for ListVolumes Request: %+v has failed. Error: %+v", *req, err)
+		log.Error(msg)
+		return nil, err
+	}
+	sharedDatastores, err := getSharedDatastores(ctx, c)
+	if err != nil {
+		msg := fmt.Sprintf("failed to obtain shared datastores. Error: %+v", err)
+		log.Error(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+	// The volume inventory only holds the volumes of the managed clusters
+	volumes, staleVolumeIDs, ok := c.manager.VolumeInventory.List()
+	if ok && !c.manager.CnsConfig.Global.ListAllVolumes {
+		// The volumes created or changed since the last refresh of the inventory are
+		// queried from CNS
+		if len(staleVolumeIDs) > 0 {
+			staleVolumes, err := queryVolumesByID(ctx, c.manager, staleVolumeIDs)
+			if err != nil {
+				msg := fmt.Sprintf("failed to query volumes %v. Error: %+v", staleVolumeIDs, err)
+				log.Error(msg)
+				return nil, status.Errorf(codes.Internal, msg)
+			}
+			volumes = append(volumes, staleVolumes...)
+		}
+		volumes = filterVolumesOnDatastores(volumes, sharedDatastores)
+	} else {
+		volumes, err = queryVolumesOnDatastores(ctx, c.manager, sharedDatastores)
+		if err != nil {
+			msg := fmt.Sprintf("failed to query volumes on shared datastores. Error: %+v", err)
+			log.Error(msg)
+			return nil, status.Errorf(codes.Internal, msg)
+		}
+	}
+	if !c.manager.CnsConfig.Global.ListAllVolumes {
+		volumes = filterOwnedVolumes(c.manager.CnsConfig, volumes)
+	}
+	volumes, nextToken, err := paginateVolumes(volumes, req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		msg := fmt.Sprintf("failed to paginate volumes. Error: %+v", err)
+		log.Error(msg)
+		return nil, status.Errorf(codes.Aborted, msg)
+	}
+	// The info of the volumes and the PodVMs they are attached to are looked up
+	// for the whole page at once
+	blockVolumeInfos, err := getBlockVolumeInfos(ctx, c.manager, volumes)
+	if err != nil {
+		log.Warnf("failed to get info of volumes. Error: %+v", err)
+		blockVolumeInfos = make(map[string]*cnstypes.CnsBlockVolumeInfo)
+	}
+	staleAttachments, err := getStaleAttachments(ctx, c.manager, blockVolumeInfos)
+	if err != nil {
+		log.Warnf("failed to check volumes for stale attachments. Error: %+v", err)
+	}
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, volume := range volumes {
+		csiVolume := &csi.Volume{
+			VolumeId:      volume.VolumeId.Id,
+			CapacityBytes: getVolumeCapacityInMb(volume) * common.MbInBytes,
+			VolumeContext: make(map[string]string),
+		}
+		if isUnboundVolume(volume, c.manager.CnsConfig.Global.ClusterID) {
+			log.Infof("volume %q was provisioned by cluster %q but is not bound to a PV or in use by a pod",
+				volume.VolumeId.Id, c.manager.CnsConfig.Global.ClusterID)
+			csiVolume.VolumeContext[common.AttributeVolumeUnbound] = "true"
+		}
+		if blockVolumeInfo, ok := blockVolumeInfos[volume.VolumeId.Id]; ok {
+			csiVolume.VolumeContext[common.AttributeCreationTime] =
+				blockVolumeInfo.VStorageObject.Config.CreateTime.Format(time.RFC3339)
+		} else {
+			log.Warnf("failed to get info of volume %q", volume.VolumeId.Id)
+		}
+		if stale := staleAttachments[volume.VolumeId.Id]; len(stale) > 0 {
+			msg := fmt.Sprintf("volume is attached to PodVMs %v which no longer exist", stale)
+			log.Warnf("volume %q: %s", volume.VolumeId.Id, msg)
+			csiVolume.VolumeContext[common.AttributeVolumeAbnormal] = "true"
+			csiVolume.VolumeContext[common.AttributeVolumeConditionMessage] = msg
+		}
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: csiVolume,
+		})
+	}
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// QueryVolumesByLabelSelector returns the IDs of the volumes on the shared datastores
+// with metadata written by the cluster whose labels match the given label selector,
+// such as "app=foo". The results are paginated like ListVolumes, with startingToken
+// and maxEntries, and the token to retrieve the next page is returned.
+func (c *controller) QueryVolumesByLabelSelector(ctx context.Context, labelSelector string,
+	startingToken string, maxEntries int32) ([]string, string, error) {
+	ctx = logger.NewContextWithLogger(ctx)
+	log := logger.GetLogger(ctx)
+	log.Infof("QueryVolumesByLabelSelector: called with label selector %q", labelSelector)
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		msg := fmt.Sprintf("invalid label selector %q. Error: %+v", labelSelector, err)
+		log.Error(msg)
+		return nil, "", status.Error(codes.InvalidArgument, msg)
+	}
+	if maxEntries < 0 {
+		msg := fmt.Sprintf("max entries %d must not be negative", maxEntries)
+		log.Error(msg)
+		return nil, "", status.Error(codes.InvalidArgument, msg)
+	}
+	sharedDatastores, err := getSharedDatastores(ctx, c)
+	if err != nil {
+		msg := fmt.Sprintf("failed to obtain shared datastores. Error: %+v", err)
+		log.Error(msg)
+		return nil, "", status.Error(codes.Internal, msg)
+	}
+	volumes, err := queryVolumesOnDatastores(ctx, c.manager, sharedDatastores)
+	if err != nil {
+		msg := fmt.Sprintf("failed to query volumes on shared datastores. Error: %+v", err)
+		log.Error(msg)
+		return nil, "", status.Error(codes.Internal, msg)
+	}
+	var matchingVolumes []cnstypes.CnsVolume
+	for _, volume := range volumes {
+		if volumeMatchesLabelSelector(volume, c.manager.CnsConfig.Global.ClusterID, selector) {
+			matchingVolumes = append(matchingVolumes, volume)
+		}
+	}
+	matchingVolumes, nextToken, err := paginateVolumes(matchingVolumes, startingToken, maxEntries)
+	if err != nil {
+		msg := fmt.Sprintf("failed to paginate volumes. Error: %+v", err)
+		log.Error(msg)
+		return nil, "", status.Error(codes.Aborted, msg)
+	}
+	volumeIDs := make([]string, 0, len(matchingVolumes))
+	for _, volume := range matchingVolumes {
+		volumeIDs = append(volumeIDs, volume.VolumeId.Id)
+	}
+	return volumeIDs, nextToken, nil
+}
+
+// CheckProvisioningReadiness runs the steps volume provisioning depends on, i.e.
+// connecting to vCenter, looking up the hosts of the cluster, computing the shared
+// datastores and resolving the given storage policy against them, and reports the
+// outcome of each. A check is reported as failed without being run if a previous
+// check failed. The storage policy check is skipped if no policy ID is given.
+func (c *controller) CheckProvisioningReadiness(ctx context.Context, storagePolicyID string) *common.ReadinessReport {
+	ctx = logger.NewContextWithLogger(ctx)
+	log := logger.GetLogger(ctx)
+	report := &common.ReadinessReport{Ready: true}
+	var failedCheck string
+	runCheck := func(name string, check func() (string, error)) {
+		result := common.ReadinessCheck{Name: name}
+		if failedCheck != "" {
+			result.Message = fmt.Sprintf("not run as the %s check failed", failedCheck)
+		} else if msg, err := check(); err != nil {
+			result.Message = err.Error()
+			failedCheck = name
+			report.Ready = false
+		} else {
+			result.Passed = true
+			result.Message = msg
+		}
+		log.Infof("readiness check %s passed: %t. %s", name, result.Passed, result.Message)
+		report.Checks = append(report.Checks, result)
+	}
+
+	runCheck(readinessCheckVCenterConnectivity, func() (string, error) {
+		vc, err := common.GetVCenter(ctx, c.manager)
+		if err != nil {
+			return "", fmt.Errorf("failed to connect to vCenter. Error: %+v", err)
+		}
+		return fmt.Sprintf("connected to vCenter %s", vc.Config.Host), nil
+	})
+	runCheck(readinessCheckClusterHosts, func() (string, error) {
+		hosts, err := getClusterHosts(ctx, c.manager)
+		if err != nil {
+			return "", fmt.Errorf("failed to get hosts of cluster %s. Error: %+v", c.manager.CnsConfig.Global.ClusterID, err)
+		}
+		if len(hosts) == 0 {
+			return "", fmt.Errorf("no hosts found in cluster %s", c.manager.CnsConfig.Global.ClusterID)
+		}
+		return fmt.Sprintf("found %d hosts in cluster %s", len(hosts), c.manager.CnsConfig.Global.ClusterID), nil
+	})
+	var sharedDatastores []*cnsvsphere.DatastoreInfo
+	runCheck(readinessCheckSharedDatastores, func() (string, error) {
+		var err error
+		sharedDatastores, err = getSharedDatastores(ctx, c)
+		if err != nil {
+			return "", fmt.Errorf("failed to get shared datastores. Error: %+v", err)
+		}
+		if len(sharedDatastores) == 0 {
+			return "", errors.New("no datastores are shared by all the hosts of the cluster")
+		}
+		return fmt.Sprintf("found %d shared datastores", len(sharedDatastores)), nil
+	})
+	runCheck(readinessCheckStoragePolicy, func() (string, error) {
+		if storagePolicyID == "" {
+			return "no storage policy given", nil
+		}
+		compatibleDatastores, err := getCompatibleDatastores(ctx, c, storagePolicyID, sharedDatastores)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve storage policy %s. Error: %+v", storagePolicyID, err)
+		}
+		if len(compatibleDatastores) == 0 {
+			return "", fmt.Errorf("no shared datastores are compatible with storage policy %s", storagePolicyID)
+		}
+		return fmt.Sprintf("%d shared datastores are compatible with storage policy %s", len(compatibleDatastores), storagePolicyID), nil
+	})
+	return report
 }
 
 func (c *controller) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
 	*csi.GetCapacityResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("GetCapacity: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+	defer logger.LogRPCCall(ctx, "GetCapacity", *req)()
+	err := validateWCPGetCapacityRequest(ctx, req)
+	if err != nil {
+		msg := fmt.Sprintf("Validation for GetCapacity Request: %+v has failed. Error: %v", *req, err)
+		log.Error(msg)
+		return nil, status.Error(codes.InvalidArgument, msg)
+	}
+	datastores, err := getSharedDatastores(ctx, c)
+	if err != nil {
+		msg := fmt.Sprintf("failed to get shared datastores in kubernetes cluster. Error: %+v", err)
+		log.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	// Only account for the datastores compatible with the storage policy of the storage class
+	if storagePolicyID := getStoragePolicyIDFromParams(req.GetParameters()); storagePolicyID != "" {
+		datastores, err = getPolicyCompatibleDatastores(ctx, c, storagePolicyID, datastores)
+		if err != nil {
+			msg := fmt.Sprintf("failed to get datastores compatible with storage policy %s. Error: %+v", storagePolicyID, err)
+			log.Error(msg)
+			return nil, status.Error(codes.Internal, msg)
+		}
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: common.AggregateAvailableCapacity(datastores, c.manager.CnsConfig.Global.CapacityAggregation),
+	}, nil
 }
 
 func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (
 	*csi.ControllerGetCapabilitiesResponse, error) {
 
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("ControllerGetCapabilities: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerGetCapabilities", *req)()
 	var caps []*csi.ControllerServiceCapability
 	for _, cap := range controllerCaps {
 		c := &csi.ControllerServiceCapability{
@@ -419,8 +984,7 @@ func (c *controller) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshot
 	*csi.CreateSnapshotResponse, error) {
 
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("CreateSnapshot: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "CreateSnapshot", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
@@ -428,8 +992,7 @@ func (c *controller) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshot
 	*csi.DeleteSnapshotResponse, error) {
 
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("DeleteSnapshot: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "DeleteSnapshot", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
@@ -437,8 +1000,7 @@ func (c *controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRe
 	*csi.ListSnapshotsResponse, error) {
 
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("ListSnapshots: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ListSnapshots", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
@@ -446,56 +1008,76 @@ func (c *controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRe
 func (c *controller) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (
 	*csi.ControllerExpandVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("ControllerExpandVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerExpandVolume", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 // GetSharedDatastoresInPodVMK8SCluster gets the shared datastores for WCP PodVM cluster
-func getSharedDatastoresInPodVMK8SCluster(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+func getSharedDatastoresInPodVMK8SCluster(ctx context.Context, c *controller) (
+	datastores []*cnsvsphere.DatastoreInfo, err error) {
+	defer func(start time.Time) { common.ObserveSharedDatastoresDuration(start, err) }(time.Now())
 	log := logger.GetLogger(ctx)
-	vc, err := common.GetVCenter(ctx, c.manager)
-	if err != nil {
-		log.Errorf("failed to get vCenter from Manager, err=%+v", err)
-		return nil, err
+	clusterID := getClusterID(ctx, c.manager.CnsConfig)
+	if host, sharedURLs, ok := hostDatastores.getSharedDatastoreURLs(clusterID); ok {
+		// Look up the datastores of a single host, so that their free space is current
+		accessibleDatastores, err := getHostAccessibleDatastores(ctx, host)
+		if err == nil {
+			var sharedDatastores []*cnsvsphere.DatastoreInfo
+			for _, datastore := range accessibleDatastores {
+				if sharedURLs[cnsvsphere.NormalizeDatastoreURL(datastore.Info.Url)] {
+					sharedDatastores = append(sharedDatastores, datastore)
+				}
+			}
+			if len(sharedDatastores) > 0 {
+				log.Debugf("The list of shared datastores from the cached hosts: %+v", sharedDatastores)
+				common.RecordSharedDatastoresCacheLookup(true)
+				return sharedDatastores, nil
+			}
+		} else {
+			log.Warnf("failed to get the accessible datastores of host %s, looking up all the hosts. err: %v",
+				host.Reference().Value, err)
+		}
 	}
-	hosts, err := vc.GetHostsByCluster(ctx, c.manager.CnsConfig.Global.ClusterID)
+	common.RecordSharedDatastoresCacheLookup(false)
+	hosts, err := getClusterHosts(ctx, c.manager)
 	if err != nil {
 		log.Errorf("failed to get hosts from VC with err %+v", err)
 		return nil, err
 	}
+	if minHostVersion := c.manager.CnsConfig.Global.MinHostVersion; minHostVersion != "" && len(hosts) > 0 {
+		hosts, err = filterHostsByMinVersion(ctx, hosts, minHostVersion)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if len(hosts) == 0 {
+			log.Errorf("%v. min-host-version: %s", errNoHostsOfMinVersion, minHostVersion)
+			return make([]*cnsvsphere.DatastoreInfo, 0), errNoHostsOfMinVersion
+		}
+	}
 	if len(hosts) == 0 {
-		errMsg := "Empty List of hosts returned from VC"
-		log.Errorf(errMsg)
-		return make([]*cnsvsphere.DatastoreInfo, 0), fmt.Errorf(errMsg)
+		log.Error(errNoClusterHosts)
+		return make([]*cnsvsphere.DatastoreInfo, 0), errNoClusterHosts
 	}
 	var sharedDatastores []*cnsvsphere.DatastoreInfo
+	hostEntries := make(map[string]hostDatastoreEntry)
 	for _, host := range hosts {
 		log.Debugf("Getting accessible datastores for node %s", host.InventoryPath)
-		accessibleDatastores, err := host.GetAllAccessibleDatastores(ctx)
+		accessibleDatastores, err := getHostAccessibleDatastores(ctx, host)
 		if err != nil {
 			return nil, err
 		}
+		hostEntries[host.Reference().Value] = newHostDatastoreEntry(host, accessibleDatastores)
 		if len(sharedDatastores) == 0 {
 			sharedDatastores = accessibleDatastores
 		} else {
-			var sharedAccessibleDatastores []*cnsvsphere.DatastoreInfo
-			// Check if sharedDatastores is found in accessibleDatastores
-			for _, sharedDs := range sharedDatastores {
-				for _, accessibleDs := range accessibleDatastores {
-					// Intersection is performed based on the datastoreUrl as this uniquely identifies the datastore.
-					if sharedDs.Info.Url == accessibleDs.Info.Url {
-						sharedAccessibleDatastores = append(sharedAccessibleDatastores, sharedDs)
-						break
-					}
-				}
-			}
-			sharedDatastores = sharedAccessibleDatastores
+			sharedDatastores = intersectDatastores(sharedDatastores, accessibleDatastores)
 		}
 		if len(sharedDatastores) == 0 {
-			return nil, fmt.Errorf("No shared datastores found in the Kubernetes cluster for host: %+v", host)
+			return nil, fmt.Errorf("%w for host: %+v", errNoSharedDatastores, host)
 		}
 	}
+	hostDatastores.set(clusterID, hostEntries)
 	log.Debugf("The list of shared datastores: %+v", sharedDatastores)
 	return sharedDatastores, nil
 }
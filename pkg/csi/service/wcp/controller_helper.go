@@ -20,21 +20,32 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	cnstypes "github.com/vmware/govmomi/cns/types"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25/types"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/util/wait"
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/syncer/podlistener"
 )
 
@@ -42,6 +53,89 @@ const (
 	defaultPodListenerServicePort = 10000
 )
 
+// Names of the checks reported by CheckProvisioningReadiness.
+const (
+	readinessCheckVCenterConnectivity = "VCenterConnectivity"
+	readinessCheckClusterHosts        = "ClusterHosts"
+	readinessCheckSharedDatastores    = "SharedDatastores"
+	readinessCheckStoragePolicy       = "StoragePolicy"
+)
+
+// getClusterHosts returns the hosts in the cluster. It's a variable so that it
+// can be overridden in the unit tests.
+var getClusterHosts = getHostsInPodVMK8SCluster
+
+// isPodVMPoweredOn returns whether the PodVM is powered on. It's a variable so
+// that it can be overridden in the unit tests.
+var isPodVMPoweredOn = func(ctx context.Context, podVM *vsphere.VirtualMachine) (bool, error) {
+	return podVM.IsActive(ctx)
+}
+
+// getHostVersion returns the ESXi version of the host. It's a variable so that
+// it can be overridden in the unit tests.
+var getHostVersion = func(ctx context.Context, host *vsphere.HostSystem) (string, error) {
+	return host.GetHostVersion(ctx)
+}
+
+// datastoreErrorLogger rate limits the errors logged for datastores which stay
+// inaccessible across requests.
+var datastoreErrorLogger = logger.NewRateLimitedLogger(5 * time.Minute)
+
+// policyCompatibilityCacheTTL is how long the datastores compatible with a
+// storage policy are cached for GetCapacity.
+const policyCompatibilityCacheTTL = 5 * time.Minute
+
+// hostDatastoreCacheTTL is how long the datastores accessible from the hosts of a
+// cluster are cached for computing the shared datastores.
+const hostDatastoreCacheTTL = 5 * time.Minute
+
+// policyCompatibility caches the URLs of the datastores compatible with a storage policy.
+var policyCompatibility = &policyCompatibilityCache{
+	entries: make(map[string]policyCompatibilityEntry),
+	ttl:     policyCompatibilityCacheTTL,
+	now:     time.Now,
+}
+
+// getCompatibleDatastores returns the datastores compatible with the given storage policy.
+// It's a variable so that it can be overridden in the unit tests.
+var getCompatibleDatastores = func(ctx context.Context, c *controller, storagePolicyID string,
+	datastores []*vsphere.DatastoreInfo) ([]*vsphere.DatastoreInfo, error) {
+	vc, err := common.GetVCenter(ctx, c.manager)
+	if err != nil {
+		return nil, err
+	}
+	return vc.GetCompatibleDatastores(ctx, storagePolicyID, datastores)
+}
+
+// sharedDatastoreRetryInterval is the interval at which the shared datastores are
+// looked up again while waiting for them to appear.
+var sharedDatastoreRetryInterval = 5 * time.Second
+
+// errNoClusterHosts is returned when no hosts are found in the cluster, e.g. while
+// the cluster is being set up.
+var errNoClusterHosts = errors.New("no hosts found in the cluster")
+
+// errNoSharedDatastores is returned when no datastore is accessible from all the
+// hosts in the cluster, e.g. while hosts are rebooting.
+var errNoSharedDatastores = errors.New("no shared datastores found in the Kubernetes cluster")
+
+// errNoHostsOfMinVersion is returned when none of the hosts in the cluster are of
+// the version configured with min-host-version.
+var errNoHostsOfMinVersion = errors.New("no hosts of the minimum version found in the cluster")
+
+// errVCenterUnavailable is returned when vCenter can't be connected to while looking
+// up the hosts of the cluster, e.g. because of a transient network failure, as
+// opposed to vCenter not being configured.
+var errVCenterUnavailable = errors.New("vCenter is unavailable")
+
+// errAffineHostNotFound is returned when the host a volume is requested to be affine
+// to with affinetohost is not a host of the cluster.
+var errAffineHostNotFound = errors.New("affine host not found in the cluster")
+
+// errAllDatastoreQueriesFailed is returned when none of the datastores could be
+// queried for volumes.
+var errAllDatastoreQueriesFailed = errors.New("failed to query volumes on all datastores")
+
 // ValidateCreateVolumeRequest is the helper function to validate
 // CreateVolumeRequest for WCP CSI driver.
 // Function returns error if validation fails otherwise returns nil.
@@ -51,11 +145,15 @@ func validateWCPCreateVolumeRequest(ctx context.Context, req *csi.CreateVolumeRe
 	for paramName := range params {
 		paramName = strings.ToLower(paramName)
 		if paramName != common.AttributeStoragePolicyID && paramName != common.AttributeFsType &&
-			paramName != common.AttributeAffineToHost {
+			paramName != common.AttributeAffineToHost && paramName != common.AttributeClusterID &&
+			paramName != common.AttributePreferredStoragePolicyID {
 			msg := fmt.Sprintf("Volume parameter %s is not a valid WCP CSI parameter.", paramName)
 			return status.Error(codes.InvalidArgument, msg)
 		}
 	}
+	if err := validateWCPCreateVolumeParamConflicts(req); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
 	// Fail file volume creation
 	if common.IsFileVolumeRequest(ctx, req.GetVolumeCapabilities()) {
 		return status.Error(codes.InvalidArgument, "File volume not supported.")
@@ -63,6 +161,32 @@ func validateWCPCreateVolumeRequest(ctx context.Context, req *csi.CreateVolumeRe
 	return common.ValidateCreateVolumeRequest(ctx, req)
 }
 
+// validateWCPCreateVolumeParamConflicts returns an error describing the conflict if
+// the parameters of the given CreateVolumeRequest can't be honored together, i.e.
+// a parameter is specified more than once with different values, as parameter
+// names are case insensitive, or fstype is specified for a raw block volume.
+func validateWCPCreateVolumeParamConflicts(req *csi.CreateVolumeRequest) error {
+	params := req.GetParameters()
+	paramNames := make(map[string]string)
+	for paramName, paramValue := range params {
+		param := strings.ToLower(paramName)
+		if otherName, exists := paramNames[param]; exists && params[otherName] != paramValue {
+			return fmt.Errorf("conflicting values %q and %q specified for parameters %s and %s",
+				params[otherName], paramValue, otherName, paramName)
+		}
+		paramNames[param] = paramName
+	}
+	if fsTypeParam, exists := paramNames[common.AttributeFsType]; exists {
+		for _, volCap := range req.GetVolumeCapabilities() {
+			if volCap.GetBlock() != nil {
+				return fmt.Errorf("parameter %s=%q conflicts with raw block access type, which has no filesystem",
+					fsTypeParam, params[fsTypeParam])
+			}
+		}
+	}
+	return nil
+}
+
 // validateWCPDeleteVolumeRequest is the helper function to validate
 // DeleteVolumeRequest for WCP CSI driver.
 // Function returns error if validation fails otherwise returns nil.
@@ -73,7 +197,11 @@ func validateWCPDeleteVolumeRequest(ctx context.Context, req *csi.DeleteVolumeRe
 // validateWCPControllerPublishVolumeRequest is the helper function to validate
 // ControllerPublishVolumeRequest for WCP CSI driver. Function returns error if validation fails otherwise returns nil.
 func validateWCPControllerPublishVolumeRequest(ctx context.Context, req *csi.ControllerPublishVolumeRequest) error {
-	return common.ValidateControllerPublishVolumeRequest(ctx, req)
+	if err := common.ValidateControllerPublishVolumeRequest(ctx, req); err != nil {
+		return err
+	}
+	// Only block volumes are supported
+	return common.ValidateVolumeCapabilityForVolumeType(ctx, req.GetVolumeCapability(), common.BlockVolumeType)
 }
 
 // validateWCPControllerUnpublishVolumeRequest is the helper function to validate
@@ -82,6 +210,235 @@ func validateWCPControllerUnpublishVolumeRequest(ctx context.Context, req *csi.C
 	return common.ValidateControllerUnpublishVolumeRequest(ctx, req)
 }
 
+// validateWCPListVolumesRequest is the helper function to validate
+// ListVolumesRequest for WCP CSI driver. Function returns error if validation fails otherwise returns nil.
+func validateWCPListVolumesRequest(ctx context.Context, req *csi.ListVolumesRequest) error {
+	if req.GetMaxEntries() < 0 {
+		return status.Error(codes.InvalidArgument, "max entries cannot be negative")
+	}
+	// The starting token is validated by paginateVolumes, which issues it
+	return nil
+}
+
+// queryVolumesOnDatastores queries CNS for the volumes present on each of the given datastores.
+// Datastores are queried one at a time so that a failure on one datastore (e.g. an inaccessible
+// datastore) does not prevent the volumes on the other datastores from being returned.
+// An error is returned only if every datastore query fails.
+func queryVolumesOnDatastores(ctx context.Context, manager *common.Manager,
+	datastores []*vsphere.DatastoreInfo) ([]cnstypes.CnsVolume, error) {
+	log := logger.GetLogger(ctx)
+	var volumes []cnstypes.CnsVolume
+	var failedDatastores []string
+	for _, datastore := range datastores {
+		queryFilter := cnstypes.CnsQueryFilter{
+			Datastores: []types.ManagedObjectReference{datastore.Reference()},
+		}
+		queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+		if err != nil {
+			datastoreErrorLogger.Warnf(ctx, "failed to query volumes on datastore: %q. Skipping the datastore. Error: %+v",
+				datastore.Info.Url, err)
+			failedDatastores = append(failedDatastores, datastore.Info.Url)
+			continue
+		}
+		volumes = append(volumes, queryResult.Volumes...)
+	}
+	if len(datastores) > 0 && len(failedDatastores) == len(datastores) {
+		return nil, errAllDatastoreQueriesFailed
+	}
+	if len(failedDatastores) > 0 {
+		log.Warnf("returning partial list of volumes. Volumes on datastores: %v could not be retrieved",
+			failedDatastores)
+	}
+	return volumes, nil
+}
+
+// queryVolumesByID returns the CNS volumes with the given IDs.
+func queryVolumesByID(ctx context.Context, manager *common.Manager, volumeIDs []string) ([]cnstypes.CnsVolume, error) {
+	queryFilter := cnstypes.CnsQueryFilter{}
+	for _, volumeID := range volumeIDs {
+		queryFilter.VolumeIds = append(queryFilter.VolumeIds, cnstypes.CnsVolumeId{Id: volumeID})
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+	if err != nil {
+		return nil, err
+	}
+	return queryResult.Volumes, nil
+}
+
+// filterVolumesOnDatastores returns the given CNS volumes which are on one of the
+// given datastores.
+func filterVolumesOnDatastores(volumes []cnstypes.CnsVolume, datastores []*vsphere.DatastoreInfo) []cnstypes.CnsVolume {
+	datastoreURLs := make(map[string]bool)
+	for _, datastore := range datastores {
+		datastoreURLs[vsphere.NormalizeDatastoreURL(datastore.Info.Url)] = true
+	}
+	var filteredVolumes []cnstypes.CnsVolume
+	for _, volume := range volumes {
+		if datastoreURLs[vsphere.NormalizeDatastoreURL(volume.DatastoreUrl)] {
+			filteredVolumes = append(filteredVolumes, volume)
+		}
+	}
+	return filteredVolumes
+}
+
+// getVolumeSetFingerprint returns a fingerprint of the IDs of the given volumes,
+// which must be sorted by volume ID.
+func getVolumeSetFingerprint(volumes []cnstypes.CnsVolume) string {
+	hash := fnv.New64a()
+	for _, volume := range volumes {
+		hash.Write([]byte(volume.VolumeId.Id))
+		hash.Write([]byte{0})
+	}
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+// paginateVolumes returns the page of volumes starting at startingToken with at most maxEntries
+// volumes, along with the token to be used to retrieve the next page. An empty next token
+// indicates that there are no more volumes to be returned.
+// The volumes are sorted by volume ID so that the order is stable across calls. The token
+// holds the offset of the next page along with a fingerprint of the set of volumes, so that
+// listing can be resumed after a restart of the driver or the caller, and is aborted if
+// volumes were created or deleted in between.
+func paginateVolumes(volumes []cnstypes.CnsVolume, startingToken string, maxEntries int32) (
+	[]cnstypes.CnsVolume, string, error) {
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].VolumeId.Id < volumes[j].VolumeId.Id
+	})
+	fingerprint := getVolumeSetFingerprint(volumes)
+	start := 0
+	if startingToken != "" {
+		tokenParts := strings.SplitN(startingToken, ":", 2)
+		var err error
+		start, err = strconv.Atoi(tokenParts[0])
+		if err != nil || len(tokenParts) != 2 || start < 0 || start > len(volumes) {
+			return nil, "", fmt.Errorf("invalid starting token %q for %d volumes", startingToken, len(volumes))
+		}
+		if tokenParts[1] != fingerprint {
+			return nil, "", fmt.Errorf("volumes have changed since starting token %q was issued", startingToken)
+		}
+	}
+	end := len(volumes)
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+	nextToken := ""
+	if end < len(volumes) {
+		nextToken = fmt.Sprintf("%d:%s", end, fingerprint)
+	}
+	return volumes[start:end], nextToken, nil
+}
+
+// volumeMatchesLabelSelector returns true if the labels of any of the entities in the
+// metadata written by the cluster with the given ID to the given CNS volume match the
+// given selector.
+func volumeMatchesLabelSelector(volume cnstypes.CnsVolume, clusterID string, selector labels.Selector) bool {
+	for _, metadata := range volume.Metadata.EntityMetadata {
+		entityMetadata, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata)
+		if !ok || entityMetadata.ClusterID != clusterID {
+			continue
+		}
+		if selector.Matches(labels.Set(common.GetLabelsMapFromKeyValue(entityMetadata.Labels))) {
+			return true
+		}
+	}
+	return false
+}
+
+// getVolumeCapacityInMb returns the capacity of the given CNS volume in MB.
+func getVolumeCapacityInMb(volume cnstypes.CnsVolume) int64 {
+	if volume.BackingObjectDetails == nil {
+		return 0
+	}
+	return volume.BackingObjectDetails.(cnstypes.BaseCnsBackingObjectDetails).GetCnsBackingObjectDetails().CapacityInMb
+}
+
+// isUnboundVolume returns true if the given CNS volume was provisioned by the
+// cluster with the given ID, but has neither PV nor pod entity metadata from the
+// cluster, i.e. the volume is not bound to a PV and not in use by a pod.
+func isUnboundVolume(volume cnstypes.CnsVolume, clusterID string) bool {
+	if volume.Metadata.ContainerCluster.ClusterId != clusterID {
+		return false
+	}
+	for _, metadata := range volume.Metadata.EntityMetadata {
+		entityMetadata, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata)
+		if !ok || entityMetadata.ClusterID != clusterID {
+			continue
+		}
+		if entityMetadata.EntityType == string(cnstypes.CnsKubernetesEntityTypePV) ||
+			entityMetadata.EntityType == string(cnstypes.CnsKubernetesEntityTypePOD) {
+			return false
+		}
+	}
+	return true
+}
+
+// getVolumeMetadataUpdateSpecs compares the labels of the given PVs with the PV
+// entity metadata of the corresponding CNS volumes and returns the update specs
+// for the volumes whose metadata has drifted from the Kubernetes state.
+func getVolumeMetadataUpdateSpecs(ctx context.Context, pvs []*v1.PersistentVolume, volumes []cnstypes.CnsVolume,
+	cfg *config.Config, username string) []*cnstypes.CnsVolumeMetadataUpdateSpec {
+	log := logger.GetLogger(ctx)
+	clusterID := cfg.Global.ClusterID
+	cnsVolumes := make(map[string]cnstypes.CnsVolume)
+	for _, volume := range volumes {
+		cnsVolumes[volume.VolumeId.Id] = volume
+	}
+	var updateSpecs []*cnstypes.CnsVolumeMetadataUpdateSpec
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != csitypes.Name {
+			continue
+		}
+		volumeID := pv.Spec.CSI.VolumeHandle
+		volume, ok := cnsVolumes[volumeID]
+		if !ok {
+			log.Debugf("volume %q for PV %q is not registered in CNS. Skipping metadata reconciliation", volumeID, pv.Name)
+			continue
+		}
+		// Build the expected labels the way the syncer does, keeping the labels the
+		// driver recorded in CNS which are not on the PV
+		pvLabels := common.GetPVLabels(pv)
+		common.AddChargebackLabels(pvLabels, cfg)
+		cnsMetadata := getCnsPVEntityMetadata(volume, pv.Name, clusterID)
+		if cnsMetadata != nil {
+			common.AddDriverOwnedPVLabels(pvLabels, common.GetLabelsMapFromKeyValue(cnsMetadata.Labels))
+		}
+		pvMetadata := vsphere.GetCnsKubernetesEntityMetaData(pv.Name, pvLabels, false,
+			string(cnstypes.CnsKubernetesEntityTypePV), "", clusterID, nil)
+		if cnsMetadata != nil && vsphere.CompareKubernetesMetadata(ctx, pvMetadata, cnsMetadata) {
+			continue
+		}
+		log.Infof("metadata of volume %q has drifted from the labels of PV %q", volumeID, pv.Name)
+		containerCluster := vsphere.GetContainerCluster(clusterID, username, cnstypes.CnsClusterFlavorWorkload)
+		updateSpecs = append(updateSpecs, &cnstypes.CnsVolumeMetadataUpdateSpec{
+			VolumeId: cnstypes.CnsVolumeId{
+				Id: volumeID,
+			},
+			Metadata: cnstypes.CnsVolumeMetadata{
+				ContainerCluster:      containerCluster,
+				ContainerClusterArray: []cnstypes.CnsContainerCluster{containerCluster},
+				EntityMetadata:        []cnstypes.BaseCnsEntityMetadata{cnstypes.BaseCnsEntityMetadata(pvMetadata)},
+			},
+		})
+	}
+	return updateSpecs
+}
+
+// getCnsPVEntityMetadata returns the PV entity metadata of the given CNS volume
+// for the given cluster, or nil if the volume has no such metadata.
+func getCnsPVEntityMetadata(volume cnstypes.CnsVolume, pvName string, clusterID string) *cnstypes.CnsKubernetesEntityMetadata {
+	for _, metadata := range volume.Metadata.EntityMetadata {
+		entityMetadata, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata)
+		if !ok {
+			continue
+		}
+		if entityMetadata.EntityType == string(cnstypes.CnsKubernetesEntityTypePV) &&
+			entityMetadata.EntityName == pvName && entityMetadata.ClusterID == clusterID {
+			return entityMetadata
+		}
+	}
+	return nil
+}
+
 // getVMUUIDFromPodListenerService gets the vmuuid from pod listener gRPC service
 func getVMUUIDFromPodListenerService(ctx context.Context, volumeID string, nodeName string) (string, error) {
 	var opts []grpc.DialOption
@@ -118,24 +475,335 @@ func getVMUUIDFromPodListenerService(ctx context.Context, volumeID string, nodeN
 	return res.VmuuidAnnotation, nil
 }
 
-// getDatacenterFromConfig gets the vcenter-datacenter where WCP PodVM cluster is deployed
-func getDatacenterFromConfig(cfg *config.Config) (map[string]string, error) {
-	vcdcMap := make(map[string]string)
+// vcDatacenter identifies the datacenter of a vCenter in which the WCP PodVM
+// cluster may be deployed.
+type vcDatacenter struct {
+	vcHost     string
+	datacenter string
+}
+
+// getVCDatacenterPairsFromConfig returns the vCenter-datacenter pairs where WCP
+// PodVM cluster may be deployed, sorted by vCenter host. With enhanced linked
+// mode, there is one pair for each of the linked vCenters.
+func getVCDatacenterPairsFromConfig(cfg *config.Config) ([]vcDatacenter, error) {
 	vcdcListMap, err := getVCDatacentersFromConfig(cfg)
 	if err != nil {
-		return vcdcMap, err
-	}
-	if len(vcdcListMap) != 1 {
-		return vcdcMap, fmt.Errorf("Found more than one vCenter instance. WCP Cluster can be deployed in only one VC")
+		return nil, err
 	}
-
+	var vcdcPairs []vcDatacenter
 	for vcHost, dcList := range vcdcListMap {
 		if len(dcList) > 1 {
-			return vcdcMap, fmt.Errorf("Found more than one datacenter instances: %+v for vcHost: %s. WCP Cluster can be deployed in only one datacenter", dcList, vcHost)
+			return nil, fmt.Errorf("Found more than one datacenter instances: %+v for vcHost: %s. WCP Cluster can be deployed in only one datacenter per VC", dcList, vcHost)
 		}
-		vcdcMap[vcHost] = dcList[0]
+		vcdcPairs = append(vcdcPairs, vcDatacenter{vcHost: vcHost, datacenter: dcList[0]})
 	}
-	return vcdcMap, nil
+	sort.Slice(vcdcPairs, func(i, j int) bool {
+		return vcdcPairs[i].vcHost < vcdcPairs[j].vcHost
+	})
+	return vcdcPairs, nil
+}
+
+// getLinkedVCenter returns the VirtualCenter for the given host, registering it
+// with the VirtualCenterManager first if it is a linked vCenter which has not
+// been registered yet.
+func getLinkedVCenter(ctx context.Context, manager *common.Manager, host string) (*vsphere.VirtualCenter, error) {
+	log := logger.GetLogger(ctx)
+	vc, err := manager.VcenterManager.GetVirtualCenter(ctx, host)
+	if err != vsphere.ErrVCNotFound {
+		return vc, err
+	}
+	vcConfig, err := vsphere.GetVirtualCenterConfigForHost(manager.CnsConfig, host)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Registering linked virtual center: %q with virtualCenterManager", host)
+	return manager.VcenterManager.RegisterVirtualCenter(ctx, vcConfig)
+}
+
+// connectVCenter connects to the given vCenter.
+var connectVCenter = func(ctx context.Context, vc *vsphere.VirtualCenter) error {
+	if err := vc.Connect(ctx); err != nil {
+		return fmt.Errorf("failed to connect to Virtual Center: %s. err: %+v", vc.Config.Host, err)
+	}
+	return nil
+}
+
+// getPodVMInVCenter returns the PodVM with the given instance UUID in the given
+// datacenter of the given connected vCenter.
+var getPodVMInVCenter = getVMByInstanceUUIDInDatacenter
+
+// findPodVMInLinkedVCenters looks up the PodVM with the given instance UUID in
+// the datacenters of all the configured vCenters and returns the PodVM along
+// with the vCenter it was found in.
+func findPodVMInLinkedVCenters(ctx context.Context, manager *common.Manager, vmInstanceUUID string) (
+	*vsphere.VirtualCenter, *vsphere.VirtualMachine, error) {
+	log := logger.GetLogger(ctx)
+	vcdcPairs, err := getVCDatacenterPairsFromConfig(manager.CnsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	var lookupErrs []string
+	for _, vcdc := range vcdcPairs {
+		vc, err := getLinkedVCenter(ctx, manager, vcdc.vcHost)
+		if err != nil {
+			log.Warnf("failed to get virtual center %s. err: %+v", vcdc.vcHost, err)
+			lookupErrs = append(lookupErrs, err.Error())
+			continue
+		}
+		if err = connectVCenter(ctx, vc); err != nil {
+			log.Warnf("failed to connect to virtual center %s. err: %+v", vcdc.vcHost, err)
+			lookupErrs = append(lookupErrs, err.Error())
+			continue
+		}
+		podVM, err := getPodVMInVCenter(ctx, vc, vcdc.datacenter, vmInstanceUUID)
+		if err != nil {
+			log.Debugf("PodVM %s not found in datacenter %s of virtual center %s. err: %+v",
+				vmInstanceUUID, vcdc.datacenter, vcdc.vcHost, err)
+			lookupErrs = append(lookupErrs, err.Error())
+			continue
+		}
+		log.Debugf("Found PodVM %s in datacenter %s of virtual center %s", vmInstanceUUID, vcdc.datacenter, vcdc.vcHost)
+		return vc, podVM, nil
+	}
+	return nil, nil, fmt.Errorf("failed to find PodVM %s in any of the virtual centers. errors: %v", vmInstanceUUID, lookupErrs)
+}
+
+// newVolumeManager returns the volume manager of the given linked vCenter.
+var newVolumeManager = cnsvolume.NewManager
+
+// getManagerForVCenter returns the manager of the volumes of the given vCenter,
+// which is the given manager for the configured vCenter, and a copy of it using
+// the volume manager of the given vCenter otherwise.
+func getManagerForVCenter(manager *common.Manager, vc *vsphere.VirtualCenter) *common.Manager {
+	if manager.VcenterConfig != nil && vc.Config.Host == manager.VcenterConfig.Host {
+		return manager
+	}
+	vcManager := *manager
+	vcManager.VolumeManager = newVolumeManager(vc)
+	return &vcManager
+}
+
+// clusterIDKey is the context key of the ID of the cluster a request is for.
+type clusterIDKey struct{}
+
+// withClusterID returns a context carrying the ID of the cluster the request is for,
+// so that the shared datastores are computed for that cluster.
+func withClusterID(ctx context.Context, clusterID string) context.Context {
+	return context.WithValue(ctx, clusterIDKey{}, clusterID)
+}
+
+// getClusterID returns the ID of the cluster the request with the given context is
+// for. Defaults to the cluster ID in the config.
+func getClusterID(ctx context.Context, cfg *config.Config) string {
+	if clusterID, ok := ctx.Value(clusterIDKey{}).(string); ok && clusterID != "" {
+		return clusterID
+	}
+	return cfg.Global.ClusterID
+}
+
+// isManagedClusterID returns true if the cluster with the given ID is managed by
+// the controller, i.e. it is cluster-id or one of additional-cluster-ids.
+func isManagedClusterID(cfg *config.Config, clusterID string) bool {
+	if clusterID == cfg.Global.ClusterID {
+		return true
+	}
+	for _, additionalClusterID := range strings.Split(cfg.Global.AdditionalClusterIDs, ",") {
+		if strings.TrimSpace(additionalClusterID) == clusterID {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnedVolume returns true if the given CNS volume belongs to one of the clusters
+// managed by the controller, according to its container cluster metadata.
+func isOwnedVolume(cfg *config.Config, volume cnstypes.CnsVolume) bool {
+	if clusterID := volume.Metadata.ContainerCluster.ClusterId; clusterID != "" && isManagedClusterID(cfg, clusterID) {
+		return true
+	}
+	for _, containerCluster := range volume.Metadata.ContainerClusterArray {
+		if containerCluster.ClusterId != "" && isManagedClusterID(cfg, containerCluster.ClusterId) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterOwnedVolumes returns the given CNS volumes which belong to one of the
+// clusters managed by the controller.
+func filterOwnedVolumes(cfg *config.Config, volumes []cnstypes.CnsVolume) []cnstypes.CnsVolume {
+	var ownedVolumes []cnstypes.CnsVolume
+	for _, volume := range volumes {
+		if isOwnedVolume(cfg, volume) {
+			ownedVolumes = append(ownedVolumes, volume)
+		}
+	}
+	return ownedVolumes
+}
+
+// validatePoweredOffPodVMAttach returns an error if the given behavior for attaching
+// volumes to powered off PodVMs is not supported. An empty value selects the default
+// of proceeding with the attach.
+func validatePoweredOffPodVMAttach(behavior string) error {
+	switch behavior {
+	case "", common.PoweredOffPodVMAttachProceed, common.PoweredOffPodVMAttachFail:
+		return nil
+	}
+	return fmt.Errorf("unsupported powered off PodVM attach behavior %q. Supported values are %q and %q",
+		behavior, common.PoweredOffPodVMAttachProceed, common.PoweredOffPodVMAttachFail)
+}
+
+// checkPodVMPowerState returns a FailedPrecondition error if the given PodVM is
+// powered off and powered-off-podvm-attach is "fail". Otherwise, attaching to a
+// powered off PodVM proceeds, as hot-add is not required. If the power state
+// cannot be determined, the attach proceeds as well.
+func checkPodVMPowerState(ctx context.Context, cfg *config.Config, podVM *vsphere.VirtualMachine) error {
+	log := logger.GetLogger(ctx)
+	poweredOn, err := isPodVMPoweredOn(ctx, podVM)
+	if err != nil {
+		log.Warnf("failed to get power state of PodVM %s. Proceeding with attach. err: %+v", podVM.UUID, err)
+		return nil
+	}
+	if poweredOn {
+		return nil
+	}
+	if cfg.Global.PoweredOffPodVMAttach == common.PoweredOffPodVMAttachFail {
+		msg := fmt.Sprintf("PodVM %s is powered off. Attaching volumes to powered off PodVMs is disabled "+
+			"by powered-off-podvm-attach", podVM.UUID)
+		log.Error(msg)
+		return status.Error(codes.FailedPrecondition, msg)
+	}
+	log.Infof("PodVM %s is powered off. Proceeding with attach as hot-add is not required", podVM.UUID)
+	return nil
+}
+
+// getPodVMHost returns the managed object ID of the host the PodVM runs on. It's a
+// variable so that it can be overridden in the unit tests.
+var getPodVMHost = func(ctx context.Context, podVM *vsphere.VirtualMachine) (string, error) {
+	host, err := podVM.GetHostSystem(ctx)
+	if err != nil {
+		return "", err
+	}
+	return host.Reference().Value, nil
+}
+
+// checkPodVMClusterMembership returns a FailedPrecondition error if the given PodVM
+// runs on a host which is not a member of any of the clusters managed by the
+// controller, i.e. cluster-id and additional-cluster-ids, so that volumes are not
+// attached to VMs outside of the clusters managed by the controller.
+func checkPodVMClusterMembership(ctx context.Context, c *controller, podVM *vsphere.VirtualMachine) error {
+	log := logger.GetLogger(ctx)
+	podVMHost, err := getPodVMHost(ctx, podVM)
+	if err != nil {
+		msg := fmt.Sprintf("failed to get the host of PodVM %s. Error: %+v", podVM.UUID, err)
+		log.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+	clusterIDs := common.GetManagedClusterIDs(c.manager)
+	var lookupErrs []string
+	for _, clusterID := range clusterIDs {
+		hosts, err := getClusterHosts(withClusterID(ctx, clusterID), c.manager)
+		if err != nil {
+			log.Warnf("failed to get the hosts of cluster %q. Error: %+v", clusterID, err)
+			lookupErrs = append(lookupErrs, err.Error())
+			continue
+		}
+		for _, host := range hosts {
+			if host.Reference().Value == podVMHost {
+				return nil
+			}
+		}
+	}
+	if len(lookupErrs) > 0 {
+		msg := fmt.Sprintf("PodVM %s runs on host %s which is not a member of the clusters %v, "+
+			"failed to get the hosts of some of them. Errors: %v", podVM.UUID, podVMHost, clusterIDs, lookupErrs)
+		log.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+	msg := fmt.Sprintf("PodVM %s runs on host %s which is not a member of the clusters %v", podVM.UUID, podVMHost, clusterIDs)
+	log.Error(msg)
+	return status.Error(codes.FailedPrecondition, msg)
+}
+
+// filterHostsByMinVersion returns the given hosts whose ESXi version is at least
+// minHostVersion. Excluded hosts, including the ones whose version cannot be
+// determined, are logged.
+func filterHostsByMinVersion(ctx context.Context, hosts []*vsphere.HostSystem,
+	minHostVersion string) ([]*vsphere.HostSystem, error) {
+	log := logger.GetLogger(ctx)
+	minVersion, err := version.ParseGeneric(minHostVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid minimum host version %q. Error: %+v", minHostVersion, err)
+	}
+	var filteredHosts []*vsphere.HostSystem
+	for _, host := range hosts {
+		hostVersion, err := getHostVersion(ctx, host)
+		if err != nil {
+			log.Warnf("excluding host %s from shared datastore computation as its version is unknown. Error: %+v",
+				host.InventoryPath, err)
+			continue
+		}
+		parsedVersion, err := version.ParseGeneric(hostVersion)
+		if err != nil {
+			log.Warnf("excluding host %s from shared datastore computation as its version %q is invalid. Error: %+v",
+				host.InventoryPath, hostVersion, err)
+			continue
+		}
+		if parsedVersion.LessThan(minVersion) {
+			log.Infof("excluding host %s from shared datastore computation as its version %s is older than %s",
+				host.InventoryPath, hostVersion, minHostVersion)
+			continue
+		}
+		filteredHosts = append(filteredHosts, host)
+	}
+	return filteredHosts, nil
+}
+
+// getHostsInPodVMK8SCluster returns the hosts of the WCP PodVM cluster from the
+// vCenter the cluster is deployed in. With enhanced linked mode, the vCenters
+// are tried in turn until the cluster is found.
+func getHostsInPodVMK8SCluster(ctx context.Context, manager *common.Manager) ([]*vsphere.HostSystem, error) {
+	log := logger.GetLogger(ctx)
+	clusterID := getClusterID(ctx, manager.CnsConfig)
+	if len(manager.CnsConfig.VirtualCenter) <= 1 {
+		vc, err := common.GetVCenter(ctx, manager)
+		if err != nil {
+			log.Errorf("failed to get vCenter from Manager, err=%+v", err)
+			if errors.Is(err, vsphere.ErrVCNotFound) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: %v", errVCenterUnavailable, err)
+		}
+		return vc.GetHostsByCluster(ctx, clusterID)
+	}
+	vcdcPairs, err := getVCDatacenterPairsFromConfig(manager.CnsConfig)
+	if err != nil {
+		return nil, err
+	}
+	var lookupErrs []string
+	for _, vcdc := range vcdcPairs {
+		vc, err := getLinkedVCenter(ctx, manager, vcdc.vcHost)
+		if err == nil {
+			err = vc.Connect(ctx)
+		}
+		if err != nil {
+			log.Warnf("failed to connect to virtual center %s. err: %+v", vcdc.vcHost, err)
+			lookupErrs = append(lookupErrs, err.Error())
+			continue
+		}
+		hosts, err := vc.GetHostsByCluster(ctx, clusterID)
+		if err != nil || len(hosts) == 0 {
+			log.Debugf("cluster %s not found in virtual center %s. err: %+v", clusterID, vcdc.vcHost, err)
+			if err != nil {
+				lookupErrs = append(lookupErrs, err.Error())
+			}
+			continue
+		}
+		log.Debugf("Found cluster %s in virtual center %s", clusterID, vcdc.vcHost)
+		return hosts, nil
+	}
+	return nil, fmt.Errorf("failed to find cluster %s in any of the virtual centers. errors: %v",
+		clusterID, lookupErrs)
 }
 
 // GetVCDatacenters returns list of datacenters for each vCenter that is registered
@@ -178,7 +846,7 @@ func getVMByInstanceUUIDInDatacenter(ctx context.Context,
 	// Get VM by UUID from datacenter
 	vm, err := dc.GetVirtualMachineByUUID(ctx, vmInstanceUUID, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to the VM from the VM Instance UUID: %s in datacenter: %+v with err: %+v", vmInstanceUUID, dc, err)
+		return nil, fmt.Errorf("failed to the VM from the VM Instance UUID: %s in datacenter: %+v with err: %w", vmInstanceUUID, dc, err)
 	}
 	return vm, nil
 }
@@ -204,3 +872,745 @@ func getPodListenerServicePort(ctx context.Context) int {
 	}
 	return podListenerServicePort
 }
+
+type policyCompatibilityEntry struct {
+	datastoreURLs map[string]bool
+	expiry        time.Time
+}
+
+// policyCompatibilityCache caches the datastores compatible with a storage policy
+// to avoid a placement check against PBM on every GetCapacity call.
+type policyCompatibilityCache struct {
+	mutex   sync.Mutex
+	entries map[string]policyCompatibilityEntry
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+// get returns the URLs of the datastores compatible with the given storage policy,
+// if they were cached and the entry has not expired.
+func (cache *policyCompatibilityCache) get(storagePolicyID string) (map[string]bool, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok := cache.entries[storagePolicyID]
+	if !ok || cache.now().After(entry.expiry) {
+		return nil, false
+	}
+	return entry.datastoreURLs, true
+}
+
+// set caches the URLs of the datastores compatible with the given storage policy.
+func (cache *policyCompatibilityCache) set(storagePolicyID string, datastoreURLs map[string]bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries[storagePolicyID] = policyCompatibilityEntry{
+		datastoreURLs: datastoreURLs,
+		expiry:        cache.now().Add(cache.ttl),
+	}
+}
+
+// storagePolicyNameCache caches the names of storage policies by ID to avoid a
+// PBM lookup on every CreateVolume call. Entries expire so that renamed policies
+// are eventually picked up.
+type storagePolicyNameCache struct {
+	mutex   sync.Mutex
+	entries map[string]storagePolicyNameEntry
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+type storagePolicyNameEntry struct {
+	name   string
+	expiry time.Time
+}
+
+// get returns the name of the storage policy with the given ID, if it was cached
+// and the entry has not expired.
+func (cache *storagePolicyNameCache) get(storagePolicyID string) (string, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok := cache.entries[storagePolicyID]
+	if !ok || cache.now().After(entry.expiry) {
+		return "", false
+	}
+	return entry.name, true
+}
+
+// set caches the name of the storage policy with the given ID.
+func (cache *storagePolicyNameCache) set(storagePolicyID string, name string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries[storagePolicyID] = storagePolicyNameEntry{
+		name:   name,
+		expiry: cache.now().Add(cache.ttl),
+	}
+}
+
+// storagePolicyNames caches the names of the storage policies by ID.
+var storagePolicyNames = &storagePolicyNameCache{
+	entries: make(map[string]storagePolicyNameEntry),
+	ttl:     policyCompatibilityCacheTTL,
+	now:     time.Now,
+}
+
+// lookupStoragePolicyName returns the name of the storage policy with the given ID.
+// It's a variable so that it can be overridden in the unit tests.
+var lookupStoragePolicyName = func(ctx context.Context, c *controller, storagePolicyID string) (string, error) {
+	vc, err := common.GetVCenter(ctx, c.manager)
+	if err != nil {
+		return "", err
+	}
+	return vc.GetStoragePolicyNameByID(ctx, storagePolicyID)
+}
+
+// getStoragePolicyName returns the name of the storage policy with the given ID,
+// using the cached name if there is one.
+func getStoragePolicyName(ctx context.Context, c *controller, storagePolicyID string) (string, error) {
+	if name, ok := storagePolicyNames.get(storagePolicyID); ok {
+		return name, nil
+	}
+	name, err := lookupStoragePolicyName(ctx, c, storagePolicyID)
+	if err != nil {
+		return "", err
+	}
+	storagePolicyNames.set(storagePolicyID, name)
+	return name, nil
+}
+
+// validateWCPGetCapacityRequest is the helper function to validate
+// GetCapacityRequest for WCP CSI driver.
+// Function returns error if validation fails otherwise returns nil.
+func validateWCPGetCapacityRequest(ctx context.Context, req *csi.GetCapacityRequest) error {
+	for _, volCap := range req.GetVolumeCapabilities() {
+		if !common.IsValidVolumeCapabilities(ctx, []*csi.VolumeCapability{volCap}) {
+			return fmt.Errorf("unsupported volume capability %+v", volCap)
+		}
+	}
+	return nil
+}
+
+// createBlockVolume creates a CNS block volume. It's a variable so that it can be
+// overridden in the unit tests.
+var createBlockVolume = common.CreateBlockVolumeUtil
+
+// createBlockVolumeWithPreferredPolicy creates the block volume of the given spec with
+// the given preferred storage policy. If no shared datastore can hold the volume with
+// it, the volume is created with the storage policy of the spec instead, or with the
+// default policy of the datastore if the spec has none. Returns the ID of the volume
+// and of the storage policy it was created with, according to CNS, so that a volume
+// created by an earlier attempt is reported with the policy it actually has.
+func createBlockVolumeWithPreferredPolicy(ctx context.Context, c *controller, spec *common.CreateVolumeSpec,
+	preferredStoragePolicyID string, sharedDatastores []*vsphere.DatastoreInfo) (string, string, error) {
+	log := logger.GetLogger(ctx)
+	if preferredStoragePolicyID == "" || preferredStoragePolicyID == spec.StoragePolicyID {
+		volumeID, err := createBlockVolume(ctx, cnstypes.CnsClusterFlavorWorkload, c.manager, spec, sharedDatastores)
+		if err != nil {
+			return "", "", err
+		}
+		return volumeID, spec.StoragePolicyID, nil
+	}
+	requiredStoragePolicyID := spec.StoragePolicyID
+	existingVolume, err := getBlockVolumeByName(ctx, c.manager, spec)
+	if err != nil {
+		return "", "", err
+	}
+	if existingVolume != nil && (existingVolume.StoragePolicyId == preferredStoragePolicyID ||
+		requiredStoragePolicyID == "" || existingVolume.StoragePolicyId == requiredStoragePolicyID) {
+		log.Infof("volume %q with name %q already exists with storage policy %q, returning it",
+			existingVolume.VolumeId.Id, spec.Name, existingVolume.StoragePolicyId)
+		return existingVolume.VolumeId.Id, existingVolume.StoragePolicyId, nil
+	}
+	// The datastores are checked for compatibility with the preferred policy first, so
+	// that falling back to the required policy is not recorded as a policy rejection
+	preferredDatastores, err := getPolicyCompatibleDatastores(ctx, c, preferredStoragePolicyID, sharedDatastores)
+	if err != nil {
+		log.Warnf("failed to check the compatibility of the datastores with preferred storage policy %q, "+
+			"considering all of them. Error: %+v", preferredStoragePolicyID, err)
+		preferredDatastores = sharedDatastores
+	}
+	if len(preferredDatastores) > 0 {
+		spec.StoragePolicyID = preferredStoragePolicyID
+		volumeID, err := createBlockVolume(ctx, cnstypes.CnsClusterFlavorWorkload, c.manager, spec, preferredDatastores)
+		spec.StoragePolicyID = requiredStoragePolicyID
+		if err == nil {
+			return volumeID, getCreatedVolumeStoragePolicyID(ctx, c.manager, volumeID, preferredStoragePolicyID), nil
+		}
+		if !errors.Is(err, common.ErrNoEligibleDatastore) && !cnsvolume.IsPlacementError(err) {
+			return "", "", err
+		}
+		log.Infof("preferred storage policy %q is unsatisfiable for volume %q, falling back to storage policy %q. Error: %+v",
+			preferredStoragePolicyID, spec.Name, requiredStoragePolicyID, err)
+	} else {
+		log.Infof("no shared datastore is compatible with preferred storage policy %q for volume %q, "+
+			"falling back to storage policy %q", preferredStoragePolicyID, spec.Name, requiredStoragePolicyID)
+	}
+	volumeID, err := createBlockVolume(ctx, cnstypes.CnsClusterFlavorWorkload, c.manager, spec, sharedDatastores)
+	if err != nil {
+		return "", "", err
+	}
+	return volumeID, getCreatedVolumeStoragePolicyID(ctx, c.manager, volumeID, requiredStoragePolicyID), nil
+}
+
+// getBlockVolumeByName returns the CNS volume of the cluster with the name of the
+// given spec, or nil if there is none.
+func getBlockVolumeByName(ctx context.Context, manager *common.Manager, spec *common.CreateVolumeSpec) (
+	*cnstypes.CnsVolume, error) {
+	log := logger.GetLogger(ctx)
+	clusterID := spec.ClusterID
+	if clusterID == "" {
+		clusterID = manager.CnsConfig.Global.ClusterID
+	}
+	queryFilter := cnstypes.CnsQueryFilter{
+		Names:               []string{spec.Name},
+		ContainerClusterIds: []string{clusterID},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(ctx, queryFilter)
+	if err != nil {
+		log.Errorf("failed to query volumes with name %q, err: %+v", spec.Name, err)
+		return nil, err
+	}
+	for _, volume := range queryResult.Volumes {
+		if volume.Name == spec.Name {
+			return &volume, nil
+		}
+	}
+	return nil, nil
+}
+
+// getCreatedVolumeStoragePolicyID returns the storage policy of the created volume
+// with the given ID, which differs from the requested one if the CNS task of an
+// earlier attempt with another policy was reused. Defaults to the requested policy
+// if the volume can't be queried.
+func getCreatedVolumeStoragePolicyID(ctx context.Context, manager *common.Manager, volumeID string,
+	requestedStoragePolicyID string) string {
+	log := logger.GetLogger(ctx)
+	volumes, err := queryVolumesByID(ctx, manager, []string{volumeID})
+	if err != nil {
+		log.Warnf("failed to query the storage policy of volume %q, assuming %q. Error: %+v",
+			volumeID, requestedStoragePolicyID, err)
+		return requestedStoragePolicyID
+	}
+	for _, volume := range volumes {
+		if volume.VolumeId.Id == volumeID && volume.StoragePolicyId != "" {
+			return volume.StoragePolicyId
+		}
+	}
+	return requestedStoragePolicyID
+}
+
+// getStoragePolicyIDFromParams returns the storage policy ID in the given storage class parameters.
+func getStoragePolicyIDFromParams(params map[string]string) string {
+	for param, value := range params {
+		if strings.ToLower(param) == common.AttributeStoragePolicyID {
+			return value
+		}
+	}
+	return ""
+}
+
+// getPolicyCompatibleDatastores filters the given datastores to the ones compatible
+// with the given storage policy. Compatible datastores are cached per storage policy
+// for policyCompatibilityCacheTTL. Incompatible datastores are recorded as excluded
+// from the placement of the volume.
+func getPolicyCompatibleDatastores(ctx context.Context, c *controller, storagePolicyID string,
+	datastores []*vsphere.DatastoreInfo) ([]*vsphere.DatastoreInfo, error) {
+	log := logger.GetLogger(ctx)
+	datastoreURLs, ok := policyCompatibility.get(storagePolicyID)
+	if !ok {
+		compatibleDatastores, err := getCompatibleDatastores(ctx, c, storagePolicyID, datastores)
+		if err != nil {
+			return nil, err
+		}
+		datastoreURLs = make(map[string]bool)
+		for _, ds := range compatibleDatastores {
+			datastoreURLs[vsphere.NormalizeDatastoreURL(ds.Info.Url)] = true
+		}
+		policyCompatibility.set(storagePolicyID, datastoreURLs)
+		log.Debugf("datastores compatible with storage policy %s: %v", storagePolicyID, datastoreURLs)
+	}
+	var compatibleDatastores []*vsphere.DatastoreInfo
+	for _, ds := range datastores {
+		if !datastoreURLs[vsphere.NormalizeDatastoreURL(ds.Info.Url)] {
+			common.RecordDatastoreExclusion(ctx, ds.Info.Url, common.DatastoreExclusionPolicyIncompatible)
+			continue
+		}
+		compatibleDatastores = append(compatibleDatastores, ds)
+	}
+	return compatibleDatastores, nil
+}
+
+// getBlockVolumeInfo returns the info of the given CNS block volume.
+func getBlockVolumeInfo(ctx context.Context, manager *common.Manager, volumeID string) (*cnstypes.CnsBlockVolumeInfo, error) {
+	queryVolumeInfoResult, err := manager.VolumeManager.QueryVolumeInfo(ctx, []cnstypes.CnsVolumeId{{Id: volumeID}})
+	if err != nil {
+		return nil, err
+	}
+	blockVolumeInfo, ok := queryVolumeInfoResult.VolumeInfo.(*cnstypes.CnsBlockVolumeInfo)
+	if !ok {
+		return nil, fmt.Errorf("unexpected volume info %+v for volume %q", queryVolumeInfoResult.VolumeInfo, volumeID)
+	}
+	return blockVolumeInfo, nil
+}
+
+// getBlockVolumeInfos returns the info of the given CNS block volumes, keyed by
+// volume ID, querying all of them in a single CNS task. Volumes whose info could
+// not be retrieved are left out.
+func getBlockVolumeInfos(ctx context.Context, manager *common.Manager, volumes []cnstypes.CnsVolume) (
+	map[string]*cnstypes.CnsBlockVolumeInfo, error) {
+	log := logger.GetLogger(ctx)
+	blockVolumeInfos := make(map[string]*cnstypes.CnsBlockVolumeInfo)
+	if len(volumes) == 0 {
+		return blockVolumeInfos, nil
+	}
+	var volumeIDs []cnstypes.CnsVolumeId
+	for _, volume := range volumes {
+		volumeIDs = append(volumeIDs, volume.VolumeId)
+	}
+	queryVolumeInfoResults, err := manager.VolumeManager.QueryVolumeInfoList(ctx, volumeIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, queryVolumeInfoResult := range queryVolumeInfoResults {
+		blockVolumeInfo, ok := queryVolumeInfoResult.VolumeInfo.(*cnstypes.CnsBlockVolumeInfo)
+		if !ok {
+			log.Warnf("unexpected volume info %+v for volume %q", queryVolumeInfoResult.VolumeInfo,
+				queryVolumeInfoResult.VolumeId.Id)
+			continue
+		}
+		blockVolumeInfos[blockVolumeInfo.VStorageObject.Config.Id.Id] = blockVolumeInfo
+	}
+	return blockVolumeInfos, nil
+}
+
+// getVolumeCreationTime returns the time the given CNS block volume was created at.
+func getVolumeCreationTime(ctx context.Context, manager *common.Manager, volumeID string) (time.Time, error) {
+	blockVolumeInfo, err := getBlockVolumeInfo(ctx, manager, volumeID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return blockVolumeInfo.VStorageObject.Config.CreateTime, nil
+}
+
+// findMissingPodVMs looks up the PodVMs with the given instance UUIDs in the datacenters
+// of all the configured vCenters, connecting to each vCenter once. It returns the PodVMs
+// confirmed not to exist in any of the vCenters, and the PodVMs whose lookup failed with
+// another error, e.g. as a vCenter could not be connected to, and thus are unknown.
+func findMissingPodVMs(ctx context.Context, manager *common.Manager, vmInstanceUUIDs []string) (
+	map[string]bool, map[string]bool, error) {
+	log := logger.GetLogger(ctx)
+	vcdcPairs, err := getVCDatacenterPairsFromConfig(manager.CnsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	missing := make(map[string]bool)
+	for _, vmInstanceUUID := range vmInstanceUUIDs {
+		missing[vmInstanceUUID] = true
+	}
+	unknown := make(map[string]bool)
+	for _, vcdc := range vcdcPairs {
+		vc, err := getLinkedVCenter(ctx, manager, vcdc.vcHost)
+		if err == nil {
+			err = connectVCenter(ctx, vc)
+		}
+		if err != nil {
+			log.Warnf("failed to look up PodVMs in virtual center %s. err: %+v", vcdc.vcHost, err)
+			for vmInstanceUUID := range missing {
+				unknown[vmInstanceUUID] = true
+			}
+			continue
+		}
+		for vmInstanceUUID := range missing {
+			_, err := getPodVMInVCenter(ctx, vc, vcdc.datacenter, vmInstanceUUID)
+			if err == nil {
+				delete(missing, vmInstanceUUID)
+				delete(unknown, vmInstanceUUID)
+			} else if !errors.Is(err, vsphere.ErrVMNotFound) {
+				log.Warnf("failed to look up PodVM %s in datacenter %s of virtual center %s. err: %+v",
+					vmInstanceUUID, vcdc.datacenter, vcdc.vcHost, err)
+				unknown[vmInstanceUUID] = true
+			}
+		}
+	}
+	for vmInstanceUUID := range unknown {
+		delete(missing, vmInstanceUUID)
+	}
+	return missing, unknown, nil
+}
+
+// getStaleAttachments returns the instance UUIDs of the PodVMs each of the given block
+// volumes is attached to which can no longer be found in any of the vCenters, keyed by
+// volume ID. Only PodVMs confirmed not to exist are reported. Volumes attached to a
+// PodVM which could not be looked up are skipped, as whether they are stale is unknown.
+func getStaleAttachments(ctx context.Context, manager *common.Manager,
+	blockVolumeInfos map[string]*cnstypes.CnsBlockVolumeInfo) (map[string][]string, error) {
+	log := logger.GetLogger(ctx)
+	var vmInstanceUUIDs []string
+	for _, blockVolumeInfo := range blockVolumeInfos {
+		for _, consumerID := range blockVolumeInfo.VStorageObject.Config.ConsumerId {
+			vmInstanceUUIDs = append(vmInstanceUUIDs, consumerID.Id)
+		}
+	}
+	staleAttachments := make(map[string][]string)
+	if len(vmInstanceUUIDs) == 0 {
+		return staleAttachments, nil
+	}
+	missing, unknown, err := findMissingPodVMs(ctx, manager, vmInstanceUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	for volumeID, blockVolumeInfo := range blockVolumeInfos {
+		var stale []string
+		skip := false
+		for _, consumerID := range blockVolumeInfo.VStorageObject.Config.ConsumerId {
+			if unknown[consumerID.Id] {
+				log.Warnf("skipping stale attachment check of volume %q as PodVM %s could not be looked up",
+					volumeID, consumerID.Id)
+				skip = true
+				break
+			}
+			if missing[consumerID.Id] {
+				log.Debugf("PodVM %s consuming volume %q not found", consumerID.Id, volumeID)
+				stale = append(stale, consumerID.Id)
+			}
+		}
+		if !skip && len(stale) > 0 {
+			staleAttachments[volumeID] = stale
+		}
+	}
+	return staleAttachments, nil
+}
+
+// getAffineHostDatastores returns the datastores accessible from the host of the cluster
+// with the given managed object ID, including the ones local to the host. A volume affine
+// to a host is only used by the PodVMs on the host, so its datastores need not be shared
+// across the cluster.
+func getAffineHostDatastores(ctx context.Context, c *controller, hostMoID string) ([]*vsphere.DatastoreInfo, error) {
+	log := logger.GetLogger(ctx)
+	hosts, err := getClusterHosts(ctx, c.manager)
+	if err != nil {
+		log.Errorf("failed to get hosts from VC with err %+v", err)
+		return nil, err
+	}
+	var affineHost *vsphere.HostSystem
+	for _, host := range hosts {
+		if host.Reference().Value == hostMoID {
+			affineHost = host
+			break
+		}
+	}
+	if affineHost == nil {
+		log.Errorf("%v. affinetohost: %s", errAffineHostNotFound, hostMoID)
+		return nil, errAffineHostNotFound
+	}
+	if minHostVersion := c.manager.CnsConfig.Global.MinHostVersion; minHostVersion != "" {
+		hosts, err = filterHostsByMinVersion(ctx, []*vsphere.HostSystem{affineHost}, minHostVersion)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if len(hosts) == 0 {
+			log.Errorf("%v. min-host-version: %s", errNoHostsOfMinVersion, minHostVersion)
+			return nil, errNoHostsOfMinVersion
+		}
+	}
+	datastores, err := getHostAccessibleDatastores(ctx, affineHost)
+	if err != nil {
+		log.Errorf("failed to get the accessible datastores of host %s. err: %v", hostMoID, err)
+		return nil, err
+	}
+	log.Debugf("The list of datastores accessible from affine host %s: %+v", hostMoID, datastores)
+	return datastores, nil
+}
+
+// waitForSharedDatastores returns the shared datastores in the cluster. If none are
+// found, they are looked up again until shared-datastore-wait-timeout-seconds elapses,
+// so that transient cluster events such as host reboots don't fail volume creation.
+// Returns the error of the last lookup, or errNoSharedDatastores, if none are found
+// by then.
+func waitForSharedDatastores(ctx context.Context, c *controller) ([]*vsphere.DatastoreInfo, error) {
+	log := logger.GetLogger(ctx)
+	timeout := time.Duration(c.manager.CnsConfig.Global.SharedDatastoreWaitTimeoutInSec) * time.Second
+	if timeout <= 0 {
+		return getSharedDatastores(ctx, c)
+	}
+	var sharedDatastores []*vsphere.DatastoreInfo
+	var lookupErr error
+	err := wait.PollImmediate(sharedDatastoreRetryInterval, timeout, func() (bool, error) {
+		datastores, err := getSharedDatastores(ctx, c)
+		if err == errNoClusterHosts || errors.Is(err, errNoSharedDatastores) || (err == nil && len(datastores) == 0) {
+			lookupErr = err
+			log.Infof("no shared datastores found, retrying in %v", sharedDatastoreRetryInterval)
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		sharedDatastores = datastores
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		log.Errorf("no shared datastores found within %v", timeout)
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return nil, errNoSharedDatastores
+	}
+	return sharedDatastores, err
+}
+
+// clusterHostsWatchRetryInterval is the interval at which the watch of the hosts of
+// the cluster is restarted after it failed.
+var clusterHostsWatchRetryInterval = time.Minute
+
+// getHostAccessibleDatastores returns the datastores accessible from the host.
+// It's a variable so that it can be overridden in the unit tests.
+var getHostAccessibleDatastores = func(ctx context.Context, host *vsphere.HostSystem) ([]*vsphere.DatastoreInfo, error) {
+	return host.GetAllAccessibleDatastores(ctx)
+}
+
+// hostDatastoreEntry holds the URLs of the datastores accessible from a host.
+type hostDatastoreEntry struct {
+	host          *vsphere.HostSystem
+	datastoreURLs map[string]bool
+}
+
+// newHostDatastoreEntry returns the entry of the given host with the given accessible datastores.
+func newHostDatastoreEntry(host *vsphere.HostSystem, datastores []*vsphere.DatastoreInfo) hostDatastoreEntry {
+	entry := hostDatastoreEntry{host: host, datastoreURLs: make(map[string]bool)}
+	for _, datastore := range datastores {
+		entry.datastoreURLs[vsphere.NormalizeDatastoreURL(datastore.Info.Url)] = true
+	}
+	return entry
+}
+
+// clusterHostDatastores holds the cached accessible datastores of the hosts of a cluster.
+type clusterHostDatastores struct {
+	// enabled is set while the hosts of the cluster are watched.
+	enabled bool
+	// generation is incremented each time the entries are replaced or dropped, so
+	// that host lookups made without holding the lock are not applied to newer entries.
+	generation int
+	// entries holds the datastores accessible from each host, keyed by the host
+	// moref value. It is nil until the shared datastores are computed.
+	entries map[string]hostDatastoreEntry
+	// expiry is the time after which the entries are no longer used.
+	expiry time.Time
+}
+
+// hostDatastoreCache caches the URLs of the datastores accessible from each host of a
+// cluster while the hosts of the cluster are watched, so that only the accessible
+// datastores of the hosts added to the cluster need to be looked up to compute the
+// shared datastores. Only the URLs are cached, as the other properties of the
+// datastores, such as their free space, change over time. As only the hosts of the
+// cluster are watched, the cached URLs expire after a TTL so that datastores mounted
+// on or unmounted from the hosts are picked up.
+type hostDatastoreCache struct {
+	mutex sync.Mutex
+	// clusters holds the cached hosts of each watched cluster, keyed by cluster ID.
+	clusters map[string]*clusterHostDatastores
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+// newHostDatastoreCache returns an empty hostDatastoreCache whose entries expire
+// after the given TTL.
+func newHostDatastoreCache(ttl time.Duration) *hostDatastoreCache {
+	return &hostDatastoreCache{ttl: ttl, now: time.Now}
+}
+
+// getCluster returns the cached hosts of the cluster with the given ID, creating
+// them if needed. Must be called with the mutex held.
+func (cache *hostDatastoreCache) getCluster(clusterID string) *clusterHostDatastores {
+	if cache.clusters == nil {
+		cache.clusters = make(map[string]*clusterHostDatastores)
+	}
+	cluster, ok := cache.clusters[clusterID]
+	if !ok {
+		cluster = &clusterHostDatastores{}
+		cache.clusters[clusterID] = cluster
+	}
+	return cluster
+}
+
+// enable starts caching the accessible datastores of the hosts of the given cluster.
+func (cache *hostDatastoreCache) enable(clusterID string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.getCluster(clusterID).enabled = true
+}
+
+// disable stops caching the accessible datastores of the hosts of the given cluster
+// and drops the cached ones.
+func (cache *hostDatastoreCache) disable(clusterID string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cluster := cache.getCluster(clusterID)
+	cluster.enabled = false
+	cluster.entries = nil
+	cluster.generation++
+}
+
+// invalidate drops the cached accessible datastores of the hosts of all the clusters,
+// so that they are computed again on the next lookup of the shared datastores.
+func (cache *hostDatastoreCache) invalidate() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, cluster := range cache.clusters {
+		cluster.entries = nil
+		cluster.generation++
+	}
+}
+
+// set caches the given accessible datastores of the hosts of the given cluster, keyed
+// by host moref value, if the hosts of the cluster are watched.
+func (cache *hostDatastoreCache) set(clusterID string, entries map[string]hostDatastoreEntry) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cluster := cache.getCluster(clusterID); cluster.enabled {
+		cluster.entries = entries
+		cluster.expiry = cache.now().Add(cache.ttl)
+		cluster.generation++
+	}
+}
+
+// getSharedDatastoreURLs returns the URLs of the datastores accessible from all the
+// cached hosts of the given cluster, along with one of the hosts, if the accessible
+// datastores of the hosts of the cluster are cached and have not expired.
+func (cache *hostDatastoreCache) getSharedDatastoreURLs(clusterID string) (*vsphere.HostSystem, map[string]bool, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cluster, ok := cache.clusters[clusterID]
+	if !ok || !cluster.enabled || len(cluster.entries) == 0 || cache.now().After(cluster.expiry) {
+		return nil, nil, false
+	}
+	hostIDs := make([]string, 0, len(cluster.entries))
+	for hostID := range cluster.entries {
+		hostIDs = append(hostIDs, hostID)
+	}
+	sort.Strings(hostIDs)
+	sharedURLs := make(map[string]bool)
+	for datastoreURL := range cluster.entries[hostIDs[0]].datastoreURLs {
+		sharedURLs[datastoreURL] = true
+	}
+	for _, hostID := range hostIDs[1:] {
+		for datastoreURL := range sharedURLs {
+			if !cluster.entries[hostID].datastoreURLs[datastoreURL] {
+				delete(sharedURLs, datastoreURL)
+			}
+		}
+	}
+	if len(sharedURLs) == 0 {
+		return nil, nil, false
+	}
+	return cluster.entries[hostIDs[0]].host, sharedURLs, true
+}
+
+// updateHosts updates the cached accessible datastores of the hosts of the given
+// cluster after its hosts changed to the given hosts. The entries of the removed
+// hosts are dropped and the accessible datastores of the added hosts are looked up,
+// without holding the mutex. Nothing is done if the accessible datastores of the
+// hosts of the cluster aren't cached.
+func (cache *hostDatastoreCache) updateHosts(ctx context.Context, c *controller, clusterID string,
+	hosts []*vsphere.HostSystem) {
+	log := logger.GetLogger(ctx)
+	cache.mutex.Lock()
+	cluster := cache.getCluster(clusterID)
+	if !cluster.enabled || cluster.entries == nil {
+		cache.mutex.Unlock()
+		return
+	}
+	clusterHosts := make(map[string]bool)
+	var addedHosts []*vsphere.HostSystem
+	for _, host := range hosts {
+		hostID := host.Reference().Value
+		clusterHosts[hostID] = true
+		if _, ok := cluster.entries[hostID]; !ok {
+			addedHosts = append(addedHosts, host)
+		}
+	}
+	for hostID := range cluster.entries {
+		if !clusterHosts[hostID] {
+			log.Infof("host %s was removed from cluster %s", hostID, clusterID)
+			delete(cluster.entries, hostID)
+		}
+	}
+	generation := cluster.generation
+	cache.mutex.Unlock()
+
+	addedEntries := make(map[string]hostDatastoreEntry)
+	var lookupErr error
+	if minHostVersion := c.manager.CnsConfig.Global.MinHostVersion; minHostVersion != "" && len(addedHosts) > 0 {
+		addedHosts, lookupErr = filterHostsByMinVersion(ctx, addedHosts, minHostVersion)
+	}
+	for _, host := range addedHosts {
+		if lookupErr != nil {
+			break
+		}
+		accessibleDatastores, err := getHostAccessibleDatastores(ctx, host)
+		if err != nil {
+			lookupErr = fmt.Errorf("failed to get the accessible datastores of host %s. err: %v",
+				host.Reference().Value, err)
+			break
+		}
+		addedEntries[host.Reference().Value] = newHostDatastoreEntry(host, accessibleDatastores)
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cluster.generation != generation || cluster.entries == nil {
+		// The entries were replaced or dropped while the added hosts were looked up
+		return
+	}
+	if lookupErr != nil {
+		log.Warnf("failed to look up the hosts added to cluster %s, dropping the cached datastores. err: %v",
+			clusterID, lookupErr)
+		cluster.entries = nil
+		cluster.generation++
+		return
+	}
+	for hostID, entry := range addedEntries {
+		log.Infof("host %s was added to cluster %s", hostID, clusterID)
+		cluster.entries[hostID] = entry
+	}
+}
+
+// hostDatastores caches the datastores accessible from each host of the watched clusters.
+var hostDatastores = newHostDatastoreCache(hostDatastoreCacheTTL)
+
+// watchClusterHosts watches the hosts of the cluster to keep the cached accessible
+// datastores of the hosts up to date. The watch is restarted after it failed, and
+// the cache is not used meanwhile.
+func (c *controller) watchClusterHosts() {
+	ctx, log := logger.GetNewContextWithLogger()
+	for {
+		clusterID := c.manager.CnsConfig.Global.ClusterID
+		vc, err := common.GetVCenter(ctx, c.manager)
+		if err == nil {
+			hostDatastores.enable(clusterID)
+			err = vc.WatchClusterHosts(ctx, clusterID, func(hosts []*vsphere.HostSystem) {
+				hostDatastores.updateHosts(ctx, c, clusterID, hosts)
+			})
+			hostDatastores.disable(clusterID)
+		}
+		log.Warnf("watch of the hosts of cluster %s stopped, restarting it in %v. err: %v",
+			clusterID, clusterHostsWatchRetryInterval, err)
+		time.Sleep(clusterHostsWatchRetryInterval)
+	}
+}
+
+// intersectDatastores returns the datastores of the first list which are also in the
+// second one, in the order of the first list. Datastores are matched by their canonical
+// URL as it uniquely identifies a datastore.
+func intersectDatastores(datastores []*vsphere.DatastoreInfo,
+	otherDatastores []*vsphere.DatastoreInfo) []*vsphere.DatastoreInfo {
+	var sharedDatastores []*vsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		for _, otherDatastore := range otherDatastores {
+			if vsphere.NormalizeDatastoreURL(datastore.Info.Url) == vsphere.NormalizeDatastoreURL(otherDatastore.Info.Url) {
+				sharedDatastores = append(sharedDatastores, datastore)
+				break
+			}
+		}
+	}
+	return sharedDatastores
+}
@@ -19,12 +19,17 @@ package wcp
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/google/uuid"
@@ -38,10 +43,15 @@ import (
 	"github.com/vmware/govmomi/simulator"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 )
 
 const (
@@ -296,6 +306,9 @@ func TestWCPCreateVolumeWithStoragePolicy(t *testing.T) {
 	if queryResult.Volumes[0].StoragePolicyId != profileID {
 		t.Fatalf("failed to match volume policy ID: %s", profileID)
 	}
+	if respCreate.Volume.VolumeContext[common.AttributeStoragePolicyName] == "" {
+		t.Errorf("expected the storage policy name in the volume context, got %+v", respCreate.Volume.VolumeContext)
+	}
 
 	// QueryAll
 	queryFilter = cnstypes.CnsQueryFilter{
@@ -334,3 +347,2081 @@ func TestWCPCreateVolumeWithStoragePolicy(t *testing.T) {
 		t.Fatalf("Volume should not exist after deletion with ID: %s", volID)
 	}
 }
+
+// fakeVolumeManager is a cnsvolume.Manager whose behaviour can be customized per test.
+type fakeVolumeManager struct {
+	createVolume    func(ctx context.Context, spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error)
+	attachVolume    func(ctx context.Context, vm *cnsvsphere.VirtualMachine, volumeID string) (string, error)
+	deleteVolume    func(ctx context.Context, volumeID string, deleteDisk bool) error
+	updateMetadata  func(ctx context.Context, spec *cnstypes.CnsVolumeMetadataUpdateSpec) error
+	queryVolume     func(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error)
+	expandVolume    func(ctx context.Context, volumeID string, size int64) error
+	queryVolumeInfo func(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId) (*cnstypes.CnsQueryVolumeInfoResult, error)
+	// queryVolumeInfoList defaults to calling queryVolumeInfo for each volume
+	queryVolumeInfoList func(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId) ([]*cnstypes.CnsQueryVolumeInfoResult, error)
+}
+
+func (f *fakeVolumeManager) CreateVolume(ctx context.Context, spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error) {
+	if f.createVolume == nil {
+		return &cnstypes.CnsVolumeId{Id: uuid.New().String()}, nil
+	}
+	return f.createVolume(ctx, spec)
+}
+
+func (f *fakeVolumeManager) AttachVolume(ctx context.Context, vm *cnsvsphere.VirtualMachine, volumeID string) (string, error) {
+	if f.attachVolume == nil {
+		return uuid.New().String(), nil
+	}
+	return f.attachVolume(ctx, vm, volumeID)
+}
+
+func (f *fakeVolumeManager) DetachVolume(ctx context.Context, vm *cnsvsphere.VirtualMachine, volumeID string) error {
+	return nil
+}
+
+func (f *fakeVolumeManager) DeleteVolume(ctx context.Context, volumeID string, deleteDisk bool) error {
+	if f.deleteVolume == nil {
+		return nil
+	}
+	return f.deleteVolume(ctx, volumeID, deleteDisk)
+}
+
+func (f *fakeVolumeManager) UpdateVolumeMetadata(ctx context.Context, spec *cnstypes.CnsVolumeMetadataUpdateSpec) error {
+	if f.updateMetadata == nil {
+		return nil
+	}
+	return f.updateMetadata(ctx, spec)
+}
+
+func (f *fakeVolumeManager) QueryVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+	if f.queryVolume == nil {
+		return &cnstypes.CnsQueryResult{}, nil
+	}
+	return f.queryVolume(ctx, queryFilter)
+}
+
+func (f *fakeVolumeManager) QueryVolumeInfo(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId) (*cnstypes.CnsQueryVolumeInfoResult, error) {
+	if f.queryVolumeInfo == nil {
+		return &cnstypes.CnsQueryVolumeInfoResult{}, nil
+	}
+	return f.queryVolumeInfo(ctx, volumeIDList)
+}
+
+func (f *fakeVolumeManager) QueryVolumeInfoList(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId) ([]*cnstypes.CnsQueryVolumeInfoResult, error) {
+	if f.queryVolumeInfoList != nil {
+		return f.queryVolumeInfoList(ctx, volumeIDList)
+	}
+	var results []*cnstypes.CnsQueryVolumeInfoResult
+	for _, volumeID := range volumeIDList {
+		result, err := f.QueryVolumeInfo(ctx, []cnstypes.CnsVolumeId{volumeID})
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (f *fakeVolumeManager) QueryAllVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter, querySelection cnstypes.CnsQuerySelection) (*cnstypes.CnsQueryResult, error) {
+	return f.QueryVolume(ctx, queryFilter)
+}
+
+func (f *fakeVolumeManager) ExpandVolume(ctx context.Context, volumeID string, size int64) error {
+	if f.expandVolume == nil {
+		return nil
+	}
+	return f.expandVolume(ctx, volumeID, size)
+}
+
+func (f *fakeVolumeManager) UpdateVolumePolicy(ctx context.Context, volumeID string,
+	datastore types.ManagedObjectReference, storagePolicyID string) error {
+	return nil
+}
+
+func (f *fakeVolumeManager) ResetManager(ctx context.Context, vcenter *cnsvsphere.VirtualCenter) {}
+
+// newFakeDatastoreInfo returns a DatastoreInfo with the given moref value and url.
+func newFakeDatastoreInfo(morefValue string, url string) *cnsvsphere.DatastoreInfo {
+	return &cnsvsphere.DatastoreInfo{
+		Datastore: &cnsvsphere.Datastore{
+			Datastore: object.NewDatastore(nil, types.ManagedObjectReference{Type: "Datastore", Value: morefValue}),
+		},
+		Info: &types.DatastoreInfo{Name: morefValue, Url: url},
+	}
+}
+
+// newFakeHost returns a host with the given moref value.
+func newFakeHost(morefValue string) *cnsvsphere.HostSystem {
+	return &cnsvsphere.HostSystem{
+		HostSystem: object.NewHostSystem(nil, types.ManagedObjectReference{Type: "HostSystem", Value: morefValue}),
+	}
+}
+
+// newFakeBlockVolume returns a CNS block volume of the test cluster with the given ID and capacity.
+func newFakeBlockVolume(volumeID string, capacityInMb int64) cnstypes.CnsVolume {
+	return cnstypes.CnsVolume{
+		VolumeId:   cnstypes.CnsVolumeId{Id: volumeID},
+		VolumeType: common.BlockVolumeType,
+		Metadata: cnstypes.CnsVolumeMetadata{
+			ContainerCluster: cnsvsphere.GetContainerCluster(testClusterName, "user", cnstypes.CnsClusterFlavorWorkload),
+		},
+		BackingObjectDetails: &cnstypes.CnsBlockBackingDetails{
+			CnsBackingObjectDetails: cnstypes.CnsBackingObjectDetails{
+				CapacityInMb: capacityInMb,
+			},
+		},
+	}
+}
+
+// newFakeController returns a controller backed by the given volume manager.
+func newFakeController(volumeManager cnsvolume.Manager) *controller {
+	cfg := &config.Config{}
+	cfg.Global.ClusterID = testClusterName
+	return &controller{
+		manager: &common.Manager{
+			VcenterConfig: &cnsvsphere.VirtualCenterConfig{},
+			CnsConfig:     cfg,
+			VolumeManager: volumeManager,
+		},
+	}
+}
+
+/*
+ * TestWCPListVolumesWithFailedDatastore verifies ListVolumes returns the volumes from
+ * the datastores which could be queried when the query on one datastore fails.
+ */
+func TestWCPListVolumesWithFailedDatastore(t *testing.T) {
+	ctx := context.Background()
+	volumeManager := &fakeVolumeManager{
+		queryVolume: func(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			switch queryFilter.Datastores[0].Value {
+			case "datastore-1":
+				return &cnstypes.CnsQueryResult{
+					Volumes: []cnstypes.CnsVolume{newFakeBlockVolume("vol-1", 1024), newFakeBlockVolume("vol-2", 2048)},
+				}, nil
+			default:
+				return nil, fmt.Errorf("datastore %q is inaccessible", queryFilter.Datastores[0].Value)
+			}
+		},
+	}
+	c := newFakeController(volumeManager)
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		return []*cnsvsphere.DatastoreInfo{
+			newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/"),
+			newFakeDatastoreInfo("datastore-2", "ds:///vmfs/volumes/datastore-2/"),
+		}, nil
+	}
+
+	resp, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed with err: %v", err)
+	}
+	if len(resp.Entries) != 2 {
+		t.Fatalf("expected 2 volumes, got %d", len(resp.Entries))
+	}
+	if resp.Entries[1].Volume.VolumeId != "vol-2" || resp.Entries[1].Volume.CapacityBytes != 2048*common.MbInBytes {
+		t.Errorf("unexpected volume entry: %+v", resp.Entries[1].Volume)
+	}
+
+	// Paginated request
+	resp, err = c.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 1})
+	if err != nil {
+		t.Fatalf("ListVolumes failed with err: %v", err)
+	}
+	if len(resp.Entries) != 1 || resp.NextToken == "" {
+		t.Fatalf("unexpected paginated response: %+v", resp)
+	}
+	resp, err = c.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 1, StartingToken: resp.NextToken})
+	if err != nil {
+		t.Fatalf("ListVolumes failed with err: %v", err)
+	}
+	if len(resp.Entries) != 1 || resp.Entries[0].Volume.VolumeId != "vol-2" || resp.NextToken != "" {
+		t.Fatalf("unexpected paginated response: %+v", resp)
+	}
+
+	// All datastore queries fail
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		return []*cnsvsphere.DatastoreInfo{newFakeDatastoreInfo("datastore-2", "ds:///vmfs/volumes/datastore-2/")}, nil
+	}
+	if _, err = c.ListVolumes(ctx, &csi.ListVolumesRequest{}); err == nil {
+		t.Fatal("expected ListVolumes to fail when all datastore queries fail")
+	}
+}
+
+/*
+ * TestWCPDeleteVolumeRetainBackingDisk verifies the backing disk is deleted by default
+ * and retained when retainbackingdisk is enabled.
+ */
+func TestWCPDeleteVolumeRetainBackingDisk(t *testing.T) {
+	ctx := context.Background()
+	var deletedDisk bool
+	volumeManager := &fakeVolumeManager{
+		deleteVolume: func(ctx context.Context, volumeID string, deleteDisk bool) error {
+			deletedDisk = deleteDisk
+			return nil
+		},
+	}
+	c := newFakeController(volumeManager)
+	req := &csi.DeleteVolumeRequest{VolumeId: "vol-1"}
+
+	if _, err := c.DeleteVolume(ctx, req); err != nil {
+		t.Fatalf("DeleteVolume failed with err: %v", err)
+	}
+	if !deletedDisk {
+		t.Error("expected backing disk to be deleted")
+	}
+
+	c.manager.CnsConfig.Global.RetainBackingDisk = true
+	if _, err := c.DeleteVolume(ctx, req); err != nil {
+		t.Fatalf("DeleteVolume failed with err: %v", err)
+	}
+	if deletedDisk {
+		t.Error("expected backing disk to be retained")
+	}
+}
+
+// newFakePV returns a CSI PV with the given name, volume handle and labels.
+func newFakePV(name string, volumeHandle string, labels map[string]string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       csitypes.Name,
+					VolumeHandle: volumeHandle,
+				},
+			},
+		},
+	}
+}
+
+/*
+ * TestWCPReconcileVolumeMetadata verifies only volumes whose CNS metadata differs
+ * from the labels of their PVs are updated, and the labels recorded by the driver
+ * are not seen as drift.
+ */
+func TestWCPReconcileVolumeMetadata(t *testing.T) {
+	ctx := context.Background()
+	labels := map[string]string{"app": "db"}
+	inSyncVolume := newFakeBlockVolume("vol-1", 1024)
+	inSyncVolume.Metadata.EntityMetadata = []cnstypes.BaseCnsEntityMetadata{
+		cnsvsphere.GetCnsKubernetesEntityMetaData("pv-1", labels, false,
+			string(cnstypes.CnsKubernetesEntityTypePV), "", testClusterName, nil),
+	}
+	driftedVolume := newFakeBlockVolume("vol-2", 1024)
+	driftedVolume.Metadata.EntityMetadata = []cnstypes.BaseCnsEntityMetadata{
+		cnsvsphere.GetCnsKubernetesEntityMetaData("pv-2", map[string]string{"app": "web"}, false,
+			string(cnstypes.CnsKubernetesEntityTypePV), "", testClusterName, nil),
+	}
+	noMetadataVolume := newFakeBlockVolume("vol-3", 1024)
+	driverLabels := map[string]string{
+		"app":                        "db",
+		common.ClusterVersionLabel:   "v1.18.2",
+		common.ExpandedCapacityLabel: "2048",
+		common.LastExpandedAtLabel:   "2020-06-01T00:00:00Z",
+	}
+	expandedVolume := newFakeBlockVolume("vol-5", 2048)
+	expandedVolume.Metadata.EntityMetadata = []cnstypes.BaseCnsEntityMetadata{
+		cnsvsphere.GetCnsKubernetesEntityMetaData("pv-5", driverLabels, false,
+			string(cnstypes.CnsKubernetesEntityTypePV), "", testClusterName, nil),
+	}
+
+	updatedVolumes := make(map[string]map[string]string)
+	volumeManager := &fakeVolumeManager{
+		queryVolume: func(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			return &cnstypes.CnsQueryResult{
+				Volumes: []cnstypes.CnsVolume{inSyncVolume, driftedVolume, noMetadataVolume, expandedVolume},
+			}, nil
+		},
+		updateMetadata: func(ctx context.Context, spec *cnstypes.CnsVolumeMetadataUpdateSpec) error {
+			metadata := spec.Metadata.EntityMetadata[0].(*cnstypes.CnsKubernetesEntityMetadata)
+			updatedVolumes[spec.VolumeId.Id] = cnsvsphere.GetLabelsMapFromKeyValue(metadata.Labels)
+			return nil
+		},
+	}
+	c := newFakeController(volumeManager)
+	pvs := []*v1.PersistentVolume{
+		newFakePV("pv-1", "vol-1", labels),
+		newFakePV("pv-2", "vol-2", labels),
+		newFakePV("pv-3", "vol-3", labels),
+		newFakePV("pv-4", "vol-4", labels),
+		newFakePV("pv-5", "vol-5", labels),
+	}
+	pvs[4].Spec.CSI.VolumeAttributes = map[string]string{common.AttributeClusterVersion: "v1.18.2"}
+	if err := c.ReconcileVolumeMetadata(ctx, pvs); err != nil {
+		t.Fatalf("ReconcileVolumeMetadata failed with err: %v", err)
+	}
+	if len(updatedVolumes) != 2 {
+		t.Fatalf("expected 2 volumes to be updated, got %v", updatedVolumes)
+	}
+	for _, volumeID := range []string{"vol-2", "vol-3"} {
+		if !reflect.DeepEqual(updatedVolumes[volumeID], labels) {
+			t.Errorf("unexpected labels for volume %q: %v", volumeID, updatedVolumes[volumeID])
+		}
+	}
+}
+
+/*
+ * TestWCPReloadConfigurationWithThumbprintChange verifies the vCenter is registered
+ * again with the new thumbprint when the thumbprint in the config changes.
+ */
+func TestWCPReloadConfigurationWithThumbprintChange(t *testing.T) {
+	ct := getControllerTest(t)
+	cfgPath := os.Getenv("VSPHERE_CSI_CONFIG")
+	if cfgPath == "" {
+		t.Skip("VSPHERE_CSI_CONFIG is not set")
+	}
+	origConf, err := ioutil.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := ioutil.WriteFile(cfgPath, origConf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		ct.controller.ReloadConfiguration()
+		ct.controller.manager.CnsConfig.Global.ClusterID = testClusterName
+	}()
+
+	// The VirtualCenter section is the last section of the config
+	thumbprint := "01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67"
+	conf := append(append([]byte{}, origConf...), []byte(fmt.Sprintf("\nthumbprint = \"%s\"\n", thumbprint))...)
+	if err = ioutil.WriteFile(cfgPath, conf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ct.controller.ReloadConfiguration()
+
+	if ct.controller.manager.VcenterConfig.Thumbprint != thumbprint {
+		t.Fatalf("expected thumbprint %q in VcenterConfig, got %q", thumbprint, ct.controller.manager.VcenterConfig.Thumbprint)
+	}
+	vcenter, err := ct.controller.manager.VcenterManager.GetVirtualCenter(ctx, ct.controller.manager.VcenterConfig.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vcenter.Config.Thumbprint != thumbprint {
+		t.Errorf("expected virtual center to be registered with thumbprint %q, got %q", thumbprint, vcenter.Config.Thumbprint)
+	}
+}
+
+// fakeVirtualCenterManager is a cnsvsphere.VirtualCenterManager which keeps the
+// registered virtual centers in memory without connecting to them.
+type fakeVirtualCenterManager struct {
+	virtualCenters map[string]*cnsvsphere.VirtualCenter
+}
+
+func (m *fakeVirtualCenterManager) GetVirtualCenter(ctx context.Context, host string) (*cnsvsphere.VirtualCenter, error) {
+	vc, ok := m.virtualCenters[host]
+	if !ok {
+		return nil, cnsvsphere.ErrVCNotFound
+	}
+	return vc, nil
+}
+
+func (m *fakeVirtualCenterManager) GetAllVirtualCenters() []*cnsvsphere.VirtualCenter {
+	var vcs []*cnsvsphere.VirtualCenter
+	for _, vc := range m.virtualCenters {
+		vcs = append(vcs, vc)
+	}
+	return vcs
+}
+
+func (m *fakeVirtualCenterManager) RegisterVirtualCenter(ctx context.Context, config *cnsvsphere.VirtualCenterConfig) (*cnsvsphere.VirtualCenter, error) {
+	if _, ok := m.virtualCenters[config.Host]; ok {
+		return nil, cnsvsphere.ErrVCAlreadyRegistered
+	}
+	vc := &cnsvsphere.VirtualCenter{Config: config}
+	m.virtualCenters[config.Host] = vc
+	return vc, nil
+}
+
+func (m *fakeVirtualCenterManager) UnregisterVirtualCenter(ctx context.Context, host string) error {
+	delete(m.virtualCenters, host)
+	return nil
+}
+
+func (m *fakeVirtualCenterManager) UnregisterAllVirtualCenters(ctx context.Context) error {
+	m.virtualCenters = make(map[string]*cnsvsphere.VirtualCenter)
+	return nil
+}
+
+/*
+ * TestWCPFindPodVMInLinkedVCenters verifies the PodVM is looked up in all the
+ * linked vCenters and the vCenter hosting the PodVM is selected.
+ */
+func TestWCPFindPodVMInLinkedVCenters(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeController(&fakeVolumeManager{})
+	c.manager.CnsConfig.VirtualCenter = map[string]*config.VirtualCenterConfig{
+		"vc1.example.com": {User: "user", Password: "password", VCenterPort: "443", Datacenters: "datacenter-1"},
+		"vc2.example.com": {User: "user", Password: "password", VCenterPort: "443", Datacenters: "datacenter-2"},
+	}
+	// Only the first vCenter is registered by the controller
+	c.manager.VcenterManager = &fakeVirtualCenterManager{
+		virtualCenters: map[string]*cnsvsphere.VirtualCenter{
+			"vc1.example.com": {Config: &cnsvsphere.VirtualCenterConfig{Host: "vc1.example.com"}},
+		},
+	}
+	vmUUID := uuid.New().String()
+	defer func(orig func(context.Context, *cnsvsphere.VirtualCenter) error) {
+		connectVCenter = orig
+	}(connectVCenter)
+	connectVCenter = func(ctx context.Context, vc *cnsvsphere.VirtualCenter) error {
+		return nil
+	}
+	defer func(orig func(context.Context, *cnsvsphere.VirtualCenter, string, string) (*cnsvsphere.VirtualMachine, error)) {
+		getPodVMInVCenter = orig
+	}(getPodVMInVCenter)
+	getPodVMInVCenter = func(ctx context.Context, vc *cnsvsphere.VirtualCenter, datacenter string,
+		vmInstanceUUID string) (*cnsvsphere.VirtualMachine, error) {
+		if vc.Config.Host == "vc2.example.com" && datacenter == "datacenter-2" && vmInstanceUUID == vmUUID {
+			return &cnsvsphere.VirtualMachine{UUID: vmInstanceUUID, VirtualCenterHost: vc.Config.Host}, nil
+		}
+		return nil, fmt.Errorf("VM %s not found in datacenter %s: %w", vmInstanceUUID, datacenter, cnsvsphere.ErrVMNotFound)
+	}
+
+	vc, podVM, err := findPodVMInLinkedVCenters(ctx, c.manager, vmUUID)
+	if err != nil {
+		t.Fatalf("findPodVMInLinkedVCenters failed with err: %v", err)
+	}
+	if vc.Config.Host != "vc2.example.com" || podVM.VirtualCenterHost != "vc2.example.com" {
+		t.Errorf("expected PodVM to be found in vc2.example.com, found in %s", vc.Config.Host)
+	}
+	if _, err = c.manager.VcenterManager.GetVirtualCenter(ctx, "vc2.example.com"); err != nil {
+		t.Errorf("expected linked vCenter vc2.example.com to be registered. err: %v", err)
+	}
+	// The volume is attached through the vCenter the PodVM was found in
+	c.manager.VcenterConfig = &cnsvsphere.VirtualCenterConfig{Host: "vc1.example.com"}
+	if manager := getManagerForVCenter(c.manager, vc); manager == c.manager || manager.VolumeManager == c.manager.VolumeManager {
+		t.Error("expected the volume manager of linked vCenter vc2.example.com to be used")
+	}
+	primary, err := c.manager.VcenterManager.GetVirtualCenter(ctx, "vc1.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager := getManagerForVCenter(c.manager, primary); manager != c.manager {
+		t.Error("expected the volume manager of vc1.example.com to be used")
+	}
+
+	if _, _, err = findPodVMInLinkedVCenters(ctx, c.manager, uuid.New().String()); err == nil {
+		t.Error("expected lookup of unknown PodVM to fail")
+	}
+}
+
+/*
+ * TestWCPIsUnboundVolume verifies volumes provisioned by the cluster without PV
+ * or pod metadata are flagged as unbound.
+ */
+func TestWCPIsUnboundVolume(t *testing.T) {
+	newVolume := func(clusterID string, entityTypes ...cnstypes.CnsKubernetesEntityType) cnstypes.CnsVolume {
+		volume := newFakeBlockVolume(uuid.New().String(), 1024)
+		volume.Metadata.ContainerCluster = cnsvsphere.GetContainerCluster(clusterID, "user", cnstypes.CnsClusterFlavorWorkload)
+		for _, entityType := range entityTypes {
+			volume.Metadata.EntityMetadata = append(volume.Metadata.EntityMetadata,
+				cnsvsphere.GetCnsKubernetesEntityMetaData("entity", nil, false, string(entityType), "", clusterID, nil))
+		}
+		return volume
+	}
+	tests := []struct {
+		name    string
+		volume  cnstypes.CnsVolume
+		unbound bool
+	}{
+		{"no metadata", newVolume(testClusterName), true},
+		{"PVC only", newVolume(testClusterName, cnstypes.CnsKubernetesEntityTypePVC), true},
+		{"bound to PV", newVolume(testClusterName, cnstypes.CnsKubernetesEntityTypePV), false},
+		{"in use by pod", newVolume(testClusterName, cnstypes.CnsKubernetesEntityTypePOD), false},
+		{"other cluster", newVolume("other-cluster"), false},
+	}
+	for _, test := range tests {
+		if unbound := isUnboundVolume(test.volume, testClusterName); unbound != test.unbound {
+			t.Errorf("%s: expected unbound to be %t, got %t", test.name, test.unbound, unbound)
+		}
+	}
+}
+
+/*
+ * TestWCPGetCapacity verifies GetCapacity accounts for all shared datastores when no
+ * storage policy is given, and only for compatible datastores otherwise.
+ */
+func TestWCPGetCapacity(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeController(&fakeVolumeManager{})
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		ds1 := newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")
+		ds1.Info.FreeSpace = 10 * common.GbInBytes
+		ds2 := newFakeDatastoreInfo("datastore-2", "ds:///vmfs/volumes/vsan:datastore-2/")
+		ds2.Info.FreeSpace = 20 * common.GbInBytes
+		return []*cnsvsphere.DatastoreInfo{ds1, ds2}, nil
+	}
+	defer func(orig func(context.Context, *controller, string, []*cnsvsphere.DatastoreInfo) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getCompatibleDatastores = orig
+	}(getCompatibleDatastores)
+	compatibilityChecks := 0
+	getCompatibleDatastores = func(ctx context.Context, c *controller, storagePolicyID string,
+		datastores []*cnsvsphere.DatastoreInfo) ([]*cnsvsphere.DatastoreInfo, error) {
+		compatibilityChecks++
+		var compatible []*cnsvsphere.DatastoreInfo
+		for _, ds := range datastores {
+			if strings.Contains(ds.Info.Url, "vsan:") {
+				compatible = append(compatible, ds)
+			}
+		}
+		return compatible, nil
+	}
+	policyCompatibility.entries = make(map[string]policyCompatibilityEntry)
+
+	// Capacity of the shared datastore with the most free space
+	resp, err := c.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatalf("GetCapacity failed with err: %v", err)
+	}
+	if resp.AvailableCapacity != 20*common.GbInBytes {
+		t.Errorf("expected available capacity %d, got %d", 20*common.GbInBytes, resp.AvailableCapacity)
+	}
+
+	// Capacity of all shared datastores
+	c.manager.CnsConfig.Global.CapacityAggregation = common.CapacityAggregationSum
+	resp, err = c.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatalf("GetCapacity failed with err: %v", err)
+	}
+	if resp.AvailableCapacity != 30*common.GbInBytes {
+		t.Errorf("expected available capacity %d, got %d", 30*common.GbInBytes, resp.AvailableCapacity)
+	}
+
+	// Capacity of the datastores compatible with the storage policy
+	req := &csi.GetCapacityRequest{
+		Parameters: map[string]string{"StoragePolicyID": "vsan-policy"},
+	}
+	for i := 0; i < 2; i++ {
+		resp, err = c.GetCapacity(ctx, req)
+		if err != nil {
+			t.Fatalf("GetCapacity failed with err: %v", err)
+		}
+		if resp.AvailableCapacity != 20*common.GbInBytes {
+			t.Errorf("expected available capacity %d, got %d", 20*common.GbInBytes, resp.AvailableCapacity)
+		}
+	}
+	if compatibilityChecks != 1 {
+		t.Errorf("expected storage policy compatibility to be checked once, got %d", compatibilityChecks)
+	}
+
+	// Incompatible datastores are recorded as excluded from the placement
+	exclusionsCtx, exclusions := common.WithDatastoreExclusions(ctx)
+	datastores, err := getSharedDatastores(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getPolicyCompatibleDatastores(exclusionsCtx, c, "vsan-policy", datastores); err != nil {
+		t.Fatal(err)
+	}
+	if reason := exclusions["ds:///vmfs/volumes/datastore-1/"]; reason != common.DatastoreExclusionPolicyIncompatible ||
+		len(exclusions) != 1 {
+		t.Errorf("expected only datastore-1 to be recorded as %q, got %v",
+			common.DatastoreExclusionPolicyIncompatible, exclusions)
+	}
+}
+
+/*
+ * TestWCPListVolumesCreationTime verifies the creation time of the volumes is
+ * returned in the volume context of the ListVolumes entries.
+ */
+func TestWCPListVolumesCreationTime(t *testing.T) {
+	ctx := context.Background()
+	createTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	volumeManager := &fakeVolumeManager{
+		queryVolume: func(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			return &cnstypes.CnsQueryResult{
+				Volumes: []cnstypes.CnsVolume{newFakeBlockVolume("vol-1", 1024)},
+			}, nil
+		},
+		queryVolumeInfo: func(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId) (*cnstypes.CnsQueryVolumeInfoResult, error) {
+			volumeInfo := &cnstypes.CnsBlockVolumeInfo{}
+			volumeInfo.VStorageObject.Config.CreateTime = createTime
+			return &cnstypes.CnsQueryVolumeInfoResult{VolumeInfo: volumeInfo}, nil
+		},
+	}
+	c := newFakeController(volumeManager)
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		return []*cnsvsphere.DatastoreInfo{newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")}, nil
+	}
+
+	resp, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed with err: %v", err)
+	}
+	if len(resp.Entries) != 1 {
+		t.Fatalf("expected 1 volume, got %d", len(resp.Entries))
+	}
+	creationTime, err := time.Parse(time.RFC3339, resp.Entries[0].Volume.VolumeContext[common.AttributeCreationTime])
+	if err != nil {
+		t.Fatalf("failed to parse creation time of volume %+v. err: %v", resp.Entries[0].Volume, err)
+	}
+	if !creationTime.Equal(createTime) || creationTime.After(time.Now()) {
+		t.Errorf("expected creation time %v, got %v", createTime, creationTime)
+	}
+}
+
+/*
+ * TestWCPWaitForSharedDatastores verifies the shared datastores are looked up again
+ * until they appear when a wait timeout is configured.
+ */
+func TestWCPWaitForSharedDatastores(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeController(&fakeVolumeManager{})
+	c.manager.CnsConfig.Global.SharedDatastoreWaitTimeoutInSec = 5
+	defer func(orig time.Duration) {
+		sharedDatastoreRetryInterval = orig
+	}(sharedDatastoreRetryInterval)
+	sharedDatastoreRetryInterval = 10 * time.Millisecond
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	lookups := 0
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		lookups++
+		switch lookups {
+		case 1:
+			return make([]*cnsvsphere.DatastoreInfo, 0), errNoClusterHosts
+		case 2:
+			return nil, fmt.Errorf("%w for host: host-1", errNoSharedDatastores)
+		}
+		return []*cnsvsphere.DatastoreInfo{newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")}, nil
+	}
+
+	datastores, err := waitForSharedDatastores(ctx, c)
+	if err != nil {
+		t.Fatalf("waitForSharedDatastores failed with err: %v", err)
+	}
+	if len(datastores) != 1 || lookups != 3 {
+		t.Errorf("expected 1 datastore after 3 lookups, got %d datastores after %d lookups", len(datastores), lookups)
+	}
+
+	// The error of the last lookup is returned once the wait times out
+	c.manager.CnsConfig.Global.SharedDatastoreWaitTimeoutInSec = 1
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		lookups++
+		return make([]*cnsvsphere.DatastoreInfo, 0), errNoClusterHosts
+	}
+	if datastores, err = waitForSharedDatastores(ctx, c); err != errNoClusterHosts || len(datastores) != 0 {
+		t.Errorf("expected errNoClusterHosts after the timeout, got %d datastores, err: %v", len(datastores), err)
+	}
+
+	// Other errors are returned right away
+	lookups = 0
+	lookupErr := fmt.Errorf("failed to get the hosts of the cluster")
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		lookups++
+		return nil, lookupErr
+	}
+	if _, err = waitForSharedDatastores(ctx, c); err != lookupErr || lookups != 1 {
+		t.Errorf("expected the lookup error after 1 lookup, got %v after %d lookups", err, lookups)
+	}
+
+	// Without a wait timeout, the result is returned right away
+	c.manager.CnsConfig.Global.SharedDatastoreWaitTimeoutInSec = 0
+	lookups = 0
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		lookups++
+		return make([]*cnsvsphere.DatastoreInfo, 0), errNoClusterHosts
+	}
+	if datastores, err = waitForSharedDatastores(ctx, c); err != errNoClusterHosts || len(datastores) != 0 || lookups != 1 {
+		t.Errorf("expected errNoClusterHosts after 1 lookup, got %d datastores after %d lookups, err: %v", len(datastores), lookups, err)
+	}
+}
+
+/*
+ * TestWCPGetAffineHostDatastores verifies the datastores local to the host a volume
+ * is affine to are eligible for the volume, and hosts outside the cluster are rejected.
+ */
+func TestWCPGetAffineHostDatastores(t *testing.T) {
+	ctx := context.Background()
+	shared := newFakeDatastoreInfo("shared", "ds:///vmfs/volumes/shared/")
+	local1 := newFakeDatastoreInfo("local-1", "ds:///vmfs/volumes/local-1/")
+	local2 := newFakeDatastoreInfo("local-2", "ds:///vmfs/volumes/local-2/")
+	defer func(orig func(context.Context, *common.Manager) ([]*cnsvsphere.HostSystem, error)) {
+		getClusterHosts = orig
+	}(getClusterHosts)
+	getClusterHosts = func(ctx context.Context, manager *common.Manager) ([]*cnsvsphere.HostSystem, error) {
+		return []*cnsvsphere.HostSystem{newFakeHost("host-1"), newFakeHost("host-2")}, nil
+	}
+	defer func(orig func(context.Context, *cnsvsphere.HostSystem) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getHostAccessibleDatastores = orig
+	}(getHostAccessibleDatastores)
+	getHostAccessibleDatastores = func(ctx context.Context, host *cnsvsphere.HostSystem) ([]*cnsvsphere.DatastoreInfo, error) {
+		if host.Reference().Value == "host-1" {
+			return []*cnsvsphere.DatastoreInfo{shared, local1}, nil
+		}
+		return []*cnsvsphere.DatastoreInfo{shared, local2}, nil
+	}
+	c := newFakeController(&fakeVolumeManager{})
+
+	datastores, err := getAffineHostDatastores(ctx, c, "host-1")
+	if err != nil {
+		t.Fatalf("failed to get the datastores of the affine host. err: %v", err)
+	}
+	var urls []string
+	for _, datastore := range datastores {
+		urls = append(urls, datastore.Info.Url)
+	}
+	if !reflect.DeepEqual(urls, []string{shared.Info.Url, local1.Info.Url}) {
+		t.Errorf("expected the shared and host-local datastores of host-1 to be eligible, got %v", urls)
+	}
+
+	if _, err = getAffineHostDatastores(ctx, c, "host-3"); err != errAffineHostNotFound {
+		t.Errorf("expected %v for a host outside the cluster, got %v", errAffineHostNotFound, err)
+	}
+}
+
+func TestWCPIntersectDatastoresURLVariants(t *testing.T) {
+	datastores := []*cnsvsphere.DatastoreInfo{
+		newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/"),
+		newFakeDatastoreInfo("datastore-2", "ds:///vmfs/volumes/vsan:52d6a6e3/"),
+		newFakeDatastoreInfo("datastore-3", "ds:///vmfs/volumes/datastore-3/"),
+	}
+	otherDatastores := []*cnsvsphere.DatastoreInfo{
+		newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1"),
+		newFakeDatastoreInfo("datastore-2", "DS:///vmfs/volumes/VSAN:52D6A6E3//"),
+	}
+	sharedDatastores := intersectDatastores(datastores, otherDatastores)
+	if len(sharedDatastores) != 2 || sharedDatastores[0] != datastores[0] || sharedDatastores[1] != datastores[1] {
+		t.Errorf("expected the datastores with equivalent URLs to be shared, got %v", sharedDatastores)
+	}
+}
+
+/*
+ * TestWCPCheckProvisioningReadiness verifies each readiness check is reported, and
+ * the checks after a failed check are reported as not run.
+ */
+func TestWCPCheckProvisioningReadiness(t *testing.T) {
+	ct := getControllerTest(t)
+	defer func(orig func(context.Context, *common.Manager) ([]*cnsvsphere.HostSystem, error)) {
+		getClusterHosts = orig
+	}(getClusterHosts)
+	getClusterHosts = func(ctx context.Context, manager *common.Manager) ([]*cnsvsphere.HostSystem, error) {
+		return []*cnsvsphere.HostSystem{{}}, nil
+	}
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		return []*cnsvsphere.DatastoreInfo{newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")}, nil
+	}
+	defer func(orig func(context.Context, *controller, string, []*cnsvsphere.DatastoreInfo) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getCompatibleDatastores = orig
+	}(getCompatibleDatastores)
+	getCompatibleDatastores = func(ctx context.Context, c *controller, storagePolicyID string,
+		datastores []*cnsvsphere.DatastoreInfo) ([]*cnsvsphere.DatastoreInfo, error) {
+		return datastores, nil
+	}
+	expectedChecks := []string{readinessCheckVCenterConnectivity, readinessCheckClusterHosts,
+		readinessCheckSharedDatastores, readinessCheckStoragePolicy}
+
+	report := ct.controller.CheckProvisioningReadiness(ctx, "policy-id")
+	if !report.Ready || len(report.Checks) != len(expectedChecks) {
+		t.Fatalf("expected all %d checks to pass, got %+v", len(expectedChecks), report)
+	}
+	for i, check := range report.Checks {
+		if check.Name != expectedChecks[i] || !check.Passed || check.Message == "" {
+			t.Errorf("expected check %s to pass with a message, got %+v", expectedChecks[i], check)
+		}
+	}
+
+	// Host lookup fails, the following checks are not run
+	getClusterHosts = func(ctx context.Context, manager *common.Manager) ([]*cnsvsphere.HostSystem, error) {
+		return nil, nil
+	}
+	report = ct.controller.CheckProvisioningReadiness(ctx, "policy-id")
+	if report.Ready || len(report.Checks) != len(expectedChecks) {
+		t.Fatalf("expected readiness check to fail, got %+v", report)
+	}
+	if !report.Checks[0].Passed {
+		t.Errorf("expected check %s to pass, got %+v", expectedChecks[0], report.Checks[0])
+	}
+	for _, check := range report.Checks[1:] {
+		if check.Passed {
+			t.Errorf("expected check %s to fail, got %+v", check.Name, check)
+		}
+	}
+}
+
+/*
+ * TestWCPListVolumesStaleAttachment verifies volumes attached to PodVMs which no
+ * longer exist are reported as abnormal by ListVolumes, and volumes attached to
+ * PodVMs which could not be looked up are not.
+ */
+func TestWCPListVolumesStaleAttachment(t *testing.T) {
+	ctx := context.Background()
+	livePodVM := uuid.New().String()
+	stalePodVM := uuid.New().String()
+	unknownPodVM := uuid.New().String()
+	consumers := map[string][]string{
+		"vol-detached": nil,
+		"vol-attached": {livePodVM},
+		"vol-stale":    {livePodVM, stalePodVM},
+		"vol-unknown":  {stalePodVM, unknownPodVM},
+	}
+	queryVolumeInfoCalls := 0
+	volumeManager := &fakeVolumeManager{
+		queryVolume: func(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			return &cnstypes.CnsQueryResult{
+				Volumes: []cnstypes.CnsVolume{
+					newFakeBlockVolume("vol-detached", 1024),
+					newFakeBlockVolume("vol-attached", 1024),
+					newFakeBlockVolume("vol-stale", 1024),
+					newFakeBlockVolume("vol-unknown", 1024),
+				},
+			}, nil
+		},
+		queryVolumeInfoList: func(ctx context.Context, volumeIDList []cnstypes.CnsVolumeId) ([]*cnstypes.CnsQueryVolumeInfoResult, error) {
+			queryVolumeInfoCalls++
+			var results []*cnstypes.CnsQueryVolumeInfoResult
+			for _, volumeID := range volumeIDList {
+				volumeInfo := &cnstypes.CnsBlockVolumeInfo{}
+				volumeInfo.VStorageObject.Config.Id.Id = volumeID.Id
+				for _, consumer := range consumers[volumeID.Id] {
+					volumeInfo.VStorageObject.Config.ConsumerId = append(volumeInfo.VStorageObject.Config.ConsumerId,
+						types.ID{Id: consumer})
+				}
+				results = append(results, &cnstypes.CnsQueryVolumeInfoResult{VolumeInfo: volumeInfo})
+			}
+			return results, nil
+		},
+	}
+	c := newFakeController(volumeManager)
+	c.manager.CnsConfig.VirtualCenter = map[string]*config.VirtualCenterConfig{
+		"vc1.example.com": {User: "user", Password: "password", VCenterPort: "443", Datacenters: "datacenter-1"},
+	}
+	c.manager.VcenterManager = &fakeVirtualCenterManager{
+		virtualCenters: map[string]*cnsvsphere.VirtualCenter{
+			"vc1.example.com": {Config: &cnsvsphere.VirtualCenterConfig{Host: "vc1.example.com"}},
+		},
+	}
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		return []*cnsvsphere.DatastoreInfo{newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")}, nil
+	}
+	connectCalls := 0
+	defer func(orig func(context.Context, *cnsvsphere.VirtualCenter) error) {
+		connectVCenter = orig
+	}(connectVCenter)
+	connectVCenter = func(ctx context.Context, vc *cnsvsphere.VirtualCenter) error {
+		connectCalls++
+		return nil
+	}
+	defer func(orig func(context.Context, *cnsvsphere.VirtualCenter, string, string) (*cnsvsphere.VirtualMachine, error)) {
+		getPodVMInVCenter = orig
+	}(getPodVMInVCenter)
+	getPodVMInVCenter = func(ctx context.Context, vc *cnsvsphere.VirtualCenter, datacenter string,
+		vmInstanceUUID string) (*cnsvsphere.VirtualMachine, error) {
+		switch vmInstanceUUID {
+		case livePodVM:
+			return &cnsvsphere.VirtualMachine{UUID: vmInstanceUUID, VirtualCenterHost: vc.Config.Host}, nil
+		case unknownPodVM:
+			return nil, fmt.Errorf("failed to look up VM %s: session expired", vmInstanceUUID)
+		}
+		return nil, fmt.Errorf("VM %s not found in datacenter %s: %w", vmInstanceUUID, datacenter, cnsvsphere.ErrVMNotFound)
+	}
+
+	resp, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed with err: %v", err)
+	}
+	if len(resp.Entries) != len(consumers) {
+		t.Fatalf("expected %d volumes, got %d", len(consumers), len(resp.Entries))
+	}
+	for _, entry := range resp.Entries {
+		volumeContext := entry.Volume.VolumeContext
+		abnormal := volumeContext[common.AttributeVolumeAbnormal] == "true"
+		if expected := entry.Volume.VolumeId == "vol-stale"; abnormal != expected {
+			t.Errorf("volume %q: expected abnormal %t, got %t", entry.Volume.VolumeId, expected, abnormal)
+		}
+		if abnormal && !strings.Contains(volumeContext[common.AttributeVolumeConditionMessage], stalePodVM) {
+			t.Errorf("volume %q: expected condition message to name PodVM %s, got %q",
+				entry.Volume.VolumeId, stalePodVM, volumeContext[common.AttributeVolumeConditionMessage])
+		}
+	}
+	if queryVolumeInfoCalls != 1 {
+		t.Errorf("expected the info of the page to be queried once, got %d queries", queryVolumeInfoCalls)
+	}
+	if connectCalls != 1 {
+		t.Errorf("expected the vCenter to be connected to once, got %d connections", connectCalls)
+	}
+}
+
+/*
+ * TestWCPCreateVolumePerPolicyLimit verifies CreateVolume requests over the
+ * concurrency limit of a storage policy are rejected with ResourceExhausted.
+ */
+func TestWCPCreateVolumePerPolicyLimit(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeController(&fakeVolumeManager{})
+	c.manager.CnsConfig.Global.MaxConcurrentCreateVolumesPerPolicy = 1
+	c.createVolumeLimiter = common.NewConcurrencyLimiter(1)
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		return nil, fmt.Errorf("no shared datastores")
+	}
+	newRequest := func(storagePolicyID string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:       testVolumeName + "-" + uuid.New().String(),
+			Parameters: map[string]string{common.AttributeStoragePolicyID: storagePolicyID},
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+			},
+		}
+	}
+
+	// Simulate a CreateVolume in progress for policy-a
+	if !c.createVolumeLimiter.TryAcquire("policy-a") {
+		t.Fatal("failed to start CreateVolume for policy-a")
+	}
+	_, err := c.CreateVolume(ctx, newRequest("policy-a"))
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Errorf("expected code %v for policy-a over its limit, got %v (err: %v)", codes.ResourceExhausted, code, err)
+	}
+	// Requests for other policies are not limited by policy-a
+	_, err = c.CreateVolume(ctx, newRequest("policy-b"))
+	if code := status.Code(err); code == codes.ResourceExhausted {
+		t.Errorf("expected CreateVolume for policy-b not to be limited, got %v", err)
+	}
+	c.createVolumeLimiter.Release("policy-a")
+	_, err = c.CreateVolume(ctx, newRequest("policy-a"))
+	if code := status.Code(err); code == codes.ResourceExhausted {
+		t.Errorf("expected CreateVolume for policy-a to proceed after release, got %v", err)
+	}
+
+	// Requests without a storage policy share a single limit
+	if !c.createVolumeLimiter.TryAcquire("") {
+		t.Fatal("failed to start CreateVolume without a storage policy")
+	}
+	_, err = c.CreateVolume(ctx, newRequest(""))
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Errorf("expected code %v for requests without a storage policy over the limit, got %v (err: %v)",
+			codes.ResourceExhausted, code, err)
+	}
+	c.createVolumeLimiter.Release("")
+}
+
+/*
+ * TestWCPValidateCreateVolumeParamConflicts verifies CreateVolume requests with
+ * conflicting parameters are rejected with InvalidArgument.
+ */
+func TestWCPValidateCreateVolumeParamConflicts(t *testing.T) {
+	ctx := context.Background()
+	mountCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	blockCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	tests := []struct {
+		name         string
+		params       map[string]string
+		volCap       *csi.VolumeCapability
+		expectedCode codes.Code
+	}{
+		{"no conflicts", map[string]string{"storagepolicyid": "policy-a", "fstype": "ext4"}, mountCap, codes.OK},
+		{"same storage policy in different case", map[string]string{"storagepolicyid": "policy-a", "StoragePolicyID": "policy-a"},
+			mountCap, codes.OK},
+		{"conflicting storage policies", map[string]string{"storagepolicyid": "policy-a", "StoragePolicyID": "policy-b"},
+			mountCap, codes.InvalidArgument},
+		{"conflicting fstypes", map[string]string{"fstype": "ext4", "FsType": "xfs"}, mountCap, codes.InvalidArgument},
+		{"conflicting hosts", map[string]string{"affinetohost": "host-1", "AffineToHost": "host-2"}, mountCap, codes.InvalidArgument},
+		{"fstype for raw block volume", map[string]string{"fstype": "ext4"}, blockCap, codes.InvalidArgument},
+		{"raw block volume", map[string]string{"storagepolicyid": "policy-a"}, blockCap, codes.OK},
+	}
+	for _, test := range tests {
+		req := &csi.CreateVolumeRequest{
+			Name:               testVolumeName,
+			Parameters:         test.params,
+			VolumeCapabilities: []*csi.VolumeCapability{test.volCap},
+		}
+		err := validateWCPCreateVolumeRequest(ctx, req)
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s: expected code %v, got %v (err: %v)", test.name, test.expectedCode, code, err)
+		}
+	}
+}
+
+/*
+ * TestWCPListVolumesResumePagination verifies a pagination token remains valid
+ * across controller instances, and ListVolumes is aborted if the set of volumes
+ * changed since the token was issued.
+ */
+func TestWCPListVolumesResumePagination(t *testing.T) {
+	ctx := context.Background()
+	volumeIDs := []string{"vol-3", "vol-1", "vol-2"}
+	volumeManager := &fakeVolumeManager{
+		queryVolume: func(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			var volumes []cnstypes.CnsVolume
+			for _, volumeID := range volumeIDs {
+				volumes = append(volumes, newFakeBlockVolume(volumeID, 1024))
+			}
+			return &cnstypes.CnsQueryResult{Volumes: volumes}, nil
+		},
+	}
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		return []*cnsvsphere.DatastoreInfo{newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")}, nil
+	}
+
+	resp, err := newFakeController(volumeManager).ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("ListVolumes failed with err: %v", err)
+	}
+	if len(resp.Entries) != 2 || resp.Entries[0].Volume.VolumeId != "vol-1" || resp.Entries[1].Volume.VolumeId != "vol-2" {
+		t.Fatalf("unexpected first page: %+v", resp.Entries)
+	}
+	token := resp.NextToken
+
+	// Resume with a new controller instance, as after a restart
+	resp, err = newFakeController(volumeManager).ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+	if err != nil {
+		t.Fatalf("ListVolumes failed to resume with token %q. err: %v", token, err)
+	}
+	if len(resp.Entries) != 1 || resp.Entries[0].Volume.VolumeId != "vol-3" || resp.NextToken != "" {
+		t.Fatalf("unexpected second page: %+v", resp)
+	}
+
+	// The set of volumes changes before the listing is resumed
+	volumeIDs = append(volumeIDs, "vol-0")
+	_, err = newFakeController(volumeManager).ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("expected code %v after the volumes changed, got %v (err: %v)", codes.Aborted, code, err)
+	}
+
+	// Malformed token
+	_, err = newFakeController(volumeManager).ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "1"})
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("expected code %v for a malformed token, got %v (err: %v)", codes.Aborted, code, err)
+	}
+}
+
+/*
+ * TestWCPCreateVolumeClusterID verifies the shared datastores are computed for the
+ * cluster selected with the clusterid parameter, and unmanaged clusters are rejected.
+ */
+func TestWCPCreateVolumeClusterID(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeController(&fakeVolumeManager{})
+	c.manager.CnsConfig.Global.AdditionalClusterIDs = "cluster-b, cluster-c"
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	var sharedDatastoresClusterID string
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		sharedDatastoresClusterID = getClusterID(ctx, c.manager.CnsConfig)
+		return nil, fmt.Errorf("no shared datastores in cluster %s", sharedDatastoresClusterID)
+	}
+	tests := []struct {
+		name              string
+		clusterID         string
+		expectedClusterID string
+		expectedCode      codes.Code
+	}{
+		{"default cluster", "", testClusterName, codes.Internal},
+		{"additional cluster", "cluster-b", "cluster-b", codes.Internal},
+		{"unmanaged cluster", "cluster-d", "", codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		sharedDatastoresClusterID = ""
+		params := map[string]string{common.AttributeStoragePolicyID: "policy-a"}
+		if test.clusterID != "" {
+			params[common.AttributeClusterID] = test.clusterID
+		}
+		_, err := c.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       testVolumeName + "-" + uuid.New().String(),
+			Parameters: params,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+			},
+		})
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s: expected code %v, got %v (err: %v)", test.name, test.expectedCode, code, err)
+		}
+		if sharedDatastoresClusterID != test.expectedClusterID {
+			t.Errorf("%s: expected shared datastores of cluster %q, got %q",
+				test.name, test.expectedClusterID, sharedDatastoresClusterID)
+		}
+	}
+}
+
+/*
+ * TestWCPQueryVolumesByLabelSelector verifies the volumes whose cluster metadata
+ * labels match the label selector are returned, page by page.
+ */
+func TestWCPQueryVolumesByLabelSelector(t *testing.T) {
+	ctx := context.Background()
+	newLabeledVolume := func(volumeID string, clusterID string, labels map[string]string) cnstypes.CnsVolume {
+		volume := newFakeBlockVolume(volumeID, 1024)
+		volume.Metadata.EntityMetadata = append(volume.Metadata.EntityMetadata,
+			cnsvsphere.GetCnsKubernetesEntityMetaData("pvc-"+volumeID, labels, false,
+				string(cnstypes.CnsKubernetesEntityTypePVC), "default", clusterID, nil))
+		return volume
+	}
+	volumeManager := &fakeVolumeManager{
+		queryVolume: func(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			return &cnstypes.CnsQueryResult{
+				Volumes: []cnstypes.CnsVolume{
+					newLabeledVolume("vol-1", testClusterName, map[string]string{"app": "foo", "tier": "db"}),
+					newLabeledVolume("vol-2", testClusterName, map[string]string{"app": "bar"}),
+					newLabeledVolume("vol-3", "other-cluster", map[string]string{"app": "foo"}),
+					newLabeledVolume("vol-4", testClusterName, map[string]string{"app": "foo"}),
+					newFakeBlockVolume("vol-5", 1024),
+				},
+			}, nil
+		},
+	}
+	c := newFakeController(volumeManager)
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		return []*cnsvsphere.DatastoreInfo{newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")}, nil
+	}
+	tests := []struct {
+		selector          string
+		expectedVolumeIDs []string
+	}{
+		{"app=foo", []string{"vol-1", "vol-4"}},
+		{"app=foo,tier=db", []string{"vol-1"}},
+		{"app in (foo, bar)", []string{"vol-1", "vol-2", "vol-4"}},
+		{"app=baz", []string{}},
+		{"app!=foo", []string{"vol-2"}},
+	}
+	for _, test := range tests {
+		volumeIDs, nextToken, err := c.QueryVolumesByLabelSelector(ctx, test.selector, "", 0)
+		if err != nil {
+			t.Fatalf("selector %q: QueryVolumesByLabelSelector failed with err: %v", test.selector, err)
+		}
+		if !reflect.DeepEqual(volumeIDs, test.expectedVolumeIDs) || nextToken != "" {
+			t.Errorf("selector %q: expected volumes %v, got %v (next token %q)",
+				test.selector, test.expectedVolumeIDs, volumeIDs, nextToken)
+		}
+	}
+
+	// Paginated query
+	volumeIDs, nextToken, err := c.QueryVolumesByLabelSelector(ctx, "app=foo", "", 1)
+	if err != nil || len(volumeIDs) != 1 || volumeIDs[0] != "vol-1" || nextToken == "" {
+		t.Fatalf("unexpected first page: %v, next token %q, err: %v", volumeIDs, nextToken, err)
+	}
+	volumeIDs, nextToken, err = c.QueryVolumesByLabelSelector(ctx, "app=foo", nextToken, 1)
+	if err != nil || len(volumeIDs) != 1 || volumeIDs[0] != "vol-4" || nextToken != "" {
+		t.Fatalf("unexpected second page: %v, next token %q, err: %v", volumeIDs, nextToken, err)
+	}
+
+	if _, _, err = c.QueryVolumesByLabelSelector(ctx, "app in (foo", "", 0); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected code %v for an invalid selector, got %v", codes.InvalidArgument, err)
+	}
+}
+
+/*
+ * TestWCPValidateControllerPublishVolumeCapability verifies ControllerPublishVolume
+ * requests with a capability which is not supported for block volumes are rejected
+ * with InvalidArgument.
+ */
+func TestWCPValidateControllerPublishVolumeCapability(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name         string
+		accessMode   csi.VolumeCapability_AccessMode_Mode
+		expectedCode codes.Code
+	}{
+		{"single node writer", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, codes.OK},
+		{"multi node multi writer", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		req := &csi.ControllerPublishVolumeRequest{
+			VolumeId: "vol-1",
+			NodeId:   "pod-1",
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: test.accessMode},
+			},
+		}
+		err := validateWCPControllerPublishVolumeRequest(ctx, req)
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s: expected code %v, got %v (err: %v)", test.name, test.expectedCode, code, err)
+		}
+	}
+}
+
+/*
+ * TestWCPGetStoragePolicyName verifies storage policy names are resolved from the
+ * ID once and then served from the cache until the entry expires.
+ */
+func TestWCPGetStoragePolicyName(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeController(&fakeVolumeManager{})
+	defer func(orig func(context.Context, *controller, string) (string, error), origCache *storagePolicyNameCache) {
+		lookupStoragePolicyName = orig
+		storagePolicyNames = origCache
+	}(lookupStoragePolicyName, storagePolicyNames)
+	now := time.Now()
+	storagePolicyNames = &storagePolicyNameCache{
+		entries: make(map[string]storagePolicyNameEntry),
+		ttl:     time.Minute,
+		now:     func() time.Time { return now },
+	}
+	lookups := 0
+	lookupStoragePolicyName = func(ctx context.Context, c *controller, storagePolicyID string) (string, error) {
+		lookups++
+		return "gold-" + storagePolicyID, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		name, err := getStoragePolicyName(ctx, c, "policy-a")
+		if err != nil || name != "gold-policy-a" {
+			t.Fatalf("expected storage policy name %q, got %q (err: %v)", "gold-policy-a", name, err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("expected 1 storage policy name lookup, got %d", lookups)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := getStoragePolicyName(ctx, c, "policy-a"); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 2 {
+		t.Errorf("expected the expired name to be looked up again, got %d lookups", lookups)
+	}
+}
+
+/*
+ * TestWCPFilterHostsByMinVersion verifies hosts older than the minimum host version,
+ * or whose version is unknown, are excluded from the shared datastore computation.
+ */
+func TestWCPFilterHostsByMinVersion(t *testing.T) {
+	ctx := context.Background()
+	defer func(orig func(context.Context, *cnsvsphere.HostSystem) (string, error)) {
+		getHostVersion = orig
+	}(getHostVersion)
+	hostVersions := map[string]string{"host-1": "7.0.0", "host-2": "6.5.0", "host-3": "6.7.0"}
+	getHostVersion = func(ctx context.Context, host *cnsvsphere.HostSystem) (string, error) {
+		hostVersion, ok := hostVersions[host.Reference().Value]
+		if !ok {
+			return "", fmt.Errorf("host %s not found", host.Reference().Value)
+		}
+		return hostVersion, nil
+	}
+	var hosts []*cnsvsphere.HostSystem
+	for _, name := range []string{"host-1", "host-2", "host-3", "host-4"} {
+		hosts = append(hosts, &cnsvsphere.HostSystem{
+			HostSystem: object.NewHostSystem(nil, types.ManagedObjectReference{Type: "HostSystem", Value: name}),
+		})
+	}
+
+	filteredHosts, err := filterHostsByMinVersion(ctx, hosts, "6.7.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var filteredHostNames []string
+	for _, host := range filteredHosts {
+		filteredHostNames = append(filteredHostNames, host.Reference().Value)
+	}
+	if !reflect.DeepEqual(filteredHostNames, []string{"host-1", "host-3"}) {
+		t.Errorf("expected hosts [host-1 host-3], got %v", filteredHostNames)
+	}
+	if _, err := filterHostsByMinVersion(ctx, hosts, "latest"); err == nil {
+		t.Error("expected an invalid minimum host version to be rejected")
+	}
+}
+
+/*
+ * TestWCPCheckPodVMPowerState verifies attaching to a powered off PodVM proceeds
+ * or fails with FailedPrecondition depending on powered-off-podvm-attach.
+ */
+func TestWCPCheckPodVMPowerState(t *testing.T) {
+	ctx := context.Background()
+	defer func(orig func(context.Context, *cnsvsphere.VirtualMachine) (bool, error)) {
+		isPodVMPoweredOn = orig
+	}(isPodVMPoweredOn)
+	podVM := &cnsvsphere.VirtualMachine{UUID: "podvm-1"}
+	tests := []struct {
+		name         string
+		behavior     string
+		poweredOn    bool
+		expectedCode codes.Code
+	}{
+		{"powered on", common.PoweredOffPodVMAttachFail, true, codes.OK},
+		{"powered off with default behavior", "", false, codes.OK},
+		{"powered off with proceed", common.PoweredOffPodVMAttachProceed, false, codes.OK},
+		{"powered off with fail", common.PoweredOffPodVMAttachFail, false, codes.FailedPrecondition},
+	}
+	for _, test := range tests {
+		poweredOn := test.poweredOn
+		isPodVMPoweredOn = func(ctx context.Context, podVM *cnsvsphere.VirtualMachine) (bool, error) {
+			return poweredOn, nil
+		}
+		cfg := &config.Config{}
+		cfg.Global.PoweredOffPodVMAttach = test.behavior
+		err := checkPodVMPowerState(ctx, cfg, podVM)
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s: expected code %v, got %v (err: %v)", test.name, test.expectedCode, code, err)
+		}
+	}
+	if err := validatePoweredOffPodVMAttach("retry"); err == nil {
+		t.Error("expected powered off PodVM attach behavior \"retry\" to be rejected")
+	}
+}
+
+/*
+ * TestWCPListVolumesScope verifies ListVolumes only returns the volumes of the
+ * clusters managed by the controller by default, and all the volumes on the shared
+ * datastores with list-all-volumes.
+ */
+func TestWCPListVolumesScope(t *testing.T) {
+	ctx := context.Background()
+	otherClusterVolume := newFakeBlockVolume("vol-2", 1024)
+	otherClusterVolume.Metadata.ContainerCluster = cnsvsphere.GetContainerCluster("other-cluster", "user",
+		cnstypes.CnsClusterFlavorWorkload)
+	noClusterVolume := newFakeBlockVolume("vol-3", 1024)
+	noClusterVolume.Metadata.ContainerCluster = cnstypes.CnsContainerCluster{}
+	volumeManager := &fakeVolumeManager{
+		queryVolume: func(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			return &cnstypes.CnsQueryResult{
+				Volumes: []cnstypes.CnsVolume{newFakeBlockVolume("vol-1", 1024), otherClusterVolume, noClusterVolume},
+			}, nil
+		},
+	}
+	c := newFakeController(volumeManager)
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		return []*cnsvsphere.DatastoreInfo{newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")}, nil
+	}
+	tests := []struct {
+		name              string
+		listAllVolumes    bool
+		expectedVolumeIDs []string
+	}{
+		{"own volumes", false, []string{"vol-1"}},
+		{"all volumes", true, []string{"vol-1", "vol-2", "vol-3"}},
+	}
+	for _, test := range tests {
+		c.manager.CnsConfig.Global.ListAllVolumes = test.listAllVolumes
+		resp, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		if err != nil {
+			t.Fatalf("%s: ListVolumes failed with err: %v", test.name, err)
+		}
+		var volumeIDs []string
+		for _, entry := range resp.Entries {
+			volumeIDs = append(volumeIDs, entry.Volume.VolumeId)
+		}
+		if !reflect.DeepEqual(volumeIDs, test.expectedVolumeIDs) {
+			t.Errorf("%s: expected volumes %v, got %v", test.name, test.expectedVolumeIDs, volumeIDs)
+		}
+	}
+}
+
+/*
+ * TestWCPDeleteVolumeConcurrent verifies concurrent DeleteVolume requests for the
+ * same volume share the result of a single CNS deletion.
+ */
+func TestWCPDeleteVolumeConcurrent(t *testing.T) {
+	ctx := context.Background()
+	var mutex sync.Mutex
+	deletedVolumes := 0
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	c := newFakeController(&fakeVolumeManager{
+		deleteVolume: func(ctx context.Context, volumeID string, deleteDisk bool) error {
+			mutex.Lock()
+			deletedVolumes++
+			if deletedVolumes == 1 {
+				close(started)
+			}
+			mutex.Unlock()
+			<-unblock
+			return fmt.Errorf("volume %s is busy", volumeID)
+		},
+	})
+	c.deleteVolumeCalls = common.NewInFlightCalls()
+
+	const requests = 5
+	errs := make(chan error, requests)
+	go func() {
+		_, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+		errs <- err
+	}()
+	<-started
+	var wg sync.WaitGroup
+	for i := 1; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			wg.Done()
+			_, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	// Give the waiting requests time to join the deletion in progress
+	time.Sleep(100 * time.Millisecond)
+	close(unblock)
+	for i := 0; i < requests; i++ {
+		if err := <-errs; status.Code(err) != codes.Internal {
+			t.Errorf("expected all the requests to fail with code %v, got err: %v", codes.Internal, err)
+		}
+	}
+	if deletedVolumes != 1 {
+		t.Errorf("expected a single CNS deletion, got %d", deletedVolumes)
+	}
+}
+
+/*
+ * TestWCPListInFlightOperations verifies a DeleteVolume request is listed as in flight
+ * while it is in progress, and no longer once it completed.
+ */
+func TestWCPListInFlightOperations(t *testing.T) {
+	ctx := context.Background()
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	c := newFakeController(&fakeVolumeManager{
+		deleteVolume: func(ctx context.Context, volumeID string, deleteDisk bool) error {
+			close(started)
+			<-unblock
+			return nil
+		},
+	})
+	c.inFlightOperations = common.NewInFlightOperations()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+		errs <- err
+	}()
+	<-started
+	operations := c.ListInFlightOperations(ctx)
+	if len(operations) != 1 || operations[0].Name != "DeleteVolume" || operations[0].Volume != "vol-1" ||
+		operations[0].StartTime.IsZero() {
+		t.Errorf("expected the deletion of vol-1 to be in flight, got %+v", operations)
+	}
+	close(unblock)
+	if err := <-errs; err != nil {
+		t.Fatalf("failed to delete the volume. err: %v", err)
+	}
+	if operations = c.ListInFlightOperations(ctx); len(operations) != 0 {
+		t.Errorf("expected no operation in flight once the deletion completed, got %+v", operations)
+	}
+}
+
+/*
+ * TestWCPDeleteVolumeVCenterUnavailable verifies DeleteVolume fails with Unavailable,
+ * so that it is retried, when vCenter responds that it is unavailable.
+ */
+func TestWCPDeleteVolumeVCenterUnavailable(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeController(&fakeVolumeManager{
+		deleteVolume: func(ctx context.Context, volumeID string, deleteDisk bool) error {
+			return &url.Error{Op: "POST", URL: "/sdk", Err: errors.New("503 Service Unavailable")}
+		},
+	})
+	_, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("expected DeleteVolume to fail with code %v when vCenter is unavailable, got %v (err: %v)",
+			codes.Unavailable, code, err)
+	}
+}
+
+/*
+ * TestWCPMaintenanceMode verifies the creation and the attachment of volumes are
+ * rejected in maintenance mode, while their detachment and deletion are allowed.
+ */
+func TestWCPMaintenanceMode(t *testing.T) {
+	ctx := context.Background()
+	deletedVolumes := 0
+	c := newFakeController(&fakeVolumeManager{
+		deleteVolume: func(ctx context.Context, volumeID string, deleteDisk bool) error {
+			deletedVolumes++
+			return nil
+		},
+	})
+	c.manager.CnsConfig.Global.MaintenanceMode = true
+
+	_, err := c.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "pvc"})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("expected CreateVolume to fail with code %v in maintenance mode, got %v (err: %v)",
+			codes.Unavailable, code, err)
+	}
+	_, err = c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: "node-1"})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("expected ControllerPublishVolume to fail with code %v in maintenance mode, got %v (err: %v)",
+			codes.Unavailable, code, err)
+	}
+	_, err = c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol-1", NodeId: "node-1"})
+	if err != nil {
+		t.Errorf("expected ControllerUnpublishVolume to succeed in maintenance mode, got err: %v", err)
+	}
+	_, err = c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+	if err != nil || deletedVolumes != 1 {
+		t.Errorf("expected DeleteVolume to delete the volume in maintenance mode, got err: %v", err)
+	}
+
+	// Leaving maintenance mode lets the requests through to their validation again
+	c.manager.CnsConfig.Global.MaintenanceMode = false
+	_, err = c.CreateVolume(ctx, &csi.CreateVolumeRequest{})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("expected CreateVolume without a name to fail with code %v, got %v (err: %v)",
+			codes.InvalidArgument, code, err)
+	}
+}
+
+/*
+ * TestWCPHostDatastoreCacheHostChanges verifies the cached shared datastores are
+ * updated incrementally when hosts are added to or removed from the cluster, only
+ * looking up the accessible datastores of the added hosts.
+ */
+func TestWCPHostDatastoreCacheHostChanges(t *testing.T) {
+	ctx := context.Background()
+	datastore1 := newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")
+	datastore2 := newFakeDatastoreInfo("datastore-2", "ds:///vmfs/volumes/datastore-2/")
+	var lookedUpHosts []string
+	defer func(orig func(context.Context, *cnsvsphere.HostSystem) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getHostAccessibleDatastores = orig
+	}(getHostAccessibleDatastores)
+	getHostAccessibleDatastores = func(ctx context.Context, host *cnsvsphere.HostSystem) ([]*cnsvsphere.DatastoreInfo, error) {
+		lookedUpHosts = append(lookedUpHosts, host.Reference().Value)
+		return []*cnsvsphere.DatastoreInfo{datastore2}, nil
+	}
+	c := newFakeController(&fakeVolumeManager{})
+	cache := newHostDatastoreCache(hostDatastoreCacheTTL)
+	cache.enable(testClusterName)
+	cache.set(testClusterName, map[string]hostDatastoreEntry{
+		"host-1": newHostDatastoreEntry(newFakeHost("host-1"), []*cnsvsphere.DatastoreInfo{datastore1, datastore2}),
+	})
+	_, sharedURLs, ok := cache.getSharedDatastoreURLs(testClusterName)
+	if !ok || len(sharedURLs) != 2 {
+		t.Fatalf("expected both datastores to be shared by the cached host, got %v", sharedURLs)
+	}
+
+	// host-2 is added to the cluster
+	cache.updateHosts(ctx, c, testClusterName, []*cnsvsphere.HostSystem{newFakeHost("host-1"), newFakeHost("host-2")})
+	if !reflect.DeepEqual(lookedUpHosts, []string{"host-2"}) {
+		t.Errorf("expected only the added host to be looked up, got %v", lookedUpHosts)
+	}
+	_, sharedURLs, ok = cache.getSharedDatastoreURLs(testClusterName)
+	if !ok || len(sharedURLs) != 1 || !sharedURLs[datastore2.Info.Url] {
+		t.Errorf("expected only datastore-2 to be shared after host-2 was added, got %v", sharedURLs)
+	}
+
+	// host-2 is removed from the cluster again
+	cache.updateHosts(ctx, c, testClusterName, []*cnsvsphere.HostSystem{newFakeHost("host-1")})
+	_, sharedURLs, ok = cache.getSharedDatastoreURLs(testClusterName)
+	if !ok || len(sharedURLs) != 2 {
+		t.Errorf("expected both datastores to be shared after host-2 was removed, got %v", sharedURLs)
+	}
+	// Other clusters are not cached
+	if _, _, ok = cache.getSharedDatastoreURLs("cluster-b"); ok {
+		t.Error("expected the shared datastores of another cluster to not be cached")
+	}
+
+	// The cache isn't used once the TTL elapsed, so that datastores mounted on or
+	// unmounted from the hosts are picked up
+	now := time.Now()
+	cache.now = func() time.Time { return now.Add(hostDatastoreCacheTTL + time.Second) }
+	if _, _, ok = cache.getSharedDatastoreURLs(testClusterName); ok {
+		t.Error("expected the shared datastores to not be cached after the TTL elapsed")
+	}
+	cache.now = time.Now
+
+	// The cache isn't used once the watch stopped
+	cache.disable(testClusterName)
+	if _, _, ok = cache.getSharedDatastoreURLs(testClusterName); ok {
+		t.Error("expected the shared datastores to not be cached after the watch stopped")
+	}
+}
+
+/*
+ * TestWCPSharedDatastoresCachedPerCluster verifies the cached hosts of the watched
+ * cluster are not used for the other clusters, and that the shared datastores
+ * returned from the cache have their current free space.
+ */
+func TestWCPSharedDatastoresCachedPerCluster(t *testing.T) {
+	ctx := context.Background()
+	defer func(orig *hostDatastoreCache) { hostDatastores = orig }(hostDatastores)
+	hostDatastores = newHostDatastoreCache(hostDatastoreCacheTTL)
+	hostDatastores.enable(testClusterName)
+	defer func(orig func(context.Context, *common.Manager) ([]*cnsvsphere.HostSystem, error)) {
+		getClusterHosts = orig
+	}(getClusterHosts)
+	var lookedUpClusters []string
+	getClusterHosts = func(ctx context.Context, manager *common.Manager) ([]*cnsvsphere.HostSystem, error) {
+		clusterID := getClusterID(ctx, manager.CnsConfig)
+		lookedUpClusters = append(lookedUpClusters, clusterID)
+		return []*cnsvsphere.HostSystem{newFakeHost(clusterID + "-host")}, nil
+	}
+	defer func(orig func(context.Context, *cnsvsphere.HostSystem) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getHostAccessibleDatastores = orig
+	}(getHostAccessibleDatastores)
+	freeSpace := int64(10 * common.GbInBytes)
+	getHostAccessibleDatastores = func(ctx context.Context, host *cnsvsphere.HostSystem) ([]*cnsvsphere.DatastoreInfo, error) {
+		datastore := newFakeDatastoreInfo(host.Reference().Value+"-ds", "ds:///vmfs/volumes/"+host.Reference().Value+"-ds/")
+		datastore.Info.FreeSpace = freeSpace
+		return []*cnsvsphere.DatastoreInfo{datastore}, nil
+	}
+	c := newFakeController(&fakeVolumeManager{})
+	c.manager.CnsConfig.Global.AdditionalClusterIDs = "cluster-b"
+
+	if _, err := getSharedDatastoresInPodVMK8SCluster(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	// The other cluster is looked up rather than served from the cache of the default cluster
+	datastores, err := getSharedDatastoresInPodVMK8SCluster(withClusterID(ctx, "cluster-b"), c)
+	if err != nil || len(datastores) != 1 || datastores[0].Info.Url != "ds:///vmfs/volumes/cluster-b-host-ds/" {
+		t.Errorf("expected the shared datastore of cluster-b, got %v (err: %v)", datastores, err)
+	}
+	// The default cluster is served from the cache with the current free space
+	freeSpace = 5 * common.GbInBytes
+	datastores, err = getSharedDatastoresInPodVMK8SCluster(ctx, c)
+	if err != nil || len(datastores) != 1 || datastores[0].Info.FreeSpace != freeSpace {
+		t.Errorf("expected the shared datastore with %d bytes free, got %v (err: %v)", freeSpace, datastores, err)
+	}
+	if !reflect.DeepEqual(lookedUpClusters, []string{testClusterName, "cluster-b"}) {
+		t.Errorf("expected the hosts of each cluster to be looked up once, got %v", lookedUpClusters)
+	}
+}
+
+/*
+ * TestWCPCreateVolumeClusterNotReady verifies CreateVolume fails with Unavailable,
+ * so that it is retried, while the cluster has no hosts.
+ */
+func TestWCPCreateVolumeClusterNotReady(t *testing.T) {
+	ctx := context.Background()
+	defer func(orig func(context.Context, *common.Manager) ([]*cnsvsphere.HostSystem, error)) {
+		getClusterHosts = orig
+	}(getClusterHosts)
+	getClusterHosts = func(ctx context.Context, manager *common.Manager) ([]*cnsvsphere.HostSystem, error) {
+		return nil, nil
+	}
+	c := newFakeController(&fakeVolumeManager{})
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+	}
+	_, err := c.CreateVolume(ctx, req)
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("expected CreateVolume to fail with code %v without hosts, got %v (err: %v)", codes.Unavailable, code, err)
+	}
+}
+
+/*
+ * TestWCPCreateVolumeVCenterUnavailable verifies CreateVolume fails with Unavailable,
+ * so that it is retried, when vCenter can't be connected to while looking up the
+ * shared datastores, and with Internal when vCenter is not configured.
+ */
+func TestWCPCreateVolumeVCenterUnavailable(t *testing.T) {
+	ctx := context.Background()
+	defer func(orig *hostDatastoreCache) { hostDatastores = orig }(hostDatastores)
+	hostDatastores = newHostDatastoreCache(hostDatastoreCacheTTL)
+	c := newFakeController(&fakeVolumeManager{})
+	c.manager.VcenterConfig.Host = "127.0.0.1"
+	// Nothing listens on the port of the vCenter, so connecting to it fails
+	c.manager.VcenterManager = &fakeVirtualCenterManager{
+		virtualCenters: map[string]*cnsvsphere.VirtualCenter{
+			"127.0.0.1": {Config: &cnsvsphere.VirtualCenterConfig{Host: "127.0.0.1", Port: 1, Insecure: true}},
+		},
+	}
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+	}
+	_, err := c.CreateVolume(ctx, req)
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("expected CreateVolume to fail with code %v when vCenter is unreachable, got %v (err: %v)",
+			codes.Unavailable, code, err)
+	}
+
+	c.manager.VcenterManager = &fakeVirtualCenterManager{virtualCenters: map[string]*cnsvsphere.VirtualCenter{}}
+	_, err = c.CreateVolume(ctx, req)
+	if code := status.Code(err); code != codes.Internal {
+		t.Errorf("expected CreateVolume to fail with code %v when vCenter is not registered, got %v (err: %v)",
+			codes.Internal, code, err)
+	}
+}
+
+/*
+ * TestWCPCreateBlockVolumeWithPreferredPolicy verifies volumes are created with the
+ * preferred storage policy when possible, and with the required one otherwise, and
+ * that retries report the policy the volume was actually created with.
+ */
+func TestWCPCreateBlockVolumeWithPreferredPolicy(t *testing.T) {
+	ctx := context.Background()
+	var requestedPolicies []string
+	satisfiable := map[string]bool{"required": true}
+	compatible := map[string]bool{"required": true}
+	// volumes holds the volumes created by name, and listed holds whether the
+	// creation of the volume has completed and CNS lists it
+	volumes := make(map[string]cnstypes.CnsVolume)
+	listed := make(map[string]bool)
+	defer func(orig func(context.Context, cnstypes.CnsClusterFlavor, *common.Manager, *common.CreateVolumeSpec,
+		[]*cnsvsphere.DatastoreInfo) (string, error)) {
+		createBlockVolume = orig
+	}(createBlockVolume)
+	createBlockVolume = func(ctx context.Context, clusterFlavor cnstypes.CnsClusterFlavor, manager *common.Manager,
+		spec *common.CreateVolumeSpec, sharedDatastores []*cnsvsphere.DatastoreInfo) (string, error) {
+		requestedPolicies = append(requestedPolicies, spec.StoragePolicyID)
+		// The CNS task of an earlier attempt is reused regardless of its policy
+		if volume, ok := volumes[spec.Name]; ok {
+			return volume.VolumeId.Id, nil
+		}
+		if !satisfiable[spec.StoragePolicyID] {
+			return "", fmt.Errorf("no compatible datastore: %w", common.ErrNoEligibleDatastore)
+		}
+		volume := newFakeBlockVolume("vol-"+spec.StoragePolicyID, spec.CapacityMB)
+		volume.Name = spec.Name
+		volume.StoragePolicyId = spec.StoragePolicyID
+		volumes[spec.Name] = volume
+		listed[spec.Name] = true
+		return volume.VolumeId.Id, nil
+	}
+	defer func(orig func(context.Context, *controller, string, []*cnsvsphere.DatastoreInfo) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getCompatibleDatastores = orig
+	}(getCompatibleDatastores)
+	getCompatibleDatastores = func(ctx context.Context, c *controller, storagePolicyID string,
+		datastores []*cnsvsphere.DatastoreInfo) ([]*cnsvsphere.DatastoreInfo, error) {
+		if compatible[storagePolicyID] {
+			return datastores, nil
+		}
+		return nil, nil
+	}
+	resetState := func() {
+		requestedPolicies = nil
+		volumes = make(map[string]cnstypes.CnsVolume)
+		listed = make(map[string]bool)
+		policyCompatibility.entries = make(map[string]policyCompatibilityEntry)
+	}
+	defer resetState()
+	c := newFakeController(&fakeVolumeManager{
+		queryVolume: func(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			result := &cnstypes.CnsQueryResult{}
+			for _, volume := range volumes {
+				for _, name := range queryFilter.Names {
+					if volume.Name == name && listed[name] {
+						result.Volumes = append(result.Volumes, volume)
+					}
+				}
+				for _, volumeID := range queryFilter.VolumeIds {
+					if volume.VolumeId == volumeID {
+						result.Volumes = append(result.Volumes, volume)
+					}
+				}
+			}
+			return result, nil
+		},
+	})
+	datastores := []*cnsvsphere.DatastoreInfo{newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")}
+
+	// The preferred policy is honored when it is satisfiable
+	satisfiable["preferred"] = true
+	compatible["preferred"] = true
+	resetState()
+	spec := &common.CreateVolumeSpec{Name: "pvc", StoragePolicyID: "required"}
+	volumeID, storagePolicyID, err := createBlockVolumeWithPreferredPolicy(ctx, c, spec, "preferred", datastores)
+	if err != nil || volumeID != "vol-preferred" || storagePolicyID != "preferred" {
+		t.Errorf("expected the volume to be created with the preferred policy, got %q, %q (err: %v)",
+			volumeID, storagePolicyID, err)
+	}
+	if !reflect.DeepEqual(requestedPolicies, []string{"preferred"}) {
+		t.Errorf("expected only the preferred policy to be tried, got %v", requestedPolicies)
+	}
+
+	// and the required policy is used when CNS can't place the volume with it
+	satisfiable["preferred"] = false
+	resetState()
+	spec = &common.CreateVolumeSpec{Name: "pvc", StoragePolicyID: "required"}
+	volumeID, storagePolicyID, err = createBlockVolumeWithPreferredPolicy(ctx, c, spec, "preferred", datastores)
+	if err != nil || volumeID != "vol-required" || storagePolicyID != "required" {
+		t.Errorf("expected the volume to be created with the required policy, got %q, %q (err: %v)",
+			volumeID, storagePolicyID, err)
+	}
+	if !reflect.DeepEqual(requestedPolicies, []string{"preferred", "required"}) {
+		t.Errorf("expected the preferred policy to be tried before the required one, got %v", requestedPolicies)
+	}
+
+	// A retry returns the volume created with the required policy, reporting that policy
+	requestedPolicies = nil
+	volumeID, storagePolicyID, err = createBlockVolumeWithPreferredPolicy(ctx, c, spec, "preferred", datastores)
+	if err != nil || volumeID != "vol-required" || storagePolicyID != "required" {
+		t.Errorf("expected the retry to return the volume with the required policy, got %q, %q (err: %v)",
+			volumeID, storagePolicyID, err)
+	}
+	if len(requestedPolicies) != 0 {
+		t.Errorf("expected the retry not to create the volume, got %v", requestedPolicies)
+	}
+
+	// including when the creation with the required policy is still in progress and
+	// its CNS task is reused for the preferred policy
+	listed["pvc"] = false
+	satisfiable["preferred"] = true
+	volumeID, storagePolicyID, err = createBlockVolumeWithPreferredPolicy(ctx, c, spec, "preferred", datastores)
+	if err != nil || volumeID != "vol-required" || storagePolicyID != "required" {
+		t.Errorf("expected the reused CNS task to be reported with the required policy, got %q, %q (err: %v)",
+			volumeID, storagePolicyID, err)
+	}
+
+	// The preferred policy isn't tried when no datastore is compatible with it, so that
+	// the fallback is not recorded as a policy rejection
+	compatible["preferred"] = false
+	resetState()
+	spec = &common.CreateVolumeSpec{Name: "pvc", StoragePolicyID: "required"}
+	volumeID, storagePolicyID, err = createBlockVolumeWithPreferredPolicy(ctx, c, spec, "preferred", datastores)
+	if err != nil || volumeID != "vol-required" || storagePolicyID != "required" {
+		t.Errorf("expected the volume to be created with the required policy, got %q, %q (err: %v)",
+			volumeID, storagePolicyID, err)
+	}
+	if !reflect.DeepEqual(requestedPolicies, []string{"required"}) {
+		t.Errorf("expected only the required policy to be tried, got %v", requestedPolicies)
+	}
+
+	// Other failures are not retried with the required policy
+	compatible["preferred"] = true
+	resetState()
+	createBlockVolume = func(ctx context.Context, clusterFlavor cnstypes.CnsClusterFlavor, manager *common.Manager,
+		spec *common.CreateVolumeSpec, sharedDatastores []*cnsvsphere.DatastoreInfo) (string, error) {
+		requestedPolicies = append(requestedPolicies, spec.StoragePolicyID)
+		return "", fmt.Errorf("vCenter is unreachable")
+	}
+	spec = &common.CreateVolumeSpec{Name: "pvc", StoragePolicyID: "required"}
+	if _, _, err = createBlockVolumeWithPreferredPolicy(ctx, c, spec, "preferred", datastores); err == nil {
+		t.Error("expected the volume creation to fail")
+	}
+	if !reflect.DeepEqual(requestedPolicies, []string{"preferred"}) {
+		t.Errorf("expected the required policy not to be tried, got %v", requestedPolicies)
+	}
+}
+
+/*
+ * TestWCPCheckPodVMClusterMembership verifies volumes are only attached to PodVMs
+ * running on the hosts of the clusters managed by the controller.
+ */
+func TestWCPCheckPodVMClusterMembership(t *testing.T) {
+	ctx := context.Background()
+	defer func(orig func(context.Context, *common.Manager) ([]*cnsvsphere.HostSystem, error)) {
+		getClusterHosts = orig
+	}(getClusterHosts)
+	getClusterHosts = func(ctx context.Context, manager *common.Manager) ([]*cnsvsphere.HostSystem, error) {
+		if getClusterID(ctx, manager.CnsConfig) == "additional-cluster" {
+			return []*cnsvsphere.HostSystem{newFakeHost("host-4")}, nil
+		}
+		return []*cnsvsphere.HostSystem{newFakeHost("host-1"), newFakeHost("host-2")}, nil
+	}
+	podVMHosts := map[string]string{"podvm-in-cluster": "host-2", "podvm-out-of-cluster": "host-3",
+		"podvm-in-additional-cluster": "host-4"}
+	defer func(orig func(context.Context, *cnsvsphere.VirtualMachine) (string, error)) {
+		getPodVMHost = orig
+	}(getPodVMHost)
+	getPodVMHost = func(ctx context.Context, podVM *cnsvsphere.VirtualMachine) (string, error) {
+		return podVMHosts[podVM.UUID], nil
+	}
+	c := newFakeController(&fakeVolumeManager{})
+
+	if err := checkPodVMClusterMembership(ctx, c, &cnsvsphere.VirtualMachine{UUID: "podvm-in-cluster"}); err != nil {
+		t.Errorf("expected the PodVM on a host of the cluster to be accepted, got %v", err)
+	}
+	err := checkPodVMClusterMembership(ctx, c, &cnsvsphere.VirtualMachine{UUID: "podvm-out-of-cluster"})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected code %v for the PodVM outside of the cluster, got %v (err: %v)",
+			codes.FailedPrecondition, code, err)
+	}
+	err = checkPodVMClusterMembership(ctx, c, &cnsvsphere.VirtualMachine{UUID: "podvm-in-additional-cluster"})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected code %v for the PodVM of an unmanaged cluster, got %v (err: %v)",
+			codes.FailedPrecondition, code, err)
+	}
+	c.manager.CnsConfig.Global.AdditionalClusterIDs = "additional-cluster"
+	if err := checkPodVMClusterMembership(ctx, c, &cnsvsphere.VirtualMachine{UUID: "podvm-in-additional-cluster"}); err != nil {
+		t.Errorf("expected the PodVM on a host of an additional cluster to be accepted, got %v", err)
+	}
+}
+
+/*
+ * TestWCPCreateVolumeNoHostsOfMinVersion verifies CreateVolume fails with
+ * FailedPrecondition when none of the hosts of the cluster are of min-host-version.
+ */
+func TestWCPCreateVolumeNoHostsOfMinVersion(t *testing.T) {
+	ctx := context.Background()
+	defer func(orig func(context.Context, *common.Manager) ([]*cnsvsphere.HostSystem, error)) {
+		getClusterHosts = orig
+	}(getClusterHosts)
+	getClusterHosts = func(ctx context.Context, manager *common.Manager) ([]*cnsvsphere.HostSystem, error) {
+		return []*cnsvsphere.HostSystem{newFakeHost("host-1")}, nil
+	}
+	defer func(orig func(context.Context, *cnsvsphere.HostSystem) (string, error)) {
+		getHostVersion = orig
+	}(getHostVersion)
+	getHostVersion = func(ctx context.Context, host *cnsvsphere.HostSystem) (string, error) {
+		return "6.7.0", nil
+	}
+	c := newFakeController(&fakeVolumeManager{})
+	c.manager.CnsConfig.Global.MinHostVersion = "7.0.0"
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+	}
+	_, err := c.CreateVolume(ctx, req)
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected CreateVolume to fail with code %v without hosts of the minimum version, got %v (err: %v)",
+			codes.FailedPrecondition, code, err)
+	}
+}
+
+// rejectingCreateVolumeValidator is a CreateVolumeValidator which rejects all requests.
+type rejectingCreateVolumeValidator struct{}
+
+func (rejectingCreateVolumeValidator) ValidateCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) error {
+	return fmt.Errorf("volume %q doesn't follow the naming convention", req.Name)
+}
+
+/*
+ * TestWCPCreateVolumeAdmissionRejected verifies CreateVolume fails with
+ * FailedPrecondition without provisioning the volume when the custom
+ * CreateVolumeValidator rejects the request.
+ */
+func TestWCPCreateVolumeAdmissionRejected(t *testing.T) {
+	ctx := context.Background()
+	defer common.SetCreateVolumeValidator(nil)
+	common.SetCreateVolumeValidator(rejectingCreateVolumeValidator{})
+	createdVolumes := 0
+	c := newFakeController(&fakeVolumeManager{
+		createVolume: func(ctx context.Context, spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error) {
+			createdVolumes++
+			return &cnstypes.CnsVolumeId{Id: "vol-1"}, nil
+		},
+	})
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+	}
+	_, err := c.CreateVolume(ctx, req)
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected CreateVolume to fail with code %v, got %v (err: %v)", codes.FailedPrecondition, code, err)
+	}
+	if createdVolumes != 0 {
+		t.Errorf("expected the rejected volume to not be created, got %d volumes created", createdVolumes)
+	}
+}
+
+/*
+ * TestWCPListVolumesFromInventory verifies ListVolumes lists the volumes on the shared
+ * datastores from the populated volume inventory instead of querying each datastore,
+ * and queries the volumes created since the last refresh from CNS.
+ */
+func TestWCPListVolumesFromInventory(t *testing.T) {
+	ctx := context.Background()
+	sharedVolume := newFakeBlockVolume("vol-1", 1024)
+	sharedVolume.DatastoreUrl = "ds:///vmfs/volumes/datastore-1/"
+	localVolume := newFakeBlockVolume("vol-2", 1024)
+	localVolume.DatastoreUrl = "ds:///vmfs/volumes/datastore-2/"
+	newVolume := newFakeBlockVolume("vol-3", 2048)
+	newVolume.DatastoreUrl = "ds:///vmfs/volumes/datastore-1/"
+	datastoreQueries := 0
+	volumes := []cnstypes.CnsVolume{sharedVolume, localVolume}
+	volumeManager := &fakeVolumeManager{
+		queryVolume: func(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			if len(queryFilter.Datastores) > 0 {
+				datastoreQueries++
+			}
+			if len(queryFilter.VolumeIds) > 0 {
+				var result []cnstypes.CnsVolume
+				for _, volume := range append(volumes, newVolume) {
+					for _, volumeID := range queryFilter.VolumeIds {
+						if volume.VolumeId.Id == volumeID.Id {
+							result = append(result, volume)
+						}
+					}
+				}
+				return &cnstypes.CnsQueryResult{Volumes: result}, nil
+			}
+			return &cnstypes.CnsQueryResult{Volumes: volumes}, nil
+		},
+	}
+	c := newFakeController(volumeManager)
+	c.manager.VolumeInventory = common.NewVolumeInventory()
+	if err := c.manager.VolumeInventory.Refresh(ctx, c.manager); err != nil {
+		t.Fatal(err)
+	}
+	// Created since the last refresh
+	c.manager.VolumeInventory.MarkStale("vol-3")
+	defer func(orig func(context.Context, *controller) ([]*cnsvsphere.DatastoreInfo, error)) {
+		getSharedDatastores = orig
+	}(getSharedDatastores)
+	getSharedDatastores = func(ctx context.Context, c *controller) ([]*cnsvsphere.DatastoreInfo, error) {
+		return []*cnsvsphere.DatastoreInfo{newFakeDatastoreInfo("datastore-1", "ds:///vmfs/volumes/datastore-1/")}, nil
+	}
+	resp, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed with err: %v", err)
+	}
+	var volumeIDs []string
+	for _, entry := range resp.Entries {
+		volumeIDs = append(volumeIDs, entry.Volume.VolumeId)
+	}
+	if expected := []string{"vol-1", "vol-3"}; !reflect.DeepEqual(volumeIDs, expected) {
+		t.Fatalf("expected volumes %v, got %v", expected, volumeIDs)
+	}
+	if capacity := resp.Entries[1].Volume.CapacityBytes; capacity != 2048*common.MbInBytes {
+		t.Errorf("expected the capacity of the new volume to be queried from CNS, got %d", capacity)
+	}
+	if datastoreQueries != 0 {
+		t.Errorf("expected no datastore to be queried with a populated inventory, got %d queries", datastoreQueries)
+	}
+
+	// The datastores are queried again once the inventory is invalidated
+	c.manager.VolumeInventory.Invalidate()
+	if _, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{}); err != nil {
+		t.Fatalf("ListVolumes failed with err: %v", err)
+	}
+	if datastoreQueries != 1 {
+		t.Errorf("expected the shared datastore to be queried after invalidation, got %d queries", datastoreQueries)
+	}
+}
@@ -77,6 +77,15 @@ func (c *controller) Init(config *config.Config) error {
 
 	log.Infof("Initializing WCPGC CSI controller")
 	var err error
+	if err = logger.SetRPCLogLevels(ctx, config.Global.RPCLogLevels); err != nil {
+		log.Errorf("failed to parse rpc-log-levels. err=%v", err)
+		return err
+	}
+	if err = logger.SetLogFormat(ctx, config.Global.LogFormat); err != nil {
+		log.Errorf("failed to parse log-format. err=%v", err)
+		return err
+	}
+	common.SetAllowedMountFlags(ctx, config.Global.AllowedMountFlags)
 	// connect to the CSI controller in supervisor cluster
 	c.supervisorNamespace, err = cnsconfig.GetSupervisorNamespace(ctx)
 	if err != nil {
@@ -147,12 +156,19 @@ func (c *controller) Init(config *config.Config) error {
 func (c *controller) ReloadConfiguration() {
 	ctx, log := logger.GetNewContextWithLogger()
 	log.Info("Reloading Configuration")
-	cfg, err := common.GetConfig(ctx)
+	cfg, err := common.GetConfigWithRetry(ctx, common.ReloadConfigReadAttempts, common.ReloadConfigReadBackoff)
 	if err != nil {
 		log.Errorf("failed to read config. Error: %+v", err)
 		return
 	}
 	if cfg != nil {
+		if err := logger.SetRPCLogLevels(ctx, cfg.Global.RPCLogLevels); err != nil {
+			log.Warnf("failed to parse rpc-log-levels, keeping the previous RPC log levels. err=%v", err)
+		}
+		if err := logger.SetLogFormat(ctx, cfg.Global.LogFormat); err != nil {
+			log.Warnf("failed to parse log-format, keeping the previous log format. err=%v", err)
+		}
+		common.SetAllowedMountFlags(ctx, cfg.Global.AllowedMountFlags)
 		restClientConfig := k8s.GetRestClientConfig(ctx, cfg.GC.Endpoint, cfg.GC.Port)
 		c.supervisorClient, err = k8s.NewSupervisorClient(ctx, restClientConfig)
 		if err != nil {
@@ -182,13 +198,16 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("CreateVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "CreateVolume", *req)()
 	err := validateGuestClusterCreateVolumeRequest(ctx, req)
 	if err != nil {
 		msg := fmt.Sprintf("Validation for CreateVolume Request: %+v has failed. Error: %+v", *req, err)
 		log.Error(msg)
 		return nil, err
 	}
+	if err := common.ValidateCreateVolumeAdmission(ctx, req); err != nil {
+		return nil, err
+	}
 	// Get PVC name and disk size for the supervisor cluster
 	// We use default prefix 'pvc-' for pvc created in the guest cluster, it is mandatory.
 	supervisorPVCName := c.tanzukubernetesClusterUID + "-" + req.Name[4:]
@@ -235,6 +254,7 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	}
 	attributes := make(map[string]string)
 	attributes[common.AttributeDiskType] = common.DiskTypeBlockVolume
+	attributes[common.AttributeAccessMode] = common.GetBlockVolumeAccessMode(req.GetVolumeCapabilities()).String()
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      supervisorPVCName,
@@ -251,7 +271,7 @@ func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("DeleteVolume: called with args: %+v", *req)
+	defer logger.LogRPCCall(ctx, "DeleteVolume", *req)()
 	var err error
 	err = validateGuestClusterDeleteVolumeRequest(ctx, req)
 	if err != nil {
@@ -280,7 +300,7 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ControllerPublishVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerPublishVolume", *req)()
 	err := validateGuestClusterControllerPublishVolumeRequest(ctx, req)
 	if err != nil {
 		msg := fmt.Sprintf("Validation for PublishVolume Request: %+v has failed. Error: %v", *req, err)
@@ -417,7 +437,7 @@ func (c *controller) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 
 	ctx = logger.NewContextWithLogger(ctx)
 	log := logger.GetLogger(ctx)
-	log.Infof("ControllerUnpublishVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerUnpublishVolume", *req)()
 	err := validateGuestClusterControllerUnpublishVolumeRequest(ctx, req)
 	if err != nil {
 		msg := fmt.Sprintf("Validation for UnpublishVolume Request: %+v has failed. Error: %v", *req, err)
@@ -522,14 +542,19 @@ func (c *controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
 
 	log := logger.GetLogger(ctx)
-	log.Infof("ValidateVolumeCapabilities: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ValidateVolumeCapabilities", *req)()
 	volCaps := req.GetVolumeCapabilities()
-	var confirmed *csi.ValidateVolumeCapabilitiesResponse_Confirmed
-	if common.IsValidVolumeCapabilities(ctx, volCaps) {
-		confirmed = &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps}
+	if !common.IsValidVolumeCapabilities(ctx, volCaps) {
+		msg := fmt.Sprintf("unsupported volume capabilities %+v", volCaps)
+		log.Info(msg)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: msg}, nil
+	}
+	if err := common.ValidateMountFlags(volCaps); err != nil {
+		log.Info(err)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
-		Confirmed: confirmed,
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps},
 	}, nil
 }
 
@@ -537,8 +562,7 @@ func (c *controller) ListVolumes(ctx context.Context, req *csi.ListVolumesReques
 	*csi.ListVolumesResponse, error) {
 
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("ListVolumes: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ListVolumes", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
@@ -546,8 +570,7 @@ func (c *controller) GetCapacity(ctx context.Context, req *csi.GetCapacityReques
 	*csi.GetCapacityResponse, error) {
 
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("GetCapacity: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "GetCapacity", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
@@ -555,8 +578,7 @@ func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.Con
 	*csi.ControllerGetCapabilitiesResponse, error) {
 
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("ControllerGetCapabilities: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerGetCapabilities", *req)()
 	var caps []*csi.ControllerServiceCapability
 	for _, cap := range controllerCaps {
 		c := &csi.ControllerServiceCapability{
@@ -574,16 +596,14 @@ func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.Con
 func (c *controller) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (
 	*csi.CreateSnapshotResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("CreateSnapshot: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "CreateSnapshot", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (c *controller) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (
 	*csi.DeleteSnapshotResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("DeleteSnapshot: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "DeleteSnapshot", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
@@ -591,8 +611,7 @@ func (c *controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRe
 	*csi.ListSnapshotsResponse, error) {
 
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("ListSnapshots: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ListSnapshots", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
@@ -600,7 +619,6 @@ func (c *controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRe
 func (c *controller) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (
 	*csi.ControllerExpandVolumeResponse, error) {
 	ctx = logger.NewContextWithLogger(ctx)
-	log := logger.GetLogger(ctx)
-	log.Infof("ControllerExpandVolume: called with args %+v", *req)
+	defer logger.LogRPCCall(ctx, "ControllerExpandVolume", *req)()
 	return nil, status.Error(codes.Unimplemented, "")
 }
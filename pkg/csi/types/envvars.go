@@ -25,4 +25,8 @@ const (
 
 	// EnvSupervisorClientBurst is the Burst for the client to the supervisor cluster API server
 	EnvSupervisorClientBurst = "SUPERVISOR_CLIENT_BURST"
+
+	// EnvMetricsAddress is the address the controller serves its metrics at, e.g. ":2112".
+	// The metrics are not served if it is not set
+	EnvMetricsAddress = "METRICS_ADDRESS"
 )
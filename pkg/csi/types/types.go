@@ -17,6 +17,8 @@ limitations under the License.
 package types
 
 import (
+	"context"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 )
@@ -27,3 +29,11 @@ type CnsController interface {
 	csi.ControllerServer
 	Init(config *config.Config) error
 }
+
+// ReadinessReporter is implemented by the CnsControllers which report whether they
+// are ready to serve RPCs, e.g. once their initialization completed. The readiness is
+// served at the readiness path of the metrics server. Controllers which don't
+// implement it are ready once Init returns.
+type ReadinessReporter interface {
+	IsReady(ctx context.Context) bool
+}
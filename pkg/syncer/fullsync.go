@@ -26,6 +26,7 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
 )
@@ -217,11 +218,12 @@ func fullSyncUpdateVolumes(ctx context.Context, updateSpecArray []cnstypes.CnsVo
 
 // buildCnsMetadataList build metadata list for given PV
 // metadata list may include PV metadata, PVC metadata and POD metadata
-func buildCnsMetadataList(ctx context.Context, pv *v1.PersistentVolume, pvToPVCMap pvcMap, pvcToPodMap podMap, clusterID string) []cnstypes.BaseCnsEntityMetadata {
+func buildCnsMetadataList(ctx context.Context, pv *v1.PersistentVolume, pvToPVCMap pvcMap, pvcToPodMap podMap, cfg *cnsconfig.Config) []cnstypes.BaseCnsEntityMetadata {
 	log := logger.GetLogger(ctx)
+	clusterID := cfg.Global.ClusterID
 	var metadataList []cnstypes.BaseCnsEntityMetadata
 	// get pv metadata
-	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pv.Name, pv.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePV), "", clusterID, nil)
+	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pv.Name, getPVLabels(pv, cfg), false, string(cnstypes.CnsKubernetesEntityTypePV), "", clusterID, nil)
 	metadataList = append(metadataList, pvMetadata)
 	if pvc, ok := pvToPVCMap[pv.Name]; ok {
 		// get pvc metadata
@@ -257,7 +259,7 @@ func getEntityMetadata(ctx context.Context, pvList []*v1.PersistentVolume, cnsVo
 
 	var queryVolumeIds []cnstypes.CnsVolumeId
 	for _, pv := range pvList {
-		k8sMetadata := buildCnsMetadataList(ctx, pv, pvToPVCMap, pvcToPodMap, metadataSyncer.configInfo.Cfg.Global.ClusterID)
+		k8sMetadata := buildCnsMetadataList(ctx, pv, pvToPVCMap, pvcToPodMap, metadataSyncer.configInfo.Cfg)
 		pvToK8sEntityMetadataMap[pv.Spec.CSI.VolumeHandle] = k8sMetadata
 		if cnsVolumeMap[pv.Spec.CSI.VolumeHandle] {
 			// PV exist in both K8S and CNS cache, add to queryVolumeIds list to check if metadata has been
@@ -287,6 +289,9 @@ func getEntityMetadata(ctx context.Context, pvList []*v1.PersistentVolume, cnsVo
 				}
 			}
 			pvToCnsEntityMetadataMap[volume.VolumeId.Id] = cnsMetadata
+			if k8sMetadata, ok := pvToK8sEntityMetadataMap[volume.VolumeId.Id]; ok {
+				preserveDriverOwnedPVLabels(k8sMetadata, cnsMetadata, metadataSyncer.configInfo.Cfg.Global.ClusterID)
+			}
 		}
 	}
 	return pvToCnsEntityMetadataMap, pvToK8sEntityMetadataMap, nil
@@ -221,7 +221,7 @@ func InitMetadataSyncer(ctx context.Context, clusterFlavor cnstypes.CnsClusterFl
 // ReloadConfiguration reloads configuration from the secret, and update controller's cached configs
 func ReloadConfiguration(ctx context.Context, metadataSyncer *metadataSyncInformer) {
 	log := logger.GetLogger(ctx)
-	cfg, err := common.GetConfig(ctx)
+	cfg, err := common.GetConfigWithRetry(ctx, common.ReloadConfigReadAttempts, common.ReloadConfigReadBackoff)
 	if err != nil {
 		log.Errorf("failed to read config. Error: %+v", err)
 		return
@@ -605,7 +605,7 @@ func csiPVCDeleted(ctx context.Context, pvc *v1.PersistentVolumeClaim, pv *v1.Pe
 func csiPVUpdated(ctx context.Context, newPv *v1.PersistentVolume, oldPv *v1.PersistentVolume, metadataSyncer *metadataSyncInformer) {
 	log := logger.GetLogger(ctx)
 	var metadataList []cnstypes.BaseCnsEntityMetadata
-	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPv.Name, newPv.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePV), "", metadataSyncer.configInfo.Cfg.Global.ClusterID, nil)
+	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPv.Name, getPVLabels(newPv, metadataSyncer.configInfo.Cfg), false, string(cnstypes.CnsKubernetesEntityTypePV), "", metadataSyncer.configInfo.Cfg.Global.ClusterID, nil)
 	metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvMetadata))
 
 	containerCluster := cnsvsphere.GetContainerCluster(metadataSyncer.configInfo.Cfg.Global.ClusterID, metadataSyncer.configInfo.Cfg.VirtualCenter[metadataSyncer.host].User, metadataSyncer.clusterFlavor)
@@ -672,6 +672,15 @@ func csiPVUpdated(ctx context.Context, newPv *v1.PersistentVolume, oldPv *v1.Per
 		}
 	}
 	// call UpdateVolumeMetadata for all other cases
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: newPv.Spec.CSI.VolumeHandle}},
+	}
+	if queryResult, err := metadataSyncer.volumeManager.QueryVolume(ctx, queryFilter); err != nil {
+		log.Warnf("PVUpdated: QueryVolume failed, labels recorded by the driver may be dropped. error: %+v", err)
+	} else if len(queryResult.Volumes) > 0 {
+		preserveDriverOwnedPVLabels(metadataList, queryResult.Volumes[0].Metadata.EntityMetadata,
+			metadataSyncer.configInfo.Cfg.Global.ClusterID)
+	}
 	updateSpec := &cnstypes.CnsVolumeMetadataUpdateSpec{
 		VolumeId: cnstypes.CnsVolumeId{
 			Id: newPv.Spec.CSI.VolumeHandle,
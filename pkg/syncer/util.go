@@ -7,7 +7,10 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 
 	cnstypes "github.com/vmware/govmomi/cns/types"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
 	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/logger"
 	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 )
@@ -58,6 +61,47 @@ func IsValidVolume(ctx context.Context, volume v1.Volume, pod *v1.Pod, metadataS
 	return true, pv, pvc
 }
 
+// getPVEntityMetadata returns the PV metadata of the cluster with the given ID in
+// the given metadata list, or nil if there is none.
+func getPVEntityMetadata(metadataList []cnstypes.BaseCnsEntityMetadata,
+	clusterID string) *cnstypes.CnsKubernetesEntityMetadata {
+	for _, metadata := range metadataList {
+		entityMetadata, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata)
+		if ok && entityMetadata.EntityType == string(cnstypes.CnsKubernetesEntityTypePV) &&
+			entityMetadata.ClusterID == clusterID {
+			return entityMetadata
+		}
+	}
+	return nil
+}
+
+// getPVLabels returns the labels to be recorded in the CNS metadata of the given PV,
+// including the chargeback labels of the given config.
+func getPVLabels(pv *v1.PersistentVolume, cfg *cnsconfig.Config) map[string]string {
+	pvLabels := common.GetPVLabels(pv)
+	common.AddChargebackLabels(pvLabels, cfg)
+	return pvLabels
+}
+
+// preserveDriverOwnedPVLabels adds the driver owned labels of the PV metadata in the
+// given CNS metadata to the PV metadata in the given metadata built from Kubernetes.
+func preserveDriverOwnedPVLabels(k8sMetadata []cnstypes.BaseCnsEntityMetadata,
+	cnsMetadata []cnstypes.BaseCnsEntityMetadata, clusterID string) {
+	k8sPVMetadata := getPVEntityMetadata(k8sMetadata, clusterID)
+	cnsPVMetadata := getPVEntityMetadata(cnsMetadata, clusterID)
+	if k8sPVMetadata == nil || cnsPVMetadata == nil {
+		return
+	}
+	cnsLabels := common.GetLabelsMapFromKeyValue(cnsPVMetadata.Labels)
+	k8sLabels := common.GetLabelsMapFromKeyValue(k8sPVMetadata.Labels)
+	for _, label := range common.DriverOwnedPVLabels {
+		value, ok := cnsLabels[label]
+		if _, set := k8sLabels[label]; ok && !set {
+			k8sPVMetadata.Labels = append(k8sPVMetadata.Labels, vimtypes.KeyValue{Key: label, Value: value})
+		}
+	}
+}
+
 // getQueryResults returns list of CnsQueryResult retrieved using
 // queryFilter with offset and limit to query volumes using pagination
 // if volumeIds is empty, then all volumes from CNS will be retrieved by pagination
@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/syncer/types"
+)
+
+// fakeVolumeManager is a volume manager which serves QueryVolume from the given
+// volumes and records the UpdateVolumeMetadata calls.
+type fakeVolumeManager struct {
+	volumes.Manager
+	volumes     []cnstypes.CnsVolume
+	updateSpecs []*cnstypes.CnsVolumeMetadataUpdateSpec
+}
+
+func (f *fakeVolumeManager) QueryVolume(ctx context.Context, queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+	return &cnstypes.CnsQueryResult{Volumes: f.volumes}, nil
+}
+
+func (f *fakeVolumeManager) UpdateVolumeMetadata(ctx context.Context, spec *cnstypes.CnsVolumeMetadataUpdateSpec) error {
+	f.updateSpecs = append(f.updateSpecs, spec)
+	return nil
+}
+
+func TestCSIPVUpdatedPreservesDriverOwnedLabels(t *testing.T) {
+	ctx := context.Background()
+	cnsLabels := map[string]string{
+		testPVLabelName:              "old-value",
+		common.ExpandedCapacityLabel: "2048",
+		common.LastExpandedAtLabel:   "2020-06-01T10:00:00Z",
+	}
+	volumeManager := &fakeVolumeManager{
+		volumes: []cnstypes.CnsVolume{{
+			VolumeId: cnstypes.CnsVolumeId{Id: "vol-1"},
+			Metadata: cnstypes.CnsVolumeMetadata{
+				EntityMetadata: []cnstypes.BaseCnsEntityMetadata{
+					cnsvsphere.GetCnsKubernetesEntityMetaData(testVolumeName, cnsLabels, false,
+						string(cnstypes.CnsKubernetesEntityTypePV), "", testClusterName, nil),
+				},
+			},
+		}},
+	}
+	cfg := &cnsconfig.Config{}
+	cfg.Global.ClusterID = testClusterName
+	cfg.Global.ChargebackLabels = "cost-center=1234"
+	cfg.VirtualCenter = map[string]*cnsconfig.VirtualCenterConfig{"vc": {User: "user"}}
+	metadataSyncer := &metadataSyncInformer{
+		clusterFlavor: cnstypes.CnsClusterFlavorVanilla,
+		volumeManager: volumeManager,
+		host:          "vc",
+		configInfo:    &types.ConfigInfo{Cfg: cfg},
+	}
+	newPV := func(labels map[string]string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: testVolumeName, Labels: labels},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: csitypes.Name, VolumeHandle: "vol-1"},
+				},
+			},
+			Status: v1.PersistentVolumeStatus{Phase: v1.VolumeBound},
+		}
+	}
+
+	csiPVUpdated(ctx, newPV(map[string]string{testPVLabelName: testPVLabelValue}),
+		newPV(map[string]string{testPVLabelName: "old-value"}), metadataSyncer)
+	if len(volumeManager.updateSpecs) != 1 {
+		t.Fatalf("expected the metadata to be updated once, got %d updates", len(volumeManager.updateSpecs))
+	}
+	pvMetadata := getPVEntityMetadata(volumeManager.updateSpecs[0].Metadata.EntityMetadata, testClusterName)
+	if pvMetadata == nil {
+		t.Fatal("expected the update to carry the PV metadata")
+	}
+	labels := common.GetLabelsMapFromKeyValue(pvMetadata.Labels)
+	expectedLabels := map[string]string{
+		testPVLabelName:              testPVLabelValue,
+		common.ExpandedCapacityLabel: "2048",
+		common.LastExpandedAtLabel:   "2020-06-01T10:00:00Z",
+		"cost-center":                "1234",
+	}
+	for key, value := range expectedLabels {
+		if labels[key] != value {
+			t.Errorf("expected label %q to be %q after the PV update, got %q", key, value, labels[key])
+		}
+	}
+}